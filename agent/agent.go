@@ -0,0 +1,74 @@
+// Package agent implements the agent running in mysql-server containers,
+// which executes the operations that need local access to the data directories and logs.
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/secret"
+)
+
+const (
+	AgentPort       = "6034"
+	RebuildLocation = "/rebuild"
+)
+
+// Options are the options of the agent
+type Options struct {
+	// SecretFile has the service token required by all the requests
+	SecretFile string
+	// MonitorURL, Host and Port are used to confirm with monitor that this instance is unregistered
+	// before it's wiped for rebuilding
+	MonitorURL string
+	Host       string
+	Port       string
+}
+
+// Start starts the http server of agent, resumes the unfinished rebuilding and analyzes the slow log
+func Start(opts Options) {
+	rb := newRebuilder(opts)
+	go rb.resume()
+	http.Handle(RebuildLocation, authorize(opts.SecretFile, rb))
+	sl := newSlowLogAnalyzer(slowLogFile)
+	go sl.run()
+	http.Handle(SlowLogLocation, authorize(opts.SecretFile, sl))
+	glog.Fatal(http.ListenAndServe(net.JoinHostPort("", AgentPort), nil))
+}
+
+// authorize refuses the requests without the service token in secretFile, which is read on each
+// request so that the token can be changed without restarting mysqld
+func authorize(secretFile string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !secret.Authorized(req, secret.Token(secretFile)) {
+			glog.Warningf("Refused the unauthorized request %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			writeJSON(rw, http.StatusForbidden, map[string]string{"Error": "The service token is missing or wrong"})
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// run executes the command and logs its combined output
+func run(name string, args ...string) error {
+	glog.V(1).Infof("Run %s %s", name, strings.Join(args, " "))
+	output, err := exec.Command(name, args...).CombinedOutput()
+	glog.V(2).Infof("Output of %s: %s", name, string(output))
+	return err
+}
+
+// output executes the command and returns its trimmed standard output
+func output(name string, args ...string) (string, error) {
+	data, err := exec.Command(name, args...).Output()
+	return strings.TrimSpace(string(data)), err
+}
+
+func writeJSON(rw http.ResponseWriter, code int, data interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(data)
+}
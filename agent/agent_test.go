@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/laincloud/mysql-service/backup"
+	"github.com/laincloud/mysql-service/secret"
+)
+
+func TestAuthorize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret.conf")
+	handler := authorize(file, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	serve := func(token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", RebuildLocation, nil)
+		if token != "" {
+			secret.SetToken(req, token)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := serve("anything"); code != http.StatusForbidden {
+		t.Errorf("All the requests should be refused without the service token, got %d", code)
+	}
+	if err := ioutil.WriteFile(file, []byte("service_token=token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for token, expected := range map[string]int{"": http.StatusForbidden, "wrong": http.StatusForbidden, "token": http.StatusAccepted} {
+		if code := serve(token); code != expected {
+			t.Errorf("Request with token %q should be %d, got %d", token, expected, code)
+		}
+	}
+}
+
+func TestCheckWipe(t *testing.T) {
+	var role string
+	mon := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if endpoint := net.JoinHostPort(req.FormValue("host"), req.FormValue("port")); endpoint != "mysql-server-2:3306" {
+			http.Error(rw, endpoint+" is not registered", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(rw).Encode(backup.RoleInfo{Role: role})
+	}))
+	defer mon.Close()
+	rb := &rebuilder{opts: Options{MonitorURL: mon.URL, Host: "mysql-server-2", Port: "3306"}}
+
+	for _, c := range []struct {
+		role   string
+		host   string
+		reason string
+	}{
+		{role: "Master", host: "mysql-server-2", reason: "instead of unregistered"},
+		{role: "Slave", host: "mysql-server-2", reason: "instead of unregistered"},
+		{role: "Unregistered", host: "mysql-server-3", reason: "with monitor failed"},
+		// mysql is not available in the tests, so the local checks fail safe
+		{role: "Unregistered", host: "mysql-server-2", reason: "read_only"},
+	} {
+		role, rb.opts.Host = c.role, c.host
+		if err := rb.checkWipe(); err == nil || !strings.Contains(err.Error(), c.reason) {
+			t.Errorf("%s %s should not be wiped for %q, got %v", c.role, c.host, c.reason, err)
+		}
+	}
+}
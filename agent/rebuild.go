@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/backup"
+)
+
+// RebuildStage is one step of rebuilding an instance from backup
+type RebuildStage string
+
+const (
+	RebuildIdle        RebuildStage = ""
+	RebuildDownloading RebuildStage = "downloading"
+	RebuildRestarting  RebuildStage = "restarting"
+	RebuildRecovering  RebuildStage = "recovering"
+	RebuildDone        RebuildStage = "done"
+	RebuildFailed      RebuildStage = "failed"
+)
+
+const (
+	rebuildStateFile = "/var/log/baklog/rebuild.json"
+	// roleUnregistered is the role of the instances unregistered in monitor
+	roleUnregistered = "Unregistered"
+	// rebuildWipeFile tells init_mysql_service.sh to empty the datadir before starting mysqld,
+	// so that the full backup is recovered by tools/full_recover.sh
+	rebuildWipeFile  = "/var/log/baklog/rebuild_wipe"
+	backupDir        = "/var/lib/mysql_backup"
+	binlogInfoFile   = "/var/lib/mysql_backup/incrbk_prepare"
+	downloadScript   = "tools/download.py"
+	incrRecoverTool  = "tools/incr_recover.sh"
+	mysqldWaitTime   = 10 * time.Minute
+	mysqldCheckTime  = 3 * time.Second
+	shutdownWaitTime = 3 * time.Second
+)
+
+// RebuildStatus is the progress of rebuilding reported to monitor
+type RebuildStatus struct {
+	Stage   RebuildStage
+	Error   string
+	Started time.Time
+	Updated time.Time
+}
+
+type rebuilder struct {
+	sync.Mutex
+	status RebuildStatus
+	opts   Options
+}
+
+func newRebuilder(opts Options) *rebuilder {
+	rb := &rebuilder{opts: opts}
+	if data, err := ioutil.ReadFile(rebuildStateFile); err == nil {
+		if err = json.Unmarshal(data, &rb.status); err != nil {
+			glog.Errorf("Unmarshal rebuild state failed: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		glog.Errorf("Read rebuild state failed: %s", err.Error())
+	}
+	return rb
+}
+
+// ServeHTTP returns the rebuild status for GET and starts rebuilding for POST
+func (rb *rebuilder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		rb.Lock()
+		status := rb.status
+		rb.Unlock()
+		writeJSON(rw, http.StatusOK, status)
+	case "POST":
+		rb.Lock()
+		defer rb.Unlock()
+		if rb.status.Stage != RebuildIdle && rb.status.Stage != RebuildDone && rb.status.Stage != RebuildFailed {
+			writeJSON(rw, http.StatusConflict, rb.status)
+			return
+		}
+		rb.status = RebuildStatus{Started: time.Now()}
+		rb.setStage(RebuildDownloading, nil)
+		go rb.download()
+		writeJSON(rw, http.StatusAccepted, rb.status)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// resume continues the rebuilding interrupted by the restart of container
+func (rb *rebuilder) resume() {
+	rb.Lock()
+	stage := rb.status.Stage
+	rb.Unlock()
+	switch stage {
+	case RebuildRestarting:
+		rb.recover()
+	case RebuildDownloading, RebuildRecovering:
+		rb.Lock()
+		rb.setStage(RebuildFailed, fmt.Errorf("Interrupted during %s", stage))
+		rb.Unlock()
+	}
+}
+
+// download migrates the latest full and increment backups into this container and restarts mysqld
+func (rb *rebuilder) download() {
+	// The checks are done here instead of in ServeHTTP, since monitor waits for the response
+	// and can't answer the role of this instance meanwhile
+	err := rb.checkWipe()
+	if err == nil {
+		err = run(downloadScript, "full")
+	}
+	if err == nil {
+		err = run(downloadScript, "increment")
+	}
+	if err == nil {
+		if files, _ := filepath.Glob(filepath.Join(backupDir, "*.tar.gz")); len(files) == 0 {
+			err = fmt.Errorf("No full backup is downloaded into %s", backupDir)
+		}
+	}
+	if err == nil {
+		// The roles may be changed during downloading
+		err = rb.checkWipe()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(rebuildWipeFile, nil, 0644)
+	}
+	rb.Lock()
+	if err != nil {
+		rb.setStage(RebuildFailed, err)
+		rb.Unlock()
+		return
+	}
+	rb.setStage(RebuildRestarting, nil)
+	rb.Unlock()
+
+	// mysqld is the main process of the container, so the container restarts after it shuts down
+	time.Sleep(shutdownWaitTime)
+	if err = run("mysqladmin", "-uroot", "shutdown"); err != nil {
+		os.Remove(rebuildWipeFile)
+		rb.Lock()
+		rb.setStage(RebuildFailed, fmt.Errorf("Shutdown mysqld failed: %s", err.Error()))
+		rb.Unlock()
+	}
+}
+
+// checkWipe refuses to wipe this instance unless monitor confirms it's unregistered, and the local
+// mysqld is read-only without replicas, so that a master or a replication source is never wiped
+func (rb *rebuilder) checkWipe() error {
+	role, err := backup.GetRole(backup.Options{MonitorURL: rb.opts.MonitorURL, Host: rb.opts.Host, Port: rb.opts.Port})
+	if err != nil {
+		return fmt.Errorf("Confirm the role of %s:%s with monitor failed: %s", rb.opts.Host, rb.opts.Port, err.Error())
+	}
+	if role.Role != roleUnregistered {
+		return fmt.Errorf("%s:%s is %s in monitor instead of unregistered", rb.opts.Host, rb.opts.Port, role.Role)
+	}
+	readOnly, err := output("mysql", "-uroot", "-N", "-B", "-e", "SELECT @@global.read_only")
+	if err != nil {
+		return fmt.Errorf("Check read_only failed: %s", err.Error())
+	}
+	if readOnly != "1" {
+		return fmt.Errorf("mysqld is writable (read_only=%s), which may be a master", readOnly)
+	}
+	replicas, err := output("mysql", "-uroot", "-N", "-B", "-e",
+		"SELECT COUNT(*) FROM information_schema.PROCESSLIST WHERE COMMAND LIKE 'Binlog Dump%'")
+	if err != nil {
+		return fmt.Errorf("Check replicas failed: %s", err.Error())
+	}
+	if replicas != "0" {
+		return fmt.Errorf("mysqld has %s connected replicas", replicas)
+	}
+	return nil
+}
+
+// recover replays the downloaded binlogs after mysqld has recovered the full backup
+func (rb *rebuilder) recover() {
+	deadline := time.Now().Add(mysqldWaitTime)
+	for run("mysqladmin", "-uroot", "ping") != nil {
+		if time.Now().After(deadline) {
+			rb.Lock()
+			rb.setStage(RebuildFailed, fmt.Errorf("mysqld is not ready in %s", mysqldWaitTime))
+			rb.Unlock()
+			return
+		}
+		time.Sleep(mysqldCheckTime)
+	}
+	rb.Lock()
+	rb.setStage(RebuildRecovering, nil)
+	rb.Unlock()
+
+	err := resetGTIDPurged()
+	if err == nil {
+		err = run(incrRecoverTool)
+	}
+	rb.Lock()
+	if err != nil {
+		rb.setStage(RebuildFailed, err)
+	} else {
+		rb.setStage(RebuildDone, nil)
+	}
+	rb.Unlock()
+}
+
+// setStage updates and saves the status. The caller must hold the lock.
+func (rb *rebuilder) setStage(stage RebuildStage, err error) {
+	rb.status.Stage = stage
+	rb.status.Updated = time.Now()
+	rb.status.Error = ""
+	if err != nil {
+		rb.status.Error = err.Error()
+		glog.Errorf("Rebuild failed: %s", err.Error())
+	} else {
+		glog.Infof("Rebuild stage: %s", stage)
+	}
+	data, _ := json.Marshal(rb.status)
+	if err := ioutil.WriteFile(rebuildStateFile, data, 0644); err != nil {
+		glog.Errorf("Save rebuild state failed: %s", err.Error())
+	}
+	glog.Flush()
+}
+
+// resetGTIDPurged sets gtid_purged to the GTID set of the full backup recorded by xtrabackup,
+// which is required before replaying the binlogs with tools/incr_recover.sh
+func resetGTIDPurged() error {
+	data, err := ioutil.ReadFile(binlogInfoFile)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("No GTID set found in %s", binlogInfoFile)
+	}
+	gtidSet := strings.Join(fields[2:], "")
+	return run("mysql", "-uroot", "-e", fmt.Sprintf("RESET MASTER; SET GLOBAL gtid_purged='%s'", gtidSet))
+}
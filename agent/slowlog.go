@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/slowlog"
+)
+
+const (
+	SlowLogLocation = "/slowlog"
+	// slowLogFile is slow_query_log_file in etc/templates/my.cnf.tmpl
+	slowLogFile     = "/var/lib/mysql_slow/slow.log"
+	maxSlowDigests  = 10000
+	defaultSlowTop  = 20
+	maxSlowTop      = 200
+	slowLogInterval = 10 * time.Second
+	slowLogChunk    = 1 << 20
+)
+
+// SlowLogReport is the top digests of the slow log returned to monitor
+type SlowLogReport struct {
+	File string
+	// Size is the bytes of the slow log read so far
+	Size    int64
+	Entries int
+	Digests int
+	Dropped int
+	Order   string
+	Top     []slowlog.Digest
+	Error   string
+}
+
+// slowLogAnalyzer reads the new entries of the slow log incrementally in background, so that a
+// request returns the digests parsed so far without reading the log
+type slowLogAnalyzer struct {
+	path string
+	// The lock is held while a chunk is parsed or the digests are read, the file is read without it
+	sync.Mutex
+	offset     int64
+	parser     *slowlog.Parser
+	aggregator *slowlog.Aggregator
+}
+
+func newSlowLogAnalyzer(path string) *slowLogAnalyzer {
+	a := &slowLogAnalyzer{path: path}
+	a.reset()
+	return a
+}
+
+// reset clears the digests. The caller must hold the lock.
+func (a *slowLogAnalyzer) reset() {
+	a.offset = 0
+	a.aggregator = slowlog.NewAggregator(maxSlowDigests)
+	a.parser = slowlog.NewParser(a.aggregator.Add)
+}
+
+// run reads the slow log in background
+func (a *slowLogAnalyzer) run() {
+	for {
+		if err := a.refresh(); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Read slow log failed: %s", err.Error())
+		}
+		time.Sleep(slowLogInterval)
+	}
+}
+
+// refresh parses the entries written since the last read by chunks of slowLogChunk bytes, so that
+// a request waits for a chunk at most. The digests are reset if the slow log is truncated or rotated,
+// when it's smaller than what was read. It's only called by run, which is the only writer of offset.
+func (a *slowLogAnalyzer) refresh() error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < a.offset {
+		glog.Infof("Slow log %s is rotated, reset the digests", a.path)
+		a.Lock()
+		a.reset()
+		a.Unlock()
+	}
+	if _, err = file.Seek(a.offset, io.SeekStart); err != nil {
+		return err
+	}
+	chunk := make([]byte, slowLogChunk)
+	for {
+		n, err := io.ReadFull(file, chunk)
+		if n > 0 {
+			a.Lock()
+			a.parser.Write(chunk[:n])
+			a.offset += int64(n)
+			a.Unlock()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ServeHTTP returns the top digests read so far for GET, e.g. /slowlog?top=20&order=total
+func (a *slowLogAnalyzer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	top, err := strconv.Atoi(req.FormValue("top"))
+	if err != nil || top <= 0 {
+		top = defaultSlowTop
+	} else if top > maxSlowTop {
+		top = maxSlowTop
+	}
+	order := req.FormValue("order")
+	if order == "" {
+		order = slowlog.SortTotalTime
+	}
+	report := SlowLogReport{File: a.path, Order: order}
+	valid := false
+	for _, o := range slowlog.SortOrders {
+		valid = valid || o == order
+	}
+	if !valid {
+		report.Error = "unknown order " + order
+		writeJSON(rw, http.StatusBadRequest, report)
+		return
+	}
+
+	a.Lock()
+	report.Size = a.offset
+	report.Entries = a.aggregator.Entries
+	report.Digests = a.aggregator.Len()
+	report.Dropped = a.aggregator.Dropped
+	report.Top = a.aggregator.Top(top, order)
+	a.Unlock()
+	writeJSON(rw, http.StatusOK, report)
+}
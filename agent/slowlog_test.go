@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const slowEntry = `# User@Host: app[app] @  [10.0.0.5]  Id:    10
+# Query_time: 2.000000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 100
+SET timestamp=1488362400;
+SELECT * FROM t WHERE id = 1;
+`
+
+func getSlowLog(t *testing.T, a *slowLogAnalyzer, query string) (int, SlowLogReport) {
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", SlowLogLocation+query, nil))
+	var report SlowLogReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestSlowLogAnalyzer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slow.log")
+	a := newSlowLogAnalyzer(path)
+	if err = a.refresh(); !os.IsNotExist(err) {
+		t.Errorf("Reading a missing slow log should fail, got %v", err)
+	}
+	if code, report := getSlowLog(t, a, ""); code != http.StatusOK || report.Entries != 0 {
+		t.Fatalf("A missing slow log should be empty, got %d %+v", code, report)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(slowEntry + slowEntry)
+	if _, report := getSlowLog(t, a, ""); report.Entries != 0 {
+		t.Errorf("The slow log should be read in background only, got %+v", report)
+	}
+	mustRefresh(t, a)
+	file.WriteString(slowEntry)
+	mustRefresh(t, a)
+	code, report := getSlowLog(t, a, "?top=1&order=count")
+	if code != http.StatusOK || report.Entries != 3 || len(report.Top) != 1 || report.Top[0].Count != 3 {
+		t.Errorf("The new entries should be read incrementally, got %d %+v", code, report)
+	}
+
+	file.Truncate(0)
+	file.WriteAt([]byte(slowEntry), 0)
+	mustRefresh(t, a)
+	if _, report = getSlowLog(t, a, ""); report.Entries != 1 {
+		t.Errorf("The digests should be reset after the slow log is rotated, got %+v", report)
+	}
+	if code, _ = getSlowLog(t, a, "?order=foo"); code != http.StatusBadRequest {
+		t.Errorf("An unknown order should be rejected, got %d", code)
+	}
+
+	// The entries across the chunks are parsed as a whole
+	entries := 2*slowLogChunk/len(slowEntry) + 1
+	file.Truncate(0)
+	file.WriteAt([]byte(strings.Repeat(slowEntry, entries)), 0)
+	a.Lock()
+	a.reset()
+	a.Unlock()
+	mustRefresh(t, a)
+	if _, report = getSlowLog(t, a, ""); report.Entries != entries || report.Digests != 1 {
+		t.Errorf("Expected %d entries of 1 digest, got %+v", entries, report)
+	}
+}
+
+func mustRefresh(t *testing.T, a *slowLogAnalyzer) {
+	t.Helper()
+	if err := a.refresh(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/backup"
+	"github.com/laincloud/mysql-service/pitr"
+	"github.com/laincloud/mysql-service/secret"
+)
+
+func main() {
+	var opts agent.Options
+	flag.StringVar(&opts.SecretFile, "secret-file", secret.DefaultFile, "The secret file with the service token")
+	flag.StringVar(&opts.MonitorURL, "monitor", backup.DefaultMonitorURL(), "The base URL of monitor")
+	flag.StringVar(&opts.Host, "host", backup.DefaultHost(), "The host of this instance registered in monitor")
+	flag.StringVar(&opts.Port, "port", "3306", "The port of this instance registered in monitor")
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "backup":
+		os.Exit(backup.Run(flag.Args()[1:]))
+	case "pitr":
+		os.Exit(pitr.Run(flag.Args()[1:]))
+	default:
+		agent.Start(opts)
+	}
+}
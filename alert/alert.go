@@ -0,0 +1,192 @@
+// Package alert delivers the alerts raised by monitor to webhooks and SMTP. The Manager deduplicates
+// the alerts which are still firing and notifies once they are resolved.
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The status of a notification
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+	// StatusEvent is a one-shot notification which is never resolved, like a role change
+	StatusEvent = "event"
+
+	queueSize = 100
+)
+
+// Alert is a problem of the cluster found by a rule
+type Alert struct {
+	Rule string
+	// Subject is what the alert is about, e.g. the endpoint of an instance
+	Subject string
+	Summary string
+	Started time.Time
+	// Resolved is zero while the alert is firing
+	Resolved time.Time
+}
+
+// Key identifies the alert for deduplication
+func (a Alert) Key() string {
+	return a.Rule + "/" + a.Subject
+}
+
+// Notification is an alert sent to the notifiers
+type Notification struct {
+	Alert
+	Status  string
+	Cluster string
+}
+
+// Text returns the notification in one line, e.g. "[FIRING] mysql-service master_down 10.0.0.1:3306: Master is unreachable"
+func (n Notification) Text() string {
+	status := map[string]string{StatusFiring: "FIRING", StatusResolved: "RESOLVED", StatusEvent: "EVENT"}[n.Status]
+	return fmt.Sprintf("[%s] %s %s %s: %s", status, n.Cluster, n.Rule, n.Subject, n.Summary)
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(n Notification) error
+	// Name is shown in the logs of failed deliveries
+	Name() string
+}
+
+type firingAlert struct {
+	Alert
+	notified time.Time
+}
+
+// Manager tracks the firing alerts and delivers the notifications in its own goroutine,
+// so that slow notifiers never block the caller
+type Manager struct {
+	sync.Mutex
+	cluster   string
+	notifiers []Notifier
+	repeat    time.Duration
+	firing    map[string]*firingAlert
+	queue     chan Notification
+	closed    bool
+	done      chan struct{}
+}
+
+// NewManager creates a Manager delivering to notifiers. A firing alert is notified again every repeat,
+// and only once if repeat is 0.
+func NewManager(cluster string, notifiers []Notifier, repeat time.Duration) *Manager {
+	m := &Manager{
+		cluster:   cluster,
+		notifiers: notifiers,
+		repeat:    repeat,
+		firing:    make(map[string]*firingAlert),
+		queue:     make(chan Notification, queueSize),
+		done:      make(chan struct{}),
+	}
+	go m.deliver()
+	return m
+}
+
+// Update replaces the firing alerts with active. The new alerts are notified as firing,
+// and the alerts not active any more are notified as resolved.
+func (m *Manager) Update(active []Alert) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool, len(active))
+	for _, a := range active {
+		key := a.Key()
+		seen[key] = true
+		if f, exist := m.firing[key]; exist {
+			f.Summary = a.Summary
+			if m.repeat > 0 && now.Sub(f.notified) >= m.repeat {
+				f.notified = now
+				m.enqueue(Notification{Alert: f.Alert, Status: StatusFiring})
+			}
+			continue
+		}
+		if a.Started.IsZero() {
+			a.Started = now
+		}
+		m.firing[key] = &firingAlert{Alert: a, notified: now}
+		m.enqueue(Notification{Alert: a, Status: StatusFiring})
+	}
+	for key, f := range m.firing {
+		if !seen[key] {
+			f.Resolved = now
+			m.enqueue(Notification{Alert: f.Alert, Status: StatusResolved})
+			delete(m.firing, key)
+		}
+	}
+}
+
+// Event notifies a one-shot alert
+func (m *Manager) Event(a Alert) {
+	m.Lock()
+	defer m.Unlock()
+	if a.Started.IsZero() {
+		a.Started = time.Now()
+	}
+	m.enqueue(Notification{Alert: a, Status: StatusEvent})
+}
+
+// Firing returns the firing alerts, the earliest first
+func (m *Manager) Firing() []Alert {
+	m.Lock()
+	defer m.Unlock()
+	alerts := make([]Alert, 0, len(m.firing))
+	for _, f := range m.firing {
+		alerts = append(alerts, f.Alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].Started.Equal(alerts[j].Started) {
+			return alerts[i].Started.Before(alerts[j].Started)
+		}
+		return alerts[i].Key() < alerts[j].Key()
+	})
+	return alerts
+}
+
+// Close stops delivering after the queued notifications are delivered. The alerts
+// raised after Close are only logged.
+func (m *Manager) Close() {
+	m.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.Unlock()
+	<-m.done
+}
+
+// enqueue logs the notification and queues it. The caller must hold the lock.
+func (m *Manager) enqueue(n Notification) {
+	n.Cluster = m.cluster
+	if n.Status == StatusResolved {
+		glog.Info(n.Text())
+	} else {
+		glog.Warning(n.Text())
+	}
+	if len(m.notifiers) == 0 || m.closed {
+		return
+	}
+	select {
+	case m.queue <- n:
+	default:
+		glog.Errorf("Alert queue is full, %s is dropped", n.Key())
+	}
+}
+
+func (m *Manager) deliver() {
+	defer close(m.done)
+	for n := range m.queue {
+		for _, notifier := range m.notifiers {
+			if err := notifier.Notify(n); err != nil {
+				glog.Errorf("Notify %s to %s failed: %s", n.Key(), notifier.Name(), err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/fake"
+)
+
+func TestManager(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []webhookPayload
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("Decode webhook payload failed: %s", err.Error())
+		}
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	mail, err := fake.NewSMTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mail.Close()
+
+	m := NewManager("mysql-service", []Notifier{
+		NewWebhook(hook.URL, time.Second),
+		&SMTP{Addr: mail.Addr(), From: "monitor@example.com", To: []string{"dba@example.com"}, User: "monitor", Password: "secret"},
+	}, 0)
+	down := Alert{Rule: "master_down", Subject: "10.0.0.1:3306", Summary: "Master 10.0.0.1:3306 is unreachable"}
+	lag := Alert{Rule: "replication_lag", Subject: "10.0.0.2:3306", Summary: "10.0.0.2:3306 is 2m0s behind master"}
+	m.Update([]Alert{down})
+	m.Update([]Alert{down, lag})
+	if firing := m.Firing(); len(firing) != 2 || firing[0].Key() != down.Key() {
+		t.Errorf("Unexpected firing alerts: %v", firing)
+	}
+	m.Update([]Alert{lag})
+	m.Event(Alert{Rule: "role_change", Subject: "master", Summary: "Master is changed"})
+	m.Close()
+
+	expected := []string{
+		"[FIRING] mysql-service master_down 10.0.0.1:3306",
+		"[FIRING] mysql-service replication_lag 10.0.0.2:3306",
+		"[RESOLVED] mysql-service master_down 10.0.0.1:3306",
+		"[EVENT] mysql-service role_change master",
+	}
+	if len(payloads) != len(expected) {
+		t.Fatalf("The duplicated alerts should be notified once, got %v", payloads)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(payloads[i].Text, prefix) {
+			t.Errorf("Webhook %d should start with %q, got %q", i, prefix, payloads[i].Text)
+		}
+	}
+	if payloads[2].Status != StatusResolved || payloads[2].Resolved == "" {
+		t.Errorf("The resolved notification should have the resolved time, got %v", payloads[2])
+	}
+
+	mails := mail.Mails()
+	if len(mails) != len(expected) {
+		t.Fatalf("Expected %d mails, got %d", len(expected), len(mails))
+	}
+	if mails[0].From != "monitor@example.com" || len(mails[0].To) != 1 || mails[0].To[0] != "dba@example.com" {
+		t.Errorf("Unexpected envelope: %s -> %v", mails[0].From, mails[0].To)
+	}
+	if !strings.Contains(mails[0].Data, "Subject: "+expected[0]) {
+		t.Errorf("Unexpected mail: %s", mails[0].Data)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	m := NewManager("mysql-service", []Notifier{NewWebhook(hook.URL, time.Second)}, 50*time.Millisecond)
+	down := Alert{Rule: "master_down", Subject: "10.0.0.1:3306"}
+	m.Update([]Alert{down})
+	m.Update([]Alert{down})
+	time.Sleep(60 * time.Millisecond)
+	m.Update([]Alert{down})
+	m.Close()
+	if count != 2 {
+		t.Errorf("The firing alert should be notified again after the repeat interval, got %d notifications", count)
+	}
+}
@@ -0,0 +1,109 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+
+// Webhook posts the notifications in JSON to URL. The "text" field makes it work
+// with the incoming webhooks of Slack as well.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+type webhookPayload struct {
+	Text     string `json:"text"`
+	Status   string `json:"status"`
+	Cluster  string `json:"cluster"`
+	Rule     string `json:"rule"`
+	Subject  string `json:"subject"`
+	Summary  string `json:"summary"`
+	Started  string `json:"started"`
+	Resolved string `json:"resolved,omitempty"`
+}
+
+// NewWebhook creates a Webhook with the request timeout
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// Name implements Notifier
+func (w *Webhook) Name() string {
+	return w.URL
+}
+
+// Notify implements Notifier
+func (w *Webhook) Notify(n Notification) error {
+	payload := webhookPayload{
+		Text:    n.Text(),
+		Status:  n.Status,
+		Cluster: n.Cluster,
+		Rule:    n.Rule,
+		Subject: n.Subject,
+		Summary: n.Summary,
+		Started: n.Started.Format(timeFormat),
+	}
+	if !n.Resolved.IsZero() {
+		payload.Resolved = n.Resolved.Format(timeFormat)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook returns %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTP mails the notifications. PLAIN auth is used if User is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	User     string
+	Password string
+}
+
+// Name implements Notifier
+func (s *SMTP) Name() string {
+	return "smtp://" + s.Addr
+}
+
+// Notify implements Notifier
+func (s *SMTP) Notify(n Notification) error {
+	var auth smtp.Auth
+	if s.User != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.User, s.Password, host)
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", n.Text())
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "Cluster: %s\r\nRule: %s\r\nSubject: %s\r\nStatus: %s\r\nStarted: %s\r\n",
+		n.Cluster, n.Rule, n.Subject, n.Status, n.Started.Format(timeFormat))
+	if !n.Resolved.IsZero() {
+		fmt.Fprintf(&body, "Resolved: %s\r\n", n.Resolved.Format(timeFormat))
+	}
+	fmt.Fprintf(&body, "\r\n%s\r\n", n.Summary)
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, body.Bytes())
+}
@@ -0,0 +1,222 @@
+// Package backup implements the full and increment backups of mysql-server,
+// which are the pre_run commands of backupd configured in lain.yaml.
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/secret"
+)
+
+// The exit codes of the backup command
+const (
+	ExitOK           = 0
+	ExitUsage        = 1
+	ExitWrongRole    = 2
+	ExitMonitorError = 3
+	ExitMySQLError   = 4
+	ExitBackupFailed = 5
+	ExitIOError      = 6
+)
+
+const (
+	TypeFull = "full"
+	TypeIncr = "incr"
+
+	roleMaster  = "Master"
+	roleStandby = "Standby"
+
+	monitorTimeout = 5 * time.Second
+	mysqlSocket    = "/var/run/mysqld/mysqld.sock"
+)
+
+// Options are the options of one backup run
+type Options struct {
+	Type       string
+	MonitorURL string
+	Host       string
+	Port       string
+	BackupDir  string
+	BinlogDir  string
+	LogDir     string
+	SecretFile string
+}
+
+// RoleInfo is the role information returned by the /api/role API of monitor
+type RoleInfo struct {
+	Role              string
+	InstanceStatus    string
+	ReplicationStatus string
+	StandbyRegistered bool
+}
+
+// exitError is an error with the exit code of the backup command
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func newExitError(code int, format string, args ...interface{}) *exitError {
+	return &exitError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// Run parses args, executes the backup and returns the exit code
+func Run(args []string) int {
+	opts := Options{}
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.StringVar(&opts.Type, "type", TypeFull, "The backup type (full|incr)")
+	flags.StringVar(&opts.MonitorURL, "monitor", DefaultMonitorURL(), "The base URL of monitor")
+	flags.StringVar(&opts.Host, "host", DefaultHost(), "The host of this instance registered in monitor")
+	flags.StringVar(&opts.Port, "port", "3306", "The port of this instance registered in monitor")
+	flags.StringVar(&opts.BackupDir, "backup-dir", "/var/lib/mysql_backup", "The directory saving full backups")
+	flags.StringVar(&opts.BinlogDir, "binlog-dir", "/var/lib/mysql_log_bin", "The directory of binlogs")
+	flags.StringVar(&opts.LogDir, "log-dir", "/var/log/baklog", "The directory of xtrabackup logs")
+	flags.StringVar(&opts.SecretFile, "secret-file", secret.DefaultFile, "The secret file with the service token to report to monitor")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if opts.Type != TypeFull && opts.Type != TypeIncr {
+		fmt.Fprintf(os.Stderr, "Unknown backup type %s\n", opts.Type)
+		return ExitUsage
+	}
+
+	manifest, err := runBackup(opts)
+	if err != nil {
+		glog.Errorf("%s backup failed: %s", opts.Type, err.Error())
+	}
+	reportMetrics(opts, manifest, err)
+	exitCode := exitCodeOf(err)
+	if reported(exitCode) {
+		report := Report{Manifest: manifest, ExitCode: exitCode}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if err := reportToMonitor(opts, report); err != nil {
+			glog.Errorf("Report backup to monitor failed: %s", err.Error())
+		}
+	}
+	glog.Flush()
+	return exitCode
+}
+
+func runBackup(opts Options) (Manifest, error) {
+	role, err := GetRole(opts)
+	if err != nil {
+		return Manifest{}, newExitError(ExitMonitorError, "Get role from monitor failed: %s", err.Error())
+	}
+	if err = checkRole(opts.Type, role); err != nil {
+		return Manifest{}, err
+	}
+	if opts.Type == TypeFull {
+		return fullBackup(opts, role)
+	}
+	return incrBackup(opts, role)
+}
+
+// checkRole returns an error with ExitWrongRole if the backup of backupType doesn't run on the instance of role.
+// The two kinds of backups run on different hosts, so the binlog positions of the full backups
+// don't apply to the binlogs of the increment backups, and recovery locates the binlogs by GTID.
+func checkRole(backupType string, role RoleInfo) error {
+	switch backupType {
+	case TypeFull:
+		// Full backups are taken on master, which is the only instance registered for sure
+		if role.Role != roleMaster {
+			return newExitError(ExitWrongRole, "Full backups run on master, but the role is %s", role.Role)
+		}
+	default:
+		// Increment backups are taken on standby, or on master if there is no standby
+		if role.Role != roleStandby && (role.Role != roleMaster || role.StandbyRegistered) {
+			return newExitError(ExitWrongRole, "Increment backups run on standby, but the role is %s", role.Role)
+		}
+	}
+	return nil
+}
+
+// exitCodeOf returns the exit code of the backup command for the error of the backup
+func exitCodeOf(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return ExitBackupFailed
+}
+
+// reported reports whether the run with exitCode is added to the backup catalog of monitor.
+// Runs on the other instances and runs unknown to monitor are not backups at all.
+func reported(exitCode int) bool {
+	return exitCode != ExitWrongRole && exitCode != ExitMonitorError
+}
+
+// GetRole returns the role of the instance of opts.Host and opts.Port from monitor
+func GetRole(opts Options) (RoleInfo, error) {
+	var role RoleInfo
+	v := url.Values{}
+	v.Set("host", opts.Host)
+	v.Set("port", opts.Port)
+	resp, err := (&http.Client{Timeout: monitorTimeout}).Get(fmt.Sprintf("%s/api/role?%s", opts.MonitorURL, v.Encode()))
+	if err != nil {
+		return role, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return role, fmt.Errorf("monitor returns %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&role)
+	return role, err
+}
+
+// reportToMonitor adds the result of this run to the backup catalog of monitor
+func reportToMonitor(opts Options, report Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Set("host", opts.Host)
+	v.Set("port", opts.Port)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/backups?%s", opts.MonitorURL, v.Encode()), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	secret.SetToken(req, secret.Token(opts.SecretFile))
+	resp, err := (&http.Client{Timeout: monitorTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("monitor returns %s", resp.Status)
+	}
+	return nil
+}
+
+// DefaultHost returns the host of this mysql-server instance registered in monitor, e.g. mysql-server-1
+func DefaultHost() string {
+	return fmt.Sprintf("%s-%s", os.Getenv("LAIN_PROCNAME"), os.Getenv("DEPLOYD_POD_INSTANCE_NO"))
+}
+
+// DefaultMonitorURL returns the web address of monitor, e.g. http://mysql-service.lain.local
+// for app "mysql-service" and http://c.b.a.lain.local for app "a.b.c".
+func DefaultMonitorURL() string {
+	parts := strings.Split(os.Getenv("LAIN_APPNAME"), ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return fmt.Sprintf("http://%s.%s", strings.Join(parts, "."), os.Getenv("LAIN_DOMAIN"))
+}
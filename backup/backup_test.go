@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckRole(t *testing.T) {
+	for _, c := range []struct {
+		backupType string
+		role       RoleInfo
+		allowed    bool
+	}{
+		{backupType: TypeFull, role: RoleInfo{Role: roleMaster}, allowed: true},
+		{backupType: TypeFull, role: RoleInfo{Role: roleMaster, StandbyRegistered: true}, allowed: true},
+		{backupType: TypeFull, role: RoleInfo{Role: roleStandby, StandbyRegistered: true}},
+		{backupType: TypeFull, role: RoleInfo{Role: "Slave"}},
+		{backupType: TypeFull, role: RoleInfo{Role: "Unregistered"}},
+		{backupType: TypeIncr, role: RoleInfo{Role: roleStandby, StandbyRegistered: true}, allowed: true},
+		// Master takes the increment backups only if there is no standby
+		{backupType: TypeIncr, role: RoleInfo{Role: roleMaster}, allowed: true},
+		{backupType: TypeIncr, role: RoleInfo{Role: roleMaster, StandbyRegistered: true}},
+		{backupType: TypeIncr, role: RoleInfo{Role: "Slave", StandbyRegistered: true}},
+		{backupType: TypeIncr, role: RoleInfo{Role: "Unregistered"}},
+	} {
+		err := checkRole(c.backupType, c.role)
+		if c.allowed && err != nil {
+			t.Errorf("%s backup should run on %+v, got %s", c.backupType, c.role, err.Error())
+		} else if !c.allowed && exitCodeOf(err) != ExitWrongRole {
+			t.Errorf("%s backup should exit with %d on %+v, got %v", c.backupType, ExitWrongRole, c.role, err)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		exitCode int
+		reported bool
+	}{
+		{err: nil, exitCode: ExitOK, reported: true},
+		{err: newExitError(ExitWrongRole, "wrong role"), exitCode: ExitWrongRole},
+		{err: newExitError(ExitMonitorError, "monitor is down"), exitCode: ExitMonitorError},
+		{err: newExitError(ExitMySQLError, "mysqld is down"), exitCode: ExitMySQLError, reported: true},
+		{err: newExitError(ExitIOError, "disk is full"), exitCode: ExitIOError, reported: true},
+		{err: fmt.Errorf("unknown"), exitCode: ExitBackupFailed, reported: true},
+	} {
+		exitCode := exitCodeOf(c.err)
+		if exitCode != c.exitCode || reported(exitCode) != c.reported {
+			t.Errorf("Exit code of %v should be %d (reported: %v), got %d (reported: %v)", c.err, c.exitCode, c.reported, exitCode, reported(exitCode))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupTimeFormat = "2006-01-02-15-04-05"
+	binlogInfoName   = "xtrabackup_binlog_info"
+	xtrabackupOK     = "completed OK!"
+	tarBlockSize     = 512
+	tarRecordSize    = 20 * tarBlockSize
+)
+
+var zeroBlock = make([]byte, tarBlockSize)
+
+// fullBackup streams the output of innobackupex into a gzipped tar file in the backup directory.
+// The binlog position of the backup is read from xtrabackup_binlog_info while streaming.
+func fullBackup(opts Options, role RoleInfo) (Manifest, error) {
+	manifest := newManifest(opts, role)
+	name := manifest.Started.Format(backupTimeFormat)
+	backupFile := filepath.Join(opts.BackupDir, name+"_bak.tar.gz")
+	logFile := filepath.Join(opts.LogDir, name)
+
+	out, err := os.Create(backupFile)
+	if err != nil {
+		return manifest, newExitError(ExitIOError, "Create backup file failed: %s", err.Error())
+	}
+	defer out.Close()
+	logOut, err := os.Create(logFile)
+	if err != nil {
+		return manifest, newExitError(ExitIOError, "Create backup log failed: %s", err.Error())
+	}
+	defer logOut.Close()
+
+	cmd := exec.Command("innobackupex", "--slave-info", "--user=root", "--stream=tar", "./")
+	cmd.Stderr = logOut
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return manifest, newExitError(ExitBackupFailed, "Pipe innobackupex failed: %s", err.Error())
+	}
+	if err = cmd.Start(); err != nil {
+		return manifest, newExitError(ExitBackupFailed, "Start innobackupex failed: %s", err.Error())
+	}
+
+	hasher := sha256.New()
+	counter := &countWriter{}
+	gzOut := gzip.NewWriter(io.MultiWriter(out, hasher, counter))
+	stream := io.TeeReader(stdout, gzOut)
+	binlogInfo, parseErr := readBinlogInfo(stream)
+	// Drain the stream so that innobackupex is never blocked and the whole tar is saved
+	_, copyErr := io.Copy(ioutil.Discard, stream)
+	if err = gzOut.Close(); err == nil {
+		err = copyErr
+	}
+	waitErr := cmd.Wait()
+	manifest.Finished = time.Now()
+
+	if err != nil {
+		os.Remove(backupFile)
+		return manifest, newExitError(ExitIOError, "Write backup file failed: %s", err.Error())
+	}
+	if waitErr != nil || !backupCompleted(logFile) {
+		os.Remove(backupFile)
+		return manifest, newExitError(ExitBackupFailed, "innobackupex failed, see %s", logFile)
+	}
+	if parseErr != nil {
+		os.Remove(backupFile)
+		return manifest, newExitError(ExitBackupFailed, "Read %s failed: %s", binlogInfoName, parseErr.Error())
+	}
+	manifest.Files = []FileInfo{{
+		Name:   filepath.Base(backupFile),
+		Size:   counter.count,
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+	}}
+	if manifest.BinlogFile, manifest.BinlogPos, manifest.GTIDSet, err = parseBinlogInfo(binlogInfo); err != nil {
+		os.Remove(backupFile)
+		return manifest, newExitError(ExitBackupFailed, "Parse %s failed: %s", binlogInfoName, err.Error())
+	}
+	if err = verifyFull(backupFile, manifest); err != nil {
+		manifest.VerifyError = err.Error()
+	} else {
+		manifest.Verified = true
+	}
+	if err = manifest.save(filepath.Join(opts.BackupDir, name+"_manifest.json")); err != nil {
+		return manifest, newExitError(ExitIOError, "Save manifest failed: %s", err.Error())
+	}
+	os.Remove(logFile)
+	return manifest, nil
+}
+
+// readBinlogInfo reads the tar stream until its end and returns the content of xtrabackup_binlog_info
+func readBinlogInfo(r io.Reader) (string, error) {
+	var binlogInfo string
+	found := false
+	err := walkTarStream(r, func(hdr *tar.Header, content io.Reader) error {
+		if path.Base(hdr.Name) != binlogInfoName {
+			return nil
+		}
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		binlogInfo, found = string(data), true
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("%s is not found in the backup", binlogInfoName)
+	}
+	return binlogInfo, nil
+}
+
+// walkTarStream calls walkFn with every file of the tar stream of innobackupex until the end of the stream.
+// The stream is a series of tar archives, since xtrabackup and innobackupex stream the files separately,
+// and each archive ends with zero blocks. The zero blocks are skipped like "tar -i" does.
+func walkTarStream(r io.Reader, walkFn func(hdr *tar.Header, content io.Reader) error) error {
+	br := bufio.NewReaderSize(r, tarRecordSize)
+	for {
+		block, err := br.Peek(tarBlockSize)
+		if err == io.EOF && len(block) == 0 {
+			return nil
+		} else if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if bytes.Equal(block, zeroBlock) {
+			br.Discard(tarBlockSize)
+			continue
+		}
+		// The reader stops at the first two zero blocks, which end the archive
+		tr := tar.NewReader(br)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err = walkFn(hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseBinlogInfo parses the content of xtrabackup_binlog_info, e.g. "lb.000003	120	uuid:1-10"
+func parseBinlogInfo(info string) (string, int64, string, error) {
+	fields := strings.Fields(info)
+	if len(fields) < 2 {
+		return "", 0, "", fmt.Errorf("invalid binlog info %q", info)
+	}
+	pos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, "", err
+	}
+	return fields[0], pos, strings.Join(fields[2:], ""), nil
+}
+
+// backupCompleted checks whether the last line of the innobackupex log ends with "completed OK!"
+func backupCompleted(logFile string) bool {
+	file, err := os.Open(logFile)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var lastLine string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lastLine = line
+		}
+	}
+	return strings.HasSuffix(lastLine, xtrabackupOK)
+}
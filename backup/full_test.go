@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const (
+	uuidMaster   = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuidStandby  = "4a0b3c1d-71ca-11e1-9e33-c80aa9429562"
+	streamSample = "testdata/xtrabackup_stream.tar.gz"
+)
+
+// tarFile is a file in the archives built by tarArchive
+type tarFile struct {
+	name    string
+	content string
+}
+
+// tarArchive builds a tar archive of files, which ends with two zero blocks
+func tarArchive(t *testing.T, files ...tarFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zeroBlocks returns n zero blocks, which pad the archives of the tar stream
+func zeroBlocks(n int) []byte {
+	return make([]byte, n*tarBlockSize)
+}
+
+// readSample returns the tar stream of the sample backup generated by testdata/gen_stream.sh
+func readSample(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(streamSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzIn, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gzIn.Close()
+	stream, err := ioutil.ReadAll(gzIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestParseBinlogInfo(t *testing.T) {
+	for _, c := range []struct {
+		info    string
+		file    string
+		pos     int64
+		gtidSet string
+		invalid bool
+	}{
+		{info: "lb.000003\t120\t" + uuidMaster + ":1-10\n", file: "lb.000003", pos: 120, gtidSet: uuidMaster + ":1-10"},
+		{info: "lb.000003\t120\n", file: "lb.000003", pos: 120},
+		// Long GTID sets are wrapped by MySQL
+		{info: "lb.000012\t4567\t" + uuidMaster + ":1-10,\n" + uuidStandby + ":1-3\n", file: "lb.000012", pos: 4567,
+			gtidSet: uuidMaster + ":1-10," + uuidStandby + ":1-3"},
+		{info: "lb.000003\n", invalid: true},
+		{info: "lb.000003\tpos\n", invalid: true},
+		{info: "", invalid: true},
+	} {
+		file, pos, gtidSet, err := parseBinlogInfo(c.info)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%q should be invalid", c.info)
+			}
+			continue
+		}
+		if err != nil || file != c.file || pos != c.pos || gtidSet != c.gtidSet {
+			t.Errorf("%q should be parsed as %s %d %s, got %s %d %s %v", c.info, c.file, c.pos, c.gtidSet, file, pos, gtidSet, err)
+		}
+	}
+}
+
+func TestReadBinlogInfo(t *testing.T) {
+	binlogInfo := "lb.000003\t120\t" + uuidMaster + ":1-10\n"
+	sample := readSample(t)
+	// The sample has several archives, and a plain tar reader stops at the end of the first one
+	if names := tarNames(sample); len(names) != 1 {
+		t.Fatalf("The sample should have several archives, got %v in the first one", names)
+	}
+	dataArchive := tarArchive(t, tarFile{"ibdata1", strings.Repeat("ibdata1", 200)}, tarFile{"test/t1.ibd", "t1"})
+	infoArchive := tarArchive(t, tarFile{binlogInfoName, binlogInfo})
+	for _, c := range []struct {
+		name       string
+		stream     []byte
+		binlogInfo string
+		err        string
+	}{
+		{name: "the sample of innobackupex", stream: sample, binlogInfo: binlogInfo},
+		{name: "one archive", stream: tarArchive(t, tarFile{"ibdata1", "data"}, tarFile{binlogInfoName, binlogInfo}), binlogInfo: binlogInfo},
+		{name: "archives padded with odd zero blocks", stream: concat(dataArchive, zeroBlocks(1), infoArchive, zeroBlocks(3)), binlogInfo: binlogInfo},
+		{name: "archives without padding", stream: concat(dataArchive, infoArchive), binlogInfo: binlogInfo},
+		{name: "no binlog info", stream: concat(dataArchive, zeroBlocks(18)), err: "not found"},
+		{name: "empty stream", stream: nil, err: "not found"},
+		{name: "truncated header", stream: concat(dataArchive, infoArchive[:100]), err: "unexpected EOF"},
+		{name: "truncated binlog info", stream: concat(dataArchive, infoArchive[:tarBlockSize+10]), err: "unexpected EOF"},
+	} {
+		info, err := readBinlogInfo(bytes.NewReader(c.stream))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Reading %s should fail with %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil || info != c.binlogInfo {
+			t.Errorf("Binlog info of %s should be %q, got %q %v", c.name, c.binlogInfo, info, err)
+		}
+	}
+}
+
+// tarNames returns the names of the files in the first archive of the stream
+func tarNames(stream []byte) []string {
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(stream))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return names
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
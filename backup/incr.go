@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"time"
+
+	// backup package needs go-sql-driver
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const incrManifestName = "incr_manifest.json"
+
+// incrBackup rotates the binlog and records the checksums of the closed binlogs,
+// which are copied by backupd after this pre_run command exits.
+func incrBackup(opts Options, role RoleInfo) (Manifest, error) {
+	manifest := newManifest(opts, role)
+	db, err := sql.Open("mysql", "root@unix("+mysqlSocket+")/")
+	if err != nil {
+		return manifest, newExitError(ExitMySQLError, "Connect to mysqld failed: %s", err.Error())
+	}
+	defer db.Close()
+	if _, err = db.Exec("FLUSH BINARY LOGS"); err != nil {
+		return manifest, newExitError(ExitMySQLError, "Flush binary logs failed: %s", err.Error())
+	}
+	var doDB, ignoreDB string
+	if err = db.QueryRow("SHOW MASTER STATUS").Scan(&manifest.BinlogFile, &manifest.BinlogPos, &doDB, &ignoreDB, &manifest.GTIDSet); err != nil {
+		return manifest, newExitError(ExitMySQLError, "Show master status failed: %s", err.Error())
+	}
+
+	binlogs, err := filepath.Glob(filepath.Join(opts.BinlogDir, "lb.[0-9]*"))
+	if err != nil {
+		return manifest, newExitError(ExitIOError, "List binlogs failed: %s", err.Error())
+	}
+	sort.Strings(binlogs)
+	for _, binlog := range binlogs {
+		// The current binlog is still being written and belongs to the next increment backup
+		if filepath.Base(binlog) >= manifest.BinlogFile {
+			continue
+		}
+		info, err := checksumFile(binlog)
+		if err != nil {
+			return manifest, newExitError(ExitIOError, "Checksum %s failed: %s", binlog, err.Error())
+		}
+		manifest.Files = append(manifest.Files, info)
+	}
+	manifest.Finished = time.Now()
+	if err = verifyBinlogs(opts.BinlogDir, manifest); err != nil {
+		manifest.VerifyError = err.Error()
+	} else {
+		manifest.Verified = true
+	}
+	if err = manifest.save(filepath.Join(opts.BinlogDir, incrManifestName)); err != nil {
+		return manifest, newExitError(ExitIOError, "Save manifest failed: %s", err.Error())
+	}
+	return manifest, nil
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	graphiteTimeout = 2 * time.Second
+	reportFormat    = "%s.%s.%s.%s %d %d\n"
+)
+
+// Manifest describes one backup. It is saved beside the backup files and reported to monitor.
+type Manifest struct {
+	Type       string
+	Host       string
+	Role       string
+	Started    time.Time
+	Finished   time.Time
+	Files      []FileInfo
+	BinlogFile string
+	BinlogPos  int64
+	GTIDSet    string
+	// Verified is true if the saved files are checked to be complete and restorable
+	Verified    bool
+	VerifyError string
+}
+
+// Report is the result of one backup run reported to monitor
+type Report struct {
+	Manifest Manifest
+	ExitCode int
+	Error    string
+}
+
+// FileInfo is the size and checksum of one backup file
+type FileInfo struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+func newManifest(opts Options, role RoleInfo) Manifest {
+	return Manifest{
+		Type:    opts.Type,
+		Host:    opts.Host,
+		Role:    role.Role,
+		Started: time.Now(),
+	}
+}
+
+// Size returns the total size of the backup files
+func (m Manifest) Size() int64 {
+	var size int64
+	for _, file := range m.Files {
+		size += file.Size
+	}
+	return size
+}
+
+func (m Manifest) save(fileName string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+// checksumFile returns the FileInfo of the file
+func checksumFile(fileName string) (FileInfo, error) {
+	info := FileInfo{Name: filepath.Base(fileName)}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if info.Size, err = io.Copy(hasher, file); err != nil {
+		return info, err
+	}
+	info.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return info, nil
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	count int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// reportMetrics logs the result of the backup and sends it to graphite if GRAPHITE_PORT is set
+func reportMetrics(opts Options, manifest Manifest, err error) {
+	success, exitCode := 1, exitCodeOf(err)
+	if err != nil {
+		success = 0
+	}
+	duration := int(manifest.Finished.Sub(manifest.Started).Seconds())
+	if manifest.Finished.IsZero() {
+		duration = 0
+	}
+	glog.Infof("%s backup of %s finished. Success: %d, exit code: %d, duration: %ds, size: %d bytes, binlog: %s:%d, GTID: %s",
+		opts.Type, opts.Host, success, exitCode, duration, manifest.Size(), manifest.BinlogFile, manifest.BinlogPos, manifest.GTIDSet)
+
+	graphitePort := os.Getenv("GRAPHITE_PORT")
+	if graphitePort == "" || exitCode == ExitWrongRole {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("graphite.lain", graphitePort), graphiteTimeout)
+	if err != nil {
+		glog.Errorf("Dial graphite failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	domain := strings.Replace(os.Getenv("LAIN_DOMAIN"), ".", "_", -1)
+	appName := strings.Replace(os.Getenv("LAIN_APPNAME"), ".", "_", -1)
+	timestamp := time.Now().Unix()
+	metrics := map[string]int64{
+		"success":   int64(success),
+		"exit_code": int64(exitCode),
+		"duration":  int64(duration),
+		"size":      manifest.Size(),
+	}
+	var data string
+	for key, value := range metrics {
+		data += fmt.Sprintf(reportFormat, domain, appName, opts.Host, fmt.Sprintf("backup_%s_%s", opts.Type, key), value, timestamp)
+	}
+	if _, err = conn.Write([]byte(data)); err != nil {
+		glog.Errorf("Send backup metrics failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binlog := filepath.Join(dir, "lb.000007")
+	if err = ioutil.WriteFile(binlog, append(binlogMagic, "events"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := checksumFile(binlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FileInfo{Name: "lb.000007", Size: 10, SHA256: "2879ab327f6fbca0b4725c2006b4c35eedd151298446deb8ab70c3cc2829373d"}
+	if info != expected {
+		t.Fatalf("FileInfo of %s is %+v instead of %+v", binlog, info, expected)
+	}
+
+	started := time.Date(2017, 6, 1, 3, 0, 0, 0, time.UTC)
+	manifest := Manifest{
+		Type:       TypeIncr,
+		Host:       "mysql-server-2",
+		Role:       roleStandby,
+		Started:    started,
+		Finished:   started.Add(time.Minute),
+		Files:      []FileInfo{info},
+		BinlogFile: "lb.000008",
+		BinlogPos:  120,
+		GTIDSet:    uuidMaster + ":1-10",
+		Verified:   true,
+	}
+	manifestFile := filepath.Join(dir, incrManifestName)
+	if err = manifest.save(manifestFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Manifest
+	if err = json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, manifest) {
+		t.Errorf("Saved manifest is %+v instead of %+v", saved, manifest)
+	}
+	if saved.Size() != 10 {
+		t.Errorf("Size of the manifest should be 10, got %d", saved.Size())
+	}
+
+	// The saved checksums detect the changed files
+	if err = verifyBinlogs(dir, saved); err != nil {
+		t.Errorf("The binlog should be verified, got %s", err.Error())
+	}
+	if err = ioutil.WriteFile(binlog, append(binlogMagic, "EVENTS"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := checksumFile(binlog); err != nil || changed == saved.Files[0] {
+		t.Errorf("Checksum of the changed binlog should differ from %+v, got %+v %v", saved.Files[0], changed, err)
+	}
+}
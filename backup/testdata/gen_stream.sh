@@ -0,0 +1,36 @@
+#!/bin/bash
+# Generates xtrabackup_stream.tar.gz, which is laid out like the output of
+# "innobackupex --stream=tar" of xtrabackup 2.2: xtrabackup streams the InnoDB files
+# as tar archives of libarchive, and innobackupex streams each of the other files with
+# "tar chf -". Each archive ends with its own zero blocks, so "tar -i" is needed to
+# extract the stream.
+set -e
+
+cd "$(dirname "$0")"
+src=$(mktemp -d)
+trap 'rm -rf "$src"' EXIT
+
+mkdir -p "$src/mysql" "$src/test"
+printf '[mysqld]\ndatadir=/var/lib/mysql\ninnodb_data_file_path=ibdata1:12M:autoextend\n' > "$src/backup-my.cnf"
+yes ibdata1 | head -c 4096 > "$src/ibdata1"
+yes t1.ibd | head -c 1500 > "$src/test/t1.ibd"
+yes t1.frm | head -c 700 > "$src/test/t1.frm"
+yes user.frm | head -c 900 > "$src/mysql/user.frm"
+printf 'lb.000003\t120\t3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10\n' > "$src/xtrabackup_binlog_info"
+printf "CHANGE MASTER TO MASTER_LOG_FILE='lb.000002', MASTER_LOG_POS=154\n" > "$src/xtrabackup_slave_info"
+yes logfile | head -c 2560 > "$src/xtrabackup_logfile"
+printf 'backup_type = full-backuped\nfrom_lsn = 0\nto_lsn = 1626007\nlast_lsn = 1626007\ncompact = 0\n' > "$src/xtrabackup_checkpoints"
+printf 'tool_name = innobackupex\ntool_version = 2.2.12\n' > "$src/xtrabackup_info"
+find "$src" -exec touch -d '2017-06-01 03:00:00' {} +
+
+(
+    cd "$src"
+    tar chf - backup-my.cnf
+    bsdtar -cf - --format ustar ibdata1 test/t1.ibd
+    tar chf - test/t1.frm
+    tar chf - mysql/user.frm
+    tar chf - xtrabackup_binlog_info
+    tar chf - xtrabackup_slave_info
+    bsdtar -cf - --format ustar xtrabackup_logfile xtrabackup_checkpoints
+    tar chf - xtrabackup_info
+) | gzip -n -9 > xtrabackup_stream.tar.gz
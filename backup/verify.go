@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const checkpointsName = "xtrabackup_checkpoints"
+
+var binlogMagic = []byte("\xfebin")
+
+// verifyFull checks that the full backup file matches the manifest and is a complete xtrabackup archive
+func verifyFull(fileName string, manifest Manifest) error {
+	if len(manifest.Files) != 1 {
+		return fmt.Errorf("expect 1 file in the manifest, got %d", len(manifest.Files))
+	}
+	info, err := checksumFile(fileName)
+	if err != nil {
+		return err
+	}
+	if info != manifest.Files[0] {
+		return fmt.Errorf("checksum mismatch: %+v is saved while %+v is expected", info, manifest.Files[0])
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzIn, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzIn.Close()
+	var checkpoints, binlogInfo bool
+	var checkpointsErr error
+	err = walkTarStream(gzIn, func(hdr *tar.Header, content io.Reader) error {
+		switch path.Base(hdr.Name) {
+		case checkpointsName:
+			data, err := ioutil.ReadAll(content)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(string(data), "full-backuped") {
+				checkpointsErr = fmt.Errorf("%s is not a full backup: %s", checkpointsName, string(data))
+				return checkpointsErr
+			}
+			checkpoints = true
+		case binlogInfoName:
+			binlogInfo = true
+		}
+		return nil
+	})
+	if checkpointsErr != nil {
+		return checkpointsErr
+	} else if err != nil {
+		return fmt.Errorf("broken archive: %s", err.Error())
+	}
+	if !checkpoints || !binlogInfo {
+		return fmt.Errorf("%s or %s is missing in the archive", checkpointsName, binlogInfoName)
+	}
+	return nil
+}
+
+// verifyBinlogs checks that the binlogs in the manifest start with the binlog magic number
+func verifyBinlogs(dir string, manifest Manifest) error {
+	for _, info := range manifest.Files {
+		file, err := os.Open(filepath.Join(dir, info.Name))
+		if err != nil {
+			return err
+		}
+		magic := make([]byte, len(binlogMagic))
+		_, err = io.ReadFull(file, magic)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("read %s failed: %s", info.Name, err.Error())
+		}
+		if !bytes.Equal(magic, binlogMagic) {
+			return fmt.Errorf("%s is not a binlog", info.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gzipStream compresses the tar stream like fullBackup does
+func gzipStream(t *testing.T, stream []byte) []byte {
+	var buf bytes.Buffer
+	gzOut := gzip.NewWriter(&buf)
+	if _, err := gzOut.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzOut.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sample, err := ioutil.ReadFile(streamSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binlogInfo := tarFile{binlogInfoName, "lb.000003\t120\n"}
+	fullCheckpoints := tarFile{checkpointsName, "backup_type = full-backuped\nfrom_lsn = 0\nto_lsn = 1626007\n"}
+	incrCheckpoints := tarFile{checkpointsName, "backup_type = incremental\nfrom_lsn = 1626007\nto_lsn = 1700000\n"}
+	for _, c := range []struct {
+		name     string
+		data     []byte
+		checksum string
+		err      string
+	}{
+		{name: "the sample of innobackupex", data: sample},
+		{name: "truncated archive", data: sample[:len(sample)/2], err: "broken archive"},
+		{name: "missing checkpoints", data: gzipStream(t, concat(tarArchive(t, tarFile{"ibdata1", "data"}), tarArchive(t, binlogInfo))),
+			err: checkpointsName + " or " + binlogInfoName + " is missing"},
+		{name: "missing binlog info", data: gzipStream(t, tarArchive(t, tarFile{"ibdata1", "data"}, fullCheckpoints)),
+			err: checkpointsName + " or " + binlogInfoName + " is missing"},
+		{name: "incremental backup", data: gzipStream(t, concat(tarArchive(t, incrCheckpoints), tarArchive(t, binlogInfo))),
+			err: "is not a full backup"},
+		{name: "not gzipped", data: tarArchive(t, fullCheckpoints, binlogInfo), err: "gzip"},
+		{name: "checksum mismatch", data: sample, checksum: strings.Repeat("0", 64), err: "checksum mismatch"},
+	} {
+		fileName := filepath.Join(dir, "2017-06-01-03-00-00_bak.tar.gz")
+		if err := ioutil.WriteFile(fileName, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := checksumFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.checksum != "" {
+			info.SHA256 = c.checksum
+		}
+		err = verifyFull(fileName, Manifest{Type: TypeFull, Files: []FileInfo{info}})
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s should be verified, got %s", c.name, err.Error())
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Verifying %s should fail with %q, got %v", c.name, c.err, err)
+		}
+	}
+}
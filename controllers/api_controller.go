@@ -3,9 +3,12 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 
 	"github.com/astaxie/beego"
 	"github.com/laincloud/mysql-service/monitor"
+	"github.com/laincloud/mysql-service/secret"
 )
 
 type APIController struct {
@@ -27,3 +30,178 @@ func (c *APIController) GetRole() {
 	}
 	c.Ctx.WriteString(inst.Role)
 }
+
+// GetRoleInfo returns the role information of the instance in json
+func (c *APIController) GetRoleInfo() {
+	req := monitor.GetRequest{
+		RequestType:  monitor.GetRoleInfo,
+		Params:       map[string]string{"endpoint": net.JoinHostPort(c.GetString("host"), c.GetString("port"))},
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(req)
+	resp := <-req.ResponseChan
+	c.Ctx.Output.SetStatus(resp.Code)
+	if resp.Err != nil {
+		c.Data["json"] = map[string]string{"error": resp.Err.Error()}
+	} else {
+		var role monitor.RoleView
+		json.Unmarshal(resp.Data, &role)
+		c.Data["json"] = role
+	}
+	c.ServeJson()
+}
+
+// PostBackup adds the backup report posted by the backup command to the backup catalog. The command
+// must carry the service token, so that the catalog used by pitr can't be forged.
+func (c *APIController) PostBackup() {
+	if !secret.Authorized(c.Ctx.Request, monitor.Secret(secret.TokenKey)) {
+		c.Ctx.Output.SetStatus(http.StatusForbidden)
+		c.Data["json"] = map[string]string{"error": "Invalid service token"}
+		c.ServeJson()
+		return
+	}
+	req := monitor.BackupRequest{
+		Endpoint:     net.JoinHostPort(c.GetString("host"), c.GetString("port")),
+		ResponseChan: make(chan monitor.PatchResponse),
+	}
+	if err := json.NewDecoder(c.Ctx.Request.Body).Decode(&req.Report); err != nil {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": err.Error()}
+		c.ServeJson()
+		return
+	}
+	monitor.ReportBackup(req)
+	resp := <-req.ResponseChan
+	c.Ctx.Output.SetStatus(resp.Code)
+	if resp.Err != nil {
+		c.Data["json"] = map[string]string{"error": resp.Err.Error()}
+	} else {
+		c.Data["json"] = map[string]string{}
+	}
+	c.ServeJson()
+}
+
+// GetBackups returns all the records in the backup catalog in json
+func (c *APIController) GetBackups() {
+	c.serveGet(monitor.GetRequest{RequestType: monitor.GetCatalog})
+}
+
+// GetMetrics returns the charts of the metrics history of the instance in json
+func (c *APIController) GetMetrics() {
+	c.serveGet(monitor.GetRequest{
+		RequestType: monitor.GetMetrics,
+		Params: map[string]string{
+			"endpoint": net.JoinHostPort(c.GetString("host"), c.GetString("port")),
+			"range":    c.GetString("range"),
+		},
+	})
+}
+
+// GetInnoDB returns the parsed InnoDB status and the deadlock history of the instance in json
+func (c *APIController) GetInnoDB() {
+	c.serveGet(monitor.GetRequest{
+		RequestType: monitor.GetInnoDB,
+		Params:      map[string]string{"endpoint": net.JoinHostPort(c.GetString("host"), c.GetString("port"))},
+	})
+}
+
+// GetSlowQueries returns the top slow queries of the instance in json
+func (c *APIController) GetSlowQueries() {
+	c.serveGet(monitor.GetRequest{
+		RequestType: monitor.GetSlowQueries,
+		Params: map[string]string{
+			"endpoint": net.JoinHostPort(c.GetString("host"), c.GetString("port")),
+			"top":      c.GetString("top"),
+			"order":    c.GetString("order"),
+		},
+	})
+}
+
+// GetSessions returns the full process list of the instance in json
+func (c *APIController) GetSessions() {
+	c.serveGet(monitor.GetRequest{
+		RequestType: monitor.GetSessions,
+		Params:      map[string]string{"endpoint": net.JoinHostPort(c.GetString("host"), c.GetString("port"))},
+	})
+}
+
+// KillSessions kills the sessions of the instance by the action kill-query or kill-connection with
+// the id, or kill-sessions with the filter, and returns the ids killed in json
+func (c *APIController) KillSessions() {
+	action := monitor.PatchAction(c.GetString("type"))
+	req := monitor.PatchRequest{
+		Action:       action,
+		Endpoint:     net.JoinHostPort(c.GetString("host"), c.GetString("port")),
+		Params:       make(map[string]string),
+		Operator:     c.Ctx.Input.IP(),
+		Role:         consoleRole(c.Ctx),
+		ResponseChan: make(chan monitor.PatchResponse),
+	}
+	if !killAction(action) {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": fmt.Sprintf("Unknown action %s", action)}
+		c.ServeJson()
+		return
+	}
+	for _, key := range actionParams {
+		if value := c.GetString(key); value != "" {
+			req.Params[key] = value
+		}
+	}
+	monitor.Patch(req)
+	resp := <-req.ResponseChan
+	c.Ctx.Output.SetStatus(resp.Code)
+	if resp.Err != nil {
+		c.Data["json"] = map[string]string{"error": resp.Err.Error()}
+	} else {
+		c.Data["json"] = map[string]string{"killed": req.Params["killed"]}
+	}
+	c.ServeJson()
+}
+
+// GetDatabases returns the application databases on master in json
+func (c *APIController) GetDatabases() {
+	c.serveGet(monitor.GetRequest{RequestType: monitor.GetDatabases})
+}
+
+// PostDatabase creates a database with its user by the action create-db, rotates or drops the
+// user by rotate-db-user or drop-db-user, or sets the quota of the database by set-quota, and
+// returns the account with the new password in json
+func (c *APIController) PostDatabase() {
+	action := monitor.PatchAction(c.GetString("type"))
+	if !databaseAction(action) {
+		c.Ctx.Output.SetStatus(http.StatusBadRequest)
+		c.Data["json"] = map[string]string{"error": fmt.Sprintf("Unknown action %s", action)}
+		c.ServeJson()
+		return
+	}
+	req := newDatabaseRequest(&c.Controller, string(action))
+	monitor.Patch(req)
+	resp := <-req.ResponseChan
+	c.Ctx.Output.SetStatus(resp.Code)
+	if resp.Err != nil {
+		c.Data["json"] = map[string]string{"error": resp.Err.Error()}
+		c.ServeJson()
+		return
+	}
+	if len(resp.Data) == 0 {
+		resp.Data = []byte("{}")
+	}
+	c.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	c.Ctx.Output.Body(resp.Data)
+}
+
+// serveGet sends req to monitor, and serves the json data in the response or the error
+func (c *APIController) serveGet(req monitor.GetRequest) {
+	req.ResponseChan = make(chan monitor.GetResponse)
+	monitor.Get(req)
+	resp := <-req.ResponseChan
+	c.Ctx.Output.SetStatus(resp.Code)
+	if resp.Err != nil {
+		c.Data["json"] = map[string]string{"error": resp.Err.Error()}
+		c.ServeJson()
+		return
+	}
+	c.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	c.Ctx.Output.Body(resp.Data)
+}
@@ -23,6 +23,9 @@ type ConsoleAuthResponse struct {
 	Role    ConsoleRole `json:"role"`
 }
 
+// consoleRoleKey is the input data of the console role of the web user, set by FilterConsoleLogin
+const consoleRoleKey = "console_role"
+
 // FilterConsoleLogin prohabits those unauthorized requests
 func FilterConsoleLogin(ctx *context.Context) {
 	//检查是否开启了SSO验证
@@ -37,12 +40,15 @@ func FilterConsoleLogin(ctx *context.Context) {
 
 	//如果没有开启SSO验证，则跳过后面的验证逻辑
 	if authConf.Type != "lain-sso" {
+		ctx.Input.SetData(consoleRoleKey, monitor.RoleAnonymous)
 		return
 	}
 
 	//如果Session中没有access_token或者有但是验证不通过，则跳转到sso的登录页面
 	if token, exist := ctx.Input.Session("access_token").(string); exist {
-		if !validateConsoleRole(monitor.ConsoleAuthURL, token) {
+		if role, ok := validateConsoleRole(monitor.ConsoleAuthURL, token); ok {
+			ctx.Input.SetData(consoleRoleKey, role)
+		} else {
 			redirectToSSO(ctx)
 		}
 	} else if code := ctx.Input.Query("code"); code == "" {
@@ -51,9 +57,9 @@ func FilterConsoleLogin(ctx *context.Context) {
 		//如果没有access_token但是有code，则用该code去sso获取access_token
 		v := url.Values{}
 		v.Set("code", code)
-		v.Set("client_id", monitor.SecretConf["client_id"])
-		v.Set("client_secret", monitor.SecretConf["secret"])
-		v.Set("redirect_uri", monitor.SecretConf["redirect_uri"])
+		v.Set("client_id", monitor.Secret("client_id"))
+		v.Set("client_secret", monitor.Secret("secret"))
+		v.Set("redirect_uri", monitor.Secret("redirect_uri"))
 		v.Set("grant_type", "authorization_code")
 		client := http.DefaultClient
 		var (
@@ -61,7 +67,7 @@ func FilterConsoleLogin(ctx *context.Context) {
 			resp      *http.Response
 			respBytes []byte
 		)
-		resp, err = client.Get(fmt.Sprintf("%s/oauth2/token?%s", monitor.SecretConf["sso_url"], v.Encode()))
+		resp, err = client.Get(fmt.Sprintf("%s/oauth2/token?%s", monitor.Secret("sso_url"), v.Encode()))
 		if err == nil {
 			defer resp.Body.Close()
 			if respBytes, err = ioutil.ReadAll(resp.Body); err == nil {
@@ -86,7 +92,8 @@ func FilterConsoleLogin(ctx *context.Context) {
 	}
 }
 
-func validateConsoleRole(authURL, token string) bool {
+// validateConsoleRole returns the console role of the token, and whether the token is valid
+func validateConsoleRole(authURL, token string) (string, bool) {
 	client := http.DefaultClient
 	if req, err := http.NewRequest("GET", authURL, nil); err == nil {
 		req.Header.Set("access-token", token)
@@ -94,20 +101,28 @@ func validateConsoleRole(authURL, token string) bool {
 			defer resp.Body.Close()
 			if respBytes, err := ioutil.ReadAll(resp.Body); err == nil {
 				caResp := ConsoleAuthResponse{}
-				return json.Unmarshal(respBytes, &caResp) == nil && caResp.Role.Role != ""
+				if json.Unmarshal(respBytes, &caResp) == nil && caResp.Role.Role != "" {
+					return caResp.Role.Role, true
+				}
 			}
 		}
 	}
-	return false
+	return "", false
+}
+
+// consoleRole returns the console role set by FilterConsoleLogin
+func consoleRole(ctx *context.Context) string {
+	role, _ := ctx.Input.GetData(consoleRoleKey).(string)
+	return role
 }
 
 func redirectToSSO(ctx *context.Context) {
 	v := url.Values{}
 	v.Set("response_type", "code")
-	v.Set("redirect_uri", monitor.SecretConf["redirect_uri"])
+	v.Set("redirect_uri", monitor.Secret("redirect_uri"))
 	v.Set("realm", "mysql")
-	v.Set("client_id", monitor.SecretConf["client_id"])
+	v.Set("client_id", monitor.Secret("client_id"))
 	v.Set("scope", "write:group")
 	v.Set("state", fmt.Sprintf("%d", time.Now().Unix()))
-	ctx.Redirect(302, fmt.Sprintf("%s/oauth2/auth?%s", monitor.SecretConf["sso_url"], v.Encode()))
+	ctx.Redirect(302, fmt.Sprintf("%s/oauth2/auth?%s", monitor.Secret("sso_url"), v.Encode()))
 }
@@ -7,7 +7,10 @@ import (
 	"net/http"
 
 	"github.com/astaxie/beego"
+	"github.com/laincloud/mysql-service/agent"
 	"github.com/laincloud/mysql-service/monitor"
+	"github.com/laincloud/mysql-service/simulator"
+	"github.com/laincloud/mysql-service/slowlog"
 )
 
 type MainController struct {
@@ -29,11 +32,194 @@ func (c *MainController) Overview() {
 		var insts []monitor.InstanceView
 		json.Unmarshal(resp.Data, &insts)
 		c.Data["Instances"] = insts
+		c.Data["Alerts"] = monitor.FiringAlerts()
 		c.Layout = "frame.html"
 		c.TplNames = "overview.html"
 	}
 }
 
+func (c *MainController) Backups() {
+	c.Data["prevAddr"] = "#"
+	c.Data["menu"] = "backups"
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetBackups,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	backupsResp := <-getReq.ResponseChan
+	getReq.RequestType = monitor.GetAllOverview
+	monitor.Get(getReq)
+	allResp := <-getReq.ResponseChan
+	if backupsResp.Err != nil {
+		c.handleError("Get backups error", backupsResp.Err.Error(), backupsResp.Code)
+	} else if allResp.Err != nil {
+		c.handleError("Get servers list error", allResp.Err.Error(), allResp.Code)
+	} else {
+		var backups monitor.BackupsView
+		var insts []monitor.InstanceView
+		json.Unmarshal(backupsResp.Data, &backups)
+		json.Unmarshal(allResp.Data, &insts)
+		c.Data["Backups"] = backups
+		c.Data["Instances"] = insts
+		c.Layout = "frame.html"
+		c.TplNames = "backups.html"
+	}
+}
+
+// Databases shows the application databases on master, and the account created or rotated
+// by DatabaseAction
+func (c *MainController) Databases() {
+	c.Data["prevAddr"] = "#"
+	c.Data["menu"] = "databases"
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetDatabases,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	databasesResp := <-getReq.ResponseChan
+	getReq.RequestType = monitor.GetAllOverview
+	monitor.Get(getReq)
+	allResp := <-getReq.ResponseChan
+	if databasesResp.Err != nil {
+		c.handleError("Get databases error", databasesResp.Err.Error(), databasesResp.Code)
+	} else if allResp.Err != nil {
+		c.handleError("Get servers list error", allResp.Err.Error(), allResp.Code)
+	} else {
+		var databases []monitor.DatabaseView
+		var insts []monitor.InstanceView
+		json.Unmarshal(databasesResp.Data, &databases)
+		json.Unmarshal(allResp.Data, &insts)
+		c.Data["Databases"] = databases
+		c.Data["Instances"] = insts
+		c.Layout = "frame.html"
+		c.TplNames = "databases.html"
+	}
+}
+
+// DatabaseAction creates a database, or rotates or drops the user of a database, and shows the
+// databases with the new password, which is not shown again
+func (c *MainController) DatabaseAction() {
+	actionType := c.GetString("type")
+	if !databaseAction(monitor.PatchAction(actionType)) {
+		c.handleError(fmt.Sprintf("%s error", actionType), "Unknown action", http.StatusBadRequest)
+		return
+	}
+	patchReq := newDatabaseRequest(&c.Controller, actionType)
+	monitor.Patch(patchReq)
+	patchResp := <-patchReq.ResponseChan
+	if patchResp.Err != nil {
+		c.handleError(fmt.Sprintf("%s error", actionType), patchResp.Err.Error(), patchResp.Code)
+		return
+	}
+	if len(patchResp.Data) > 0 {
+		var account monitor.AccountView
+		json.Unmarshal(patchResp.Data, &account)
+		c.Data["Account"] = account
+	}
+	c.Databases()
+}
+
+// databaseParams are the parameters of the database actions, name and user for provisioning
+// and the others for set-quota
+var databaseParams = []string{"name", "user", "max_connections", "max_size", "block"}
+
+// newDatabaseRequest returns the request of the database action of the web request
+func newDatabaseRequest(c *beego.Controller, actionType string) monitor.PatchRequest {
+	req := monitor.PatchRequest{
+		Action:       monitor.PatchAction(actionType),
+		Params:       make(map[string]string),
+		Operator:     c.Ctx.Input.IP(),
+		Role:         consoleRole(c.Ctx),
+		ResponseChan: make(chan monitor.PatchResponse),
+	}
+	for _, key := range databaseParams {
+		if value := c.GetString(key); value != "" {
+			req.Params[key] = value
+		}
+	}
+	return req
+}
+
+func databaseAction(action monitor.PatchAction) bool {
+	return action == monitor.ActionCreateDatabase || action == monitor.ActionRotateDBUser ||
+		action == monitor.ActionDropDBUser || action == monitor.ActionSetQuota
+}
+
+// Config shows the effective configuration of monitord
+func (c *MainController) Config() {
+	c.Data["prevAddr"] = "#"
+	c.Data["menu"] = "config"
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetAllOverview,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	resp := <-getReq.ResponseChan
+	if resp.Err != nil {
+		c.handleError("Get servers list error", resp.Err.Error(), resp.Code)
+	} else {
+		var insts []monitor.InstanceView
+		json.Unmarshal(resp.Data, &insts)
+		cfg := monitor.CurrentConfig()
+		c.Data["Instances"] = insts
+		c.Data["ConfigFile"] = cfg.FileName()
+		c.Data["ConfigItems"] = cfg.Items()
+		c.Data["Credentials"] = monitor.CredentialStatus()
+		c.Layout = "frame.html"
+		c.TplNames = "config.html"
+	}
+}
+
+// Simulator shows the simulated cluster and the failure scenarios in simulate mode
+func (c *MainController) Simulator() {
+	c.Data["prevAddr"] = "#"
+	c.Data["menu"] = "simulator"
+	sim := simulator.Current()
+	if sim == nil {
+		c.handleError("Simulator error", "monitord is not running with -simulate", http.StatusNotFound)
+		return
+	}
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetAllOverview,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	resp := <-getReq.ResponseChan
+	if resp.Err != nil {
+		c.handleError("Get servers list error", resp.Err.Error(), resp.Code)
+	} else {
+		var insts []monitor.InstanceView
+		json.Unmarshal(resp.Data, &insts)
+		c.Data["Instances"] = insts
+		c.Data["SimulatedInstances"] = sim.Instances()
+		c.Data["Scenarios"] = simulator.Scenarios
+		c.Data["Events"] = sim.Events()
+		c.Layout = "frame.html"
+		c.TplNames = "simulator.html"
+	}
+}
+
+// Simulate applies a failure scenario to the simulated cluster
+func (c *MainController) Simulate() {
+	sim := simulator.Current()
+	if sim == nil {
+		c.handleError("Simulator error", "monitord is not running with -simulate", http.StatusNotFound)
+		return
+	}
+	scenario := c.GetString("scenario")
+	endpoint := c.GetString("endpoint")
+	if err := sim.Apply(simulator.Scenario(scenario), endpoint); err != nil {
+		c.handleError(fmt.Sprintf("Simulate %s error", scenario), err.Error(), http.StatusBadRequest)
+	} else {
+		c.Redirect("/simulator", http.StatusFound)
+	}
+}
+
+// Simulating is the template function telling whether monitord runs with -simulate
+func Simulating() bool {
+	return simulator.Current() != nil
+}
+
 func (c *MainController) Details() {
 	endpoint := net.JoinHostPort(c.GetString("host"), c.GetString("port"))
 	c.Data["prevAddr"] = endpoint
@@ -45,25 +231,104 @@ func (c *MainController) Details() {
 	}
 	monitor.Get(getReq)
 	singleResp := <-getReq.ResponseChan
+	getReq.RequestType = monitor.GetInnoDB
+	monitor.Get(getReq)
+	innodbResp := <-getReq.ResponseChan
 	getReq.RequestType = monitor.GetAllOverview
 	monitor.Get(getReq)
 	allResp := <-getReq.ResponseChan
 	if singleResp.Err != nil {
 		c.handleError(fmt.Sprintf("Get details of %s error", endpoint), singleResp.Err.Error(), singleResp.Code)
+	} else if innodbResp.Err != nil {
+		c.handleError(fmt.Sprintf("Get InnoDB status of %s error", endpoint), innodbResp.Err.Error(), innodbResp.Code)
 	} else if allResp.Err != nil {
 		c.handleError("Get servers list error", allResp.Err.Error(), allResp.Code)
 	} else {
 		var inst monitor.InstanceView
+		var innodbView monitor.InnoDBView
 		var insts []monitor.InstanceView
 		json.Unmarshal(singleResp.Data, &inst)
+		json.Unmarshal(innodbResp.Data, &innodbView)
 		json.Unmarshal(allResp.Data, &insts)
 		c.Data["Instance"] = inst
+		c.Data["InnoDB"] = innodbView
 		c.Data["Instances"] = insts
+		c.Data["MetricsRanges"] = monitor.MetricsRanges
 		c.TplNames = "details.html"
 		c.Layout = "frame.html"
 	}
 }
 
+// SlowQueries shows the top slow queries of the instance aggregated by their fingerprints
+func (c *MainController) SlowQueries() {
+	endpoint := net.JoinHostPort(c.GetString("host"), c.GetString("port"))
+	c.Data["prevAddr"] = endpoint
+	c.Data["menu"] = "slowlog"
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetSlowQueries,
+		Params:       map[string]string{"endpoint": endpoint, "top": c.GetString("top"), "order": c.GetString("order")},
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	slowResp := <-getReq.ResponseChan
+	getReq.RequestType = monitor.GetAllOverview
+	monitor.Get(getReq)
+	allResp := <-getReq.ResponseChan
+	if slowResp.Err != nil {
+		c.handleError(fmt.Sprintf("Get slow queries of %s error", endpoint), slowResp.Err.Error(), slowResp.Code)
+	} else if allResp.Err != nil {
+		c.handleError("Get servers list error", allResp.Err.Error(), allResp.Code)
+	} else {
+		var report agent.SlowLogReport
+		var insts []monitor.InstanceView
+		json.Unmarshal(slowResp.Data, &report)
+		json.Unmarshal(allResp.Data, &insts)
+		c.Data["Host"], c.Data["Port"] = c.GetString("host"), c.GetString("port")
+		c.Data["Report"] = report
+		c.Data["Orders"] = slowlog.SortOrders
+		c.Data["Instances"] = insts
+		c.TplNames = "slowlog.html"
+		c.Layout = "frame.html"
+	}
+}
+
+func (c *MainController) Repair() {
+	endpoint := net.JoinHostPort(c.GetString("host"), c.GetString("port"))
+	c.Data["prevAddr"] = endpoint
+	c.Data["menu"] = "details"
+	getReq := monitor.GetRequest{
+		RequestType:  monitor.GetRepairPlan,
+		Params:       map[string]string{"endpoint": endpoint},
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(getReq)
+	repairResp := <-getReq.ResponseChan
+	getReq.RequestType = monitor.GetAllOverview
+	monitor.Get(getReq)
+	allResp := <-getReq.ResponseChan
+	if repairResp.Err != nil {
+		c.handleError(fmt.Sprintf("Get repair plan of %s error", endpoint), repairResp.Err.Error(), repairResp.Code)
+	} else if allResp.Err != nil {
+		c.handleError("Get servers list error", allResp.Err.Error(), allResp.Code)
+	} else {
+		var repair monitor.RepairView
+		var insts []monitor.InstanceView
+		json.Unmarshal(repairResp.Data, &repair)
+		json.Unmarshal(allResp.Data, &insts)
+		c.Data["Repair"] = repair
+		c.Data["Instances"] = insts
+		c.TplNames = "repair.html"
+		c.Layout = "frame.html"
+	}
+}
+
+// actionParams are the parameters of actions, gtid for skip and the others for the kill actions
+var actionParams = []string{"gtid", "id", "user", "client", "db", "command", "min_time", "mode"}
+
+func killAction(action monitor.PatchAction) bool {
+	return action == monitor.ActionKillQuery || action == monitor.ActionKillConnection || action == monitor.ActionKillSessions
+}
+
 func (c *MainController) Action() {
 	endpoint := net.JoinHostPort(c.GetString("host"), c.GetString("port"))
 	actionType := c.GetString("type")
@@ -71,12 +336,22 @@ func (c *MainController) Action() {
 	patchReq := monitor.PatchRequest{
 		Action:       monitor.PatchAction(actionType),
 		Endpoint:     endpoint,
+		Params:       make(map[string]string),
+		Operator:     c.Ctx.Input.IP(),
+		Role:         consoleRole(c.Ctx),
 		ResponseChan: make(chan monitor.PatchResponse),
 	}
+	for _, key := range actionParams {
+		if value := c.GetString(key); value != "" {
+			patchReq.Params[key] = value
+		}
+	}
 	monitor.Patch(patchReq)
 	patchResp := <-patchReq.ResponseChan
 	if patchResp.Err != nil {
 		c.handleError(fmt.Sprintf("%s on %s error", actionType, endpoint), patchResp.Err.Error(), patchResp.Code)
+	} else if killAction(patchReq.Action) {
+		c.Redirect(fmt.Sprintf("/details?host=%s&port=%s", c.GetString("host"), c.GetString("port")), http.StatusFound)
 	} else {
 		c.Redirect("/", http.StatusFound)
 	}
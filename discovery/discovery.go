@@ -0,0 +1,112 @@
+// Package discovery finds the mysql-server instances managed by monitor and the monitor watched by proxies.
+// Besides lainlet, the instances can be listed in a static file or DNS SRV records,
+// so that the service can run outside LAIN.
+package discovery
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Discovery finds the endpoints of mysql-server instances and monitor
+type Discovery interface {
+	// WatchInstances sends the sorted endpoints ("host:port") of mysql-server instances each time they change,
+	// until ctx is done. Errors are logged and retried by the implementation.
+	WatchInstances(ctx context.Context) <-chan []string
+	// MonitorAddr returns the address of the SSE server of monitor, e.g. "web-1:6033"
+	MonitorAddr() (string, error)
+}
+
+const (
+	BackendLainlet = "lainlet"
+	BackendStatic  = "static"
+	BackendDNS     = "dns"
+
+	// CooldownTime is the interval between two polls or reconnections
+	CooldownTime = 3 * time.Second
+)
+
+var (
+	backend     = flag.String("discovery", BackendLainlet, "The service discovery backend (lainlet|static|dns)")
+	monitorAddr = flag.String("discovery-monitor", "web-1:6033", "The address of monitor for lainlet discovery")
+	staticFile  = flag.String("discovery-file", "conf/discovery.conf", "The instance list file for static discovery")
+	instanceSRV = flag.String("discovery-srv", "", "The SRV name of mysql-server instances for dns discovery, e.g. _mysql._tcp.mysql.example.com")
+	monitorSRV  = flag.String("discovery-monitor-srv", "", "The SRV name of monitor for dns discovery, e.g. _monitor._tcp.mysql.example.com")
+)
+
+// FromFlags creates the Discovery selected by the command line flags
+func FromFlags() (Discovery, error) {
+	switch *backend {
+	case BackendLainlet:
+		return NewLainlet(net.JoinHostPort("lainlet.lain", os.Getenv("LAINLET_PORT")), os.Getenv("LAIN_APPNAME"), "mysql-server", *monitorAddr), nil
+	case BackendStatic:
+		return NewStatic(*staticFile), nil
+	case BackendDNS:
+		if *instanceSRV == "" || *monitorSRV == "" {
+			return nil, fmt.Errorf("-discovery-srv and -discovery-monitor-srv are required for dns discovery")
+		}
+		return NewDNS(*instanceSRV, *monitorSRV), nil
+	}
+	return nil, fmt.Errorf("Unknown discovery backend %s", *backend)
+}
+
+// poll calls list every CooldownTime and sends the endpoints to the returned channel when they change
+func poll(ctx context.Context, name string, list func() ([]string, error)) <-chan []string {
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		var prev []string
+		sent := false
+		for {
+			endpoints, err := list()
+			if err != nil {
+				glog.Errorf("%s discovery failed: %s", name, err.Error())
+			} else {
+				sort.Strings(endpoints)
+				if !sent || !reflect.DeepEqual(prev, endpoints) {
+					select {
+					case ch <- endpoints:
+						prev, sent = endpoints, true
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-time.After(CooldownTime):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// AppResolver resolves the container IPs of a LAIN app, which is implemented by the backends knowing the apps
+type AppResolver interface {
+	ResolveApp(appName string) ([]string, error)
+}
+
+// ResolveApp returns the sorted IPs of appName by disc if it's an AppResolver, otherwise looks up appName in DNS
+func ResolveApp(disc Discovery, appName string) ([]string, error) {
+	var ips []string
+	var err error
+	if resolver, ok := disc.(AppResolver); ok {
+		ips, err = resolver.ResolveApp(appName)
+	} else {
+		ips, err = net.LookupHost(appName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/fake"
+	"golang.org/x/net/context"
+)
+
+// receive waits for the next endpoints from ch
+func receive(t *testing.T, ch <-chan []string) []string {
+	t.Helper()
+	select {
+	case endpoints, ok := <-ch:
+		if !ok {
+			t.Fatal("Watching is stopped")
+		}
+		return endpoints
+	case <-time.After(3 * CooldownTime):
+		t.Fatal("No endpoints are received")
+	}
+	return nil
+}
+
+func TestLainlet(t *testing.T) {
+	lainlet, err := fake.NewLainlet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lainlet.Close()
+	lainlet.SetInstances("mysql-server", 3306, 3306)
+	lainlet.SetInstances("web", 6033)
+
+	disc := NewLainlet(lainlet.Addr(), "mysql", "mysql-server", "web-1:6033")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := disc.WatchInstances(ctx)
+	if endpoints := receive(t, ch); !reflect.DeepEqual(endpoints, []string{"mysql-server-1:3306", "mysql-server-2:3306"}) {
+		t.Errorf("Unexpected endpoints %v", endpoints)
+	}
+
+	lainlet.SetInstances("mysql-server", 3306, 3306, 3306)
+	if endpoints := receive(t, ch); len(endpoints) != 3 || endpoints[2] != "mysql-server-3:3306" {
+		t.Errorf("Unexpected endpoints after scaling %v", endpoints)
+	}
+	if addr, _ := disc.MonitorAddr(); addr != "web-1:6033" {
+		t.Errorf("Unexpected monitor %s", addr)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "discovery.conf")
+	content := "# comment\ninstance=10.0.0.2:3306\ninstance=10.0.0.1:3306\nmonitor=10.0.0.9:6033\n"
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disc := NewStatic(fileName)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if endpoints := receive(t, disc.WatchInstances(ctx)); !reflect.DeepEqual(endpoints, []string{"10.0.0.1:3306", "10.0.0.2:3306"}) {
+		t.Errorf("Unexpected endpoints %v", endpoints)
+	}
+	if addr, err := disc.MonitorAddr(); err != nil || addr != "10.0.0.9:6033" {
+		t.Errorf("Unexpected monitor %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// DNS looks up the endpoints from DNS SRV records, e.g. the services registered in consul
+type DNS struct {
+	instanceSRV string
+	monitorSRV  string
+}
+
+// NewDNS creates a DNS looking up instanceSRV for mysql-server instances and monitorSRV for monitor
+func NewDNS(instanceSRV, monitorSRV string) *DNS {
+	return &DNS{instanceSRV: instanceSRV, monitorSRV: monitorSRV}
+}
+
+// WatchInstances implements Discovery
+func (d *DNS) WatchInstances(ctx context.Context) <-chan []string {
+	return poll(ctx, "dns", func() ([]string, error) {
+		return lookupSRV(d.instanceSRV)
+	})
+}
+
+// MonitorAddr implements Discovery
+func (d *DNS) MonitorAddr() (string, error) {
+	endpoints, err := lookupSRV(d.monitorSRV)
+	if err != nil {
+		return "", err
+	}
+	return endpoints[0], nil
+}
+
+// lookupSRV returns the endpoints of the SRV records of name, ordered by priority and weight
+func lookupSRV(name string) ([]string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No SRV record of %s", name)
+	}
+	endpoints := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port))))
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/lainlet/client"
+	"golang.org/x/net/context"
+)
+
+type procInstance struct {
+	InstanceNo int    `json:"InstanceNo"`
+	Port       int    `json:"Port"`
+	ProcName   string `json:"ProcName"`
+}
+
+type appProcs struct {
+	Procs []procInstance `json:"proc"`
+}
+
+// coreInfo is the pods of a proc returned by the coreinfowatcher API of lainlet
+type coreInfo struct {
+	PodInfos []struct {
+		Containers []struct {
+			IP string `json:"ContainerIp"`
+		} `json:"ContainerInfos"`
+	}
+}
+
+// Lainlet watches the instances of a proc from the procwatcher API of lainlet.
+// The endpoints are in the format "proc-N:port", which are resolved by the DNS of LAIN.
+type Lainlet struct {
+	client      *client.Client
+	watchURL    string
+	procName    string
+	monitorAddr string
+}
+
+// NewLainlet creates a Lainlet watching procName of appName from lainlet at addr
+func NewLainlet(addr, appName, procName, monitorAddr string) *Lainlet {
+	return &Lainlet{
+		client:      client.New(addr),
+		watchURL:    fmt.Sprintf("/v2/procwatcher?appname=%s", appName),
+		procName:    procName,
+		monitorAddr: monitorAddr,
+	}
+}
+
+// WatchInstances implements Discovery
+func (l *Lainlet) WatchInstances(ctx context.Context) <-chan []string {
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		var endpointList []string
+		sent := false
+		for ctx.Err() == nil {
+			ch, err := l.client.Watch(l.watchURL, ctx)
+			if err != nil {
+				glog.Errorf("Watch lainlet failed: %s", err.Error())
+				time.Sleep(CooldownTime)
+				continue
+			}
+			for event := range ch {
+				var procs []appProcs
+				if err := json.Unmarshal(event.Data, &procs); err != nil {
+					glog.Errorf("Unmarshal event error: %s", err.Error())
+					time.Sleep(CooldownTime)
+					continue
+				}
+				var tmpList []string
+				for _, proc := range procs {
+					for _, instance := range proc.Procs {
+						if instance.ProcName == l.procName {
+							tmpList = append(tmpList, fmt.Sprintf("%s-%d:%d", instance.ProcName, instance.InstanceNo, instance.Port))
+						}
+					}
+				}
+				sort.Strings(tmpList)
+				if !sent || !reflect.DeepEqual(tmpList, endpointList) {
+					select {
+					case out <- tmpList:
+						endpointList, sent = tmpList, true
+					case <-ctx.Done():
+						return
+					}
+				}
+				time.Sleep(CooldownTime)
+			}
+			time.Sleep(CooldownTime)
+		}
+	}()
+	return out
+}
+
+// MonitorAddr implements Discovery. The monitor is the web proc of the same app.
+func (l *Lainlet) MonitorAddr() (string, error) {
+	return l.monitorAddr, nil
+}
+
+// ResolveApp implements AppResolver by the coreinfowatcher API of lainlet, returning the IPs of the containers
+// of all the procs of appName
+func (l *Lainlet) ResolveApp(appName string) ([]string, error) {
+	data, err := l.client.Get("/v2/coreinfowatcher?appname="+url.QueryEscape(appName), 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var procs map[string]coreInfo
+	if err = json.Unmarshal(data, &procs); err != nil {
+		return nil, fmt.Errorf("Unmarshal coreinfo of %s error: %s", appName, err.Error())
+	}
+	var ips []string
+	for _, proc := range procs {
+		for _, pod := range proc.PodInfos {
+			for _, container := range pod.Containers {
+				if container.IP != "" {
+					ips = append(ips, container.IP)
+				}
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No container of app %s is found", appName)
+	}
+	return ips, nil
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Memory keeps the endpoints in memory, which are changed by Update.
+// It is used by tests and the simulator.
+type Memory struct {
+	sync.Mutex
+	monitorAddr string
+	watchers    []memoryWatcher
+	// endpoints is the last update, sent to the new watchers first
+	endpoints []string
+	updated   bool
+}
+
+type memoryWatcher struct {
+	ctx context.Context
+	ch  chan []string
+}
+
+// NewMemory creates a Memory with the address of monitor
+func NewMemory(monitorAddr string) *Memory {
+	return &Memory{monitorAddr: monitorAddr}
+}
+
+// Update sends endpoints to all the watchers
+func (m *Memory) Update(endpoints []string) {
+	endpoints = append([]string(nil), endpoints...)
+	sort.Strings(endpoints)
+	m.Lock()
+	watchers := m.watchers
+	m.endpoints, m.updated = endpoints, true
+	m.Unlock()
+	for _, w := range watchers {
+		select {
+		case w.ch <- endpoints:
+		case <-w.ctx.Done():
+		}
+	}
+}
+
+// Endpoints returns the endpoints of the last update
+func (m *Memory) Endpoints() []string {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string(nil), m.endpoints...)
+}
+
+// WatchInstances implements Discovery. The watcher receives the last update first if there is one,
+// and must keep receiving until ctx is done.
+func (m *Memory) WatchInstances(ctx context.Context) <-chan []string {
+	in := make(chan []string)
+	out := make(chan []string)
+	m.Lock()
+	m.watchers = append(m.watchers, memoryWatcher{ctx: ctx, ch: in})
+	last, updated := m.endpoints, m.updated
+	m.Unlock()
+	go func() {
+		defer close(out)
+		if updated {
+			select {
+			case out <- last:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case endpoints := <-in:
+				select {
+				case out <- endpoints:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// MonitorAddr implements Discovery
+func (m *Memory) MonitorAddr() (string, error) {
+	return m.monitorAddr, nil
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Static reads the endpoints from a file, which is reloaded when it changes.
+// Each line of the file is "instance=host:port" or "monitor=host:port", and lines starting with # are ignored:
+//
+//	instance=10.0.0.1:3306
+//	instance=10.0.0.2:3306
+//	monitor=10.0.0.9:6033
+type Static struct {
+	fileName string
+}
+
+// NewStatic creates a Static reading fileName
+func NewStatic(fileName string) *Static {
+	return &Static{fileName: fileName}
+}
+
+// WatchInstances implements Discovery
+func (s *Static) WatchInstances(ctx context.Context) <-chan []string {
+	return poll(ctx, "static", func() ([]string, error) {
+		conf, err := s.read()
+		return conf["instance"], err
+	})
+}
+
+// MonitorAddr implements Discovery
+func (s *Static) MonitorAddr() (string, error) {
+	conf, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	if len(conf["monitor"]) == 0 {
+		return "", fmt.Errorf("No monitor is configured in %s", s.fileName)
+	}
+	return conf["monitor"][0], nil
+}
+
+func (s *Static) read() (map[string][]string, error) {
+	conf := make(map[string][]string)
+	file, err := os.Open(s.fileName)
+	if err != nil {
+		return conf, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return conf, fmt.Errorf("invalid line %q in %s", line, s.fileName)
+		}
+		key := strings.TrimSpace(kv[0])
+		conf[key] = append(conf[key], strings.TrimSpace(kv[1]))
+	}
+	return conf, scanner.Err()
+}
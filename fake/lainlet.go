@@ -0,0 +1,219 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+type lainletProc struct {
+	InstanceNo int    `json:"InstanceNo"`
+	Port       int    `json:"Port"`
+	ProcName   string `json:"ProcName"`
+}
+
+type lainletProcGroup struct {
+	ProcName string        `json:"ProcName"`
+	Procs    []lainletProc `json:"proc"`
+}
+
+// Lainlet is a fake lainlet listening on 127.0.0.1, which serves /v2/procwatcher, /v2/configwatcher and
+// /v2/coreinfowatcher. The procwatcher pushes an update event to the watchers each time the instances are changed.
+type Lainlet struct {
+	mu       sync.Mutex
+	listener net.Listener
+	procs    map[string][]int
+	config   map[string]string
+	apps     map[string][]string
+	eventID  int64
+	watchers map[chan []byte]struct{}
+}
+
+// NewLainlet starts a fake lainlet on a random port of 127.0.0.1
+func NewLainlet() (*Lainlet, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &Lainlet{
+		listener: listener,
+		procs:    make(map[string][]int),
+		config:   make(map[string]string),
+		apps:     make(map[string][]string),
+		watchers: make(map[chan []byte]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/procwatcher", l.serveProcWatcher)
+	mux.HandleFunc("/v2/configwatcher", l.serveConfigWatcher)
+	mux.HandleFunc("/v2/coreinfowatcher", l.serveCoreInfoWatcher)
+	go http.Serve(listener, mux)
+	return l, nil
+}
+
+// Addr returns the address of lainlet, in the format "127.0.0.1:port"
+func (l *Lainlet) Addr() string {
+	return l.listener.Addr().String()
+}
+
+// Close stops lainlet and ends the watches
+func (l *Lainlet) Close() {
+	l.listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.watchers {
+		close(ch)
+		delete(l.watchers, ch)
+	}
+}
+
+// SetInstances sets the ports of the instances of procName, the i-th port for instance i+1.
+// No ports removes the proc.
+func (l *Lainlet) SetInstances(procName string, ports ...int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(ports) == 0 {
+		delete(l.procs, procName)
+	} else {
+		l.procs[procName] = append([]int(nil), ports...)
+	}
+	data := l.procData()
+	for ch := range l.watchers {
+		select {
+		case ch <- data:
+		default:
+			// The watcher is slow, it reads the latest data later
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- data
+		}
+	}
+}
+
+// SetConfig sets a config item served by /v2/configwatcher, e.g. "features/graphite"
+func (l *Lainlet) SetConfig(key, value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config[key] = value
+}
+
+// SetContainers sets the container IPs of the web proc of appName served by /v2/coreinfowatcher.
+// No IPs removes the app.
+func (l *Lainlet) SetContainers(appName string, ips ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(ips) == 0 {
+		delete(l.apps, appName)
+	} else {
+		l.apps[appName] = append([]string(nil), ips...)
+	}
+}
+
+// procData returns the JSON of the procs. The caller must hold the lock.
+func (l *Lainlet) procData() []byte {
+	names := make([]string, 0, len(l.procs))
+	for name := range l.procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]lainletProcGroup, 0, len(names))
+	for _, name := range names {
+		group := lainletProcGroup{ProcName: name}
+		for i, port := range l.procs[name] {
+			group.Procs = append(group.Procs, lainletProc{InstanceNo: i + 1, Port: port, ProcName: name})
+		}
+		groups = append(groups, group)
+	}
+	data, _ := json.Marshal(groups)
+	return data
+}
+
+func (l *Lainlet) serveProcWatcher(rw http.ResponseWriter, req *http.Request) {
+	l.mu.Lock()
+	data := l.procData()
+	l.mu.Unlock()
+	if req.URL.Query().Get("watch") != "1" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(data)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 1)
+	l.mu.Lock()
+	l.watchers[ch] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.watchers, ch)
+		l.mu.Unlock()
+	}()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	event := "init"
+	for {
+		l.mu.Lock()
+		l.eventID++
+		id := l.eventID
+		l.mu.Unlock()
+		if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		event = "update"
+		select {
+		case newData, ok := <-ch:
+			if !ok {
+				return
+			}
+			data = newData
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (l *Lainlet) serveConfigWatcher(rw http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("target")
+	l.mu.Lock()
+	result := make(map[string]string)
+	for k, v := range l.config {
+		if key == "" || k == key {
+			result[k] = v
+		}
+	}
+	l.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+func (l *Lainlet) serveCoreInfoWatcher(rw http.ResponseWriter, req *http.Request) {
+	type container struct {
+		ContainerIp string
+	}
+	type pod struct {
+		InstanceNo int
+		Containers []container `json:"ContainerInfos"`
+	}
+	appName := req.URL.Query().Get("appname")
+	result := make(map[string]map[string][]pod)
+	l.mu.Lock()
+	if ips, exist := l.apps[appName]; exist {
+		var pods []pod
+		for i, ip := range ips {
+			pods = append(pods, pod{InstanceNo: i + 1, Containers: []container{{ContainerIp: ip}}})
+		}
+		result[appName+".web.web"] = map[string][]pod{"PodInfos": pods}
+	}
+	l.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
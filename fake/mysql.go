@@ -0,0 +1,1670 @@
+// Package fake provides in-process fakes of MySQL, lainlet and SMTP, so that monitor and proxy
+// can be exercised end-to-end by tests and the simulator without real servers.
+package fake
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/mysql-service/gtid"
+)
+
+// The packet types and commands of the MySQL client/server protocol
+const (
+	comQuit   = 0x01
+	comInitDB = 0x02
+	comQuery  = 0x03
+	comPing   = 0x0e
+
+	iOK  = 0x00
+	iEOF = 0xfe
+	iERR = 0xff
+
+	protocolVersion   = 10
+	clientProtocol41  = 0x00000200
+	clientSecureConn  = 0x00008000
+	clientLongPass    = 0x00000001
+	clientLongFlag    = 0x00000004
+	clientTransaction = 0x00002000
+	clientPluginAuth  = 0x00080000
+	clientSSL         = 0x00000800
+	serverCapability  = clientLongPass | clientLongFlag | clientProtocol41 | clientTransaction | clientSecureConn | clientPluginAuth
+	statusAutocommit  = 0x0002
+	charsetUTF8       = 33
+	fieldTypeString   = 0xfd
+	maxPacketSize     = 1<<24 - 1
+	binlogStartPos    = 154
+	transactionSize   = 300
+	fakeServerVersion = "5.7.17-fake"
+)
+
+// The MySQL errors returned by the fake server
+const (
+	ErrUnknownCommand = 1047
+	ErrAccessDenied   = 1045
+	ErrSyntax         = 1064
+	ErrDBCreateExists = 1007
+	ErrCannotUser     = 1396
+	ErrNoSuchUser     = 1133
+	ErrNoSuchGrant    = 1141
+	ErrUnknownThread  = 1094
+	ErrSlaveRunning   = 1198
+	ErrNotSlave       = 1200
+	ErrInjected       = 1105
+	ErrMasterConnect  = 2003
+)
+
+var (
+	registry = struct {
+		sync.Mutex
+		servers map[string]*MySQL
+	}{servers: make(map[string]*MySQL)}
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`, "*", `\*`, "+", `\+`, "?", `\?`, "(", `\(`, ")", `\)`,
+		"[", `\[`, "]", `\]`, "{", `\{`, "}", `\}`, "|", `\|`, "^", `\^`, "$", `\$`, "%", ".*", "_", ".")
+)
+
+// replica is the replication configured by CHANGE MASTER TO
+type replica struct {
+	host         string
+	port         int
+	user         string
+	password     string
+	autoPosition bool
+	ioRunning    bool
+	sqlRunning   bool
+	ioConnected  bool
+	ioErrno      int
+	retrieved    gtid.Set
+	readFile     string
+	readPos      int
+	execFile     string
+	execPos      int
+	lag          int
+	sqlErrno     int
+	sqlError     string
+	failedGTID   string
+	// breakErrno and breakError are the error of the next transaction set by BreakReplication
+	breakErrno int
+	breakError string
+}
+
+// process is a row of SHOW PROCESSLIST, which is a client connection or one added by AddProcess
+type process struct {
+	id      int
+	user    string
+	host    string
+	db      string
+	command string
+	info    string
+	started time.Time
+	conn    net.Conn
+}
+
+// MySQL is a fake MySQL server listening on 127.0.0.1, which speaks enough of the protocol
+// for go-sql-driver and answers the statements issued by msops and monitor from a scriptable state.
+// Replication between fake servers is simulated: a replica applies the transactions of its source
+// each time its slave status is read.
+type MySQL struct {
+	mu           sync.Mutex
+	listener     net.Listener
+	addr         string
+	uuid         string
+	binlogSeq    int
+	binlogPos    int
+	executed     gtid.Set
+	variables    map[string]string
+	status       map[string]string
+	innodbStatus string
+	users        map[string]string
+	databases    map[string]int64
+	hosts        map[string]string
+	grants       map[string][]string
+	privileges   map[string]map[string]bool
+	global       map[string]globalPrivileges
+	limits       map[string]int
+	replica      *replica
+	processes    map[int]*process
+	nextID       int
+	statements   []string
+	failures     map[string]string
+	tlsConfig    *tls.Config
+	tlsSessions  int
+	denied       int
+	down         bool
+	partitioned  bool
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// NewMySQL starts a fake MySQL server on a random port of 127.0.0.1
+func NewMySQL() (*MySQL, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	m := &MySQL{
+		listener:   listener,
+		addr:       listener.Addr().String(),
+		uuid:       uuid,
+		binlogSeq:  1,
+		binlogPos:  binlogStartPos,
+		executed:   make(gtid.Set),
+		status:     make(map[string]string),
+		users:      make(map[string]string),
+		databases:  map[string]int64{"information_schema": 0, "mysql": 0, "performance_schema": 0, "sys": 0},
+		hosts:      make(map[string]string),
+		grants:     make(map[string][]string),
+		privileges: make(map[string]map[string]bool),
+		global:     make(map[string]globalPrivileges),
+		limits:     make(map[string]int),
+		processes:  make(map[int]*process),
+		nextID:     1,
+		failures:   make(map[string]string),
+	}
+	_, port, _ := net.SplitHostPort(m.addr)
+	m.variables = map[string]string{
+		"server_uuid":        uuid,
+		"server_id":          port,
+		"port":               port,
+		"version":            fakeServerVersion,
+		"read_only":          "OFF",
+		"super_read_only":    "OFF",
+		"gtid_mode":          "ON",
+		"log_bin":            "ON",
+		"log_slave_updates":  "ON",
+		"max_connections":    "151",
+		"max_allowed_packet": "4194304",
+	}
+	registry.Lock()
+	registry.servers[m.addr] = m
+	registry.Unlock()
+	m.wg.Add(1)
+	go m.serve()
+	return m, nil
+}
+
+// Addr returns the endpoint of the server, in the format "127.0.0.1:port"
+func (m *MySQL) Addr() string {
+	return m.addr
+}
+
+// UUID returns the server_uuid of the server
+func (m *MySQL) UUID() string {
+	return m.uuid
+}
+
+// Close stops the server and closes all the connections
+func (m *MySQL) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.closeConnsLocked()
+	m.mu.Unlock()
+	registry.Lock()
+	delete(registry.servers, m.addr)
+	registry.Unlock()
+	m.listener.Close()
+	m.wg.Wait()
+}
+
+// SetDown makes the server unreachable or reachable again. The connections are closed
+// when the server goes down, and the new ones are closed right after being accepted.
+func (m *MySQL) SetDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+	if down {
+		m.closeConnsLocked()
+	}
+}
+
+// Down reports whether the server is set down
+func (m *MySQL) Down() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.down
+}
+
+// SetPartitioned cuts the server off from its clients like SetDown, but the replicas of the server
+// keep replicating from it, like a network partition between the server and the monitor.
+func (m *MySQL) SetPartitioned(partitioned bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partitioned = partitioned
+	if partitioned {
+		m.closeConnsLocked()
+	}
+}
+
+// Partitioned reports whether the server is partitioned from its clients
+func (m *MySQL) Partitioned() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.partitioned
+}
+
+// Commit executes n transactions, which advance the binlog position and executed GTID set
+func (m *MySQL) Commit(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n <= 0 {
+		return
+	}
+	last := m.executed.Last(m.uuid)
+	m.executed = union(m.executed, gtid.Set{m.uuid: {{Start: last + 1, End: last + int64(n)}}})
+	m.binlogPos += n * transactionSize
+}
+
+// DeniedLogins returns the number of the logins denied by a wrong password
+func (m *MySQL) DeniedLogins() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.denied
+}
+
+// ExecutedGTIDSet returns gtid_executed of the server
+func (m *MySQL) ExecutedGTIDSet() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.executed.String()
+}
+
+// SetVariable sets a global variable shown by SHOW GLOBAL VARIABLES
+func (m *MySQL) SetVariable(name, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.variables[strings.ToLower(name)] = value
+}
+
+// Variable returns the value of a global variable
+func (m *MySQL) Variable(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.variables[strings.ToLower(name)]
+}
+
+// SetStatus sets a global status shown by SHOW GLOBAL STATUS, which overrides the computed ones
+// like Threads_connected and Questions
+func (m *MySQL) SetStatus(name, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status[name] = value
+}
+
+// SetInnoDBStatus sets the text returned by SHOW ENGINE INNODB STATUS
+func (m *MySQL) SetInnoDBStatus(text string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.innodbStatus = text
+}
+
+// SetPassword makes the server check the password of user. The users without a password
+// set are accepted with any password. Passwords are replicated to the replicas.
+func (m *MySQL) SetPassword(user, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user] = password
+}
+
+// SetDatabaseSize creates the database if it doesn't exist, and sets the size of its tables in bytes
+func (m *MySQL) SetDatabaseSize(name string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.databases[name] = size
+}
+
+// Database returns the size of the database, and whether it exists
+func (m *MySQL) Database(name string) (int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size, exist := m.databases[name]
+	return size, exist
+}
+
+// Account returns the password of user and the databases granted to user, and whether user exists
+func (m *MySQL) Account(user string) (password string, databases []string, exist bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	password, exist = m.users[user]
+	return password, append([]string(nil), m.grants[user]...), exist
+}
+
+// SetHost changes the host of the account of user, which is '%' if it's created by CREATE USER '...'@'%'
+func (m *MySQL) SetHost(user, host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[user] = host
+}
+
+// globalPrivileges are the privileges of a user ON *.*
+type globalPrivileges struct {
+	privileges []string
+	grantable  bool
+}
+
+// SetGlobalPrivileges sets the privileges of user ON *.*, which are shown in
+// information_schema.USER_PRIVILEGES. The users not set have all the privileges WITH GRANT OPTION.
+func (m *MySQL) SetGlobalPrivileges(user string, grantable bool, privileges ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.global[user] = globalPrivileges{privileges: privileges, grantable: grantable}
+}
+
+// Privileges returns the sorted privileges of user on the database, as it's written in GRANT
+func (m *MySQL) Privileges(user, database string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var privileges []string
+	for privilege := range m.privileges[user+"@"+database] {
+		privileges = append(privileges, privilege)
+	}
+	sort.Strings(privileges)
+	return privileges
+}
+
+// MaxUserConnections returns MAX_USER_CONNECTIONS of user, 0 for unlimited
+func (m *MySQL) MaxUserConnections(user string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limits[user]
+}
+
+// SetTLS enables SSL of the server with config, or disables it if config is nil
+func (m *MySQL) SetTLS(config *tls.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tlsConfig = config
+}
+
+// TLSSessions returns the number of the connections upgraded to TLS by SSLRequest
+func (m *MySQL) TLSSessions() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tlsSessions
+}
+
+// AddProcess adds a client shown in SHOW PROCESSLIST and returns its id
+func (m *MySQL) AddProcess(user, host, command, info string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addProcessLocked(&process{user: user, host: host, command: command, info: info})
+}
+
+// AddQuery adds a client running the query in db for seconds and returns its id
+func (m *MySQL) AddQuery(user, host, db, info string, seconds int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.addProcessLocked(&process{user: user, host: host, db: db, command: "Query", info: info})
+	m.processes[id].started = time.Now().Add(-time.Duration(seconds) * time.Second)
+	return id
+}
+
+// Process returns the command and the query of the process, and whether it exists
+func (m *MySQL) Process(id int) (command, info string, exist bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, exist := m.processes[id]; exist {
+		return p.command, p.info, true
+	}
+	return "", "", false
+}
+
+// ProcessCount returns the number of processes of user
+func (m *MySQL) ProcessCount(user string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, p := range m.processes {
+		if p.user == user {
+			n++
+		}
+	}
+	return n
+}
+
+// FailOn makes the statements starting with prefix (case insensitive) fail with message.
+// An empty message removes the failure.
+func (m *MySQL) FailOn(prefix, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix = strings.ToUpper(prefix)
+	if message == "" {
+		delete(m.failures, prefix)
+	} else {
+		m.failures[prefix] = message
+	}
+}
+
+// Statements returns the statements received by the server in order
+func (m *MySQL) Statements() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.statements...)
+}
+
+// ResetStatements clears the received statements
+func (m *MySQL) ResetStatements() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statements = nil
+}
+
+// Source returns the endpoint the server replicates from, or "" if it is not a replica
+func (m *MySQL) Source() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replica == nil || m.replica.host == "" {
+		return ""
+	}
+	return net.JoinHostPort(m.replica.host, strconv.Itoa(m.replica.port))
+}
+
+// ReplicateFrom configures and starts the replication from source with GTID auto position,
+// like CHANGE MASTER TO and START SLAVE
+func (m *MySQL) ReplicateFrom(source *MySQL, user, password string) {
+	host, portStr, _ := net.SplitHostPort(source.Addr())
+	port, _ := strconv.Atoi(portStr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replica = &replica{host: host, port: port, user: user, password: password, autoPosition: true,
+		ioRunning: true, sqlRunning: true, retrieved: make(gtid.Set)}
+}
+
+// SetReplicationLag stops the SQL thread from applying new transactions and reports seconds
+// as Seconds_Behind_Master. The replica catches up once the lag is set to 0.
+func (m *MySQL) SetReplicationLag(seconds int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replica != nil {
+		m.replica.lag = seconds
+	}
+}
+
+// ReplicationLag returns the lag set by SetReplicationLag
+func (m *MySQL) ReplicationLag() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replica == nil {
+		return 0
+	}
+	return m.replica.lag
+}
+
+// ReplicationError returns the last error of the SQL thread, or "" if there is none
+func (m *MySQL) ReplicationError() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replica == nil {
+		return ""
+	}
+	return m.replica.sqlError
+}
+
+// BreakReplication makes the SQL thread stop with an error on the next transaction of the source,
+// like a conflicting row. The error is cleared once the failed transaction is skipped by
+// committing an empty transaction with its GTID and the slave is started again.
+func (m *MySQL) BreakReplication(errno int, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replica != nil {
+		m.replica.breakErrno, m.replica.breakError = errno, message
+	}
+}
+
+// replicaSource returns the running source server of the replica, or nil
+func (m *MySQL) replicaSource() *MySQL {
+	source := m.Source()
+	if source == "" {
+		return nil
+	}
+	registry.Lock()
+	s := registry.servers[source]
+	registry.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down || s.closed {
+		return nil
+	}
+	return s
+}
+
+// syncReplica applies the transactions of the source to the replica. The lock of the source
+// and the lock of the replica are never held at the same time, so that two servers replicating
+// from each other don't dead lock.
+func (m *MySQL) syncReplica() {
+	source := m.replicaSource()
+	var (
+		sourceUUID      string
+		executed        gtid.Set
+		file            string
+		pos             int
+		users           map[string]string
+		sourceAvailable = source != nil
+	)
+	if sourceAvailable {
+		source.mu.Lock()
+		sourceUUID = source.uuid
+		executed = union(source.executed)
+		file, pos = source.binlogFile(), source.binlogPos
+		users = make(map[string]string, len(source.users))
+		for user, password := range source.users {
+			users[user] = password
+		}
+		source.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.replica
+	if r == nil {
+		return
+	}
+	r.ioConnected, r.ioErrno = false, 0
+	if !r.ioRunning {
+		return
+	}
+	if !sourceAvailable {
+		r.ioErrno = ErrMasterConnect
+		return
+	}
+	if password, checked := users[r.user]; checked && password != r.password {
+		r.ioErrno = ErrAccessDenied
+		return
+	}
+	r.ioConnected = true
+	r.retrieved, r.readFile, r.readPos = executed, file, pos
+	if !r.sqlRunning || r.lag > 0 {
+		return
+	}
+	if next := m.executed.Last(sourceUUID) + 1; r.breakErrno != 0 && executed.Contains(sourceUUID, next) {
+		r.sqlRunning = false
+		r.sqlErrno, r.sqlError, r.failedGTID = r.breakErrno, r.breakError, fmt.Sprintf("%s:%d", sourceUUID, next)
+		r.breakErrno, r.breakError = 0, ""
+		return
+	}
+	m.executed = union(m.executed, executed)
+	r.execFile, r.execPos = file, pos
+	for user, password := range users {
+		m.users[user] = password
+	}
+}
+
+func (m *MySQL) binlogFile() string {
+	return fmt.Sprintf("mysql-bin.%06d", m.binlogSeq)
+}
+
+func (m *MySQL) addProcessLocked(p *process) int {
+	p.id = m.nextID
+	p.started = time.Now()
+	m.nextID++
+	m.processes[p.id] = p
+	return p.id
+}
+
+func (m *MySQL) closeConnsLocked() {
+	for id, p := range m.processes {
+		if p.conn != nil {
+			p.conn.Close()
+			delete(m.processes, id)
+		}
+	}
+}
+
+func (m *MySQL) serve() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		if m.down || m.partitioned || m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		id := m.addProcessLocked(&process{host: conn.RemoteAddr().String(), command: "Connect", conn: conn})
+		m.mu.Unlock()
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			defer m.disconnect(id, conn)
+			m.handleConn(id, conn)
+		}()
+	}
+}
+
+func (m *MySQL) disconnect(id int, conn net.Conn) {
+	conn.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, exist := m.processes[id]; exist && p.conn == conn {
+		delete(m.processes, id)
+	}
+}
+
+// session is the state of a client connection
+type session struct {
+	conn     *packetConn
+	id       int
+	user     string
+	gtidNext string
+	// noAutoCreateUser is whether NO_AUTO_CREATE_USER is added to sql_mode of the session
+	noAutoCreateUser bool
+}
+
+func (m *MySQL) handleConn(id int, conn net.Conn) {
+	s := &session{conn: newPacketConn(conn), id: id}
+	if err := m.handshake(s, conn); err != nil {
+		return
+	}
+	for {
+		s.conn.seq = 0
+		data, err := s.conn.readPacket()
+		if err != nil || len(data) == 0 {
+			return
+		}
+		switch data[0] {
+		case comQuit:
+			return
+		case comPing, comInitDB:
+			err = s.conn.writeOK(0)
+		case comQuery:
+			err = m.query(s, string(data[1:]))
+		default:
+			err = s.conn.writeError(ErrUnknownCommand, "Unknown command")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *MySQL) handshake(s *session, conn net.Conn) error {
+	cipher := make([]byte, 20)
+	if _, err := rand.Read(cipher); err != nil {
+		return err
+	}
+	for i := range cipher {
+		// printable bytes without NUL, like the scramble of MySQL
+		cipher[i] = cipher[i]%94 + 33
+	}
+	greeting := []byte{protocolVersion}
+	greeting = append(greeting, fakeServerVersion...)
+	greeting = append(greeting, 0)
+	greeting = appendUint32(greeting, uint32(s.id))
+	greeting = append(greeting, cipher[:8]...)
+	greeting = append(greeting, 0)
+	m.mu.Lock()
+	tlsConfig := m.tlsConfig
+	m.mu.Unlock()
+	capability := uint32(serverCapability)
+	if tlsConfig != nil {
+		capability |= clientSSL
+	}
+	greeting = appendUint16(greeting, uint16(capability))
+	greeting = append(greeting, charsetUTF8)
+	greeting = appendUint16(greeting, statusAutocommit)
+	greeting = appendUint16(greeting, uint16(capability>>16))
+	greeting = append(greeting, 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, cipher[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, "mysql_native_password"...)
+	greeting = append(greeting, 0)
+	if err := s.conn.writePacket(greeting); err != nil {
+		return err
+	}
+
+	data, err := s.conn.readPacket()
+	if err != nil {
+		return err
+	}
+	// capability flags [4], max packet size [4], charset [1], reserved [23]
+	if len(data) < 32 {
+		return fmt.Errorf("malformed handshake response")
+	}
+	if len(data) == 32 && binary.LittleEndian.Uint32(data)&clientSSL != 0 {
+		// SSLRequest, the handshake response follows in TLS
+		if tlsConfig == nil {
+			return fmt.Errorf("SSL is not enabled")
+		}
+		// The client hello may be buffered by the reader of the plain connection
+		tlsConn := tls.Server(bufferedConn{Conn: conn, r: s.conn.rw.Reader}, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.tlsSessions++
+		m.mu.Unlock()
+		seq := s.conn.seq
+		s.conn = newPacketConn(tlsConn)
+		s.conn.seq = seq
+		if data, err = s.conn.readPacket(); err != nil {
+			return err
+		}
+		if len(data) < 32 {
+			return fmt.Errorf("malformed handshake response")
+		}
+	}
+	pos := 32
+	end := pos
+	for end < len(data) && data[end] != 0 {
+		end++
+	}
+	s.user = string(data[pos:end])
+	pos = end + 1
+	var token []byte
+	if pos < len(data) {
+		n := int(data[pos])
+		if pos+1+n <= len(data) {
+			token = data[pos+1 : pos+1+n]
+		}
+	}
+
+	m.mu.Lock()
+	password, checked := m.users[s.user]
+	if p, exist := m.processes[s.id]; exist {
+		p.user, p.command = s.user, "Sleep"
+	}
+	m.mu.Unlock()
+	if checked && !checkScramble(token, cipher, password) {
+		m.mu.Lock()
+		m.denied++
+		m.mu.Unlock()
+		s.conn.writeError(ErrAccessDenied, fmt.Sprintf("Access denied for user '%s'@'127.0.0.1' (using password: YES)", s.user))
+		return fmt.Errorf("access denied")
+	}
+	return s.conn.writeOK(0)
+}
+
+// checkScramble verifies the token of mysql_native_password:
+// SHA1(password) XOR SHA1(cipher + SHA1(SHA1(password)))
+func checkScramble(token, cipher []byte, password string) bool {
+	if password == "" {
+		return len(token) == 0
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(cipher)
+	h.Write(stage2[:])
+	expected := h.Sum(nil)
+	if len(token) != len(expected) {
+		return false
+	}
+	for i := range expected {
+		if expected[i]^stage1[i] != token[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resultSet is the columns and text rows of a query result. A nil value is NULL.
+type resultSet struct {
+	columns []string
+	rows    [][]*string
+}
+
+func (m *MySQL) query(s *session, stmt string) error {
+	stmt = strings.TrimRight(strings.TrimSpace(stmt), ";")
+	upper := strings.ToUpper(stmt)
+
+	m.mu.Lock()
+	m.statements = append(m.statements, stmt)
+	m.status["Questions"] = strconv.Itoa(atoi(m.status["Questions"]) + 1)
+	if p, exist := m.processes[s.id]; exist {
+		p.command, p.info = "Query", stmt
+	}
+	var failure string
+	for prefix, message := range m.failures {
+		if strings.HasPrefix(upper, prefix) {
+			failure = message
+		}
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		if p, exist := m.processes[s.id]; exist {
+			p.command, p.info = "Sleep", ""
+		}
+		m.mu.Unlock()
+	}()
+	if failure != "" {
+		return s.conn.writeError(ErrInjected, failure)
+	}
+
+	switch {
+	case upper == "SHOW SLAVE STATUS":
+		m.syncReplica()
+		return s.conn.writeResultSet(m.slaveStatus())
+	case upper == "SHOW MASTER STATUS":
+		return s.conn.writeResultSet(m.masterStatus())
+	case strings.HasPrefix(upper, "SHOW GLOBAL STATUS"):
+		return s.conn.writeResultSet(filterLike(m.globalStatus(), stmt))
+	case strings.HasPrefix(upper, "SHOW GLOBAL VARIABLES"):
+		m.syncReplica()
+		m.mu.Lock()
+		vars := make(map[string]string, len(m.variables)+1)
+		for name, value := range m.variables {
+			vars[name] = value
+		}
+		vars["gtid_executed"] = m.executed.String()
+		m.mu.Unlock()
+		return s.conn.writeResultSet(filterLike(vars, stmt))
+	case upper == "SHOW PROCESSLIST":
+		return s.conn.writeResultSet(m.processList(false))
+	case upper == "SHOW FULL PROCESSLIST":
+		return s.conn.writeResultSet(m.processList(true))
+	case upper == "SHOW ENGINE INNODB STATUS":
+		m.mu.Lock()
+		text := m.innodbStatus
+		m.mu.Unlock()
+		return s.conn.writeResultSet(resultSet{
+			columns: []string{"Type", "Name", "Status"},
+			rows:    [][]*string{{str("InnoDB"), str(""), str(text)}},
+		})
+	case strings.HasPrefix(upper, "SELECT @@"):
+		return s.conn.writeResultSet(m.selectVariables(stmt[len("SELECT "):]))
+	case strings.HasPrefix(upper, "KILL "):
+		return m.kill(s, strings.TrimSpace(stmt[len("KILL "):]))
+	case strings.HasPrefix(upper, "SET GLOBAL "):
+		return m.setGlobal(s, stmt[len("SET GLOBAL "):])
+	case strings.HasPrefix(upper, "SET GTID_NEXT"):
+		values := parseAssignments(stmt[len("SET "):])
+		s.gtidNext = values["GTID_NEXT"]
+		if strings.ToUpper(s.gtidNext) == "AUTOMATIC" {
+			s.gtidNext = ""
+		}
+		return s.conn.writeOK(0)
+	case upper == "BEGIN":
+		return s.conn.writeOK(0)
+	case upper == "COMMIT":
+		return m.commit(s)
+	case strings.HasPrefix(upper, "SET PASSWORD FOR "):
+		return m.setPassword(s, stmt)
+	case strings.HasPrefix(upper, "CREATE DATABASE "), strings.HasPrefix(upper, "DROP DATABASE "),
+		strings.HasPrefix(upper, "CREATE USER "), strings.HasPrefix(upper, "DROP USER "), strings.HasPrefix(upper, "GRANT "),
+		strings.HasPrefix(upper, "REVOKE "):
+		return m.account(s, stmt)
+	case strings.Contains(upper, "FROM INFORMATION_SCHEMA.USER_PRIVILEGES"):
+		return s.conn.writeResultSet(m.userPrivileges(s.user))
+	case strings.Contains(upper, "FROM INFORMATION_SCHEMA.SCHEMATA"):
+		return s.conn.writeResultSet(m.schemata())
+	case strings.Contains(upper, "FROM MYSQL.DB"):
+		return s.conn.writeResultSet(m.databaseGrants(stmt))
+	case strings.Contains(upper, "FROM MYSQL.USER"):
+		m.mu.Lock()
+		rs := resultSet{columns: []string{"User"}}
+		for _, user := range sortedKeys(m.users) {
+			rs.rows = append(rs.rows, []*string{str(user)})
+		}
+		m.mu.Unlock()
+		return s.conn.writeResultSet(rs)
+	case strings.HasPrefix(upper, "SET SQL_MODE"):
+		s.noAutoCreateUser = strings.Contains(upper, "NO_AUTO_CREATE_USER")
+		return s.conn.writeOK(0)
+	case strings.HasPrefix(upper, "SET "):
+		// SET NAMES and the other session variables
+		return s.conn.writeOK(0)
+	case strings.HasPrefix(upper, "STOP SLAVE"):
+		return m.stopSlave(s, upper)
+	case strings.HasPrefix(upper, "START SLAVE"):
+		return m.startSlave(s, upper)
+	case upper == "RESET SLAVE" || upper == "RESET SLAVE ALL":
+		return m.resetSlave(s, upper == "RESET SLAVE ALL")
+	case strings.HasPrefix(upper, "CHANGE MASTER TO "):
+		return m.changeMaster(s, stmt[len("CHANGE MASTER TO "):])
+	}
+	return s.conn.writeError(ErrSyntax, fmt.Sprintf("You have an error in your SQL syntax near '%s'", stmt))
+}
+
+func (m *MySQL) slaveStatus() resultSet {
+	columns := []string{"Slave_IO_State", "Master_Host", "Master_User", "Master_Port", "Connect_Retry",
+		"Master_Log_File", "Read_Master_Log_Pos", "Relay_Log_File", "Relay_Log_Pos", "Relay_Master_Log_File",
+		"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Last_Error", "Skip_Counter", "Exec_Master_Log_Pos",
+		"Seconds_Behind_Master", "Last_IO_Errno", "Last_IO_Error", "Last_SQL_Errno", "Last_SQL_Error",
+		"Master_UUID", "Retrieved_Gtid_Set", "Executed_Gtid_Set", "Auto_Position"}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.replica
+	if r == nil {
+		return resultSet{columns: columns}
+	}
+	ioState, ioRunning, ioErrno, ioError := "", "No", 0, ""
+	if r.ioRunning {
+		if r.ioConnected {
+			ioState, ioRunning = "Waiting for master to send event", "Yes"
+		} else {
+			ioState, ioRunning, ioErrno = "Connecting to master", "Connecting", r.ioErrno
+			ioError = fmt.Sprintf("error connecting to master '%s@%s:%d' - retry-time: 60  retries: 1", r.user, r.host, r.port)
+		}
+	}
+	sqlRunning := "No"
+	if r.sqlRunning {
+		sqlRunning = "Yes"
+	}
+	var behind *string
+	if r.ioConnected && r.sqlRunning {
+		behind = str(strconv.Itoa(r.lag))
+	}
+	masterUUID := ""
+	registry.Lock()
+	if source := registry.servers[net.JoinHostPort(r.host, strconv.Itoa(r.port))]; source != nil {
+		masterUUID = source.uuid
+	}
+	registry.Unlock()
+	autoPosition := "0"
+	if r.autoPosition {
+		autoPosition = "1"
+	}
+	return resultSet{columns: columns, rows: [][]*string{{
+		str(ioState), str(r.host), str(r.user), str(strconv.Itoa(r.port)), str("60"),
+		str(r.readFile), str(strconv.Itoa(r.readPos)), str("relay-bin.000002"), str(strconv.Itoa(r.execPos)), str(r.execFile),
+		str(ioRunning), str(sqlRunning), str(strconv.Itoa(r.sqlErrno)), str(r.sqlError), str("0"), str(strconv.Itoa(r.execPos)),
+		behind, str(strconv.Itoa(ioErrno)), str(ioError), str(strconv.Itoa(r.sqlErrno)), str(r.sqlError),
+		str(masterUUID), str(r.retrieved.String()), str(m.executed.String()), str(autoPosition),
+	}}}
+}
+
+func (m *MySQL) masterStatus() resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return resultSet{
+		columns: []string{"File", "Position", "Binlog_Do_DB", "Binlog_Ignore_DB", "Executed_Gtid_Set"},
+		rows:    [][]*string{{str(m.binlogFile()), str(strconv.Itoa(m.binlogPos)), str(""), str(""), str(m.executed.String())}},
+	}
+}
+
+func (m *MySQL) globalStatus() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := map[string]string{
+		"Threads_connected": strconv.Itoa(len(m.processes)),
+		"Threads_running":   "1",
+		"Uptime":            "3600",
+	}
+	for name, value := range m.status {
+		status[name] = value
+	}
+	return status
+}
+
+// processList returns the processes, whose queries are truncated to 100 characters unless full
+func (m *MySQL) processList(full bool) resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]int, 0, len(m.processes))
+	for id := range m.processes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	rs := resultSet{columns: []string{"Id", "User", "Host", "db", "Command", "Time", "State", "Info"}}
+	for _, id := range ids {
+		p := m.processes[id]
+		var info, db *string
+		if p.info != "" {
+			info = str(p.info)
+			if !full && len(p.info) > 100 {
+				info = str(p.info[:100])
+			}
+		}
+		if p.db != "" {
+			db = str(p.db)
+		}
+		rs.rows = append(rs.rows, []*string{str(strconv.Itoa(id)), str(p.user), str(p.host), db, str(p.command),
+			str(strconv.Itoa(int(time.Since(p.started).Seconds()))), str(""), info})
+	}
+	return rs
+}
+
+// selectVariables answers "SELECT @@a, @@b" used by the driver on connecting
+func (m *MySQL) selectVariables(names string) resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rs resultSet
+	row := make([]*string, 0, 1)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		rs.columns = append(rs.columns, name)
+		if value, exist := m.variables[strings.ToLower(strings.TrimPrefix(name, "@@"))]; exist {
+			row = append(row, str(value))
+		} else {
+			row = append(row, nil)
+		}
+	}
+	rs.rows = [][]*string{row}
+	return rs
+}
+
+// kill answers "KILL [CONNECTION | QUERY] id". KILL QUERY interrupts the query and keeps the connection.
+func (m *MySQL) kill(s *session, arg string) error {
+	upper := strings.ToUpper(arg)
+	queryOnly := strings.HasPrefix(upper, "QUERY ")
+	if queryOnly || strings.HasPrefix(upper, "CONNECTION ") {
+		arg = strings.TrimSpace(arg[strings.Index(arg, " "):])
+	}
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return s.conn.writeError(ErrSyntax, fmt.Sprintf("You have an error in your SQL syntax near '%s'", arg))
+	}
+	m.mu.Lock()
+	p, exist := m.processes[id]
+	if exist && queryOnly {
+		p.command, p.info = "Sleep", ""
+	} else if exist {
+		delete(m.processes, id)
+	}
+	m.mu.Unlock()
+	if !exist {
+		return s.conn.writeError(ErrUnknownThread, fmt.Sprintf("Unknown thread id: %d", id))
+	}
+	if queryOnly {
+		return s.conn.writeOK(0)
+	}
+	if p.conn != nil && id != s.id {
+		p.conn.Close()
+	}
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) setGlobal(s *session, assignments string) error {
+	m.mu.Lock()
+	for name, value := range parseAssignments(assignments) {
+		name = strings.ToLower(name)
+		if prev := m.variables[name]; prev == "ON" || prev == "OFF" {
+			switch strings.ToUpper(value) {
+			case "1", "ON":
+				value = "ON"
+			case "0", "OFF":
+				value = "OFF"
+			}
+		}
+		m.variables[name] = value
+	}
+	m.mu.Unlock()
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) commit(s *session) error {
+	if s.gtidNext != "" {
+		set, err := gtid.Parse(s.gtidNext)
+		if err != nil {
+			return s.conn.writeError(ErrSyntax, err.Error())
+		}
+		m.mu.Lock()
+		m.executed = union(m.executed, set)
+		m.binlogPos += transactionSize
+		m.mu.Unlock()
+	}
+	return s.conn.writeOK(0)
+}
+
+var setPasswordExp = regexp.MustCompile(`(?i)^SET PASSWORD FOR '([^']*)'@'[^']*'\s*=\s*PASSWORD\('([^']*)'\)$`)
+
+func (m *MySQL) setPassword(s *session, stmt string) error {
+	match := setPasswordExp.FindStringSubmatch(stmt)
+	if match == nil {
+		return s.conn.writeError(ErrSyntax, fmt.Sprintf("You have an error in your SQL syntax near '%s'", stmt))
+	}
+	m.mu.Lock()
+	m.users[match[1]] = match[2]
+	m.mu.Unlock()
+	// The change is a transaction replicated to the replicas
+	m.Commit(1)
+	return s.conn.writeOK(0)
+}
+
+var (
+	createDatabaseExp = regexp.MustCompile("(?i)^CREATE DATABASE `([^`]+)`")
+	dropDatabaseExp   = regexp.MustCompile("(?i)^DROP DATABASE `([^`]+)`$")
+	createUserExp     = regexp.MustCompile(`(?i)^CREATE USER '([^']*)'@'([^']*)' IDENTIFIED BY '([^']*)'$`)
+	dropUserExp       = regexp.MustCompile(`(?i)^DROP USER '([^']*)'@'[^']*'$`)
+	grantExp          = regexp.MustCompile("(?i)^GRANT (.+) ON `([^`]+)`\\.\\* TO '([^']*)'@'([^']*)'$")
+	revokeExp         = regexp.MustCompile("(?i)^REVOKE (.+) ON `([^`]+)`\\.\\* FROM '([^']*)'@'([^']*)'$")
+	userLimitExp      = regexp.MustCompile(`(?i)^GRANT USAGE ON \*\.\* TO '([^']*)'@'([^']*)' WITH MAX_USER_CONNECTIONS (\d+)$`)
+	selectColumnsExp  = regexp.MustCompile(`(?i)^SELECT (.+) FROM `)
+)
+
+// privilegeColumns are the columns in mysql.db of the privileges on a database
+var privilegeColumns = map[string]string{
+	"SELECT": "Select_priv", "INSERT": "Insert_priv", "UPDATE": "Update_priv", "DELETE": "Delete_priv",
+	"CREATE": "Create_priv", "DROP": "Drop_priv", "GRANT OPTION": "Grant_priv", "REFERENCES": "References_priv",
+	"INDEX": "Index_priv", "ALTER": "Alter_priv", "CREATE TEMPORARY TABLES": "Create_tmp_table_priv",
+	"LOCK TABLES": "Lock_tables_priv", "CREATE VIEW": "Create_view_priv", "SHOW VIEW": "Show_view_priv",
+	"CREATE ROUTINE": "Create_routine_priv", "ALTER ROUTINE": "Alter_routine_priv", "EXECUTE": "Execute_priv",
+	"EVENT": "Event_priv", "TRIGGER": "Trigger_priv",
+}
+
+// account answers the statements creating and dropping databases and users, granting privileges
+// on a database and limiting the connections of users. Like mysql.db, the database of a grant is kept
+// as it's written, and the grant is removed once all its privileges are revoked. Each user has only
+// one host. Granting to an account not created fails if the session has NO_AUTO_CREATE_USER, and
+// is accepted without creating the account otherwise.
+func (m *MySQL) account(s *session, stmt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if match := createDatabaseExp.FindStringSubmatch(stmt); match != nil {
+		if _, exist := m.databases[match[1]]; exist {
+			return s.conn.writeError(ErrDBCreateExists, fmt.Sprintf("Can't create database '%s'; database exists", match[1]))
+		}
+		m.databases[match[1]] = 0
+	} else if match = dropDatabaseExp.FindStringSubmatch(stmt); match != nil {
+		delete(m.databases, match[1])
+	} else if match = createUserExp.FindStringSubmatch(stmt); match != nil {
+		if _, exist := m.users[match[1]]; exist {
+			return s.conn.writeError(ErrCannotUser, fmt.Sprintf("Operation CREATE USER failed for '%s'@'%s'", match[1], match[2]))
+		}
+		m.users[match[1]], m.hosts[match[1]] = match[3], match[2]
+	} else if match = dropUserExp.FindStringSubmatch(stmt); match != nil {
+		if _, exist := m.users[match[1]]; !exist {
+			return s.conn.writeError(ErrCannotUser, fmt.Sprintf("Operation DROP USER failed for '%s'@'%%'", match[1]))
+		}
+		for _, db := range m.grants[match[1]] {
+			delete(m.privileges, match[1]+"@"+db)
+		}
+		delete(m.users, match[1])
+		delete(m.hosts, match[1])
+		delete(m.grants, match[1])
+	} else if match = userLimitExp.FindStringSubmatch(stmt); match != nil {
+		if !m.accountExists(match[1], match[2]) {
+			return m.noSuchUser(s, match[1], match[2])
+		}
+		m.limits[match[1]] = atoi(match[3])
+	} else if match = grantExp.FindStringSubmatch(stmt); match != nil {
+		if !m.accountExists(match[3], match[4]) {
+			return m.noSuchUser(s, match[3], match[4])
+		}
+		key := match[3] + "@" + match[2]
+		if m.privileges[key] == nil {
+			m.privileges[key] = make(map[string]bool)
+			m.grants[match[3]] = append(m.grants[match[3]], match[2])
+		}
+		for _, privilege := range splitPrivileges(match[1]) {
+			m.privileges[key][privilege] = true
+		}
+	} else if match = revokeExp.FindStringSubmatch(stmt); match != nil {
+		key := match[3] + "@" + match[2]
+		privileges := splitPrivileges(match[1])
+		for _, privilege := range privileges {
+			if !m.accountExists(match[3], match[4]) || !m.privileges[key][privilege] {
+				return s.conn.writeError(ErrNoSuchGrant, fmt.Sprintf("There is no such grant defined for user '%s' on host '%s'", match[3], match[4]))
+			}
+		}
+		for _, privilege := range privileges {
+			delete(m.privileges[key], privilege)
+		}
+		if len(m.privileges[key]) == 0 {
+			delete(m.privileges, key)
+			dbs := m.grants[match[3]][:0]
+			for _, db := range m.grants[match[3]] {
+				if db != match[2] {
+					dbs = append(dbs, db)
+				}
+			}
+			m.grants[match[3]] = dbs
+		}
+	} else {
+		return s.conn.writeError(ErrSyntax, fmt.Sprintf("You have an error in your SQL syntax near '%s'", stmt))
+	}
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) accountExists(user, host string) bool {
+	_, exist := m.users[user]
+	return exist && m.hosts[user] == host
+}
+
+// noSuchUser fails granting to an account not created if the session has NO_AUTO_CREATE_USER
+func (m *MySQL) noSuchUser(s *session, user, host string) error {
+	if !s.noAutoCreateUser {
+		return s.conn.writeOK(0)
+	}
+	return s.conn.writeError(ErrNoSuchUser, fmt.Sprintf("Can't find any matching row in the user table for '%s'@'%s'", user, host))
+}
+
+func splitPrivileges(list string) []string {
+	privileges := strings.Split(strings.ToUpper(list), ",")
+	for i := range privileges {
+		privileges[i] = strings.TrimSpace(privileges[i])
+	}
+	return privileges
+}
+
+// schemata answers the query of the databases and the sizes of their tables
+func (m *MySQL) schemata() resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rs := resultSet{columns: []string{"SCHEMA_NAME", "SIZE"}}
+	names := make([]string, 0, len(m.databases))
+	for name := range m.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rs.rows = append(rs.rows, []*string{str(name), str(strconv.FormatInt(m.databases[name], 10))})
+	}
+	return rs
+}
+
+// userPrivileges answers the query of the privileges of the session user ON *.*
+func (m *MySQL) userPrivileges(user string) resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	global, exist := m.global[user]
+	if !exist {
+		global.grantable = true
+		global.privileges = append(global.privileges, "CREATE USER")
+		for privilege := range privilegeColumns {
+			if privilege != "GRANT OPTION" {
+				global.privileges = append(global.privileges, privilege)
+			}
+		}
+		sort.Strings(global.privileges)
+	}
+	grantable := "NO"
+	if global.grantable {
+		grantable = "YES"
+	}
+	rs := resultSet{columns: []string{"PRIVILEGE_TYPE", "IS_GRANTABLE"}}
+	for _, privilege := range global.privileges {
+		rs.rows = append(rs.rows, []*string{str(privilege), str(grantable)})
+	}
+	return rs
+}
+
+// databaseGrants answers the query of User, Host, Db and the privilege columns in mysql.db, which
+// are "Y" or "N"
+func (m *MySQL) databaseGrants(stmt string) resultSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rs resultSet
+	if match := selectColumnsExp.FindStringSubmatch(stmt); match != nil {
+		for _, column := range strings.Split(match[1], ",") {
+			rs.columns = append(rs.columns, strings.TrimSpace(column))
+		}
+	}
+	for _, user := range sortedKeys(m.users) {
+		for _, db := range m.grants[user] {
+			row := make([]*string, len(rs.columns))
+			for i, column := range rs.columns {
+				switch column {
+				case "User":
+					row[i] = str(user)
+				case "Host":
+					row[i] = str(m.hosts[user])
+				case "Db":
+					row[i] = str(db)
+				default:
+					row[i] = str("N")
+					for privilege := range m.privileges[user+"@"+db] {
+						if privilegeColumns[privilege] == column {
+							row[i] = str("Y")
+						}
+					}
+				}
+			}
+			rs.rows = append(rs.rows, row)
+		}
+	}
+	return rs
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *MySQL) stopSlave(s *session, upper string) error {
+	m.mu.Lock()
+	if r := m.replica; r != nil {
+		if !strings.HasSuffix(upper, "SQL_THREAD") {
+			r.ioRunning, r.ioConnected = false, false
+		}
+		if !strings.HasSuffix(upper, "IO_THREAD") {
+			r.sqlRunning = false
+		}
+	}
+	m.mu.Unlock()
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) startSlave(s *session, upper string) error {
+	m.mu.Lock()
+	r := m.replica
+	if r == nil || r.host == "" {
+		m.mu.Unlock()
+		return s.conn.writeError(ErrNotSlave, "The server is not configured as slave; fix in config file or with CHANGE MASTER TO")
+	}
+	if !strings.HasSuffix(upper, "SQL_THREAD") {
+		r.ioRunning = true
+	}
+	if !strings.HasSuffix(upper, "IO_THREAD") {
+		if r.failedGTID != "" {
+			// The failed transaction fails again unless it is skipped
+			if failed, err := gtid.Parse(r.failedGTID); err == nil && m.executed.ContainsSet(failed) {
+				r.sqlErrno, r.sqlError, r.failedGTID = 0, "", ""
+			}
+		}
+		r.sqlRunning = r.failedGTID == ""
+	}
+	m.mu.Unlock()
+	m.syncReplica()
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) resetSlave(s *session, all bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.replica
+	if r != nil && (r.ioRunning || r.sqlRunning) {
+		return s.conn.writeError(ErrSlaveRunning, "This operation cannot be performed with a running slave; run STOP SLAVE first")
+	}
+	if all {
+		m.replica = nil
+	} else if r != nil {
+		m.replica = &replica{host: r.host, port: r.port, user: r.user, password: r.password,
+			autoPosition: r.autoPosition, retrieved: make(gtid.Set)}
+	}
+	return s.conn.writeOK(0)
+}
+
+func (m *MySQL) changeMaster(s *session, assignments string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.replica
+	if r != nil && (r.ioRunning || r.sqlRunning) {
+		return s.conn.writeError(ErrSlaveRunning, "This operation cannot be performed with a running slave; run STOP SLAVE first")
+	}
+	if r == nil {
+		r = &replica{retrieved: make(gtid.Set)}
+	}
+	changed := *r
+	for name, value := range parseAssignments(assignments) {
+		switch name {
+		case "MASTER_HOST":
+			changed.host = value
+		case "MASTER_PORT":
+			changed.port = atoi(value)
+		case "MASTER_USER":
+			changed.user = value
+		case "MASTER_PASSWORD":
+			changed.password = value
+		case "MASTER_AUTO_POSITION":
+			changed.autoPosition = value == "1"
+		case "MASTER_LOG_FILE":
+			changed.readFile, changed.execFile = value, value
+		case "MASTER_LOG_POS":
+			changed.readPos, changed.execPos = atoi(value), atoi(value)
+		default:
+			return s.conn.writeError(ErrSyntax, fmt.Sprintf("Unknown option %s of CHANGE MASTER TO", name))
+		}
+	}
+	if changed.host != r.host || changed.port != r.port {
+		changed.retrieved = make(gtid.Set)
+	}
+	m.replica = &changed
+	return s.conn.writeOK(0)
+}
+
+// parseAssignments parses "A='x', B=1" to {"A": "x", "B": "1"}, with the names upper-cased
+// and the quotes and escapes of the values removed
+func parseAssignments(s string) map[string]string {
+	values := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.ToUpper(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if len(s) > 0 && (s[0] == '\'' || s[0] == '"') {
+			quote := s[0]
+			var b []byte
+			i := 1
+			for ; i < len(s) && s[i] != quote; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b = append(b, s[i])
+			}
+			value, s = string(b), s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		values[name] = value
+		s = strings.TrimLeft(s, " ,")
+	}
+	return values
+}
+
+// filterLike returns the rows of vars whose names match the LIKE pattern at the end of stmt
+func filterLike(vars map[string]string, stmt string) resultSet {
+	rs := resultSet{columns: []string{"Variable_name", "Value"}}
+	pattern := "%"
+	if i := strings.Index(strings.ToUpper(stmt), " LIKE "); i >= 0 {
+		pattern = strings.Trim(strings.TrimSpace(stmt[i+len(" LIKE "):]), `'"`)
+	}
+	exp, err := regexp.Compile("(?i)^" + likeEscaper.Replace(pattern) + "$")
+	if err != nil {
+		return rs
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if exp.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rs.rows = append(rs.rows, []*string{str(name), str(vars[name])})
+	}
+	return rs
+}
+
+// union returns a new set containing the transactions of all the sets
+func union(sets ...gtid.Set) gtid.Set {
+	parts := make([]string, 0, len(sets))
+	for _, set := range sets {
+		if s := set.String(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	result, _ := gtid.Parse(strings.Join(parts, ","))
+	return result
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// packetConn reads and writes the packets of the MySQL protocol
+type packetConn struct {
+	rw  *bufio.ReadWriter
+	seq byte
+}
+
+// bufferedConn reads conn through r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func newPacketConn(conn net.Conn) *packetConn {
+	return &packetConn{rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+}
+
+func (c *packetConn) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	c.seq = header[3] + 1
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *packetConn) writePacket(data []byte) error {
+	if len(data) >= maxPacketSize {
+		return fmt.Errorf("packet of %d bytes is too large", len(data))
+	}
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), c.seq}
+	c.seq++
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(data); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *packetConn) writeOK(affectedRows uint64) error {
+	data := []byte{iOK}
+	data = appendLengthEncodedInt(data, affectedRows)
+	data = appendLengthEncodedInt(data, 0)
+	data = appendUint16(data, statusAutocommit)
+	data = appendUint16(data, 0)
+	return c.writePacket(data)
+}
+
+func (c *packetConn) writeError(errno int, message string) error {
+	data := []byte{iERR}
+	data = appendUint16(data, uint16(errno))
+	data = append(data, "#HY000"...)
+	data = append(data, message...)
+	return c.writePacket(data)
+}
+
+func (c *packetConn) writeEOF() error {
+	data := []byte{iEOF}
+	data = appendUint16(data, 0)
+	data = appendUint16(data, statusAutocommit)
+	return c.writePacket(data)
+}
+
+func (c *packetConn) writeResultSet(rs resultSet) error {
+	if err := c.writePacket(appendLengthEncodedInt(nil, uint64(len(rs.columns)))); err != nil {
+		return err
+	}
+	for _, column := range rs.columns {
+		var data []byte
+		for _, s := range []string{"def", "", "", "", column, column} {
+			data = appendLengthEncodedString(data, s)
+		}
+		data = append(data, 0x0c)
+		data = appendUint16(data, charsetUTF8)
+		data = appendUint32(data, 1024)
+		data = append(data, fieldTypeString, 0, 0, 0, 0, 0)
+		if err := c.writePacket(data); err != nil {
+			return err
+		}
+	}
+	if err := c.writeEOF(); err != nil {
+		return err
+	}
+	for _, row := range rs.rows {
+		var data []byte
+		for _, value := range row {
+			if value == nil {
+				data = append(data, 0xfb)
+			} else {
+				data = appendLengthEncodedString(data, *value)
+			}
+		}
+		if err := c.writePacket(data); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+func appendUint16(data []byte, n uint16) []byte {
+	return append(data, byte(n), byte(n>>8))
+}
+
+func appendUint32(data []byte, n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return append(data, b...)
+}
+
+func appendLengthEncodedInt(data []byte, n uint64) []byte {
+	switch {
+	case n < 251:
+		return append(data, byte(n))
+	case n < 1<<16:
+		return append(data, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(data, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, n)
+	return append(append(data, 0xfe), b...)
+}
+
+func appendLengthEncodedString(data []byte, s string) []byte {
+	return append(appendLengthEncodedInt(data, uint64(len(s))), s...)
+}
@@ -0,0 +1,128 @@
+package fake
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Mail is a message received by the fake SMTP server
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTP is a fake SMTP server listening on 127.0.0.1, which accepts any PLAIN auth and keeps the mails
+type SMTP struct {
+	mu       sync.Mutex
+	listener net.Listener
+	mails    []Mail
+	wg       sync.WaitGroup
+}
+
+// NewSMTP starts a fake SMTP server on a random port of 127.0.0.1
+func NewSMTP() (*SMTP, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SMTP{listener: listener}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the server, in the format "127.0.0.1:port"
+func (s *SMTP) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Mails returns the received mails in order
+func (s *SMTP) Mails() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail(nil), s.mails...)
+}
+
+// Close stops the server
+func (s *SMTP) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *SMTP) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *SMTP) handleConn(conn net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(rw, format+"\r\n", args...)
+		rw.Flush()
+	}
+	reply("220 fake ESMTP")
+	var mail Mail
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-fake\r\n250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "AUTH"):
+			reply("235 Authentication successful")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			mail = Mail{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			mail.To = append(mail.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data []string
+			for {
+				dataLine, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				dataLine = strings.TrimRight(dataLine, "\r\n")
+				if dataLine == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(dataLine, "."))
+			}
+			mail.Data = strings.Join(data, "\n")
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "RSET" || cmd == "NOOP":
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
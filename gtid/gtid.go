@@ -0,0 +1,184 @@
+// Package gtid parses and inspects MySQL GTID sets such as
+// "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:7,4a0b3c1d-71ca-11e1-9e33-c80aa9429562:1-3".
+package gtid
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Interval is a closed range of transaction numbers of one server UUID.
+type Interval struct {
+	Start int64
+	End   int64
+}
+
+// Set maps a lower-case server UUID to its sorted and merged intervals.
+type Set map[string][]Interval
+
+// Parse parses a GTID set in the format printed by MySQL.
+// Whitespaces and newlines in the set, which MySQL uses to wrap long sets, are ignored.
+func Parse(s string) (Set, error) {
+	set := make(Set)
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return set, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid GTID set %q", part)
+		}
+		uuid := strings.ToLower(fields[0])
+		for _, rng := range fields[1:] {
+			var iv Interval
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if iv.Start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid GTID interval %q: %s", rng, err.Error())
+			}
+			iv.End = iv.Start
+			if len(bounds) == 2 {
+				if iv.End, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid GTID interval %q: %s", rng, err.Error())
+				}
+			}
+			if iv.Start <= 0 || iv.End < iv.Start {
+				return nil, fmt.Errorf("invalid GTID interval %q", rng)
+			}
+			set[uuid] = append(set[uuid], iv)
+		}
+		set[uuid] = merge(set[uuid])
+	}
+	return set, nil
+}
+
+// Contains reports whether the transaction uuid:no is in the set.
+func (s Set) Contains(uuid string, no int64) bool {
+	for _, iv := range s[strings.ToLower(uuid)] {
+		if iv.Start <= no && no <= iv.End {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsSet reports whether every transaction of other is in the set.
+func (s Set) ContainsSet(other Set) bool {
+	for uuid, ivs := range other {
+		for _, iv := range ivs {
+			covered := false
+			for _, siv := range s[uuid] {
+				if siv.Start <= iv.Start && iv.End <= siv.End {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Last returns the largest transaction number of uuid in the set, or 0 if there is none.
+func (s Set) Last(uuid string) int64 {
+	ivs := s[strings.ToLower(uuid)]
+	if len(ivs) == 0 {
+		return 0
+	}
+	return ivs[len(ivs)-1].End
+}
+
+// String formats the set the way MySQL does, with the UUIDs sorted.
+func (s Set) String() string {
+	uuids := make([]string, 0, len(s))
+	for uuid, ivs := range s {
+		if len(ivs) > 0 {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	parts := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		part := uuid
+		for _, iv := range s[uuid] {
+			if iv.Start == iv.End {
+				part += fmt.Sprintf(":%d", iv.Start)
+			} else {
+				part += fmt.Sprintf(":%d-%d", iv.Start, iv.End)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Subtract returns the transactions of the set which are not in other, with every UUID of the set.
+// On a slave, the retrieved set minus the executed set are the transactions waiting to be applied.
+func (s Set) Subtract(other Set) Set {
+	result := make(Set)
+	for uuid, ivs := range s {
+		for _, iv := range ivs {
+			rest := []Interval{iv}
+			for _, oiv := range other[uuid] {
+				var next []Interval
+				for _, r := range rest {
+					if oiv.End < r.Start || r.End < oiv.Start {
+						next = append(next, r)
+						continue
+					}
+					if r.Start < oiv.Start {
+						next = append(next, Interval{Start: r.Start, End: oiv.Start - 1})
+					}
+					if oiv.End < r.End {
+						next = append(next, Interval{Start: oiv.End + 1, End: r.End})
+					}
+				}
+				rest = next
+			}
+			result[uuid] = append(result[uuid], rest...)
+		}
+		if len(result[uuid]) == 0 {
+			delete(result, uuid)
+		}
+	}
+	return result
+}
+
+func merge(ivs []Interval) []Interval {
+	sort.Sort(intervalSorter(ivs))
+	merged := ivs[:0]
+	for _, iv := range ivs {
+		if n := len(merged); n > 0 && iv.Start <= merged[n-1].End+1 {
+			if iv.End > merged[n-1].End {
+				merged[n-1].End = iv.End
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+type intervalSorter []Interval
+
+func (ivs intervalSorter) Len() int {
+	return len(ivs)
+}
+
+func (ivs intervalSorter) Swap(i, j int) {
+	ivs[i], ivs[j] = ivs[j], ivs[i]
+}
+
+func (ivs intervalSorter) Less(i, j int) bool {
+	return ivs[i].Start < ivs[j].Start
+}
@@ -0,0 +1,104 @@
+package gtid
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	uuidA = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuidB = "4a0b3c1d-71ca-11e1-9e33-c80aa9429562"
+)
+
+func mustParse(t *testing.T, s string) Set {
+	t.Helper()
+	set, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse %q failed: %s", s, err.Error())
+	}
+	return set
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		out string
+	}{
+		{in: "", out: ""},
+		{in: uuidA + ":1-5", out: uuidA + ":1-5"},
+		{in: "3E11FA47-71CA-11E1-9E33-C80AA9429562:7:1-5", out: uuidA + ":1-5:7"},
+		// Adjacent and overlapping intervals are merged
+		{in: uuidA + ":1-5:6-8:3-4:10", out: uuidA + ":1-8:10"},
+		{in: uuidA + ":1-3," + uuidA + ":4-6", out: uuidA + ":1-6"},
+		// MySQL wraps long sets with newlines, and the UUIDs are sorted
+		{in: uuidB + ":1-3,\n" + uuidA + ":1-5:7", out: uuidA + ":1-5:7," + uuidB + ":1-3"},
+	} {
+		if out := mustParse(t, c.in).String(); out != c.out {
+			t.Errorf("Parse %q should be %q, got %q", c.in, c.out, out)
+		}
+	}
+	for _, in := range []string{uuidA, ":1-5", uuidA + ":0-5", uuidA + ":5-1", uuidA + ":a-b", uuidA + ":1-"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("%q should be invalid", in)
+		}
+	}
+}
+
+func TestContainsSet(t *testing.T) {
+	set := mustParse(t, uuidA+":1-10:20-30,"+uuidB+":1-5")
+	for _, c := range []struct {
+		other    string
+		expected bool
+	}{
+		{other: "", expected: true},
+		{other: uuidA + ":1-10", expected: true},
+		{other: uuidA + ":3:25-30," + uuidB + ":5", expected: true},
+		{other: uuidA + ":10-20", expected: false},
+		{other: uuidA + ":31", expected: false},
+		{other: uuidB + ":1-6", expected: false},
+		{other: "5c0b3c1d-71ca-11e1-9e33-c80aa9429562:1", expected: false},
+	} {
+		if contains := set.ContainsSet(mustParse(t, c.other)); contains != c.expected {
+			t.Errorf("ContainsSet %q should be %v", c.other, c.expected)
+		}
+	}
+	if !set.Contains(upper(uuidB), 3) || set.Contains(uuidA, 15) {
+		t.Errorf("Contains is wrong for %s", set)
+	}
+}
+
+func TestLast(t *testing.T) {
+	set := mustParse(t, uuidA+":1-10:20-30,"+uuidB+":7")
+	for uuid, expected := range map[string]int64{uuidA: 30, upper(uuidB): 7, "5c0b3c1d-71ca-11e1-9e33-c80aa9429562": 0} {
+		if last := set.Last(uuid); last != expected {
+			t.Errorf("Last of %s should be %d, got %d", uuid, expected, last)
+		}
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	for _, c := range []struct {
+		set      string
+		other    string
+		expected string
+	}{
+		{set: uuidA + ":1-10", other: uuidA + ":1-6", expected: uuidA + ":7-10"},
+		{set: uuidA + ":1-10", other: uuidA + ":1-10", expected: ""},
+		{set: uuidA + ":1-10", other: "", expected: uuidA + ":1-10"},
+		// The other set may have holes and the transactions of other UUIDs
+		{set: uuidA + ":5-10", other: uuidA + ":1-6:8-9," + uuidB + ":1-100", expected: uuidA + ":7:10"},
+		{set: uuidA + ":1-5:8-10", other: uuidA + ":2-3:9", expected: uuidA + ":1:4-5:8:10"},
+		// Every UUID of the set is subtracted, not only one of them
+		{set: uuidA + ":1-10," + upper(uuidB) + ":1-5", other: uuidA + ":1-9," + uuidB + ":1-3", expected: uuidA + ":10," + uuidB + ":4-5"},
+		{set: uuidB + ":1-10", other: uuidA + ":1-6", expected: uuidB + ":1-10"},
+	} {
+		if result := mustParse(t, c.set).Subtract(mustParse(t, c.other)); result.String() != c.expected {
+			t.Errorf("%q minus %q should be %q, got %q", c.set, c.other, c.expected, result.String())
+		}
+	}
+}
+
+// upper returns uuid in upper case, which is accepted as well
+func upper(uuid string) string {
+	return strings.ToUpper(uuid)
+}
@@ -2,6 +2,13 @@
 
 ./gen_mycnf.py $1 $2
 
+# The agent asks to empty the datadir when rebuilding this instance from backup
+if [ -f /var/log/baklog/rebuild_wipe ]; then
+    echo "Empty datadir for rebuilding"
+    rm -rf /var/lib/mysql/*
+    rm -f /var/log/baklog/rebuild_wipe
+fi
+
 dataExist=`ls /var/lib/mysql`
 bkExist=`ls /var/lib/mysql_backup`
 if [ -z "$dataExist" -a -n "$bkExist" ]; then
@@ -9,5 +16,6 @@ if [ -z "$dataExist" -a -n "$bkExist" ]; then
     cd tools && ./full_recover.sh
     cd ..
 fi
+/lain/app/agentd -alsologtostderr=true -log_dir=/var/log -v=2 &
 echo "Start to init..."
 exec tools/entrypoint.sh mysqld
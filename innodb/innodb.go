@@ -0,0 +1,150 @@
+// Package innodb parses the output of "SHOW ENGINE INNODB STATUS" into its sections
+// and the latest detected deadlock.
+package innodb
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The sections shown on the details page
+const (
+	SectionDeadlock      = "LATEST DETECTED DEADLOCK"
+	SectionTransactions  = "TRANSACTIONS"
+	SectionBufferPool    = "BUFFER POOL AND MEMORY"
+	SectionRowOperations = "ROW OPERATIONS"
+)
+
+var (
+	// The time line of a deadlock in MySQL 5.7, e.g. "2017-03-01 10:00:00 0x7f2b5c0f9700",
+	// or in MySQL 5.6, e.g. "2017-03-01 10:00:00 7f2b5c0f9700"
+	deadlockTimeExp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})`)
+	// e.g. "*** (1) TRANSACTION:"
+	deadlockTrxExp      = regexp.MustCompile(`^\*\*\* \((\d+)\) TRANSACTION:`)
+	deadlockRollbackExp = regexp.MustCompile(`^\*\*\* WE ROLL BACK TRANSACTION \((\d+)\)`)
+)
+
+// Section is a section of the status, whose name is framed by lines of dashes
+type Section struct {
+	Name string
+	Text string
+}
+
+// Status is the parsed status of InnoDB
+type Status struct {
+	Sections []Section
+	// Deadlock is nil if no deadlock has been detected since the instance started
+	Deadlock *Deadlock
+}
+
+// Deadlock is the latest deadlock detected by InnoDB
+type Deadlock struct {
+	// Detected is the time printed by InnoDB in the local time of the instance,
+	// which is zero if it can't be parsed
+	Detected     time.Time
+	Transactions []DeadlockTransaction
+	// RolledBack is the number of the transaction rolled back by InnoDB, e.g. "2"
+	RolledBack string
+	Text       string
+}
+
+// DeadlockTransaction is a transaction in a deadlock
+type DeadlockTransaction struct {
+	Number string
+	// Transaction is the line of the id and state, e.g. "TRANSACTION 1234, ACTIVE 2 sec starting index read"
+	Transaction string
+	// Thread is the line of the MySQL thread id, host and user
+	Thread string
+	Query  string
+	// WaitingFor is the first line of the lock the transaction was waiting for
+	WaitingFor string
+}
+
+// Section returns the text of the section, or "" if there is no such section
+func (s Status) Section(name string) string {
+	for _, section := range s.Sections {
+		if section.Name == name {
+			return section.Text
+		}
+	}
+	return ""
+}
+
+// Parse parses the status text
+func Parse(text string) Status {
+	var status Status
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	var current *Section
+	var body []string
+	flush := func() {
+		if current != nil {
+			current.Text = strings.TrimSpace(strings.Join(body, "\n"))
+			status.Sections = append(status.Sections, *current)
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		if i+2 < len(lines) && isRule(lines[i]) && isRule(lines[i+2]) && strings.TrimSpace(lines[i+1]) != "" {
+			flush()
+			current, body = &Section{Name: strings.TrimSpace(lines[i+1])}, nil
+			i += 2
+			continue
+		}
+		if isRule(lines[i]) && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "END OF INNODB MONITOR OUTPUT") {
+			break
+		}
+		body = append(body, lines[i])
+	}
+	flush()
+	if text := status.Section(SectionDeadlock); text != "" {
+		deadlock := parseDeadlock(text)
+		status.Deadlock = &deadlock
+	}
+	return status
+}
+
+// isRule reports whether the line is a line of dashes framing a section name
+func isRule(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) >= 3 && strings.Trim(line, "-") == ""
+}
+
+func parseDeadlock(text string) Deadlock {
+	deadlock := Deadlock{Text: text}
+	lines := strings.Split(text, "\n")
+	if matches := deadlockTimeExp.FindStringSubmatch(lines[0]); len(matches) == 2 {
+		deadlock.Detected, _ = time.ParseInLocation("2006-01-02 15:04:05", matches[1], time.Local)
+	}
+	var trx *DeadlockTransaction
+	// The part of the transaction the next lines belong to
+	var part string
+	for _, line := range lines[1:] {
+		if matches := deadlockTrxExp.FindStringSubmatch(line); len(matches) == 2 {
+			deadlock.Transactions = append(deadlock.Transactions, DeadlockTransaction{Number: matches[1]})
+			trx, part = &deadlock.Transactions[len(deadlock.Transactions)-1], "transaction"
+			continue
+		}
+		if matches := deadlockRollbackExp.FindStringSubmatch(line); len(matches) == 2 {
+			deadlock.RolledBack = matches[1]
+			continue
+		}
+		if trx == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "*** ("+trx.Number+") WAITING FOR THIS LOCK"):
+			part = "waiting"
+		case strings.HasPrefix(line, "***"):
+			part = ""
+		case part == "transaction" && strings.HasPrefix(line, "TRANSACTION "):
+			trx.Transaction = line
+		case part == "transaction" && strings.HasPrefix(line, "MySQL thread id "):
+			trx.Thread, part = line, "query"
+		case part == "query":
+			trx.Query = strings.TrimSpace(trx.Query + "\n" + line)
+		case part == "waiting" && trx.WaitingFor == "":
+			trx.WaitingFor = line
+		}
+	}
+	return deadlock
+}
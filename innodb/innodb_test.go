@@ -0,0 +1,107 @@
+package innodb
+
+import (
+	"strings"
+	"testing"
+)
+
+// status57 is a trimmed output of MySQL 5.7
+const status57 = `
+=====================================
+2017-03-01 10:05:00 0x7f2b5c0f9700 INNODB MONITOR OUTPUT
+=====================================
+Per second averages calculated from the last 20 seconds
+-----------------
+BACKGROUND THREAD
+-----------------
+srv_master_thread loops: 10 srv_active, 0 srv_shutdown, 100 srv_idle
+----------
+SEMAPHORES
+----------
+OS WAIT ARRAY INFO: reservation count 5
+------------------------
+LATEST DETECTED DEADLOCK
+------------------------
+2017-03-01 10:00:00 0x7f2b5c0f9700
+*** (1) TRANSACTION:
+TRANSACTION 1234, ACTIVE 2 sec starting index read
+mysql tables in use 1, locked 1
+LOCK WAIT 2 lock struct(s), heap size 1136, 1 row lock(s)
+MySQL thread id 10, OS thread handle 139, query id 100 10.0.0.5 app updating
+UPDATE t SET a = 1
+WHERE id = 2
+*** (1) WAITING FOR THIS LOCK TO BE GRANTED:
+RECORD LOCKS space id 24 page no 3 n bits 72 index PRIMARY of table ` + "`test`.`t`" + ` trx id 1234 lock_mode X locks rec but not gap waiting
+Record lock, heap no 3 PHYSICAL RECORD: n_fields 4; compact format; info bits 0
+*** (2) TRANSACTION:
+TRANSACTION 1235, ACTIVE 3 sec starting index read
+MySQL thread id 11, OS thread handle 140, query id 101 10.0.0.6 app updating
+UPDATE t SET a = 2 WHERE id = 1
+*** (2) HOLDS THE LOCK(S):
+RECORD LOCKS space id 24 page no 3 n bits 72 index PRIMARY of table ` + "`test`.`t`" + ` trx id 1235 lock_mode X locks rec but not gap
+*** (2) WAITING FOR THIS LOCK TO BE GRANTED:
+RECORD LOCKS space id 24 page no 3 n bits 72 index PRIMARY of table ` + "`test`.`t`" + ` trx id 1235 lock_mode X locks rec but not gap waiting
+*** WE ROLL BACK TRANSACTION (2)
+------------
+TRANSACTIONS
+------------
+Trx id counter 1240
+History list length 12
+LIST OF TRANSACTIONS FOR EACH SESSION:
+---TRANSACTION 421, not started
+----------------------
+BUFFER POOL AND MEMORY
+----------------------
+Total large memory allocated 137428992
+Buffer pool hit rate 1000 / 1000, young-making rate 0 / 1000 not 0 / 1000
+--------------
+ROW OPERATIONS
+--------------
+0 queries inside InnoDB, 0 queries in queue
+Number of rows inserted 10, updated 5, deleted 0, read 100
+----------------------------
+END OF INNODB MONITOR OUTPUT
+============================
+`
+
+func TestParse(t *testing.T) {
+	status := Parse(status57)
+	var names []string
+	for _, section := range status.Sections {
+		names = append(names, section.Name)
+	}
+	expected := "BACKGROUND THREAD,SEMAPHORES,LATEST DETECTED DEADLOCK,TRANSACTIONS,BUFFER POOL AND MEMORY,ROW OPERATIONS"
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("Expected sections %s, got %v", expected, names)
+	}
+	if text := status.Section(SectionTransactions); !strings.HasPrefix(text, "Trx id counter 1240") ||
+		!strings.HasSuffix(text, "---TRANSACTION 421, not started") {
+		t.Errorf("Unexpected transactions section: %q", text)
+	}
+	if text := status.Section(SectionRowOperations); !strings.HasSuffix(text, "read 100") {
+		t.Errorf("The end of the output should not be in the last section: %q", text)
+	}
+
+	deadlock := status.Deadlock
+	if deadlock == nil {
+		t.Fatal("The deadlock is not parsed")
+	}
+	if deadlock.Detected.Format("2006-01-02 15:04:05") != "2017-03-01 10:00:00" || deadlock.RolledBack != "2" {
+		t.Errorf("Unexpected deadlock: %v, rolled back %s", deadlock.Detected, deadlock.RolledBack)
+	}
+	if len(deadlock.Transactions) != 2 {
+		t.Fatalf("Expected 2 transactions, got %v", deadlock.Transactions)
+	}
+	first, second := deadlock.Transactions[0], deadlock.Transactions[1]
+	if first.Transaction != "TRANSACTION 1234, ACTIVE 2 sec starting index read" ||
+		!strings.HasPrefix(first.Thread, "MySQL thread id 10,") || first.Query != "UPDATE t SET a = 1\nWHERE id = 2" {
+		t.Errorf("Unexpected first transaction: %+v", first)
+	}
+	if second.Query != "UPDATE t SET a = 2 WHERE id = 1" || !strings.HasSuffix(second.WaitingFor, "trx id 1235 lock_mode X locks rec but not gap waiting") {
+		t.Errorf("Unexpected second transaction: %+v", second)
+	}
+
+	if status = Parse(strings.Replace(status57, "LATEST DETECTED DEADLOCK", "FILE I/O", 1)); status.Deadlock != nil {
+		t.Errorf("There should be no deadlock, got %v", status.Deadlock)
+	}
+}
@@ -0,0 +1,190 @@
+// Package metrics keeps the history of the metrics of instances in bounded on-disk ring buffers,
+// so that the charts work without graphite.
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	magic      = "MSMETR01"
+	headerSize = 16
+	// recordSize is the unix time and the values of a Sample
+	recordSize = 8 + 8*fieldCount
+	fieldCount = 5
+)
+
+// Sample is the metrics of an instance at Time. The unknown values are NaN, e.g. the lag of master.
+type Sample struct {
+	Time              time.Time
+	QPS               float64
+	ThreadsConnected  float64
+	ThreadsRunning    float64
+	ReplicationLag    float64
+	BufferPoolHitRate float64
+}
+
+func (s *Sample) fields() [fieldCount]*float64 {
+	return [fieldCount]*float64{&s.QPS, &s.ThreadsConnected, &s.ThreadsRunning, &s.ReplicationLag, &s.BufferPoolHitRate}
+}
+
+// Ring is a file of a fixed number of samples, the oldest of which is overwritten by Append.
+// The file begins with a header of the magic, the capacity and the next slot to write.
+type Ring struct {
+	file     *os.File
+	capacity int
+	next     int
+}
+
+// OpenRing opens or creates the ring file of capacity samples. A file with another capacity
+// or format is cleared.
+func OpenRing(path string, capacity int) (*Ring, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %d", capacity)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Ring{file: file, capacity: capacity}
+	if fileCapacity, next, err := readHeader(file); err == nil && fileCapacity == capacity {
+		r.next = next
+		return r, nil
+	} else if err != nil && err != io.EOF && err != errBadHeader {
+		file.Close()
+		return nil, err
+	}
+	if err = r.reset(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadRing opens the ring file read-only with the capacity in its header, so that the samples
+// of an instance without a sampler are read without clearing the file
+func ReadRing(path string) (*Ring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	capacity, next, err := readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a ring file: %s", path, err.Error())
+	}
+	return &Ring{file: file, capacity: capacity, next: next}, nil
+}
+
+var errBadHeader = errors.New("bad header")
+
+// readHeader returns the capacity and the next slot in the header of file
+func readHeader(file *os.File) (int, int, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+	capacity := int(binary.LittleEndian.Uint32(header[8:12]))
+	if string(header[:8]) != magic || capacity <= 0 {
+		return 0, 0, errBadHeader
+	}
+	return capacity, int(binary.LittleEndian.Uint32(header[12:16])) % capacity, nil
+}
+
+// reset clears the samples and writes the header
+func (r *Ring) reset() error {
+	if err := r.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := r.file.Truncate(int64(headerSize + r.capacity*recordSize)); err != nil {
+		return err
+	}
+	r.next = 0
+	return r.writeHeader()
+}
+
+func (r *Ring) writeHeader() error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(r.capacity))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(r.next))
+	_, err := r.file.WriteAt(header, 0)
+	return err
+}
+
+// Append writes s to the next slot
+func (r *Ring) Append(s Sample) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, s.Time.Unix())
+	for _, field := range s.fields() {
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(*field))
+	}
+	if _, err := r.file.WriteAt(buf.Bytes(), int64(headerSize+r.next*recordSize)); err != nil {
+		return err
+	}
+	r.next = (r.next + 1) % r.capacity
+	return r.writeHeader()
+}
+
+// Samples returns the samples since the time in order
+func (r *Ring) Samples(since time.Time) ([]Sample, error) {
+	data := make([]byte, r.capacity*recordSize)
+	if _, err := r.file.ReadAt(data, headerSize); err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for i := 0; i < r.capacity; i++ {
+		record := data[((r.next+i)%r.capacity)*recordSize:]
+		unix := int64(binary.LittleEndian.Uint64(record))
+		if unix == 0 || unix < since.Unix() {
+			continue
+		}
+		s := Sample{Time: time.Unix(unix, 0)}
+		for j, field := range s.fields() {
+			*field = math.Float64frombits(binary.LittleEndian.Uint64(record[8+8*j:]))
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// Close closes the file
+func (r *Ring) Close() error {
+	return r.file.Close()
+}
+
+// Downsample averages the samples into at most points samples. The time of each sample is the time
+// of the last one averaged, and NaN values are skipped.
+func Downsample(samples []Sample, points int) []Sample {
+	if points <= 0 || len(samples) <= points {
+		return samples
+	}
+	result := make([]Sample, 0, points)
+	for i := 0; i < points; i++ {
+		bucket := samples[i*len(samples)/points : (i+1)*len(samples)/points]
+		avg := Sample{Time: bucket[len(bucket)-1].Time}
+		for j, field := range avg.fields() {
+			sum, n := 0.0, 0
+			for k := range bucket {
+				if v := *bucket[k].fields()[j]; !math.IsNaN(v) {
+					sum += v
+					n++
+				}
+			}
+			if n == 0 {
+				*field = math.NaN()
+			} else {
+				*field = sum / float64(n)
+			}
+		}
+		result = append(result, avg)
+	}
+	return result
+}
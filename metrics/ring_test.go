@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sampleAt(unix int64, qps float64) Sample {
+	return Sample{Time: time.Unix(unix, 0), QPS: qps, ThreadsConnected: 1, ThreadsRunning: 1,
+		ReplicationLag: math.NaN(), BufferPoolHitRate: 99}
+}
+
+func TestRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instance.ring")
+	r, err := OpenRing(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 4; i++ {
+		if err = r.Append(sampleAt(1000+i, float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	if r, err = OpenRing(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := r.Samples(time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || samples[0].QPS != 2 || samples[2].QPS != 4 {
+		t.Fatalf("The oldest sample should be overwritten, got %v", samples)
+	}
+	if !math.IsNaN(samples[0].ReplicationLag) || samples[0].BufferPoolHitRate != 99 {
+		t.Errorf("Values are not kept: %v", samples[0])
+	}
+	if samples, _ = r.Samples(time.Unix(1004, 0)); len(samples) != 1 {
+		t.Errorf("Only the samples since the time should be returned, got %v", samples)
+	}
+	r.Close()
+
+	// Reading doesn't need the capacity, and keeps the samples
+	if r, err = ReadRing(path); err != nil {
+		t.Fatal(err)
+	}
+	if samples, _ = r.Samples(time.Unix(0, 0)); len(samples) != 3 || samples[2].QPS != 4 {
+		t.Errorf("The samples should be read with the capacity in the header, got %v", samples)
+	}
+	if err = r.Append(sampleAt(1005, 5)); err == nil {
+		t.Errorf("A ring opened by ReadRing should not be written")
+	}
+	r.Close()
+	if _, err = ReadRing(filepath.Join(dir, "missing.ring")); err == nil {
+		t.Errorf("Reading a missing ring should fail")
+	}
+
+	if r, err = OpenRing(path, 5); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if samples, _ = r.Samples(time.Unix(0, 0)); len(samples) != 0 {
+		t.Errorf("The ring should be cleared when the capacity changes, got %v", samples)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	var samples []Sample
+	for i := int64(0); i < 10; i++ {
+		samples = append(samples, sampleAt(i, float64(i)))
+	}
+	result := Downsample(samples, 5)
+	if len(result) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(result))
+	}
+	if result[0].QPS != 0.5 || result[0].Time.Unix() != 1 || !math.IsNaN(result[0].ReplicationLag) {
+		t.Errorf("Unexpected first sample %v", result[0])
+	}
+}
@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ericpai/msops"
+	"github.com/laincloud/mysql-service/alert"
+)
+
+// The rules of alerts checked after each inspection
+const (
+	RuleMasterDown       = "master_down"
+	RuleReplicationError = "replication_error"
+	RuleReplicationLag   = "replication_lag"
+	RuleRoleChange       = "role_change"
+	RuleBackupStale      = "backup_stale"
+	RuleSplitBrain       = "split_brain"
+	RuleQuotaExceeded    = "quota_exceeded"
+
+	keySMTPPassword = "smtp_passwd"
+	webhookTimeout  = 5 * time.Second
+)
+
+// alerts is replaced by Configure
+var alerts = alert.NewManager("", nil, 0)
+
+// smtpNotifier reads the password from the secret file on each delivery, so that it follows the reloads
+type smtpNotifier struct {
+	alert.SMTP
+}
+
+func (s *smtpNotifier) Notify(n alert.Notification) error {
+	notifier := s.SMTP
+	notifier.Password = credentials.get(keySMTPPassword)
+	return notifier.Notify(n)
+}
+
+// splitList splits a comma separated config item
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateAlerting checks the webhooks and the SMTP settings
+func (cfg Config) validateAlerting() error {
+	for _, webhook := range splitList(cfg.AlertWebhooks) {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alert_webhooks: %q is not a valid http(s) URL", webhook)
+		}
+	}
+	if cfg.SMTPAddr != "" && (cfg.SMTPFrom == "" || len(splitList(cfg.SMTPTo)) == 0) {
+		return fmt.Errorf("smtp_from and smtp_to are required when smtp_addr is set")
+	}
+	if cfg.AlertLagThreshold <= 0 {
+		return fmt.Errorf("alert_lag_threshold must be positive")
+	}
+	if cfg.AlertRepeatInterval < 0 {
+		return fmt.Errorf("alert_repeat_interval must not be negative")
+	}
+	return nil
+}
+
+// newAlertManager creates the alert manager delivering to the webhooks and SMTP of cfg
+func newAlertManager(cfg Config) *alert.Manager {
+	var notifiers []alert.Notifier
+	for _, webhook := range splitList(cfg.AlertWebhooks) {
+		notifiers = append(notifiers, alert.NewWebhook(webhook, webhookTimeout))
+	}
+	if cfg.SMTPAddr != "" {
+		notifiers = append(notifiers, &smtpNotifier{alert.SMTP{
+			Addr: cfg.SMTPAddr,
+			From: cfg.SMTPFrom,
+			To:   splitList(cfg.SMTPTo),
+			User: cfg.SMTPUser,
+		}})
+	}
+	cluster := lainAppName
+	if cluster == "" {
+		cluster = "mysql-service"
+	}
+	return alert.NewManager(cluster, notifiers, cfg.AlertRepeatInterval)
+}
+
+// FiringAlerts returns the alerts which are firing
+func FiringAlerts() []alert.Alert {
+	return alerts.Firing()
+}
+
+// checkAlerts evaluates the rules of alerts against the cluster
+func (monitor *MySQLMonitor) checkAlerts() {
+	var active []alert.Alert
+	raise := func(rule, subject, summary string) {
+		active = append(active, alert.Alert{Rule: rule, Subject: subject, Summary: summary})
+	}
+
+	if monitor.master != "" && msops.CheckInstance(monitor.master) != msops.InstanceOK {
+		raise(RuleMasterDown, monitor.master, fmt.Sprintf("Master %s is unreachable", monitor.master))
+	}
+	for _, endpoint := range monitor.registered() {
+		if endpoint == monitor.master || monitor.master == "" {
+			continue
+		}
+		status, err := msops.GetSlaveStatus(endpoint)
+		switch msops.CheckReplication(endpoint, monitor.master) {
+		case msops.ReplicationError, msops.ReplicationWrongMaster:
+			summary := fmt.Sprintf("Replication of %s from %s is broken", endpoint, monitor.master)
+			if err == nil && status.LastSQLError != "" {
+				summary += ": " + status.LastSQLError
+			} else if err == nil && status.LastIOError != "" {
+				summary += ": " + status.LastIOError
+			}
+			raise(RuleReplicationError, endpoint, summary)
+		}
+		if lag := time.Duration(status.SecondsBehindMaster) * time.Second; err == nil && lag > conf.AlertLagThreshold {
+			raise(RuleReplicationLag, endpoint, fmt.Sprintf("%s is %s behind master, over %s", endpoint, lag, conf.AlertLagThreshold))
+		}
+	}
+	if writable := monitor.writableInstances(); len(writable) > 1 {
+		raise(RuleSplitBrain, "cluster", fmt.Sprintf("%d instances accept writes independently: %s",
+			len(writable), strings.Join(writable, ", ")))
+	}
+	for backupType, summary := range monitor.staleBackups() {
+		raise(RuleBackupStale, backupType, summary)
+	}
+	for database, summary := range monitor.quotaAlerts {
+		raise(RuleQuotaExceeded, database, summary)
+	}
+	alerts.Update(active)
+
+	if monitor.alertsChecked {
+		if monitor.master != monitor.alertedMaster {
+			alerts.Event(alert.Alert{Rule: RuleRoleChange, Subject: "master",
+				Summary: fmt.Sprintf("Master is changed from %s to %s", orNone(monitor.alertedMaster), orNone(monitor.master))})
+		}
+		if monitor.standby != monitor.alertedStandby {
+			alerts.Event(alert.Alert{Rule: RuleRoleChange, Subject: "standby",
+				Summary: fmt.Sprintf("Standby is changed from %s to %s", orNone(monitor.alertedStandby), orNone(monitor.standby))})
+		}
+	}
+	monitor.alertsChecked, monitor.alertedMaster, monitor.alertedStandby = true, monitor.master, monitor.standby
+}
+
+// writableInstances returns the registered instances which have read_only off and don't replicate
+func (monitor *MySQLMonitor) writableInstances() []string {
+	var writable []string
+	for _, endpoint := range monitor.registered() {
+		vars, err := msops.GetGlobalVariables(endpoint, "read_only")
+		if err != nil || vars["read_only"] != "OFF" {
+			continue
+		}
+		if status, err := msops.GetSlaveStatus(endpoint); err == nil && status.MasterHost == "" {
+			writable = append(writable, endpoint)
+		}
+	}
+	sort.Strings(writable)
+	return writable
+}
+
+func orNone(endpoint string) string {
+	if endpoint == "" {
+		return "none"
+	}
+	return endpoint
+}
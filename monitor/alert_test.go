@@ -0,0 +1,97 @@
+package monitor
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/laincloud/mysql-service/alert"
+)
+
+// recorder keeps the notifications delivered by the alert manager
+type recorder struct {
+	sync.Mutex
+	notifications []alert.Notification
+}
+
+func (r *recorder) Name() string {
+	return "recorder"
+}
+
+func (r *recorder) Notify(n alert.Notification) error {
+	r.Lock()
+	defer r.Unlock()
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func firingKeys() []string {
+	var keys []string
+	for _, a := range alerts.Firing() {
+		keys = append(keys, a.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestCheckAlerts(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(true)
+	rec := &recorder{}
+	alerts = alert.NewManager("test", []alert.Notifier{rec}, 0)
+	oldMaster, newMaster, slave := c.servers[0], c.servers[1], c.servers[2]
+
+	msMonitor.checkAlerts()
+	if keys := firingKeys(); len(keys) != 0 {
+		t.Fatalf("A healthy cluster should not raise alerts, got %v", keys)
+	}
+	c.mustAccept(switchToMaster(newMaster.Addr()))
+	msMonitor.checkAlerts()
+
+	slave.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	oldMaster.SetReplicationLag(120)
+	newMaster.Commit(1)
+	msMonitor.checkAlerts()
+	expected := []string{
+		RuleReplicationError + "/" + slave.Addr(),
+		RuleReplicationLag + "/" + oldMaster.Addr(),
+	}
+	if keys := firingKeys(); len(keys) != 2 || keys[0] != expected[0] || keys[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+
+	oldMaster.SetReplicationLag(0)
+	c.mustAccept(detach(slave.Addr()))
+	msMonitor.checkAlerts()
+	if keys := firingKeys(); len(keys) != 1 || keys[0] != RuleSplitBrain+"/cluster" {
+		t.Errorf("The detached writable slave should raise split brain, got %v", keys)
+	}
+
+	newMaster.SetDown(true)
+	// The vendored driver doesn't ping on Ping, so the master is found down after the pooled connections fail
+	inspectRoles(t)
+	msMonitor.checkAlerts()
+	if keys := firingKeys(); len(keys) == 0 || keys[0] != RuleMasterDown+"/"+newMaster.Addr() {
+		t.Errorf("The master which is down should raise an alert, got %v", keys)
+	}
+
+	alerts.Close()
+	var events, resolved []string
+	for _, n := range rec.notifications {
+		switch n.Status {
+		case alert.StatusEvent:
+			events = append(events, n.Summary)
+		case alert.StatusResolved:
+			resolved = append(resolved, n.Key())
+		}
+	}
+	if len(events) != 2 || events[0] != "Master is changed from "+oldMaster.Addr()+" to "+newMaster.Addr() {
+		t.Errorf("Switching should notify the role changes, got %v", events)
+	}
+	sort.Strings(resolved)
+	if expected = append(expected, RuleSplitBrain+"/cluster"); !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Expected %v resolved, got %v", expected, resolved)
+	}
+}
@@ -0,0 +1,50 @@
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// auditLog is the file in ConfigDir saving the audit records
+const auditLog = "audit.log"
+
+// AuditRecord records one operation made by web users
+type AuditRecord struct {
+	Time     time.Time
+	Operator string
+	Role     string
+	Endpoint string
+	Action   string
+	Params   map[string]string
+	Result   string
+}
+
+// audit appends the operation to the audit log, one json record per line
+func audit(req PatchRequest, err error) {
+	record := AuditRecord{
+		Time:     time.Now(),
+		Operator: req.Operator,
+		Role:     req.Role,
+		Endpoint: req.Endpoint,
+		Action:   string(req.Action),
+		Params:   req.Params,
+		Result:   "OK",
+	}
+	if err != nil {
+		record.Result = err.Error()
+	}
+	glog.Infof("Audit: %s(%s) %s on %s %v: %s", record.Operator, record.Role, record.Action, record.Endpoint, record.Params, record.Result)
+	data, _ := json.Marshal(record)
+	file, err := os.OpenFile(conf.path(auditLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Errorf("Open audit log failed: %s", err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		glog.Errorf("Write audit log failed: %s", err.Error())
+	}
+}
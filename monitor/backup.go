@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/backup"
+)
+
+// backupCatalog is the file in ConfigDir saving the backup catalog
+const backupCatalog = "backups"
+
+// BackupRecord is one backup run in the backup catalog
+type BackupRecord struct {
+	Endpoint string
+	Received time.Time
+	backup.Report
+}
+
+// BackupRequest reports a backup run of the endpoint to monitor
+type BackupRequest struct {
+	Endpoint     string
+	Report       backup.Report
+	ResponseChan chan PatchResponse
+}
+
+// ReportBackup receives a BackupRequest and sends to monitor to handle
+func ReportBackup(req BackupRequest) {
+	msMonitor.backupReqChan <- req
+}
+
+// Good reports whether the backup succeeded and is verified
+func (record BackupRecord) Good() bool {
+	return record.ExitCode == backup.ExitOK && record.Manifest.Verified
+}
+
+func (monitor *MySQLMonitor) handleBackupReport(req BackupRequest) {
+	resp := PatchResponse{Code: http.StatusCreated}
+	if req.Report.Manifest.Type != backup.TypeFull && req.Report.Manifest.Type != backup.TypeIncr {
+		resp.Code, resp.Err = http.StatusBadRequest, fmt.Errorf("Unknown backup type %s", req.Report.Manifest.Type)
+	} else {
+		monitor.backups = append(monitor.backups, BackupRecord{
+			Endpoint: req.Endpoint,
+			Received: time.Now(),
+			Report:   req.Report,
+		})
+		if len(monitor.backups) > conf.MaxBackupRecords {
+			monitor.backups = monitor.backups[len(monitor.backups)-conf.MaxBackupRecords:]
+		}
+		glog.Infof("%s backup of %s is reported, exit code: %d", req.Report.Manifest.Type, req.Endpoint, req.Report.ExitCode)
+		monitor.saveBackupCatalog()
+	}
+	req.ResponseChan <- resp
+}
+
+func (monitor *MySQLMonitor) loadBackupCatalog() {
+	if data, err := ioutil.ReadFile(conf.path(backupCatalog)); err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("Load backup catalog failed: %s", err.Error())
+		}
+	} else if err = json.Unmarshal(data, &monitor.backups); err != nil {
+		glog.Errorf("Unmarshal backup catalog failed: %s", err.Error())
+	}
+	var err error
+	if monitor.backupSchedules, err = loadBackupSchedules(conf.LainConfigFile); err != nil {
+		glog.Errorf("Load backup schedules failed: %s", err.Error())
+	}
+}
+
+func (monitor *MySQLMonitor) saveBackupCatalog() {
+	data, _ := json.Marshal(monitor.backups)
+	if err := ioutil.WriteFile(conf.path(backupCatalog), data, 0644); err != nil {
+		glog.Errorf("Save backup catalog failed: %s", err.Error())
+	}
+}
+
+// lastGoodBackup returns the latest good backup of backupType
+func (monitor *MySQLMonitor) lastGoodBackup(backupType string) (BackupRecord, bool) {
+	for i := len(monitor.backups) - 1; i >= 0; i-- {
+		if record := monitor.backups[i]; record.Manifest.Type == backupType && record.Good() {
+			return record, true
+		}
+	}
+	return BackupRecord{}, false
+}
+
+// backupAlerts returns the warnings for the backups older than their schedules in lain.yaml
+func (monitor *MySQLMonitor) backupAlerts() []string {
+	stale := monitor.staleBackups()
+	alerts := make([]string, 0, len(stale))
+	for _, backupType := range []string{backup.TypeFull, backup.TypeIncr} {
+		if alert, exist := stale[backupType]; exist {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// staleBackups returns the reasons why the backups are stale, by backup type
+func (monitor *MySQLMonitor) staleBackups() map[string]string {
+	stale := make(map[string]string)
+	for _, backupType := range []string{backup.TypeFull, backup.TypeIncr} {
+		interval, exist := monitor.backupSchedules[backupType]
+		if !exist {
+			continue
+		}
+		if record, exist := monitor.lastGoodBackup(backupType); !exist {
+			stale[backupType] = fmt.Sprintf("No good %s backup is recorded", backupType)
+		} else if age := time.Since(record.Manifest.Started); age > interval+conf.BackupGraceTime {
+			stale[backupType] = fmt.Sprintf("The last good %s backup is %s old, longer than its schedule interval %s",
+				backupType, formatAge(age), formatAge(interval))
+		}
+	}
+	return stale
+}
+
+// loadBackupSchedules reads the schedules of backup_full and backup_increment from lain.yaml,
+// and returns the longest interval between two runs of each backup type
+func loadBackupSchedules(fileName string) (map[string]time.Duration, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	schedules := make(map[string]time.Duration)
+	var backupType string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "backup_full:"):
+			backupType = backup.TypeFull
+		case strings.HasPrefix(line, "backup_increment:"):
+			backupType = backup.TypeIncr
+		case strings.HasPrefix(line, "schedule:") && backupType != "":
+			expr := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "schedule:")), `"'`)
+			if schedules[backupType], err = cronInterval(expr); err != nil {
+				return nil, err
+			}
+			backupType = ""
+		}
+	}
+	return schedules, scanner.Err()
+}
+
+// cronInterval estimates the longest interval between two runs of the cron expression.
+// Only the forms used by backupd are supported: "*", a fixed value or "*/N" in each field.
+func cronInterval(expr string) (time.Duration, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return 0, fmt.Errorf("invalid cron expression %q", expr)
+	}
+	minute, hour, dom, month, dow := fields[0], fields[1], fields[2], fields[3], fields[4]
+	step := func(field string, unit, whole time.Duration) (time.Duration, error) {
+		if !strings.HasPrefix(field, "*/") {
+			return whole, nil
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(field, "*/"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid cron field %q", field)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	day := 24 * time.Hour
+	switch {
+	case month != "*":
+		return step(month, 31*day, 366*day)
+	case dow != "*":
+		return 7 * day, nil
+	case dom != "*":
+		return step(dom, day, 31*day)
+	case hour != "*":
+		return step(hour, time.Hour, day)
+	case minute != "*":
+		return step(minute, time.Minute, time.Hour)
+	}
+	return time.Minute, nil
+}
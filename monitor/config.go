@@ -0,0 +1,495 @@
+package monitor
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laincloud/lainlet/client"
+)
+
+// The sources of configuration items, from the lowest priority to the highest
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+	// SourceSimulator is the configuration of the simulated cluster, see Override
+	SourceSimulator = "simulator"
+
+	// maxMetricsSamples bounds the ring file of each instance to about 48MB
+	maxMetricsSamples = 1000000
+
+	defaultConfigFile = "conf/monitor.yaml"
+	configEnvPrefix   = "MONITOR_"
+)
+
+// Config is the configuration of monitord
+type Config struct {
+	MonitorPort string
+	// ConfigDir saves the cluster roles, the backup catalog and the audit log
+	ConfigDir      string
+	SecretFile     string
+	LainConfigFile string
+	DBAUser        string
+	ReplUser       string
+	GraphiteAddr   string
+	LainletAddr    string
+
+	InspectInterval time.Duration
+	ReportInterval  time.Duration
+	ConnTimeout     time.Duration
+	AgentTimeout    time.Duration
+	// SlowLogTimeout is the timeout of requests for the slow log digests, which are larger than the others
+	SlowLogTimeout time.Duration
+
+	// A registered instance missing in service discovery keeps its role until it is missing
+	// in MissingGraceEvents consecutive lists or for MissingGraceTime, and is unreachable
+	MissingGraceEvents int
+	MissingGraceTime   time.Duration
+
+	// AlertWebhooks and SMTPTo are comma separated. The SMTP password is smtp_passwd in the secret file.
+	AlertWebhooks       string
+	SMTPAddr            string
+	SMTPFrom            string
+	SMTPTo              string
+	SMTPUser            string
+	AlertLagThreshold   time.Duration
+	AlertRepeatInterval time.Duration
+
+	// The samples of metrics are kept for MetricsRetention, see package metrics
+	MetricsInterval  time.Duration
+	MetricsRetention time.Duration
+
+	// The latest deadlock of each instance is checked every DeadlockCheckInterval, and at most
+	// MaxDeadlockRecords deadlocks of all the instances are kept
+	DeadlockCheckInterval time.Duration
+	MaxDeadlockRecords    int
+
+	// The sizes and the connections of the databases with quotas are checked every QuotaCheckInterval
+	QuotaCheckInterval time.Duration
+
+	// KillRoles are the comma separated console roles allowed to kill sessions. "anonymous" is the
+	// role of all the web users when SSO is disabled, which is only allowed if it's added explicitly.
+	KillRoles string
+	// DatabaseRoles are the comma separated console roles allowed to create databases, rotate or drop
+	// their users and set their quotas. Like KillRoles, anonymous is only allowed if it's added explicitly.
+	DatabaseRoles string
+
+	MaxBackupRecords int
+	// BackupGraceTime is the time allowed for a scheduled backup to finish
+	BackupGraceTime time.Duration
+
+	fileName string
+	sources  map[string]string
+}
+
+// ConfigItem is one item of the effective configuration shown on the config page
+type ConfigItem struct {
+	Key    string
+	Value  string
+	Source string
+	Usage  string
+}
+
+type configField struct {
+	key   string
+	usage string
+	// ptr is *string, *int or *time.Duration
+	ptr interface{}
+}
+
+// DefaultConfig returns the configuration used in LAIN
+func DefaultConfig() Config {
+	return Config{
+		MonitorPort:           "6033",
+		ConfigDir:             "/var/lib/monitor.conf",
+		SecretFile:            "conf/secret.conf",
+		LainConfigFile:        "lain.yaml",
+		DBAUser:               "dba",
+		ReplUser:              "repl",
+		GraphiteAddr:          net.JoinHostPort("graphite.lain", os.Getenv("GRAPHITE_PORT")),
+		LainletAddr:           net.JoinHostPort("lainlet.lain", os.Getenv("LAINLET_PORT")),
+		InspectInterval:       3 * time.Second,
+		ReportInterval:        time.Minute,
+		ConnTimeout:           time.Second,
+		AgentTimeout:          time.Second,
+		SlowLogTimeout:        10 * time.Second,
+		MissingGraceEvents:    3,
+		MissingGraceTime:      30 * time.Second,
+		AlertLagThreshold:     time.Minute,
+		AlertRepeatInterval:   time.Hour,
+		MetricsInterval:       time.Minute,
+		MetricsRetention:      7 * 24 * time.Hour,
+		DeadlockCheckInterval: 30 * time.Second,
+		MaxDeadlockRecords:    200,
+		QuotaCheckInterval:    time.Minute,
+		KillRoles:             "owner,admin",
+		DatabaseRoles:         "owner,admin",
+		MaxBackupRecords:      500,
+		BackupGraceTime:       time.Hour,
+	}
+}
+
+func (cfg *Config) fields() []configField {
+	return []configField{
+		{"monitor_port", "The port of the SSE server for proxies", &cfg.MonitorPort},
+		{"config_dir", "The directory saving cluster roles, the backup catalog and the audit log", &cfg.ConfigDir},
+		{"secret_file", "The file of passwords and SSO secrets", &cfg.SecretFile},
+		{"lain_config_file", "The lain.yaml to read the backup schedules from", &cfg.LainConfigFile},
+		{"dba_user", "The MySQL user to manage instances", &cfg.DBAUser},
+		{"repl_user", "The MySQL user of replication", &cfg.ReplUser},
+		{"graphite_addr", "The address of graphite to report stats to", &cfg.GraphiteAddr},
+		{"lainlet_addr", "The address of lainlet to read the graphite feature from", &cfg.LainletAddr},
+		{"inspect_interval", "The interval of inspecting instances", &cfg.InspectInterval},
+		{"report_interval", "The interval of reporting stats to graphite", &cfg.ReportInterval},
+		{"conn_timeout", "The timeout of connecting to MySQL", &cfg.ConnTimeout},
+		{"agent_timeout", "The timeout of requests to agents", &cfg.AgentTimeout},
+		{"slowlog_timeout", "The timeout of requests for the slow log digests to agents", &cfg.SlowLogTimeout},
+		{"missing_grace_events", "The consecutive discovery lists missing an instance before its role is dropped", &cfg.MissingGraceEvents},
+		{"missing_grace_time", "The time an instance is missing in discovery before its role is dropped", &cfg.MissingGraceTime},
+		{"alert_webhooks", "The comma separated URLs to post alerts to, e.g. Slack incoming webhooks", &cfg.AlertWebhooks},
+		{"smtp_addr", "The SMTP server to mail alerts with, e.g. smtp.example.com:25", &cfg.SMTPAddr},
+		{"smtp_from", "The sender of alert mails", &cfg.SMTPFrom},
+		{"smtp_to", "The comma separated recipients of alert mails", &cfg.SMTPTo},
+		{"smtp_user", "The user of SMTP auth, whose password is smtp_passwd in the secret file", &cfg.SMTPUser},
+		{"alert_lag_threshold", "The replication lag raising an alert", &cfg.AlertLagThreshold},
+		{"alert_repeat_interval", "The interval of notifying a firing alert again, 0 to notify once", &cfg.AlertRepeatInterval},
+		{"metrics_interval", "The interval of sampling the metrics of instances for the charts", &cfg.MetricsInterval},
+		{"metrics_retention", "The time the samples of metrics are kept for, e.g. 168h", &cfg.MetricsRetention},
+		{"deadlock_check_interval", "The interval of checking the latest deadlocks of instances", &cfg.DeadlockCheckInterval},
+		{"max_deadlock_records", "The number of deadlocks kept in the deadlock history", &cfg.MaxDeadlockRecords},
+		{"quota_check_interval", "The interval of checking the quotas of the application databases", &cfg.QuotaCheckInterval},
+		{"kill_roles", "The comma separated console roles allowed to kill sessions", &cfg.KillRoles},
+		{"database_roles", "The comma separated console roles allowed to manage the application databases", &cfg.DatabaseRoles},
+		{"max_backup_records", "The number of records kept in the backup catalog", &cfg.MaxBackupRecords},
+		{"backup_grace_time", "The time allowed for a scheduled backup to finish", &cfg.BackupGraceTime},
+	}
+}
+
+func (field configField) set(value string) error {
+	switch ptr := field.ptr.(type) {
+	case *string:
+		*ptr = value
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", field.key, err.Error())
+		}
+		*ptr = v
+	case *time.Duration:
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", field.key, err.Error())
+		}
+		*ptr = v
+	}
+	return nil
+}
+
+func (field configField) String() string {
+	switch ptr := field.ptr.(type) {
+	case *string:
+		return *ptr
+	case *int:
+		return strconv.Itoa(*ptr)
+	case *time.Duration:
+		return ptr.String()
+	}
+	return ""
+}
+
+// flagName returns the command line flag of key, e.g. -inspect-interval for inspect_interval
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// envName returns the environment variable of key, e.g. MONITOR_INSPECT_INTERVAL for inspect_interval
+func envName(key string) string {
+	return configEnvPrefix + strings.ToUpper(key)
+}
+
+// ConfigLoader loads Config from the defaults, the config file, the environment variables
+// and the command line flags, each overriding the former ones
+type ConfigLoader struct {
+	fs        *flag.FlagSet
+	fileName  *string
+	overrides []configOverride
+}
+
+type configOverride struct {
+	key    string
+	value  string
+	source string
+}
+
+// NewConfigLoader registers the config flags to fs, which must be parsed before Load
+func NewConfigLoader(fs *flag.FlagSet) *ConfigLoader {
+	loader := &ConfigLoader{
+		fs:       fs,
+		fileName: fs.String("config", defaultConfigFile, "The config file of monitord"),
+	}
+	defaults := DefaultConfig()
+	for _, field := range defaults.fields() {
+		usage := fmt.Sprintf("%s (default %s, env %s)", field.usage, field.String(), envName(field.key))
+		fs.String(flagName(field.key), "", usage)
+	}
+	return loader
+}
+
+// Load loads and validates the configuration. A missing default config file is ignored.
+func (loader *ConfigLoader) Load() (Config, error) {
+	cfg := DefaultConfig()
+	cfg.fileName = *loader.fileName
+	cfg.sources = make(map[string]string)
+	fields := cfg.fields()
+	for _, field := range fields {
+		cfg.sources[field.key] = SourceDefault
+	}
+
+	if _, err := os.Stat(cfg.fileName); err == nil || cfg.fileName != defaultConfigFile {
+		items, err := loadConfigFile(cfg.fileName)
+		if err != nil {
+			return cfg, fmt.Errorf("Load config file %s failed: %s", cfg.fileName, err.Error())
+		}
+		for _, field := range fields {
+			if value := items[field.key]; value != "" {
+				if err := field.set(value); err != nil {
+					return cfg, fmt.Errorf("Invalid config in %s: %s", cfg.fileName, err.Error())
+				}
+				cfg.sources[field.key] = SourceFile
+			}
+		}
+	} else {
+		cfg.fileName = ""
+	}
+
+	for _, field := range fields {
+		if value := os.Getenv(envName(field.key)); value != "" {
+			if err := field.set(value); err != nil {
+				return cfg, fmt.Errorf("Invalid env %s: %s", envName(field.key), err.Error())
+			}
+			cfg.sources[field.key] = SourceEnv
+		}
+	}
+
+	var err error
+	loader.fs.Visit(func(f *flag.Flag) {
+		for _, field := range fields {
+			if err == nil && f.Name == flagName(field.key) {
+				if err = field.set(f.Value.String()); err == nil {
+					cfg.sources[field.key] = SourceFlag
+				}
+			}
+		}
+	})
+	if err != nil {
+		return cfg, fmt.Errorf("Invalid flag: %s", err.Error())
+	}
+
+	for _, o := range loader.overrides {
+		for _, field := range fields {
+			if o.key == field.key {
+				if err := field.set(o.value); err != nil {
+					return cfg, fmt.Errorf("Invalid %s config: %s", o.source, err.Error())
+				}
+				cfg.sources[field.key] = o.source
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// loadConfigFile reads the items of the config file, which is a YAML mapping of the keys to scalars
+// like "inspect_interval: 3s". Nested mappings and lists are not supported, as no item needs them.
+func loadConfigFile(fileName string) (map[string]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	items := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(line, "- ") {
+			return nil, fmt.Errorf("line %d: nested mappings and lists are not supported", lineNo)
+		}
+		sep := strings.Index(line, ": ")
+		if sep < 0 && strings.HasSuffix(line, ":") {
+			sep = len(line) - 1
+		}
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: %q is not a key: value pair", lineNo, line)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value, err := yamlScalar(strings.TrimSpace(line[sep+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+		if _, exist := items[key]; exist {
+			return nil, fmt.Errorf("line %d: %s is duplicated", lineNo, key)
+		}
+		items[key] = value
+	}
+	return items, scanner.Err()
+}
+
+// yamlScalar returns the value of a plain, single-quoted or double-quoted YAML scalar followed by an optional comment
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "'"):
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				continue
+			}
+			// A single quote is escaped by another one
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the quoted value", rest)
+			}
+			return strings.Replace(s[1:i], "''", "'", -1), nil
+		}
+		return "", fmt.Errorf("unterminated quoted value %s", s)
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] != '"' {
+				continue
+			}
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the quoted value", rest)
+			}
+			return strconv.Unquote(s[:i+1])
+		}
+		return "", fmt.Errorf("unterminated quoted value %s", s)
+	}
+	// A comment starts with a # after a whitespace
+	if strings.HasPrefix(s, "#") {
+		s = ""
+	} else if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	} else if i = strings.Index(s, "\t#"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "~" || s == "null" {
+		return "", nil
+	}
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") || s == "|" || s == ">" {
+		return "", fmt.Errorf("%s is not a scalar", s)
+	}
+	return s, nil
+}
+
+// Override sets the item key to value from source, which takes precedence over all the other sources.
+// It must be called before Load.
+func (loader *ConfigLoader) Override(key, value, source string) {
+	loader.overrides = append(loader.overrides, configOverride{key: key, value: value, source: source})
+}
+
+// Validate checks whether the configuration is usable
+func (cfg Config) Validate() error {
+	if port, err := strconv.Atoi(cfg.MonitorPort); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("monitor_port %q is not a valid port", cfg.MonitorPort)
+	}
+	for key, addr := range map[string]string{"graphite_addr": cfg.GraphiteAddr, "lainlet_addr": cfg.LainletAddr} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%s %q is not a valid address: %s", key, addr, err.Error())
+		}
+	}
+	if info, err := os.Stat(cfg.ConfigDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("config_dir %s is not a directory", cfg.ConfigDir)
+	}
+	if cfg.DBAUser == "" || cfg.ReplUser == "" {
+		return fmt.Errorf("dba_user and repl_user must not be empty")
+	}
+	if cfg.InspectInterval < time.Second {
+		return fmt.Errorf("inspect_interval %s is shorter than 1s", cfg.InspectInterval)
+	}
+	for key, d := range map[string]time.Duration{
+		"report_interval":         cfg.ReportInterval,
+		"conn_timeout":            cfg.ConnTimeout,
+		"agent_timeout":           cfg.AgentTimeout,
+		"slowlog_timeout":         cfg.SlowLogTimeout,
+		"backup_grace_time":       cfg.BackupGraceTime,
+		"missing_grace_time":      cfg.MissingGraceTime,
+		"deadlock_check_interval": cfg.DeadlockCheckInterval,
+		"quota_check_interval":    cfg.QuotaCheckInterval,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", key)
+		}
+	}
+	if cfg.MissingGraceEvents <= 0 {
+		return fmt.Errorf("missing_grace_events must be positive")
+	}
+	if cfg.MetricsInterval < time.Second {
+		return fmt.Errorf("metrics_interval %s is shorter than 1s", cfg.MetricsInterval)
+	}
+	if capacity := cfg.MetricsRetention / cfg.MetricsInterval; capacity < 1 || capacity > maxMetricsSamples {
+		return fmt.Errorf("metrics_retention %s keeps %d samples, which must be between 1 and %d",
+			cfg.MetricsRetention, capacity, maxMetricsSamples)
+	}
+	if cfg.MaxBackupRecords <= 0 {
+		return fmt.Errorf("max_backup_records must be positive")
+	}
+	if cfg.MaxDeadlockRecords <= 0 {
+		return fmt.Errorf("max_deadlock_records must be positive")
+	}
+	return cfg.validateAlerting()
+}
+
+// FileName returns the loaded config file, or "" if there is none
+func (cfg Config) FileName() string {
+	return cfg.fileName
+}
+
+// Items returns the effective configuration with the source of each item
+func (cfg Config) Items() []ConfigItem {
+	fields := cfg.fields()
+	items := make([]ConfigItem, 0, len(fields))
+	for _, field := range fields {
+		source := cfg.sources[field.key]
+		if source == "" {
+			source = SourceDefault
+		}
+		items = append(items, ConfigItem{Key: field.key, Value: field.String(), Source: source, Usage: field.usage})
+	}
+	return items
+}
+
+// path returns the path of a file in ConfigDir
+func (cfg Config) path(name string) string {
+	return filepath.Join(cfg.ConfigDir, name)
+}
+
+// Configure sets the configuration of monitor, which must be called before Start
+func Configure(cfg Config) {
+	conf = cfg
+	connParam["timeout"] = cfg.ConnTimeout.String()
+	lainletClient = client.New(cfg.LainletAddr)
+	credentials.load()
+	alerts.Close()
+	alerts = newAlertManager(cfg)
+}
+
+// CurrentConfig returns the configuration of monitor
+func CurrentConfig() Config {
+	return conf
+}
@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// loadConfig loads the configuration with the command line args
+func loadConfig(args ...string) (Config, error) {
+	fs := flag.NewFlagSet("monitord", flag.ContinueOnError)
+	loader := NewConfigLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return loader.Load()
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := loadConfig("-config=../conf/monitor.yaml.example", "-config-dir="+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GraphiteAddr != "graphite.lain:2003" || cfg.MetricsRetention != 168*time.Hour || cfg.MaxDeadlockRecords != 200 ||
+		cfg.AlertWebhooks != "https://hooks.slack.com/services/T000/B000/XXXX" || cfg.KillRoles != "owner,admin,anonymous" {
+		t.Errorf("The example is loaded as %+v", cfg)
+	}
+	for key, source := range map[string]string{"graphite_addr": SourceFile, "config_dir": SourceFlag, "smtp_user": SourceDefault} {
+		if cfg.sources[key] != source {
+			t.Errorf("The source of %s should be %s, got %s", key, source, cfg.sources[key])
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "monitor.yaml")
+	for _, c := range []struct {
+		content string
+		items   map[string]string
+		invalid bool
+	}{
+		{
+			content: "---\n# roles\nkill_roles: owner,admin  # comment\n\nsmtp_from: 'MySQL Monitor <mysql@example.com>'\n" +
+				"smtp_to: \"dba@example.com, ops@example.com\" # comment\nsmtp_user:\nsmtp_addr: ~\nalert_webhooks: http://hooks.example.com/a#b\n",
+			items: map[string]string{
+				"kill_roles":     "owner,admin",
+				"smtp_from":      "MySQL Monitor <mysql@example.com>",
+				"smtp_to":        "dba@example.com, ops@example.com",
+				"smtp_user":      "",
+				"smtp_addr":      "",
+				"alert_webhooks": "http://hooks.example.com/a#b",
+			},
+		},
+		{content: "smtp_from: 'it''s me'\nsmtp_to: \"a\\\"b\"\n", items: map[string]string{"smtp_from": "it's me", "smtp_to": `a"b`}},
+		{content: "alert:\n  smtp_addr: smtp.example.com:25\n", invalid: true},
+		{content: "kill_roles:\n- owner\n- admin\n", invalid: true},
+		{content: "kill_roles: [owner, admin]\n", invalid: true},
+		{content: "smtp_from: 'unterminated\n", invalid: true},
+		{content: "smtp_from: \"a\" b\n", invalid: true},
+		{content: "smtp_from\n", invalid: true},
+		{content: "smtp_from: a\nsmtp_from: b\n", invalid: true},
+	} {
+		if err = ioutil.WriteFile(fileName, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		items, err := loadConfigFile(fileName)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%q should be invalid, got %v", c.content, items)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(items, c.items) {
+			t.Errorf("%q should be loaded as %v, got %v %v", c.content, c.items, items, err)
+		}
+	}
+
+	// The env overrides the file, and the flag overrides the env
+	content := "config_dir: " + dir + "\ninspect_interval: 5s\nreport_interval: 2m\nconn_timeout: 2s\n"
+	if err = ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"MONITOR_REPORT_INTERVAL": "3m", "MONITOR_CONN_TIMEOUT": "3s"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	cfg, err := loadConfig("-config="+fileName, "-conn-timeout=4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InspectInterval != 5*time.Second || cfg.ReportInterval != 3*time.Minute || cfg.ConnTimeout != 4*time.Second {
+		t.Errorf("The intervals are %s, %s and %s", cfg.InspectInterval, cfg.ReportInterval, cfg.ConnTimeout)
+	}
+	if _, err = loadConfig("-config=" + filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("A missing config file given by -config should fail")
+	}
+}
@@ -0,0 +1,489 @@
+package monitor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericpai/msops"
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/gtid"
+	"github.com/laincloud/mysql-service/secret"
+)
+
+const (
+	keyDBAPassword  = "dba_passwd"
+	keyReplPassword = "repl_passwd"
+
+	// credentialOverride is the file in ConfigDir saving the rotated passwords
+	credentialOverride = "credentials"
+	passwordLength     = 24
+	passwordChars      = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	rotateVerifyTime   = 15 * time.Second
+	rotateCheckTime    = time.Second
+)
+
+// rotatedPassword is a password changed by monitor, which overrides the one in the secret file
+// until the secret file is changed by the operator
+type rotatedPassword struct {
+	Password string
+	// BaseHash is the sha256 of the password in the secret file when rotated
+	BaseHash string
+	Rotated  time.Time
+}
+
+// CredentialView is the source of the password of a MySQL user shown on the config page
+type CredentialView struct {
+	User    string
+	Action  PatchAction
+	Source  string
+	Rotated string
+}
+
+// credentialManager keeps the secrets read from the secret file and the rotated passwords.
+// It is read by the web controllers and monitor concurrently.
+type credentialManager struct {
+	sync.RWMutex
+	secrets map[string]string
+	modTime time.Time
+	rotated map[string]rotatedPassword
+}
+
+var credentials = &credentialManager{
+	secrets: make(map[string]string),
+	rotated: make(map[string]rotatedPassword),
+}
+
+// Secret returns the value of key in the secret file, e.g. client_id
+func Secret(key string) string {
+	return credentials.get(key)
+}
+
+// CredentialStatus returns where the passwords of dba and repl come from
+func CredentialStatus() []CredentialView {
+	credentials.RLock()
+	defer credentials.RUnlock()
+	views := make([]CredentialView, 0, 2)
+	for _, user := range []struct {
+		name   string
+		key    string
+		action PatchAction
+	}{{conf.DBAUser, keyDBAPassword, ActionRotateDBA}, {conf.ReplUser, keyReplPassword, ActionRotateRepl}} {
+		view := CredentialView{User: user.name, Action: user.action, Source: conf.SecretFile}
+		if rotated, exist := credentials.rotated[user.key]; exist {
+			view.Source = conf.path(credentialOverride)
+			view.Rotated = rotated.Rotated.Format("2006-01-02 15:04:05")
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+func (cm *credentialManager) get(key string) string {
+	cm.RLock()
+	defer cm.RUnlock()
+	if rotated, exist := cm.rotated[key]; exist {
+		return rotated.Password
+	}
+	return cm.secrets[key]
+}
+
+func dbaPassword() string {
+	return credentials.get(keyDBAPassword)
+}
+
+func replPassword() string {
+	return credentials.get(keyReplPassword)
+}
+
+// load reads the secret file if it is modified, and the rotated passwords on the first call.
+// It returns true if the password of dba or repl is changed.
+func (cm *credentialManager) load() bool {
+	info, err := os.Stat(conf.SecretFile)
+	if err != nil {
+		glog.Errorf("Cann't open secret file: %s", conf.SecretFile)
+		return false
+	}
+	cm.Lock()
+	defer cm.Unlock()
+	if info.ModTime().Equal(cm.modTime) {
+		return false
+	}
+	secrets, err := secret.ReadFile(conf.SecretFile)
+	if err != nil {
+		glog.Errorf("Read secret file failed: %s", err.Error())
+		return false
+	}
+	first := cm.modTime.IsZero()
+	if first {
+		if data, err := ioutil.ReadFile(conf.path(credentialOverride)); err == nil {
+			if err = json.Unmarshal(data, &cm.rotated); err != nil {
+				glog.Errorf("Unmarshal rotated passwords failed: %s", err.Error())
+			}
+		} else if !os.IsNotExist(err) {
+			glog.Errorf("Read rotated passwords failed: %s", err.Error())
+		}
+	}
+	prevDBA, prevRepl := cm.effective(keyDBAPassword), cm.effective(keyReplPassword)
+	cm.secrets, cm.modTime = secrets, info.ModTime()
+	// A rotated password is obsolete once the operator updates the secret file
+	discarded := false
+	for key, rotated := range cm.rotated {
+		if rotated.BaseHash != hashSecret(secrets[key]) {
+			glog.Infof("%s in the secret file is changed, the rotated one is discarded", key)
+			delete(cm.rotated, key)
+			discarded = true
+		}
+	}
+	if discarded {
+		cm.saveRotated()
+	}
+	if !first {
+		glog.Info("Secret file is reloaded")
+	}
+	return !first && (prevDBA != cm.effective(keyDBAPassword) || prevRepl != cm.effective(keyReplPassword))
+}
+
+// effective returns the password of key. The caller must hold the lock.
+func (cm *credentialManager) effective(key string) string {
+	if rotated, exist := cm.rotated[key]; exist {
+		return rotated.Password
+	}
+	return cm.secrets[key]
+}
+
+// setRotated overrides the password of key and saves it to ConfigDir
+func (cm *credentialManager) setRotated(key, password string) error {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.rotated[key] = rotatedPassword{
+		Password: password,
+		BaseHash: hashSecret(cm.secrets[key]),
+		Rotated:  time.Now(),
+	}
+	return cm.saveRotated()
+}
+
+// saveRotated saves the rotated passwords. The caller must hold the lock.
+func (cm *credentialManager) saveRotated() error {
+	data, _ := json.Marshal(cm.rotated)
+	err := ioutil.WriteFile(conf.path(credentialOverride), data, 0600)
+	if err != nil {
+		glog.Errorf("Save rotated passwords failed: %s", err.Error())
+	}
+	return err
+}
+
+func hashSecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// registerInstance registers endpoint to msops with the current passwords. msops adds its own parameters to
+// the map, so it gets a copy of connParam, which is read by the sessions outside the main loop.
+func registerInstance(endpoint string) error {
+	params := make(map[string]string, len(connParam))
+	for key, value := range connParam {
+		params[key] = value
+	}
+	return msops.Register(endpoint, conf.DBAUser, dbaPassword(), conf.ReplUser, replPassword(), params)
+}
+
+// reregisterAll reconnects to all the registered instances with the current passwords
+func (monitor *MySQLMonitor) reregisterAll() {
+	endpoints := make([]string, 0, len(monitor.slave)+2)
+	if monitor.master != "" {
+		endpoints = append(endpoints, monitor.master)
+	}
+	if monitor.standby != "" {
+		endpoints = append(endpoints, monitor.standby)
+	}
+	for endpoint := range monitor.slave {
+		endpoints = append(endpoints, endpoint)
+	}
+	for _, endpoint := range endpoints {
+		msops.Unregister(endpoint)
+		if err := registerInstance(endpoint); err != nil {
+			glog.Errorf("Register %s with new credentials failed: %s", endpoint, err.Error())
+		}
+	}
+	glog.Infof("%d instances are registered with new credentials", len(endpoints))
+}
+
+// replicas returns the registered instances configured to replicate from another instance,
+// including the master if it replicates from the standby
+func (monitor *MySQLMonitor) replicas() []string {
+	var endpoints []string
+	candidates := []string{monitor.master, monitor.standby}
+	for endpoint := range monitor.slave {
+		candidates = append(candidates, endpoint)
+	}
+	for _, endpoint := range candidates {
+		if endpoint == "" {
+			continue
+		}
+		if slaveSt, err := msops.GetSlaveStatus(endpoint); err == nil && slaveSt.MasterHost != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// rotation is a password rotation waiting for the instances to replicate the new password
+type rotation struct {
+	req  PatchRequest
+	user string
+	// oldDBAPassword is the password of dba before the rotation, which the instances accept until
+	// they replicate the change
+	oldDBAPassword string
+	// masterSet is gtid_executed of master after the password is changed, or nil if it's unknown
+	masterSet gtid.Set
+	// others are the registered instances except master, and replicas are the ones replicating
+	others   []string
+	replicas []string
+	// failed are the replicas whose replication password is not changed
+	failed []string
+}
+
+// rotationProgress is sent by watchRotation to the main loop
+type rotationProgress struct {
+	// Replicated are the instances to be reconnected with the new password
+	Replicated []string
+	// Done is true once the rotation is verified, and Failed are the instances not working with it
+	Done   bool
+	Failed []string
+}
+
+// rotatePassword changes the password of user on master, which is replicated to the other instances.
+// The new password of repl is set to every replica by CHANGE MASTER TO. The new password is saved in
+// ConfigDir, and should be copied to the secret file by the operator. Master is reconnected with the new
+// password at once, while the other instances are waited for and the rotation is verified by watchRotation
+// outside the main loop. The request is answered by updateRotation after that.
+func (monitor *MySQLMonitor) rotatePassword(req PatchRequest, user, key string) (int, error) {
+	if monitor.master == "" {
+		return http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	if monitor.rotating != nil {
+		return http.StatusConflict, fmt.Errorf("The password of %s is being rotated", monitor.rotating.user)
+	}
+	password, err := newPassword()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	r := &rotation{req: req, user: user, oldDBAPassword: dbaPassword()}
+	glog.Infof("Rotate the password of %s", user)
+	if err = execInSession(monitor.master, fmt.Sprintf("SET PASSWORD FOR '%s'@'%%' = PASSWORD('%s')", user, password)); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Change password on master failed: %s", err.Error())
+	}
+	if err = credentials.setRotated(key, password); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Password is changed and used by monitor, but not saved: %s", err.Error())
+	}
+	r.replicas = monitor.replicas()
+	if key == keyReplPassword {
+		for _, endpoint := range r.replicas {
+			if err := execInSession(endpoint, "STOP SLAVE",
+				fmt.Sprintf("CHANGE MASTER TO MASTER_USER='%s', MASTER_PASSWORD='%s'", user, password), "START SLAVE"); err != nil {
+				glog.Errorf("Change replication password of %s failed: %s", endpoint, err.Error())
+				r.failed = append(r.failed, endpoint)
+			}
+		}
+	}
+
+	monitor.reregister(monitor.master)
+	variables, err := msops.GetGlobalVariables(monitor.master, "gtid_executed")
+	if err == nil {
+		r.masterSet, err = gtid.Parse(variables["gtid_executed"])
+	}
+	if err != nil {
+		glog.Errorf("Get gtid_executed of master failed, the instances are registered without waiting: %s", err.Error())
+	}
+	for _, endpoint := range monitor.registered() {
+		if endpoint != monitor.master {
+			r.others = append(r.others, endpoint)
+		}
+	}
+	monitor.rotating = r
+	go monitor.watchRotation(*r, monitor.master)
+	return http.StatusAccepted, nil
+}
+
+// watchRotation waits for each instance other than master to execute masterSet, which includes the password
+// changed on master, and sends it to the main loop to be reconnected. Until then the instance still accepts the
+// old password only. The instances not caught up in rotateVerifyTime are reconnected anyway. At last it verifies
+// the rotation. It runs outside the main loop, so it uses its own sessions instead of msops.
+func (monitor *MySQLMonitor) watchRotation(r rotation, master string) {
+	pending := make(map[string]bool, len(r.others))
+	for _, endpoint := range r.others {
+		pending[endpoint] = true
+	}
+	deadline := time.Now().Add(rotateVerifyTime)
+	for len(pending) > 0 {
+		var replicated []string
+		for endpoint := range pending {
+			if r.masterSet != nil && time.Now().Before(deadline) && !executedSet(endpoint, r.oldDBAPassword, r.masterSet) {
+				continue
+			}
+			replicated = append(replicated, endpoint)
+			delete(pending, endpoint)
+		}
+		if len(replicated) > 0 {
+			monitor.rotationChan <- rotationProgress{Replicated: replicated}
+		}
+		if len(pending) > 0 {
+			time.Sleep(rotateCheckTime)
+		}
+	}
+	failed := r.failed
+	if len(failed) == 0 {
+		failed = verifyRotation(append([]string{master}, r.others...), r.replicas)
+	}
+	monitor.rotationChan <- rotationProgress{Done: true, Failed: failed}
+}
+
+// updateRotation reconnects the instances which have replicated the new password, and answers the
+// request of the rotation once it's verified
+func (monitor *MySQLMonitor) updateRotation(progress rotationProgress) {
+	r := monitor.rotating
+	if r == nil {
+		return
+	}
+	registered := make(map[string]bool)
+	for _, endpoint := range monitor.registered() {
+		registered[endpoint] = true
+	}
+	for _, endpoint := range progress.Replicated {
+		// The instances unregistered during the rotation are registered again with the new password
+		if registered[endpoint] {
+			monitor.reregister(endpoint)
+		}
+	}
+	if !progress.Done {
+		return
+	}
+	glog.Infof("%d instances are registered with new credentials", len(registered))
+	resp := PatchResponse{Code: http.StatusAccepted}
+	if len(progress.Failed) > 0 {
+		resp.Code = http.StatusInternalServerError
+		resp.Err = fmt.Errorf("Password of %s is rotated, but %s are not working with it", r.user, strings.Join(progress.Failed, ", "))
+	}
+	monitor.rotating = nil
+	audit(r.req, resp.Err)
+	r.req.ResponseChan <- resp
+}
+
+// reregister reconnects to endpoint with the current passwords
+func (monitor *MySQLMonitor) reregister(endpoint string) {
+	msops.Unregister(endpoint)
+	if err := registerInstance(endpoint); err != nil {
+		glog.Errorf("Register %s with new credentials failed: %s", endpoint, err.Error())
+	}
+}
+
+// executedSet reports whether endpoint has executed set. It connects with the password of dba before the
+// rotation, which is denied once the change is replicated. Any error is reported as executed, so that the
+// instances which can't be checked are not waited for.
+func executedSet(endpoint, password string, set gtid.Set) bool {
+	db, err := openSessionAs(endpoint, password, nil)
+	if err != nil {
+		return true
+	}
+	defer db.Close()
+	var name, value string
+	if err = db.QueryRow("SHOW GLOBAL VARIABLES LIKE 'gtid_executed'").Scan(&name, &value); err != nil {
+		return true
+	}
+	executed, err := gtid.Parse(value)
+	return err != nil || executed.ContainsSet(set)
+}
+
+// verifyRotation waits until all the instances are connected and all the replicas are replicating with
+// the new passwords, and returns the ones which are not
+func verifyRotation(instances, replicas []string) []string {
+	deadline := time.Now().Add(rotateVerifyTime)
+	for {
+		var failed []string
+		for _, endpoint := range instances {
+			if err := pingSession(endpoint); err != nil {
+				failed = append(failed, endpoint)
+			}
+		}
+		for _, endpoint := range replicas {
+			if running, err := slaveRunning(endpoint); err != nil || !running {
+				failed = append(failed, endpoint)
+			}
+		}
+		if len(failed) == 0 || time.Now().After(deadline) {
+			return failed
+		}
+		time.Sleep(rotateCheckTime)
+	}
+}
+
+// pingSession connects to endpoint with the current password of dba
+func pingSession(endpoint string) error {
+	db, err := openSession(endpoint)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+// slaveRunning reports whether both the IO thread and the SQL thread of endpoint are running
+func slaveRunning(endpoint string) (bool, error) {
+	db, err := openSession(endpoint)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return false, err
+	}
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return false, err
+	}
+	running := 0
+	for i, column := range columns {
+		if (column == "Slave_IO_Running" || column == "Slave_SQL_Running") && values[i].String == "Yes" {
+			running++
+		}
+	}
+	return running == 2, nil
+}
+
+func newPassword() (string, error) {
+	password := make([]byte, passwordLength)
+	max := big.NewInt(int64(len(passwordChars)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
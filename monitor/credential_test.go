@@ -0,0 +1,108 @@
+package monitor
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ericpai/msops"
+)
+
+func TestRotateReplPassword(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(true)
+	master, standby, slave := c.servers[0], c.servers[1], c.servers[2]
+	master.Commit(1)
+
+	c.mustAccept(c.rotate(conf.ReplUser, keyReplPassword, nil))
+	password := replPassword()
+	if password == testReplPassword || len(password) != passwordLength {
+		t.Fatalf("Password of repl is not rotated: %q", password)
+	}
+	if _, err := os.Stat(conf.path(credentialOverride)); err != nil {
+		t.Errorf("Rotated password is not saved: %s", err.Error())
+	}
+
+	master.Commit(1)
+	for _, endpoint := range []string{standby.Addr(), slave.Addr()} {
+		if st := msops.CheckReplication(endpoint, master.Addr()); st != msops.ReplicationOK {
+			t.Errorf("Replication of %s is %d after rotating", endpoint, st)
+		}
+	}
+}
+
+func TestRotateDBAPasswordWaitsForReplicas(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(true)
+	master, slave := c.servers[0], c.servers[2]
+	master.Commit(1)
+	// The slave gets the new password only after its lag is gone
+	slave.SetReplicationLag(10)
+	time.AfterFunc(2*rotateCheckTime, func() { slave.SetReplicationLag(0) })
+
+	c.mustAccept(c.rotate(conf.DBAUser, keyDBAPassword, func(progress rotationProgress) {
+		for _, endpoint := range progress.Replicated {
+			if endpoint == slave.Addr() && slave.ReplicationLag() != 0 {
+				t.Errorf("The slave is registered with the new password before it's replicated")
+			}
+		}
+	}))
+	if st := msops.CheckInstance(slave.Addr()); st != msops.InstanceOK {
+		t.Errorf("The slave is %d after rotating", st)
+	}
+	if executed := slave.ExecutedGTIDSet(); executed != master.ExecutedGTIDSet() {
+		t.Errorf("The slave should catch up with the password change, got %s", executed)
+	}
+}
+
+func TestRotatedPasswordDiscarded(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	c.mustAccept(register(c.servers[0].Addr(), ActionRegisterMaster))
+	c.mustAccept(c.rotate(conf.DBAUser, keyDBAPassword, nil))
+	if dbaPassword() == testDBAPassword {
+		t.Fatalf("Password of dba is not rotated")
+	}
+
+	// The operator copies another password to the secret file
+	secrets := "dba_passwd=changed-by-operator\nrepl_passwd=" + testReplPassword + "\n"
+	if err := writeSecretFile(secrets); err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.load() {
+		t.Errorf("Changing the secret file should change the credentials")
+	}
+	if password := dbaPassword(); password != "changed-by-operator" {
+		t.Errorf("Password in the changed secret file should be used, got %q", password)
+	}
+}
+
+// rotate rotates the password of user, and runs the main loop for the progress of the rotation until the
+// request is answered. Each progress is passed to check if it's not nil.
+func (c *testCluster) rotate(user, key string, check func(rotationProgress)) (int, error) {
+	c.t.Helper()
+	req := PatchRequest{Action: ActionRotateDBA, ResponseChan: make(chan PatchResponse, 1)}
+	if code, err := msMonitor.rotatePassword(req, user, key); err != nil {
+		return code, err
+	}
+	if code, err := msMonitor.rotatePassword(req, user, key); code != http.StatusConflict {
+		c.t.Errorf("A second rotation should be conflicted, got %d: %v", code, err)
+	}
+	timeout := time.After(2*rotateVerifyTime + 5*time.Second)
+	for {
+		select {
+		case progress := <-msMonitor.rotationChan:
+			if check != nil {
+				check(progress)
+			}
+			msMonitor.updateRotation(progress)
+		case resp := <-req.ResponseChan:
+			return resp.Code, resp.Err
+		case <-timeout:
+			c.t.Fatalf("The rotation of %s is not finished", user)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package monitor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// maxDBUserLength is the limit of user names of MySQL 5.6
+	maxDBUserLength = 16
+	maxDatabaseName = 64
+	// appPrivileges are the privileges granted to the user of an application on its database
+	appPrivileges = "SELECT, INSERT, UPDATE, DELETE, CREATE, DROP, INDEX, ALTER, CREATE TEMPORARY TABLES, " +
+		"LOCK TABLES, EXECUTE, CREATE VIEW, SHOW VIEW, CREATE ROUTINE, ALTER ROUTINE, EVENT, TRIGGER, REFERENCES"
+)
+
+var (
+	identifierExp   = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	systemDatabases = []string{"information_schema", "mysql", "performance_schema", "sys"}
+)
+
+// DatabaseView is an application database on master and the users granted on it
+type DatabaseView struct {
+	Name     string
+	Size     int64
+	SizeText string
+	Users    []string
+	// Connections is the number of connections of the users, and Quota is nil if it's unlimited
+	Connections int
+	Quota       *Quota
+	MaxSizeText string
+	// QuotaAlert is the summary of the quota exceeded in the last check
+	QuotaAlert string
+	// accounts are the user@host granted on the database, one user may have several hosts
+	accounts []dbAccount
+}
+
+// dbAccount is an account granted on an application database, with the writePrivileges it holds
+type dbAccount struct {
+	User   string
+	Host   string
+	Writes []string
+}
+
+// AccountView is the user of an application database returned when it's created or its password
+// is rotated. The password is not saved by monitor, so it's only shown once.
+type AccountView struct {
+	User     string
+	Database string
+	Password string
+}
+
+func isSystemDatabase(name string) bool {
+	for _, db := range systemDatabases {
+		if name == db {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDatabase(name string) error {
+	if !identifierExp.MatchString(name) || len(name) > maxDatabaseName {
+		return fmt.Errorf("Invalid database name %q, which should be lower case letters, digits and underscores", name)
+	}
+	if isSystemDatabase(name) {
+		return fmt.Errorf("Database %s is reserved", name)
+	}
+	return nil
+}
+
+func validateDBUser(user string) error {
+	if !identifierExp.MatchString(user) || len(user) > maxDBUserLength {
+		return fmt.Errorf("Invalid user name %q, which should be at most %d lower case letters, digits and underscores", user, maxDBUserLength)
+	}
+	if isSysUser(user) {
+		return fmt.Errorf("User %s is reserved", user)
+	}
+	return nil
+}
+
+// grantName escapes the wildcards "_" in the database name of GRANT, which is also how the name is
+// saved in mysql.db
+func grantName(database string) string {
+	return strings.Replace(database, "_", `\_`, -1)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// appDatabases returns the databases except the system ones, and the accounts granted on each database
+// with the writePrivileges they hold
+func appDatabases(db *sql.DB) ([]DatabaseView, error) {
+	rows, err := db.Query("SELECT s.SCHEMA_NAME, COALESCE(SUM(t.DATA_LENGTH + t.INDEX_LENGTH), 0) " +
+		"FROM information_schema.SCHEMATA s LEFT JOIN information_schema.TABLES t ON t.TABLE_SCHEMA = s.SCHEMA_NAME " +
+		"GROUP BY s.SCHEMA_NAME")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var databases []DatabaseView
+	index := make(map[string]int)
+	for rows.Next() {
+		var view DatabaseView
+		if err = rows.Scan(&view.Name, &view.Size); err != nil {
+			return nil, err
+		}
+		if isSystemDatabase(view.Name) {
+			continue
+		}
+		view.SizeText = formatSize(view.Size)
+		index[view.Name] = len(databases)
+		databases = append(databases, view)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	columns := []string{"User", "Host", "Db"}
+	for _, privilege := range writePrivileges {
+		columns = append(columns, privilege.column)
+	}
+	grants, err := db.Query(fmt.Sprintf("SELECT %s FROM mysql.db", strings.Join(columns, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	defer grants.Close()
+	values := make([]string, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for grants.Next() {
+		if err = grants.Scan(dest...); err != nil {
+			return nil, err
+		}
+		i, exist := index[strings.Replace(values[2], `\_`, "_", -1)]
+		if !exist {
+			continue
+		}
+		account := dbAccount{User: values[0], Host: values[1]}
+		for j, privilege := range writePrivileges {
+			if values[3+j] == "Y" {
+				account.Writes = append(account.Writes, privilege.name)
+			}
+		}
+		if !containsString(databases[i].Users, account.User) {
+			databases[i].Users = append(databases[i].Users, account.User)
+		}
+		databases[i].accounts = append(databases[i].accounts, account)
+	}
+	sort.Slice(databases, func(i, j int) bool { return databases[i].Name < databases[j].Name })
+	return databases, grants.Err()
+}
+
+// checkDBAPrivileges checks that dba has CREATE USER and appPrivileges WITH GRANT OPTION ON *.*. They are
+// granted when an instance is initialized, and by tools/grant_dba.sh on the clusters initialized before.
+func checkDBAPrivileges(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT PRIVILEGE_TYPE, IS_GRANTABLE FROM information_schema.USER_PRIVILEGES " +
+		`WHERE GRANTEE = CONCAT("'", REPLACE(CURRENT_USER(), "@", "'@'"), "'")`)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+	granted := make(map[string]bool)
+	for rows.Next() {
+		var privilege, grantable string
+		if err = rows.Scan(&privilege, &grantable); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		granted[privilege] = privilege == "CREATE USER" || grantable == "YES"
+	}
+	if err = rows.Err(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var missing []string
+	for _, privilege := range append([]string{"CREATE USER"}, strings.Split(appPrivileges, ", ")...) {
+		if !granted[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+	if len(missing) > 0 {
+		return http.StatusForbidden, fmt.Errorf("%s lacks %s ON *.* WITH GRANT OPTION, run /lain/app/tools/grant_dba.sh "+
+			"in the container of master to grant the privileges", conf.DBAUser, strings.Join(missing, ", "))
+	}
+	return http.StatusOK, nil
+}
+
+// dbUsers returns all the users of MySQL
+func dbUsers(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT User FROM mysql.user")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]bool)
+	for rows.Next() {
+		var user string
+		if err = rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users[user] = true
+	}
+	return users, rows.Err()
+}
+
+// getDatabases returns the application databases on master
+func getDatabases() ([]byte, int, error) {
+	if msMonitor.master == "" {
+		return nil, http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	db, err := openSession(msMonitor.master)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	databases, err := appDatabases(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	connections := userConnections()
+	for i := range databases {
+		for _, user := range databases[i].Users {
+			databases[i].Connections += connections[user]
+		}
+		if quota := msMonitor.quotas[databases[i].Name]; quota != nil {
+			databases[i].Quota, databases[i].MaxSizeText = quota, formatSize(quota.MaxSize)
+		}
+		databases[i].QuotaAlert = msMonitor.quotaAlerts[databases[i].Name]
+	}
+	data, err := json.Marshal(databases)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// manageDatabase handles the database actions of req on master, if the role of req is in DatabaseRoles
+func (monitor *MySQLMonitor) manageDatabase(req PatchRequest) ([]byte, int, error) {
+	if !roleAllowed(req.Role, conf.DatabaseRoles) {
+		return nil, http.StatusForbidden, fmt.Errorf("Role %s is not allowed to manage databases", req.Role)
+	}
+	switch req.Action {
+	case ActionCreateDatabase:
+		return createDatabase(req.Params["name"], req.Params["user"])
+	case ActionRotateDBUser:
+		return rotateDBUser(req.Params["user"])
+	case ActionDropDBUser:
+		code, err := dropDBUser(req.Params["user"])
+		return nil, code, err
+	default:
+		code, err := monitor.setQuota(req.Params["name"], req.Params)
+		return nil, code, err
+	}
+}
+
+// createDatabase creates the database and its user on master, which are replicated to the other
+// instances. The user is the database name if it's empty, and is granted appPrivileges on the database.
+func createDatabase(name, user string) ([]byte, int, error) {
+	if user == "" {
+		user = name
+	}
+	if err := validateDatabase(name); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := validateDBUser(user); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if msMonitor.master == "" {
+		return nil, http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	db, err := openSession(msMonitor.master)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	if code, err := checkDBAPrivileges(db); err != nil {
+		return nil, code, err
+	}
+	databases, err := appDatabases(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for _, database := range databases {
+		if database.Name == name {
+			return nil, http.StatusConflict, fmt.Errorf("Database %s already exists", name)
+		}
+	}
+	users, err := dbUsers(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if users[user] {
+		return nil, http.StatusConflict, fmt.Errorf("User %s already exists", user)
+	}
+	password, err := newPassword()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	glog.Infof("Create database %s with user %s", name, user)
+	if _, err = db.Exec(fmt.Sprintf("CREATE DATABASE `%s` DEFAULT CHARACTER SET utf8mb4", name)); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE USER '%s'@'%%' IDENTIFIED BY '%s'", user, password),
+		fmt.Sprintf("GRANT %s ON `%s`.* TO '%s'@'%%'", appPrivileges, grantName(name), user),
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			// The database is just created and empty, so it's dropped with the user to allow retrying
+			db.Exec(fmt.Sprintf("DROP USER '%s'@'%%'", user))
+			db.Exec(fmt.Sprintf("DROP DATABASE `%s`", name))
+			return nil, http.StatusInternalServerError, fmt.Errorf("Create user %s failed: %s", user, err.Error())
+		}
+	}
+	data, _ := json.Marshal(AccountView{User: user, Database: name, Password: password})
+	return data, http.StatusAccepted, nil
+}
+
+// appUser returns the database of the application user, or an error if user is not granted on
+// any application database, so that the users not created by monitor are never changed
+func appUser(db *sql.DB, user string) (string, int, error) {
+	if err := validateDBUser(user); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	databases, err := appDatabases(db)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	for _, database := range databases {
+		for _, u := range database.Users {
+			if u == user {
+				return database.Name, http.StatusOK, nil
+			}
+		}
+	}
+	return "", http.StatusNotFound, fmt.Errorf("User %s is not found in the application databases", user)
+}
+
+// rotateDBUser changes the password of the application user on master
+func rotateDBUser(user string) ([]byte, int, error) {
+	if msMonitor.master == "" {
+		return nil, http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	db, err := openSession(msMonitor.master)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	if code, err := checkDBAPrivileges(db); err != nil {
+		return nil, code, err
+	}
+	database, code, err := appUser(db, user)
+	if err != nil {
+		return nil, code, err
+	}
+	password, err := newPassword()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	glog.Infof("Rotate the password of %s", user)
+	if _, err = db.Exec(fmt.Sprintf("SET PASSWORD FOR '%s'@'%%' = PASSWORD('%s')", user, password)); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	data, _ := json.Marshal(AccountView{User: user, Database: database, Password: password})
+	return data, http.StatusAccepted, nil
+}
+
+// dropDBUser drops the application user on master. The database is kept with its data.
+func dropDBUser(user string) (int, error) {
+	if msMonitor.master == "" {
+		return http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	db, err := openSession(msMonitor.master)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	if code, err := checkDBAPrivileges(db); err != nil {
+		return code, err
+	}
+	if _, code, err := appUser(db, user); err != nil {
+		return code, err
+	}
+	glog.Infof("Drop user %s", user)
+	if _, err = db.Exec(fmt.Sprintf("DROP USER '%s'@'%%'", user)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusAccepted, nil
+}
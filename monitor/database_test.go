@@ -0,0 +1,123 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProvisionDatabase(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master := c.servers[0]
+	master.SetDatabaseSize("legacy", 2048)
+
+	for _, params := range [][2]string{{"Orders", ""}, {"mysql", "app"}, {"orders", "dba"}, {"orders", "a_very_long_user_name"}, {"legacy", "legacy"}} {
+		if _, code, err := createDatabase(params[0], params[1]); err == nil {
+			t.Errorf("Database %s with user %s should be rejected", params[0], params[1])
+		} else if params[0] == "legacy" && code != http.StatusConflict {
+			t.Errorf("Creating an existing database should conflict, got %d", code)
+		}
+	}
+
+	// The cluster initialized before dba has the privileges to manage the databases is told how to upgrade
+	master.SetGlobalPrivileges(conf.DBAUser, false, "RELOAD", "PROCESS", "SUPER", "CREATE USER", "SELECT")
+	if _, code, err := createDatabase("shop_orders", ""); code != http.StatusForbidden || !strings.Contains(err.Error(), "grant_dba.sh") ||
+		!strings.Contains(err.Error(), "SELECT, INSERT") {
+		t.Errorf("Creating a database without the privileges of dba should be forbidden, got %d %v", code, err)
+	}
+	if _, exist := master.Database("shop_orders"); exist {
+		t.Errorf("The database should not be created without the privileges of dba")
+	}
+	master.SetGlobalPrivileges(conf.DBAUser, true, append([]string{"CREATE USER"}, strings.Split(appPrivileges, ", ")...)...)
+
+	data, code, err := createDatabase("shop_orders", "")
+	c.mustAccept(code, err)
+	var account AccountView
+	if err = json.Unmarshal(data, &account); err != nil {
+		t.Fatal(err)
+	}
+	password, granted, exist := master.Account("shop_orders")
+	if !exist || account.User != "shop_orders" || account.Password == "" || password != account.Password {
+		t.Fatalf("Unexpected account %+v, the password on master is %q", account, password)
+	}
+	if len(granted) != 1 || granted[0] != `shop\_orders` {
+		t.Errorf("The user should be granted on its database only, got %v", granted)
+	}
+	if _, code, err = createDatabase("other", "shop_orders"); code != http.StatusConflict {
+		t.Errorf("Creating an existing user should conflict, got %d %v", code, err)
+	}
+	if _, exist = master.Database("other"); exist {
+		t.Errorf("The database should not be created if the user exists")
+	}
+
+	data, code, err = getDatabases()
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("Get databases failed: %d %v", code, err)
+	}
+	var databases []DatabaseView
+	json.Unmarshal(data, &databases)
+	if len(databases) != 2 || databases[0].Name != "legacy" || databases[0].SizeText != formatSize(2048) ||
+		databases[1].Name != "shop_orders" || len(databases[1].Users) != 1 || databases[1].Users[0] != "shop_orders" {
+		t.Errorf("Unexpected databases: %+v", databases)
+	}
+
+	data, code, err = rotateDBUser("shop_orders")
+	c.mustAccept(code, err)
+	json.Unmarshal(data, &account)
+	if password, _, _ = master.Account("shop_orders"); password != account.Password || account.Database != "shop_orders" {
+		t.Errorf("The password is not rotated: %+v", account)
+	}
+	if _, code, _ = rotateDBUser("repl"); code != http.StatusBadRequest {
+		t.Errorf("The password of repl should not be rotated as a database user, got %d", code)
+	}
+	master.SetPassword("someone", "secret")
+	if code, _ = dropDBUser("someone"); code != http.StatusNotFound {
+		t.Errorf("The users not granted on application databases should not be dropped, got %d", code)
+	}
+	c.mustAccept(dropDBUser("shop_orders"))
+	if _, _, exist = master.Account("shop_orders"); exist {
+		t.Errorf("The user is not dropped")
+	}
+	if _, exist = master.Database("shop_orders"); !exist {
+		t.Errorf("The database should be kept after its user is dropped")
+	}
+}
+
+func TestDatabaseRoles(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	c.setup(false)
+	master := c.servers[0]
+	master.SetGlobalPrivileges(conf.DBAUser, true, append([]string{"CREATE USER"}, strings.Split(appPrivileges, ", ")...)...)
+
+	patch := func(action PatchAction, role string, params map[string]string) PatchResponse {
+		req := PatchRequest{Action: action, Params: params, Operator: "tester", Role: role, ResponseChan: make(chan PatchResponse, 1)}
+		msMonitor.handlePatch(req)
+		return <-req.ResponseChan
+	}
+	for _, role := range []string{"normal", ""} {
+		for _, action := range []PatchAction{ActionCreateDatabase, ActionRotateDBUser, ActionDropDBUser, ActionSetQuota} {
+			params := map[string]string{"name": "orders", "user": "orders", "max_connections": "10"}
+			if resp := patch(action, role, params); resp.Code != http.StatusForbidden {
+				t.Errorf("Role %q should not %s, got %d %v", role, action, resp.Code, resp.Err)
+			}
+		}
+	}
+	if _, exist := master.Database("orders"); exist {
+		t.Errorf("The database should not be created by a rejected role")
+	}
+
+	if resp := patch(ActionCreateDatabase, "admin", map[string]string{"name": "orders"}); resp.Err != nil {
+		t.Fatalf("Role admin should create databases: %s", resp.Err.Error())
+	}
+	if _, exist := master.Database("orders"); !exist {
+		t.Errorf("The database should be created by role admin")
+	}
+	conf.DatabaseRoles = "owner,admin," + RoleAnonymous
+	if resp := patch(ActionDropDBUser, "", map[string]string{"user": "orders"}); resp.Err != nil {
+		t.Errorf("Anonymous should manage databases once it's added to database_roles: %s", resp.Err.Error())
+	}
+}
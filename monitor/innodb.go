@@ -0,0 +1,124 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/innodb"
+)
+
+// deadlockHistory is the file in ConfigDir saving the deadlocks detected in the instances
+const deadlockHistory = "deadlocks"
+
+// innodbSections are the sections of InnoDB status shown on the details page
+var innodbSections = []string{
+	innodb.SectionDeadlock,
+	innodb.SectionTransactions,
+	innodb.SectionBufferPool,
+	innodb.SectionRowOperations,
+}
+
+// DeadlockRecord is a distinct deadlock detected in an instance
+type DeadlockRecord struct {
+	Endpoint string
+	// Found is when monitor found the deadlock, while Deadlock.Detected is printed by InnoDB
+	Found time.Time
+	innodb.Deadlock
+}
+
+// InnoDBView is the InnoDB status of an instance and its deadlock history, the latest first
+type InnoDBView struct {
+	Sections  []innodb.Section
+	Deadlock  *innodb.Deadlock
+	Deadlocks []DeadlockRecord
+	Error     string
+}
+
+func (monitor *MySQLMonitor) loadDeadlocks() {
+	if data, err := ioutil.ReadFile(conf.path(deadlockHistory)); err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("Load deadlock history failed: %s", err.Error())
+		}
+	} else if err = json.Unmarshal(data, &monitor.deadlocks); err != nil {
+		glog.Errorf("Unmarshal deadlock history failed: %s", err.Error())
+	}
+}
+
+func (monitor *MySQLMonitor) saveDeadlocks() {
+	data, _ := json.Marshal(monitor.deadlocks)
+	if err := ioutil.WriteFile(conf.path(deadlockHistory), data, 0644); err != nil {
+		glog.Errorf("Save deadlock history failed: %s", err.Error())
+	}
+}
+
+// checkDeadlocks records the latest deadlocks of the registered instances which are not recorded yet.
+// InnoDB keeps only the latest deadlock, so the deadlocks between two checks are lost.
+func (monitor *MySQLMonitor) checkDeadlocks() {
+	found := false
+	for _, endpoint := range monitor.registered() {
+		text, err := innodbStatusText(endpoint)
+		if err != nil {
+			glog.V(2).Infof("Get InnoDB status of %s failed: %s", endpoint, err.Error())
+			continue
+		}
+		deadlock := innodb.Parse(text).Deadlock
+		if deadlock == nil || monitor.deadlockRecorded(endpoint, deadlock) {
+			continue
+		}
+		glog.Warningf("Deadlock is detected in %s at %s", endpoint, deadlock.Detected.Format("2006-01-02 15:04:05"))
+		monitor.deadlocks = append(monitor.deadlocks, DeadlockRecord{Endpoint: endpoint, Found: time.Now(), Deadlock: *deadlock})
+		found = true
+	}
+	if !found {
+		return
+	}
+	if len(monitor.deadlocks) > conf.MaxDeadlockRecords {
+		monitor.deadlocks = monitor.deadlocks[len(monitor.deadlocks)-conf.MaxDeadlockRecords:]
+	}
+	monitor.saveDeadlocks()
+}
+
+// deadlockRecorded reports whether the latest recorded deadlock of endpoint is the same one
+func (monitor *MySQLMonitor) deadlockRecorded(endpoint string, deadlock *innodb.Deadlock) bool {
+	for i := len(monitor.deadlocks) - 1; i >= 0; i-- {
+		if record := monitor.deadlocks[i]; record.Endpoint == endpoint {
+			return record.Text == deadlock.Text
+		}
+	}
+	return false
+}
+
+// getInnoDB returns the InnoDB status of the instance. The deadlock history is returned even if the
+// instance is unreachable.
+func getInnoDB(endpoint string) ([]byte, int, error) {
+	var data []byte
+	if _, code, err := getInstance(endpoint); err != nil {
+		return data, code, err
+	}
+	view := InnoDBView{Deadlocks: make([]DeadlockRecord, 0)}
+	if text, err := innodbStatusText(endpoint); err != nil {
+		view.Error = err.Error()
+	} else {
+		status := innodb.Parse(text)
+		for _, name := range innodbSections {
+			if section := status.Section(name); section != "" {
+				view.Sections = append(view.Sections, innodb.Section{Name: name, Text: section})
+			}
+		}
+		view.Deadlock = status.Deadlock
+	}
+	for i := len(msMonitor.deadlocks) - 1; i >= 0; i-- {
+		if msMonitor.deadlocks[i].Endpoint == endpoint {
+			view.Deadlocks = append(view.Deadlocks, msMonitor.deadlocks[i])
+		}
+	}
+	data, err := json.Marshal(view)
+	if err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
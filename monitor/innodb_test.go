@@ -0,0 +1,78 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func innodbStatusWithDeadlock(detected, query string) string {
+	return `
+------------------------
+LATEST DETECTED DEADLOCK
+------------------------
+` + detected + ` 0x7f2b5c0f9700
+*** (1) TRANSACTION:
+TRANSACTION 1234, ACTIVE 2 sec starting index read
+MySQL thread id 10, OS thread handle 139, query id 100 10.0.0.5 app updating
+` + query + `
+*** (1) WAITING FOR THIS LOCK TO BE GRANTED:
+RECORD LOCKS space id 24 page no 3 n bits 72 index PRIMARY of table test.t trx id 1234 lock_mode X waiting
+*** WE ROLL BACK TRANSACTION (1)
+------------
+TRANSACTIONS
+------------
+History list length 12
+--------------
+ROW OPERATIONS
+--------------
+Number of rows inserted 10, updated 5, deleted 0, read 100
+----------------------------
+END OF INNODB MONITOR OUTPUT
+============================
+`
+}
+
+func TestCheckDeadlocks(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0], c.servers[1]
+
+	msMonitor.checkDeadlocks()
+	if len(msMonitor.deadlocks) != 0 {
+		t.Fatalf("No deadlock should be recorded, got %v", msMonitor.deadlocks)
+	}
+	master.SetInnoDBStatus(innodbStatusWithDeadlock("2017-03-01 10:00:00", "UPDATE t SET a = 1 WHERE id = 2"))
+	msMonitor.checkDeadlocks()
+	msMonitor.checkDeadlocks()
+	master.SetInnoDBStatus(innodbStatusWithDeadlock("2017-03-01 11:00:00", "UPDATE t SET a = 2 WHERE id = 1"))
+	msMonitor.checkDeadlocks()
+	if len(msMonitor.deadlocks) != 2 {
+		t.Fatalf("Expected 2 distinct deadlocks, got %v", msMonitor.deadlocks)
+	}
+
+	data, code, err := getInnoDB(master.Addr())
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("Get InnoDB status failed: %d %v", code, err)
+	}
+	var view InnoDBView
+	if err = json.Unmarshal(data, &view); err != nil {
+		t.Fatal(err)
+	}
+	if len(view.Sections) != 3 || view.Deadlock == nil || view.Deadlock.Transactions[0].Query != "UPDATE t SET a = 2 WHERE id = 1" {
+		t.Errorf("Unexpected InnoDB status: %+v", view)
+	}
+	if len(view.Deadlocks) != 2 || view.Deadlocks[0].Detected.Hour() != 11 || view.Deadlocks[1].RolledBack != "1" {
+		t.Errorf("The deadlock history should be the latest first, got %+v", view.Deadlocks)
+	}
+	if data, _, _ = getInnoDB(slave.Addr()); json.Unmarshal(data, &view) != nil || view.Deadlock != nil || len(view.Deadlocks) != 0 {
+		t.Errorf("The slave has no deadlock, got %s", data)
+	}
+
+	msMonitor.deadlocks = nil
+	msMonitor.loadDeadlocks()
+	if len(msMonitor.deadlocks) != 2 || msMonitor.deadlocks[0].Endpoint != master.Addr() {
+		t.Errorf("The deadlock history should be saved, got %v", msMonitor.deadlocks)
+	}
+}
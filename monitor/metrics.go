@@ -0,0 +1,217 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericpai/msops"
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/metrics"
+)
+
+const (
+	// metricsDir in ConfigDir keeps one ring file of samples for each instance
+	metricsDir = "metrics"
+	// chartPoints is the number of points in a chart at most
+	chartPoints = 360
+)
+
+// MetricsRanges are the ranges of the charts on the details page
+var MetricsRanges = []string{"1h", "6h", "24h", "7d"}
+
+var metricsRangeDurations = map[string]time.Duration{
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// metricsSampler keeps the ring of an instance and its last counters, to derive the rates from
+type metricsSampler struct {
+	ring     *metrics.Ring
+	counters map[string]float64
+	sampled  time.Time
+}
+
+// metricsCapacity is the number of samples kept for each instance
+func (cfg Config) metricsCapacity() int {
+	return int(cfg.MetricsRetention / cfg.MetricsInterval)
+}
+
+// metricsFile returns the path of the ring file of an instance
+func metricsFile(endpoint string) string {
+	return conf.path(metricsDir + "/" + strings.NewReplacer(":", "_", "/", "_").Replace(endpoint) + ".ring")
+}
+
+// sampleMetrics appends a sample of every registered instance to its ring. The rings of the
+// unregistered instances are closed, while their files are kept for the history.
+func (monitor *MySQLMonitor) sampleMetrics() {
+	now := time.Now()
+	registered := make(map[string]bool)
+	for _, endpoint := range monitor.registered() {
+		registered[endpoint] = true
+		sampler, exist := monitor.samplers[endpoint]
+		if !exist {
+			if err := os.MkdirAll(conf.path(metricsDir), 0755); err != nil {
+				glog.Errorf("Create metrics directory failed: %s", err.Error())
+				return
+			}
+			ring, err := metrics.OpenRing(metricsFile(endpoint), conf.metricsCapacity())
+			if err != nil {
+				glog.Errorf("Open metrics of %s failed: %s", endpoint, err.Error())
+				continue
+			}
+			sampler = &metricsSampler{ring: ring}
+			monitor.samplers[endpoint] = sampler
+		}
+		sample, err := sampler.sample(endpoint, endpoint == monitor.master, now)
+		if err != nil {
+			glog.Warningf("Sample metrics of %s failed: %s", endpoint, err.Error())
+			continue
+		}
+		if err = sampler.ring.Append(sample); err != nil {
+			glog.Errorf("Save metrics of %s failed: %s", endpoint, err.Error())
+		}
+	}
+	for endpoint, sampler := range monitor.samplers {
+		if !registered[endpoint] {
+			sampler.ring.Close()
+			delete(monitor.samplers, endpoint)
+		}
+	}
+}
+
+// closeSamplers closes the rings of all the instances
+func (monitor *MySQLMonitor) closeSamplers() {
+	for endpoint, sampler := range monitor.samplers {
+		sampler.ring.Close()
+		delete(monitor.samplers, endpoint)
+	}
+}
+
+// sample reads the status of the instance. QPS and the buffer pool hit rate are derived from
+// the counters since the last sample, so they are unknown in the first one.
+func (sampler *metricsSampler) sample(endpoint string, isMaster bool, now time.Time) (metrics.Sample, error) {
+	status, err := msops.GetGlobalStatus(endpoint, "%")
+	if err != nil {
+		return metrics.Sample{}, err
+	}
+	sample := metrics.Sample{
+		Time:              now,
+		QPS:               math.NaN(),
+		ThreadsConnected:  statusValue(status, "Threads_connected"),
+		ThreadsRunning:    statusValue(status, "Threads_running"),
+		ReplicationLag:    math.NaN(),
+		BufferPoolHitRate: math.NaN(),
+	}
+	counters := map[string]float64{}
+	for _, name := range []string{"Questions", "Innodb_buffer_pool_read_requests", "Innodb_buffer_pool_reads"} {
+		counters[name] = statusValue(status, name)
+	}
+	if elapsed := now.Sub(sampler.sampled).Seconds(); sampler.counters != nil && elapsed > 0 {
+		delta := func(name string) float64 {
+			// A restarted instance resets the counters, whose delta is unknown
+			if d := counters[name] - sampler.counters[name]; d >= 0 {
+				return d
+			}
+			return math.NaN()
+		}
+		sample.QPS = delta("Questions") / elapsed
+		if requests := delta("Innodb_buffer_pool_read_requests"); requests > 0 {
+			sample.BufferPoolHitRate = 100 * (1 - delta("Innodb_buffer_pool_reads")/requests)
+		}
+	}
+	sampler.counters, sampler.sampled = counters, now
+
+	if !isMaster {
+		if slaveSt, err := msops.GetSlaveStatus(endpoint); err == nil && slaveSt.MasterHost != "" && slaveSt.SlaveSQLRunning == "Yes" {
+			sample.ReplicationLag = float64(slaveSt.SecondsBehindMaster)
+		}
+	}
+	return sample, nil
+}
+
+// statusValue returns the global status as a number, or NaN if it's unknown
+func statusValue(status map[string]string, name string) float64 {
+	value, err := strconv.ParseFloat(status[name], 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return value
+}
+
+// getMetrics returns the charts of an instance over the range, reading the ring file even if the
+// instance is not registered any more
+func getMetrics(endpoint, metricsRange string) ([]byte, int, error) {
+	var data []byte
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return data, http.StatusBadRequest, err
+	}
+	if metricsRange == "" {
+		metricsRange = MetricsRanges[1]
+	}
+	duration, exist := metricsRangeDurations[metricsRange]
+	if !exist {
+		return data, http.StatusBadRequest, fmt.Errorf("range must be one of %s", strings.Join(MetricsRanges, ", "))
+	}
+	var samples []metrics.Sample
+	var err error
+	since := time.Now().Add(-duration)
+	if sampler, exist := msMonitor.samplers[endpoint]; exist {
+		samples, err = sampler.ring.Samples(since)
+	} else if _, statErr := os.Stat(metricsFile(endpoint)); statErr == nil {
+		var ring *metrics.Ring
+		// Only the sampler may clear the ring, e.g. when metrics_capacity is changed
+		if ring, err = metrics.ReadRing(metricsFile(endpoint)); err == nil {
+			samples, err = ring.Samples(since)
+			ring.Close()
+		}
+	}
+	if err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	samples = metrics.Downsample(samples, chartPoints)
+
+	series := func(label string, value func(metrics.Sample) float64) MetricSeriesView {
+		view := MetricSeriesView{Label: label, Data: make([][2]interface{}, 0, len(samples))}
+		for _, sample := range samples {
+			point := [2]interface{}{sample.Time.Unix() * 1000, nil}
+			if v := value(sample); !math.IsNaN(v) {
+				point[1] = v
+			}
+			view.Data = append(view.Data, point)
+		}
+		return view
+	}
+	metricsView := MetricsView{
+		Endpoint: endpoint,
+		Range:    metricsRange,
+		Interval: conf.MetricsInterval.String(),
+		Charts: []MetricChartView{
+			{Title: "QPS", Series: []MetricSeriesView{
+				series("Questions/s", func(s metrics.Sample) float64 { return s.QPS }),
+			}},
+			{Title: "Threads", Series: []MetricSeriesView{
+				series("Threads_connected", func(s metrics.Sample) float64 { return s.ThreadsConnected }),
+				series("Threads_running", func(s metrics.Sample) float64 { return s.ThreadsRunning }),
+			}},
+			{Title: "Replication Lag", Unit: "s", Series: []MetricSeriesView{
+				series("Seconds_Behind_Master", func(s metrics.Sample) float64 { return s.ReplicationLag }),
+			}},
+			{Title: "Buffer Pool Hit Rate", Unit: "%", Series: []MetricSeriesView{
+				series("Hit rate", func(s metrics.Sample) float64 { return s.BufferPoolHitRate }),
+			}},
+		},
+	}
+	if data, err = json.Marshal(metricsView); err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
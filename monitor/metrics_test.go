@@ -0,0 +1,78 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSampleMetrics(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0], c.servers[1]
+	slave.SetReplicationLag(12)
+	master.SetStatus("Innodb_buffer_pool_read_requests", "1000")
+	master.SetStatus("Innodb_buffer_pool_reads", "100")
+
+	msMonitor.sampleMetrics()
+	// The rates are derived from the counters in the last minute
+	for _, sampler := range msMonitor.samplers {
+		sampler.sampled = sampler.sampled.Add(-time.Minute)
+	}
+	master.SetStatus("Innodb_buffer_pool_read_requests", "2000")
+	master.SetStatus("Innodb_buffer_pool_reads", "110")
+	msMonitor.sampleMetrics()
+
+	getView := func(endpoint string) MetricsView {
+		data, code, err := getMetrics(endpoint, "1h")
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("Get metrics of %s failed: %d %v", endpoint, code, err)
+		}
+		var view MetricsView
+		if err = json.Unmarshal(data, &view); err != nil {
+			t.Fatal(err)
+		}
+		return view
+	}
+	lastValue := func(view MetricsView, chart int) interface{} {
+		data := view.Charts[chart].Series[0].Data
+		if len(data) != 2 {
+			t.Fatalf("Expected 2 samples of %s, got %v", view.Charts[chart].Title, data)
+		}
+		return data[1][1]
+	}
+
+	masterView := getView(master.Addr())
+	if qps, ok := lastValue(masterView, 0).(float64); !ok || qps <= 0 {
+		t.Errorf("QPS of master should be derived from Questions, got %v", lastValue(masterView, 0))
+	}
+	if rate := lastValue(masterView, 3); rate != 99.0 {
+		t.Errorf("Expected buffer pool hit rate 99, got %v", rate)
+	}
+	if lag := lastValue(masterView, 2); lag != nil {
+		t.Errorf("Master has no replication lag, got %v", lag)
+	}
+	if first := masterView.Charts[0].Series[0].Data[0][1]; first != nil {
+		t.Errorf("QPS of the first sample is unknown, got %v", first)
+	}
+	if lag := lastValue(getView(slave.Addr()), 2); lag != 12.0 {
+		t.Errorf("Expected replication lag 12, got %v", lag)
+	}
+
+	// The history of an unregistered instance is kept
+	c.mustAccept(unregister(slave.Addr()))
+	msMonitor.sampleMetrics()
+	if _, exist := msMonitor.samplers[slave.Addr()]; exist {
+		t.Errorf("The ring of the unregistered instance should be closed")
+	}
+	lastValue(getView(slave.Addr()), 2)
+	// Reading it doesn't clear the ring of another capacity
+	conf.MetricsRetention *= 2
+	lastValue(getView(slave.Addr()), 2)
+
+	if _, code, _ := getMetrics(master.Addr(), "2h"); code != http.StatusBadRequest {
+		t.Errorf("An unknown range should be rejected, got %d", code)
+	}
+}
@@ -1,13 +1,19 @@
 package monitor
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/ericpai/msops"
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/gtid"
+	"github.com/laincloud/mysql-service/secret"
 )
 
 type PatchAction string
@@ -15,17 +21,39 @@ type GetType string
 
 const (
 	ActionActive          PatchAction = "active"
+	ActionCreateDatabase  PatchAction = "create-db"
 	ActionDetach          PatchAction = "detach"
+	ActionDropDBUser      PatchAction = "drop-db-user"
+	ActionKillConnection  PatchAction = "kill-connection"
+	ActionKillQuery       PatchAction = "kill-query"
+	ActionKillSessions    PatchAction = "kill-sessions"
 	ActionPause           PatchAction = "pause"
+	ActionRebuild         PatchAction = "rebuild"
 	ActionRegisterMaster  PatchAction = "master"
 	ActionRegisterStandby PatchAction = "standby"
 	ActionRegisterSlave   PatchAction = "slave"
+	ActionRepairRebuild   PatchAction = "repair-rebuild"
 	ActionResume          PatchAction = "resume"
+	ActionSetQuota        PatchAction = "set-quota"
+	ActionRetrySQL        PatchAction = "retry"
+	ActionRotateDBUser    PatchAction = "rotate-db-user"
+	ActionRotateDBA       PatchAction = "rotate-dba"
+	ActionRotateRepl      PatchAction = "rotate-repl"
+	ActionSkipTrx         PatchAction = "skip"
 	ActionSwtich          PatchAction = "switch"
 	ActionUnregister      PatchAction = "unregister"
 
 	GetAllOverview GetType = "overview"
 	GetOneDetails  GetType = "detail"
+	GetRepairPlan  GetType = "repair"
+	GetRoleInfo    GetType = "role"
+	GetBackups     GetType = "backups"
+	GetCatalog     GetType = "catalog"
+	GetMetrics     GetType = "metrics"
+	GetInnoDB      GetType = "innodb"
+	GetSlowQueries GetType = "slowlog"
+	GetSessions    GetType = "sessions"
+	GetDatabases   GetType = "databases"
 )
 
 type InstanceModel struct {
@@ -148,13 +176,12 @@ func register(endpoint string, role PatchAction) (int, error) {
 	if _, exist := msMonitor.unregistered[endpoint]; !exist {
 		return http.StatusForbidden, fmt.Errorf("%s is registered", endpoint)
 	}
-	newConf := getSecretConf()
 	switch role {
 	case ActionRegisterMaster:
 		if msMonitor.master != "" {
 			return http.StatusForbidden, fmt.Errorf("Master is registered")
 		}
-		if err := msops.Register(endpoint, dbaUser, newConf["dba_passwd"], replUser, newConf["repl_passwd"], connParam); err != nil {
+		if err := registerInstance(endpoint); err != nil {
 			return http.StatusInternalServerError, err
 		}
 		msMonitor.master = endpoint
@@ -162,7 +189,7 @@ func register(endpoint string, role PatchAction) (int, error) {
 		if msMonitor.master == "" {
 			return http.StatusForbidden, fmt.Errorf("Master is not registered")
 		}
-		if err := msops.Register(endpoint, dbaUser, newConf["dba_passwd"], replUser, newConf["repl_passwd"], connParam); err != nil {
+		if err := registerInstance(endpoint); err != nil {
 			return http.StatusInternalServerError, err
 		}
 		msMonitor.slave[endpoint] = placeHolder
@@ -173,7 +200,7 @@ func register(endpoint string, role PatchAction) (int, error) {
 		if msMonitor.standby != "" {
 			return http.StatusForbidden, fmt.Errorf("Standby is registered")
 		}
-		if err := msops.Register(endpoint, dbaUser, newConf["dba_passwd"], replUser, newConf["repl_passwd"], connParam); err != nil {
+		if err := registerInstance(endpoint); err != nil {
 			return http.StatusInternalServerError, err
 		}
 		msMonitor.standby = endpoint
@@ -182,6 +209,71 @@ func register(endpoint string, role PatchAction) (int, error) {
 	return http.StatusAccepted, nil
 }
 
+// rebuild asks the agent of an unregistered instance to rebuild it from the latest backups.
+// The instance is registered as an active slave by monitor after the agent finishes.
+func rebuild(endpoint string) (int, error) {
+	if _, exist := msMonitor.unregistered[endpoint]; !exist {
+		return http.StatusForbidden, fmt.Errorf("%s is registered", endpoint)
+	}
+	if msMonitor.master == "" {
+		return http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	if status, exist := msMonitor.rebuilding[endpoint]; exist && status.Stage != agent.RebuildFailed {
+		return http.StatusForbidden, fmt.Errorf("%s is rebuilding", endpoint)
+	}
+	status, code, err := requestAgent("POST", endpoint)
+	if err != nil {
+		return code, fmt.Errorf("Start rebuilding %s failed: %s", endpoint, err.Error())
+	}
+	msMonitor.rebuilding[endpoint] = &status
+	return http.StatusAccepted, nil
+}
+
+// agentURL returns the URL of the location of the agent running with endpoint
+func agentURL(endpoint, location string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, agent.AgentPort), location), nil
+}
+
+// doAgent sends the request to the agent with the service token
+func doAgent(method, url string) (*http.Response, error) {
+	return doAgentTimeout(method, url, conf.AgentTimeout)
+}
+
+// doAgentTimeout sends the request to the agent with the service token and the timeout
+func doAgentTimeout(method, url string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	secret.SetToken(req, Secret(secret.TokenKey))
+	return (&http.Client{Timeout: timeout}).Do(req)
+}
+
+// requestAgent sends the request to the rebuild API of the agent running with endpoint
+func requestAgent(method, endpoint string) (agent.RebuildStatus, int, error) {
+	var status agent.RebuildStatus
+	url, err := agentURL(endpoint, agent.RebuildLocation)
+	if err != nil {
+		return status, http.StatusBadRequest, err
+	}
+	resp, err := doAgent(method, url)
+	if err != nil {
+		return status, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, http.StatusBadGateway, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return status, resp.StatusCode, fmt.Errorf("agent returns %s, rebuild stage: %s", resp.Status, status.Stage)
+	}
+	return status, resp.StatusCode, nil
+}
+
 func resume(endpoint string) (int, error) {
 	if endpoint == msMonitor.master {
 		if err := msops.SetGlobalVariable(endpoint, "read_only", 0); err != nil {
@@ -195,6 +287,112 @@ func resume(endpoint string) (int, error) {
 	return http.StatusAccepted, nil
 }
 
+// replicationSource returns the endpoint which endpoint replicates from
+func replicationSource(endpoint string) string {
+	if endpoint == msMonitor.master {
+		return msMonitor.standby
+	}
+	return msMonitor.master
+}
+
+// failedTransaction returns the GTID of the transaction which stops the SQL thread of endpoint.
+// An empty string is returned if the SQL thread has no error. After a switchover, the relay log
+// may still have the transactions of the previous master, so the failed transaction is only known
+// if the retrieved but not executed transactions have a single next one to apply.
+func failedTransaction(endpoint string) (string, int, error) {
+	slaveStatus, err := msops.GetSlaveStatus(endpoint)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if slaveStatus.LastSQLErrno == 0 {
+		return "", http.StatusOK, nil
+	}
+	if !slaveStatus.AutoPosition {
+		return "", http.StatusForbidden, fmt.Errorf("%s does not replicate with GTID auto position", endpoint)
+	}
+	var retrieved, executed gtid.Set
+	if retrieved, err = gtid.Parse(slaveStatus.RetrievedGtidSet); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if executed, err = gtid.Parse(slaveStatus.ExecutedGtidSet); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	pending := retrieved.Subtract(executed)
+	candidates := make([]string, 0, len(pending))
+	for uuid, ivs := range pending {
+		candidates = append(candidates, fmt.Sprintf("%s:%d", uuid, ivs[0].Start))
+	}
+	sort.Strings(candidates)
+	switch len(candidates) {
+	case 0:
+		return "", http.StatusConflict, fmt.Errorf("Can't find the failed transaction, every transaction of %s is executed", slaveStatus.RetrievedGtidSet)
+	case 1:
+		return candidates[0], http.StatusOK, nil
+	}
+	return "", http.StatusConflict, fmt.Errorf("The failed transaction is unknown, it may be any of %s", strings.Join(candidates, ", "))
+}
+
+// skipTransaction skips the failed transaction on endpoint by committing an empty transaction with its GTID.
+// The GTID must be the one shown to the user, or the transaction may have changed since the user confirmed.
+func skipTransaction(endpoint, confirmedGTID string) (int, error) {
+	if endpoint == msMonitor.master && msMonitor.standby == "" {
+		return http.StatusForbidden, fmt.Errorf("%s does not replicate from any instance", endpoint)
+	}
+	failedGTID, code, err := failedTransaction(endpoint)
+	if err != nil {
+		return code, err
+	}
+	if failedGTID == "" {
+		return http.StatusForbidden, fmt.Errorf("The SQL thread of %s has no error", endpoint)
+	}
+	if failedGTID != confirmedGTID {
+		return http.StatusConflict, fmt.Errorf("The failed transaction of %s is %s instead of %s", endpoint, failedGTID, confirmedGTID)
+	}
+	if err := execInSession(endpoint,
+		"STOP SLAVE",
+		fmt.Sprintf("SET GTID_NEXT='%s'", failedGTID),
+		"BEGIN",
+		"COMMIT",
+		"SET GTID_NEXT='AUTOMATIC'",
+		"START SLAVE",
+	); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Skip %s failed: %s", failedGTID, err.Error())
+	}
+	return http.StatusAccepted, nil
+}
+
+// repairRebuild unregisters a standby or slave whose SQL thread stopped with an error, and rebuilds
+// it from the latest backups. It's the last resort when the failed transaction can't be retried or skipped.
+func repairRebuild(endpoint string) (int, error) {
+	if endpoint == msMonitor.master {
+		return http.StatusForbidden, fmt.Errorf("Master is not allowed to be rebuilt")
+	}
+	if _, isSlave := msMonitor.slave[endpoint]; !isSlave && endpoint != msMonitor.standby {
+		return http.StatusForbidden, fmt.Errorf("%s is not a registered standby or slave", endpoint)
+	}
+	if msMonitor.master == "" {
+		return http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	if code, err := unregister(endpoint); err != nil {
+		return code, err
+	}
+	if code, err := rebuild(endpoint); err != nil {
+		return code, fmt.Errorf("%s is unregistered, but %s", endpoint, err.Error())
+	}
+	return http.StatusAccepted, nil
+}
+
+// retrySQL restarts the SQL thread of endpoint to execute the failed transaction again
+func retrySQL(endpoint string) (int, error) {
+	if endpoint == msMonitor.master && msMonitor.standby == "" {
+		return http.StatusForbidden, fmt.Errorf("%s does not replicate from any instance", endpoint)
+	}
+	if err := execInSession(endpoint, "STOP SLAVE SQL_THREAD", "START SLAVE SQL_THREAD"); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Retry SQL thread failed: %s", err.Error())
+	}
+	return http.StatusAccepted, nil
+}
+
 func switchToMaster(endpoint string) (int, error) {
 	if endpoint == msMonitor.master {
 		return http.StatusForbidden, fmt.Errorf("%s is already master now", endpoint)
@@ -206,13 +404,21 @@ func switchToMaster(endpoint string) (int, error) {
 		return http.StatusForbidden, fmt.Errorf("%s is not registered", endpoint)
 	}
 
-	if err := msops.KillProcesses(msMonitor.master, sysUsers...); err != nil {
+	// The master-mode proxies hold the new connections until the switching is done or fails
+	msMonitor.switching = endpoint
+	msMonitor.publish(fmt.Sprintf("Switching master to %s", endpoint))
+	defer func() {
+		msMonitor.switching = ""
+		msMonitor.publish("Switching master is finished")
+	}()
+
+	if err := msops.KillProcesses(msMonitor.master, sysUsers()...); err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("Pre-killing failed: %s", err.Error())
 	}
 	if err := msops.SetGlobalVariable(msMonitor.master, "read_only", 1); err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("Enable read_only failed: %s", err.Error())
 	}
-	if err := msops.KillProcesses(msMonitor.master, sysUsers...); err != nil {
+	if err := msops.KillProcesses(msMonitor.master, sysUsers()...); err != nil {
 		msops.SetGlobalVariable(msMonitor.master, "read_only", 0)
 		return http.StatusInternalServerError, fmt.Errorf("Post-killing failed: %s", err.Error())
 	}
@@ -0,0 +1,285 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericpai/msops"
+	"github.com/laincloud/lainlet/client"
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/fake"
+	"golang.org/x/net/context"
+)
+
+func TestRegister(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	master, standby, slave := c.servers[0].Addr(), c.servers[1].Addr(), c.servers[2].Addr()
+
+	if code, err := register(slave, ActionRegisterSlave); err == nil || code != http.StatusForbidden {
+		t.Errorf("Slave should not be registered before master, got %d", code)
+	}
+	c.mustAccept(register(master, ActionRegisterMaster))
+	if code, err := register(master, ActionRegisterMaster); err == nil || code != http.StatusForbidden {
+		t.Errorf("Master should not be registered twice, got %d", code)
+	}
+	c.mustAccept(register(standby, ActionRegisterStandby))
+	c.mustAccept(register(slave, ActionRegisterSlave))
+	if len(msMonitor.unregistered) != 0 {
+		t.Errorf("All the instances should be registered, got %v", msMonitor.unregistered)
+	}
+	for _, endpoint := range []string{master, standby, slave} {
+		if st := msops.CheckInstance(endpoint); st != msops.InstanceOK {
+			t.Errorf("%s is %d after registered", endpoint, st)
+		}
+	}
+
+	c.mustAccept(active(slave))
+	if source := c.servers[2].Source(); source != master {
+		t.Errorf("Slave should replicate from master after activated, got %q", source)
+	}
+	if st := msops.CheckReplication(slave, master); st != msops.ReplicationOK {
+		t.Errorf("Replication of slave is %d", st)
+	}
+}
+
+func TestSwitchToStandby(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(true)
+	oldMaster, standby, slave := c.servers[0], c.servers[1], c.servers[2]
+	oldMaster.Commit(10)
+	appID := oldMaster.AddProcess("app", "10.0.0.1:40000", "Sleep", "")
+
+	// The roles are watched like proxies do, to check what they receive during the switching
+	server := httptest.NewServer(*msMonitor.es)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.New(server.Listener.Addr().String()).Watch(MonitorLocation, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watch is subscribed once it receives the roles published again
+	for subscribed := false; !subscribed; {
+		msMonitor.prevData = ""
+		msMonitor.publish("Watched")
+		select {
+		case <-events:
+			subscribed = true
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	c.mustAccept(switchToMaster(standby.Addr()))
+	var received []map[string][]string
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			roles := make(map[string][]string)
+			json.Unmarshal(event.Data, &roles)
+			received = append(received, roles)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("The switching should be published, got %v", received)
+		}
+	}
+	if roles := received[0]; len(roles[roleMaster]) != 0 || !reflect.DeepEqual(roles[SwitchingKey], []string{standby.Addr()}) {
+		t.Errorf("The new master should be published as switching first, got %v", roles)
+	}
+	if roles := received[1]; !reflect.DeepEqual(roles[roleMaster], []string{standby.Addr()}) || len(roles[SwitchingKey]) != 0 {
+		t.Errorf("The new master should be published after switching, got %v", roles)
+	}
+	if msMonitor.master != standby.Addr() || msMonitor.standby != oldMaster.Addr() {
+		t.Fatalf("Roles are not switched: master %s, standby %s", msMonitor.master, msMonitor.standby)
+	}
+	if msMonitor.switching != "" || !strings.Contains(msMonitor.prevData, `"master":["`+standby.Addr()) {
+		t.Errorf("The new master should be published after switching, got %s", msMonitor.prevData)
+	}
+	if oldMaster.ProcessCount("app") != 0 {
+		t.Errorf("Process %d of the application should be killed on the old master", appID)
+	}
+	if standby.Source() != "" {
+		t.Errorf("New master should not replicate from any instance, got %s", standby.Source())
+	}
+	if oldMaster.Source() != standby.Addr() || slave.Source() != standby.Addr() {
+		t.Errorf("Sources of old master and slave: %q, %q", oldMaster.Source(), slave.Source())
+	}
+	if oldMaster.Variable("read_only") != "ON" || standby.Variable("read_only") != "OFF" {
+		t.Errorf("read_only of old and new master: %s, %s", oldMaster.Variable("read_only"), standby.Variable("read_only"))
+	}
+
+	standby.Commit(5)
+	roles := inspectRoles(t)
+	if len(roles[roleMaster]) != 1 || roles[roleMaster][0] != standby.Addr() || len(roles[roleSlave]) != 1 {
+		t.Errorf("Unexpected roles after switching: %v", roles)
+	}
+	if st := msops.CheckReplication(oldMaster.Addr(), standby.Addr()); st != msops.ReplicationOK {
+		t.Errorf("Replication of the old master is %d", st)
+	}
+}
+
+func TestSwitchToSlave(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(false)
+	oldMaster, slave, otherSlave := c.servers[0], c.servers[1], c.servers[2]
+	oldMaster.Commit(1)
+
+	c.mustAccept(switchToMaster(slave.Addr()))
+	if msMonitor.master != slave.Addr() {
+		t.Fatalf("Master is not switched, got %s", msMonitor.master)
+	}
+	if _, exist := msMonitor.slave[oldMaster.Addr()]; !exist {
+		t.Errorf("Old master should be a slave")
+	}
+	if oldMaster.Source() != slave.Addr() || otherSlave.Source() != slave.Addr() {
+		t.Errorf("Sources of old master and the other slave: %q, %q", oldMaster.Source(), otherSlave.Source())
+	}
+}
+
+func TestSwitchToLaggingSlave(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0], c.servers[1]
+	slave.SetReplicationLag(60)
+	master.Commit(1)
+
+	if code, err := switchToMaster(slave.Addr()); err == nil || code != http.StatusInternalServerError {
+		t.Fatalf("Switching to a lagging slave should fail, got %d", code)
+	}
+	if msMonitor.master != master.Addr() {
+		t.Errorf("Master should not be changed, got %s", msMonitor.master)
+	}
+	if master.Variable("read_only") != "OFF" {
+		t.Errorf("read_only of master should be restored")
+	}
+}
+
+func TestSkipTransaction(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0], c.servers[1]
+	slave.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	master.Commit(2)
+
+	failed, _, err := failedTransaction(slave.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.ToLower(master.UUID()) + ":1"; failed != expected {
+		t.Fatalf("Failed transaction is %s instead of %s", failed, expected)
+	}
+	if code, err := skipTransaction(slave.Addr(), master.UUID()+":2"); err == nil || code != http.StatusConflict {
+		t.Errorf("Skipping an unconfirmed transaction should conflict, got %d", code)
+	}
+	c.mustAccept(skipTransaction(slave.Addr(), failed))
+	if st := msops.CheckReplication(slave.Addr(), master.Addr()); st != msops.ReplicationOK {
+		t.Errorf("Replication is %d after skipping", st)
+	}
+}
+
+func TestSkipTransactionOfTwoSources(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0], c.servers[1]
+	// The master has the transactions of a previous master, like after a switchover
+	previous, err := fake.NewMySQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer previous.Close()
+	previous.Commit(3)
+	master.ReplicateFrom(previous, conf.ReplUser, testReplPassword)
+	sync := func() {
+		for _, server := range []*fake.MySQL{master, slave} {
+			if _, err := msops.GetSlaveStatus(server.Addr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sync()
+	slave.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	master.Commit(1)
+	sync()
+
+	// The transactions of the previous master are executed, so the failed one is known
+	failed, _, err := failedTransaction(slave.Addr())
+	if expected := strings.ToLower(master.UUID()) + ":1"; err != nil || failed != expected {
+		t.Fatalf("Failed transaction is %s (%v) instead of %s", failed, err, expected)
+	}
+	if actions := getRepairActions(slave.Addr()); !reflect.DeepEqual(actions, []string{"retry", "skip", "repair-rebuild"}) {
+		t.Errorf("Repair actions are %v", actions)
+	}
+
+	// Now the relay log has the transactions of both masters, and either of them may be the failed one
+	previous.Commit(2)
+	sync()
+	if failed, code, err := failedTransaction(slave.Addr()); err == nil || code != http.StatusConflict {
+		t.Fatalf("The failed transaction should be unknown, got %s (%d)", failed, code)
+	}
+	if actions := getRepairActions(slave.Addr()); !reflect.DeepEqual(actions, []string{"retry", "repair-rebuild"}) {
+		t.Errorf("Skip should not be offered, got %v", actions)
+	}
+	if code, err := skipTransaction(slave.Addr(), strings.ToLower(master.UUID())+":1"); err == nil || code != http.StatusConflict {
+		t.Errorf("Skipping should be refused, got %d", code)
+	}
+	if executed := slave.ExecutedGTIDSet(); strings.Contains(executed, strings.ToLower(master.UUID())) {
+		t.Errorf("No transaction of master should be skipped, got %s", executed)
+	}
+}
+
+func TestRepairRebuild(t *testing.T) {
+	c := newTestCluster(t, 2)
+	defer c.close()
+	c.setup(false)
+	master, slave := c.servers[0].Addr(), c.servers[1].Addr()
+	requested := make(chan string, 10)
+	server := startAgent(t, func(rw http.ResponseWriter, req *http.Request) {
+		requested <- req.Method + " " + req.URL.Path
+		rw.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(rw).Encode(agent.RebuildStatus{Stage: agent.RebuildDownloading})
+	})
+	defer server.Close()
+
+	if code, err := repairRebuild(master); err == nil || code != http.StatusForbidden {
+		t.Errorf("Master should not be rebuilt, got %d", code)
+	}
+	c.mustAccept(repairRebuild(slave))
+	if _, exist := msMonitor.unregistered[slave]; !exist {
+		t.Errorf("The rebuilt slave should be unregistered")
+	}
+	if _, exist := msMonitor.slave[slave]; exist {
+		t.Errorf("The rebuilt slave should not be a slave any more")
+	}
+	if status, exist := msMonitor.rebuilding[slave]; !exist || status.Stage != agent.RebuildDownloading {
+		t.Errorf("The slave should be rebuilding, got %+v", status)
+	}
+	if len(requested) != 1 || <-requested != "POST "+agent.RebuildLocation {
+		t.Errorf("The agent should be asked to rebuild once")
+	}
+	if code, err := repairRebuild(slave); err == nil || code != http.StatusForbidden {
+		t.Errorf("An unregistered instance should not be repaired, got %d", code)
+	}
+}
+
+// startAgent starts a fake agent of the fake servers, which listens on the loopback address as well
+func startAgent(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", agent.AgentPort))
+	if err != nil {
+		t.Skipf("The agent port is not available: %s", err.Error())
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	return server
+}
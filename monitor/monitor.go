@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +17,8 @@ import (
 	"github.com/ericpai/msops"
 	"github.com/golang/glog"
 	"github.com/laincloud/lainlet/client"
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/discovery"
 )
 
 type MySQLMonitor struct {
@@ -26,20 +27,50 @@ type MySQLMonitor struct {
 	slave        map[string]interface{}
 	standby      string
 	unregistered map[string]interface{}
-	newConnChan  chan string
-	newEventChan chan map[string]interface{}
-	getReqChan   chan GetRequest
-	patchReqChan chan PatchRequest
+	// missing are the registered instances missing in service discovery, which keep their roles
+	// during the grace period
+	missing    map[string]*missingInstance
+	rebuilding map[string]*agent.RebuildStatus
+	// The rebuild status is polled from the agents outside the main loop, and sent back by
+	// rebuildStatusChan. rebuildPolling is whether a poll is running.
+	rebuildStatusChan chan map[string]agent.RebuildStatus
+	rebuildPolling    bool
+	newConnChan       chan string
+	newEventChan      chan map[string]interface{}
+	getReqChan        chan GetRequest
+	patchReqChan      chan PatchRequest
+	// rotating is the password rotation waited for outside the main loop, which sends the progress
+	// back by rotationChan
+	rotating     *rotation
+	rotationChan chan rotationProgress
+
+	backups         []BackupRecord
+	backupSchedules map[string]time.Duration
+	backupReqChan   chan BackupRequest
+
+	samplers  map[string]*metricsSampler
+	deadlocks []DeadlockRecord
+
+	// quotas are the quotas of the application databases, and quotaAlerts are the summaries of
+	// the quotas exceeded in the last checkQuotas
+	quotas      map[string]*Quota
+	quotaAlerts map[string]string
+
+	// The roles notified by the last checkAlerts, to notify the role changes
+	alertsChecked  bool
+	alertedMaster  string
+	alertedStandby string
+
+	// prevData is the roles published to proxies last time, and switching is the new master during
+	// switchToMaster, which is published so that proxies hold the new connections until it's done
+	prevData  string
+	switching string
 }
 
-type ProcInstance struct {
-	InstanceNo int    `json:"InstanceNo"`
-	Port       int    `json:"Port"`
-	ProcName   string `json:"ProcName"`
-}
-
-type AppProcs struct {
-	Procs []ProcInstance `json:"proc"`
+// missingInstance records since when and in how many consecutive lists of discovery an instance is missing
+type missingInstance struct {
+	Since  time.Time
+	Events int
 }
 
 type AuthConfInfo struct {
@@ -47,34 +78,31 @@ type AuthConfInfo struct {
 }
 
 const (
-	sseID          = "1"
-	sseInit        = "init"
-	sseUpdate      = "update"
-	reportFormat   = "%s.%s.%s.%s %d %d\n"
-	secretFileName = "conf/secret.conf"
-	dbaUser        = "dba"
-	replUser       = "repl"
-	masterConfig   = "/var/lib/monitor.conf/master"
-	slaveConfig    = "/var/lib/monitor.conf/slave"
-	standbyConfig  = "/var/lib/monitor.conf/standby"
-	roleMaster     = "master"
-	roleSlave      = "slave"
-	reportTime     = time.Minute
-	inspectTime    = 3 * time.Second
-	CooldownTime   = 3 * time.Second
+	sseID        = "1"
+	sseInit      = "init"
+	sseUpdate    = "update"
+	reportFormat = "%s.%s.%s.%s %d %d\n"
+	roleMaster   = "master"
+	roleSlave    = "slave"
+	roleStandby  = "standby"
+
+	// The files in ConfigDir saving the cluster roles
+	masterConfig  = "master"
+	slaveConfig   = "slave"
+	standbyConfig = "standby"
+	rebuildConfig = "rebuilding"
 )
 
 const (
-	MonitorPort     = "6033"
 	MonitorLocation = "/servers"
+	// SwitchingKey is published with the new master instead of "master" during switching master
+	SwitchingKey = "switching"
 )
 
 var (
-	lainDomain      = os.Getenv("LAIN_DOMAIN")
-	lainAppName     = os.Getenv("LAIN_APPNAME")
-	graphiteAddress = net.JoinHostPort("graphite.lain", os.Getenv("GRAPHITE_PORT"))
-	lainletClient   = client.New(net.JoinHostPort("lainlet.lain", os.Getenv("LAINLET_PORT")))
-	procWatcherURL  = fmt.Sprintf("/v2/procwatcher?appname=%s", lainAppName)
+	lainDomain    = os.Getenv("LAIN_DOMAIN")
+	lainAppName   = os.Getenv("LAIN_APPNAME")
+	lainletClient = client.New(conf.LainletAddr)
 
 	graphiteKeyDomain  = strings.Replace(lainDomain, ".", "_", -1)
 	graphiteKeyAppName = strings.Replace(lainAppName, ".", "_", -1)
@@ -85,93 +113,138 @@ var (
 		"charset": "utf8",
 		"timeout": "1s",
 	}
-	sysUsers = []string{dbaUser, replUser, "root", "system user"}
-
-	SecretConf = getSecretConf()
-
-	msMonitor MySQLMonitor
+	conf = DefaultConfig()
+	// msMonitor is created before Start, so that the requests sent before Start are served once it runs
+	msMonitor = newMonitor()
 )
 
-// Start starts the main goroutine of monitor
-func Start() {
+// Start starts the main goroutine of monitor, which manages the instances found by disc
+func Start(disc discovery.Discovery) {
+	defer (*(msMonitor.es)).Close()
 
+	msMonitor.loadConfig()
+	msMonitor.loadBackupCatalog()
+	msMonitor.loadDeadlocks()
+	msMonitor.loadQuotas()
+	http.Handle(MonitorLocation, *(msMonitor.es))
+	go msMonitor.listenDiscovery(disc)
+	go msMonitor.run()
+	glog.Fatal(http.ListenAndServe(net.JoinHostPort("", conf.MonitorPort), &msMonitor))
+}
+
+// newMonitor creates a monitor without any instances
+func newMonitor() MySQLMonitor {
 	settings := &eventsource.Settings{
 		IdleTimeout:    6 * time.Hour,
 		CloseOnTimeout: true,
 		Timeout:        3 * time.Second,
 	}
 	eventsource := eventsource.New(settings, nil)
-	msMonitor = MySQLMonitor{
+	return MySQLMonitor{
 		es:           &eventsource,
 		slave:        make(map[string]interface{}),
 		unregistered: make(map[string]interface{}),
-		newConnChan:  make(chan string),
-		newEventChan: make(chan map[string]interface{}),
-		getReqChan:   make(chan GetRequest),
-		patchReqChan: make(chan PatchRequest),
-	}
-	defer (*(msMonitor.es)).Close()
+		missing:      make(map[string]*missingInstance),
+		rebuilding:   make(map[string]*agent.RebuildStatus),
 
-	msMonitor.loadConfig()
-	http.Handle(MonitorLocation, *(msMonitor.es))
-	go msMonitor.listenLainletEvent()
-	go msMonitor.run()
-	glog.Fatal(http.ListenAndServe(net.JoinHostPort("", MonitorPort), msMonitor))
+		rebuildStatusChan: make(chan map[string]agent.RebuildStatus),
+		rotationChan:      make(chan rotationProgress),
+		newConnChan:       make(chan string),
+		newEventChan:      make(chan map[string]interface{}),
+		getReqChan:        make(chan GetRequest),
+		patchReqChan:      make(chan PatchRequest),
+
+		backupReqChan: make(chan BackupRequest),
+
+		samplers: make(map[string]*metricsSampler),
+		quotas:   make(map[string]*Quota),
+	}
 }
 
 // ServeHTTP sends a singal to monitor sending init event to the new proxy
-func (monitor MySQLMonitor) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+func (monitor *MySQLMonitor) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	(*(monitor.es)).ServeHTTP(rw, req)
 	monitor.newConnChan <- req.RemoteAddr
 }
 
 func (monitor *MySQLMonitor) run() {
-	prevData := monitor.inspect()
-	reportTick := time.Tick(reportTime)
-	inspectTick := time.Tick(inspectTime)
+	monitor.prevData = monitor.inspect()
+	reportTick := time.Tick(conf.ReportInterval)
+	inspectTick := time.Tick(conf.InspectInterval)
+	metricsTick := time.Tick(conf.MetricsInterval)
+	deadlockTick := time.Tick(conf.DeadlockCheckInterval)
+	quotaTick := time.Tick(conf.QuotaCheckInterval)
 	for {
 		select {
 		case portalEndpoint := <-monitor.newConnChan:
 			glog.V(2).Infof("Portal %s connnected to monitor", portalEndpoint)
-			(*(monitor.es)).SendEventMessage(prevData, sseInit, sseID)
-			glog.V(2).Infof("Send data: %s", string(prevData))
+			(*(monitor.es)).SendEventMessage(monitor.prevData, sseInit, sseID)
+			glog.V(2).Infof("Send data: %s", monitor.prevData)
 		case newInstList := <-monitor.newEventChan:
 			monitor.updateServersList(newInstList)
-			newData := monitor.inspect()
-			if prevData != newData {
-				prevData = newData
-				glog.V(2).Info("Server list is updated")
-				(*(monitor.es)).SendEventMessage(prevData, sseUpdate, sseID)
-				glog.V(2).Infof("Send data: %s", string(prevData))
-			}
+			monitor.publish("Server list is updated")
 		case req := <-monitor.getReqChan:
 			monitor.handleGet(req)
 		case req := <-monitor.patchReqChan:
 			monitor.handlePatch(req)
+		case req := <-monitor.backupReqChan:
+			monitor.handleBackupReport(req)
+		case statuses := <-monitor.rebuildStatusChan:
+			monitor.updateRebuilding(statuses)
+		case progress := <-monitor.rotationChan:
+			monitor.updateRotation(progress)
 		case <-inspectTick:
-			newData := monitor.inspect()
-			if prevData != newData {
-				prevData = newData
-				glog.V(2).Info("Inspect finished, the cluster status is changed")
-				(*(monitor.es)).SendEventMessage(prevData, sseUpdate, sseID)
-				glog.V(2).Infof("Send data: %s", string(prevData))
+			if credentials.load() {
+				monitor.reregisterAll()
 			}
+			monitor.checkRebuilding()
+			monitor.dropMissing()
+			monitor.publish("Inspect finished, the cluster status is changed")
+			monitor.checkAlerts()
 		case <-reportTick:
 			monitor.report()
+		case <-metricsTick:
+			monitor.sampleMetrics()
+		case <-deadlockTick:
+			monitor.checkDeadlocks()
+		case <-quotaTick:
+			monitor.checkQuotas()
 		}
 		glog.Flush()
 	}
 }
 
+// publish sends the roles to proxies if they are changed since the last time
+func (monitor *MySQLMonitor) publish(reason string) {
+	newData := monitor.inspect()
+	if monitor.prevData != newData {
+		monitor.prevData = newData
+		glog.V(2).Info(reason)
+		(*(monitor.es)).SendEventMessage(newData, sseUpdate, sseID)
+		glog.V(2).Infof("Send data: %s", newData)
+	}
+}
+
 func (monitor *MySQLMonitor) inspect() string {
 	roleEndpoints := make(map[string][]string)
 
 	roleEndpoints[roleMaster] = make([]string, 0, 1)
 
-	if msops.CheckInstance(monitor.master) == msops.InstanceOK {
+	if monitor.switching != "" {
+		roleEndpoints[SwitchingKey] = []string{monitor.switching}
+	} else if msops.CheckInstance(monitor.master) == msops.InstanceOK {
 		roleEndpoints[roleMaster] = append(roleEndpoints[roleMaster], monitor.master)
 	}
 
+	// The standby is published for the standby-only ports of proxies, e.g. for backups, but not while
+	// it's being switched to master
+	roleEndpoints[roleStandby] = make([]string, 0, 1)
+	if monitor.standby != "" && monitor.standby != monitor.switching {
+		if st := msops.CheckReplication(monitor.standby, monitor.master); st == msops.ReplicationOK || st == msops.ReplicationSyning {
+			roleEndpoints[roleStandby] = append(roleEndpoints[roleStandby], monitor.standby)
+		}
+	}
+
 	roleEndpoints[roleSlave] = make([]string, 0, len(monitor.slave))
 
 	for endpoint := range monitor.slave {
@@ -184,42 +257,34 @@ func (monitor *MySQLMonitor) inspect() string {
 	return string(jsonStr)
 }
 
+// updateServersList applies the instances found by discovery. A registered instance missing in the list
+// keeps its role until it is missing for MissingGraceEvents consecutive lists or MissingGraceTime,
+// and is unreachable, so that a transient or partial list doesn't wipe out the roles.
 func (monitor *MySQLMonitor) updateServersList(newInstList map[string]interface{}) {
-	if monitor.master != "" {
-		if _, exist := newInstList[monitor.master]; !exist {
-			// If master endpoint is lost, we are dead
-			glog.Errorf("Can't find master endpoint %s. Unregistered", monitor.master)
-			msops.Unregister(monitor.master)
-			monitor.master = ""
-		} else {
-			delete(newInstList, monitor.master)
-		}
-	}
-
-	for endpoint := range monitor.slave {
-		if _, exist := newInstList[endpoint]; !exist {
-			glog.V(1).Infof("Slave %s is missed. Unregistered", endpoint)
-			msops.Unregister(endpoint)
-			delete(monitor.slave, endpoint)
-		} else {
+	for _, endpoint := range monitor.registered() {
+		if _, exist := newInstList[endpoint]; exist {
+			if _, missing := monitor.missing[endpoint]; missing {
+				glog.Infof("%s is found again", endpoint)
+				delete(monitor.missing, endpoint)
+			}
 			delete(newInstList, endpoint)
+			continue
 		}
-	}
-
-	if monitor.standby != "" {
-		if _, exist := newInstList[monitor.standby]; !exist {
-			glog.Infof("Standby %s is missed", monitor.standby)
-			msops.Unregister(monitor.standby)
-			monitor.standby = ""
-		} else {
-			delete(newInstList, monitor.standby)
+		missing, exist := monitor.missing[endpoint]
+		if !exist {
+			glog.Warningf("%s is missing in service discovery", endpoint)
+			missing = &missingInstance{Since: time.Now()}
+			monitor.missing[endpoint] = missing
 		}
+		missing.Events++
 	}
+	monitor.dropMissing()
 
 	for endpoint := range monitor.unregistered {
 		if _, exist := newInstList[endpoint]; !exist {
 			glog.V(1).Infof("Unregistered %s is missed", endpoint)
 			delete(monitor.unregistered, endpoint)
+			delete(monitor.rebuilding, endpoint)
 		} else {
 			delete(newInstList, endpoint)
 		}
@@ -229,37 +294,115 @@ func (monitor *MySQLMonitor) updateServersList(newInstList map[string]interface{
 	}
 }
 
-func (monitor *MySQLMonitor) listenLainletEvent() {
-	endpointList := make(map[string]interface{})
-	for {
-		ch, err := lainletClient.Watch(procWatcherURL, context.Background())
-		if err != nil {
-			glog.Errorf("Goroutine listenLainletEvent connects to lainlet failed: %s", err.Error())
-			time.Sleep(CooldownTime)
+// registered returns the endpoints of master, standby and slaves
+func (monitor *MySQLMonitor) registered() []string {
+	endpoints := make([]string, 0, len(monitor.slave)+2)
+	if monitor.master != "" {
+		endpoints = append(endpoints, monitor.master)
+	}
+	if monitor.standby != "" {
+		endpoints = append(endpoints, monitor.standby)
+	}
+	for endpoint := range monitor.slave {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// dropMissing unregisters the missing instances which are out of the grace period and unreachable
+func (monitor *MySQLMonitor) dropMissing() {
+	for endpoint, missing := range monitor.missing {
+		_, isSlave := monitor.slave[endpoint]
+		if endpoint != monitor.master && endpoint != monitor.standby && !isSlave {
+			// The role is changed by an action during the grace period
+			delete(monitor.missing, endpoint)
 			continue
 		}
-		for event := range ch {
-			var appProcs []AppProcs
-			if err := json.Unmarshal(event.Data, &appProcs); err != nil {
-				glog.Errorf("Unmarshal event error: %s", err.Error())
-				time.Sleep(CooldownTime)
+		if missing.Events < conf.MissingGraceEvents && time.Since(missing.Since) < conf.MissingGraceTime {
+			continue
+		}
+		if msops.CheckInstance(endpoint) == msops.InstanceOK {
+			continue
+		}
+		switch endpoint {
+		case monitor.master:
+			// If master endpoint is lost, we are dead
+			glog.Errorf("Can't find master endpoint %s. Unregistered", endpoint)
+			monitor.master = ""
+		case monitor.standby:
+			glog.Infof("Standby %s is missed", endpoint)
+			monitor.standby = ""
+		default:
+			glog.V(1).Infof("Slave %s is missed. Unregistered", endpoint)
+			delete(monitor.slave, endpoint)
+		}
+		msops.Unregister(endpoint)
+		delete(monitor.missing, endpoint)
+	}
+}
+
+// listenDiscovery sends the instances found by disc to monitor
+func (monitor *MySQLMonitor) listenDiscovery(disc discovery.Discovery) {
+	for endpoints := range disc.WatchInstances(context.Background()) {
+		tmpList := make(map[string]interface{})
+		for _, endpoint := range endpoints {
+			tmpList[endpoint] = placeHolder
+		}
+		monitor.newEventChan <- tmpList
+	}
+}
+
+// checkRebuilding polls the progress of rebuilding instances from their agents in a goroutine, so
+// that the slow agents don't block the main loop. The statuses are applied by updateRebuilding.
+func (monitor *MySQLMonitor) checkRebuilding() {
+	if monitor.rebuildPolling || len(monitor.rebuilding) == 0 {
+		return
+	}
+	endpoints := make([]string, 0, len(monitor.rebuilding))
+	for endpoint := range monitor.rebuilding {
+		endpoints = append(endpoints, endpoint)
+	}
+	monitor.rebuildPolling = true
+	go func() {
+		statuses := make(map[string]agent.RebuildStatus, len(endpoints))
+		for _, endpoint := range endpoints {
+			status, _, err := requestAgent("GET", endpoint)
+			if err != nil {
+				glog.V(2).Infof("Get rebuild status of %s failed: %s", endpoint, err.Error())
 				continue
 			}
-			tmpList := make(map[string]interface{})
-			for _, appProc := range appProcs {
-				for _, instance := range appProc.Procs {
-					if instance.ProcName == "mysql-server" {
-						tmpList[fmt.Sprintf("%s-%d:%d", instance.ProcName, instance.InstanceNo, instance.Port)] = placeHolder
-					}
-				}
-			}
-			if !reflect.DeepEqual(tmpList, endpointList) {
-				monitor.newEventChan <- tmpList
-				endpointList = tmpList
-			}
-			time.Sleep(CooldownTime)
+			statuses[endpoint] = status
+		}
+		monitor.rebuildStatusChan <- statuses
+	}()
+}
+
+// updateRebuilding updates the progress of rebuilding instances, and registers the instance as an
+// active slave when its rebuilding is done. The instances dropped during the poll are skipped.
+func (monitor *MySQLMonitor) updateRebuilding(statuses map[string]agent.RebuildStatus) {
+	monitor.rebuildPolling = false
+	for endpoint, status := range statuses {
+		if _, exist := monitor.rebuilding[endpoint]; !exist {
+			continue
+		}
+		status := status
+		monitor.rebuilding[endpoint] = &status
+		if status.Stage != agent.RebuildDone {
+			continue
+		}
+		if _, exist := monitor.unregistered[endpoint]; !exist {
+			continue
+		}
+		if _, err := register(endpoint, ActionRegisterSlave); err != nil {
+			glog.Errorf("Register rebuilt instance %s failed: %s", endpoint, err.Error())
+			continue
+		}
+		if _, err := active(endpoint); err != nil {
+			glog.Errorf("Active rebuilt instance %s failed: %s", endpoint, err.Error())
 		}
-		time.Sleep(CooldownTime)
+		glog.Infof("%s is rebuilt and registered as slave", endpoint)
+		delete(monitor.rebuilding, endpoint)
+		monitor.saveConfig()
 	}
 }
 
@@ -275,9 +418,9 @@ func (monitor *MySQLMonitor) report() {
 		return
 	}
 
-	conn, err := net.DialTimeout("tcp", graphiteAddress, time.Second*2)
+	conn, err := net.DialTimeout("tcp", conf.GraphiteAddr, time.Second*2)
 	if err != nil {
-		glog.Errorf("Dial %s failed: %s", graphiteAddress, err.Error())
+		glog.Errorf("Dial %s failed: %s", conf.GraphiteAddr, err.Error())
 		return
 	}
 	defer conn.Close()
@@ -298,55 +441,70 @@ func (monitor *MySQLMonitor) getReportData() []string {
 	return data
 }
 
-//loadConfig loads role information from local files
+// loadConfig loads role information from local files
 func (monitor *MySQLMonitor) loadConfig() {
-	if data, err := load(masterConfig); err != nil {
+	if data, err := load(conf.path(masterConfig)); err != nil {
 		glog.Errorf("Load master config failed: %s", err.Error())
 	} else if len(data) == 1 {
 		monitor.master = data[0]
-		if err := msops.Register(monitor.master, dbaUser, SecretConf["dba_passwd"], replUser, SecretConf["repl_passwd"], connParam); err != nil {
+		if err := registerInstance(monitor.master); err != nil {
 			glog.Errorf("Register master failed: %s", err.Error())
 		}
 	}
 
-	if data, err := load(slaveConfig); err != nil {
+	if data, err := load(conf.path(slaveConfig)); err != nil {
 		glog.Errorf("Load slave config failed: %s", err.Error())
 	} else {
 		for _, endpoint := range data {
 			monitor.slave[endpoint] = placeHolder
-			if err := msops.Register(endpoint, dbaUser, SecretConf["dba_passwd"], replUser, SecretConf["repl_passwd"], connParam); err != nil {
+			if err := registerInstance(endpoint); err != nil {
 				glog.Errorf("Register slave failed: %s", err.Error())
 			}
 		}
 	}
 
-	if data, err := load(standbyConfig); err != nil {
+	if data, err := load(conf.path(standbyConfig)); err != nil {
 		glog.Errorf("Load standby config failed: %s", err.Error())
 	} else if len(data) == 1 {
 		monitor.standby = data[0]
-		if err := msops.Register(monitor.standby, dbaUser, SecretConf["dba_passwd"], replUser, SecretConf["repl_passwd"], connParam); err != nil {
+		if err := registerInstance(monitor.standby); err != nil {
 			glog.Errorf("Register standby failed: %s", err.Error())
 		}
 	}
 
+	if data, err := load(conf.path(rebuildConfig)); err != nil {
+		glog.Errorf("Load rebuilding config failed: %s", err.Error())
+	} else {
+		for _, endpoint := range data {
+			monitor.rebuilding[endpoint] = &agent.RebuildStatus{}
+		}
+	}
+
 	glog.Flush()
 }
 
-//saveConfig saves role information to local files
+// saveConfig saves role information to local files
 func (monitor *MySQLMonitor) saveConfig() {
-	if err := save(monitor.master, masterConfig); err != nil {
+	if err := save(monitor.master, conf.path(masterConfig)); err != nil {
 		glog.Errorf("Save master config failed: %s", err.Error())
 	}
 	slaveArr := make([]string, 0, len(monitor.slave))
 	for endpoint := range monitor.slave {
 		slaveArr = append(slaveArr, endpoint)
 	}
-	if err := save(strings.Join(slaveArr, "\n"), slaveConfig); err != nil {
+	if err := save(strings.Join(slaveArr, "\n"), conf.path(slaveConfig)); err != nil {
 		glog.Errorf("Save slave config failed: %s", err.Error())
 	}
-	if err := save(monitor.standby, standbyConfig); err != nil {
+	if err := save(monitor.standby, conf.path(standbyConfig)); err != nil {
 		glog.Errorf("Save standby config failed: %s", err.Error())
 	}
+	rebuildArr := make([]string, 0, len(monitor.rebuilding))
+	for endpoint := range monitor.rebuilding {
+		rebuildArr = append(rebuildArr, endpoint)
+	}
+	if err := save(strings.Join(rebuildArr, "\n"), conf.path(rebuildConfig)); err != nil {
+		glog.Errorf("Save rebuilding config failed: %s", err.Error())
+	}
 
 	glog.Flush()
 }
@@ -359,6 +517,30 @@ func (monitor *MySQLMonitor) handleGet(req GetRequest) {
 		resp.Data, resp.Code, resp.Err = getAllOverview()
 	case GetOneDetails:
 		resp.Data, resp.Code, resp.Err = getOneDetails(req.Params["endpoint"])
+	case GetRepairPlan:
+		resp.Data, resp.Code, resp.Err = getRepairPlan(req.Params["endpoint"])
+	case GetRoleInfo:
+		resp.Data, resp.Code, resp.Err = getRoleInfo(req.Params["endpoint"])
+	case GetBackups:
+		resp.Data, resp.Code, resp.Err = getBackups()
+	case GetCatalog:
+		resp.Data, resp.Code, resp.Err = getCatalog()
+	case GetMetrics:
+		resp.Data, resp.Code, resp.Err = getMetrics(req.Params["endpoint"], req.Params["range"])
+	case GetInnoDB:
+		resp.Data, resp.Code, resp.Err = getInnoDB(req.Params["endpoint"])
+	case GetSlowQueries:
+		if _, resp.Code, resp.Err = getInstance(req.Params["endpoint"]); resp.Err == nil {
+			go func() {
+				resp.Data, resp.Code, resp.Err = getSlowQueries(req.Params["endpoint"], req.Params["top"], req.Params["order"])
+				req.ResponseChan <- resp
+			}()
+			return
+		}
+	case GetSessions:
+		resp.Data, resp.Code, resp.Err = getSessions(req.Params["endpoint"])
+	case GetDatabases:
+		resp.Data, resp.Code, resp.Err = getDatabases()
 	}
 	req.ResponseChan <- resp
 }
@@ -374,16 +556,42 @@ func (monitor *MySQLMonitor) handlePatch(req PatchRequest) {
 		switch req.Action {
 		case ActionActive:
 			resp.Code, resp.Err = active(req.Endpoint)
+		case ActionCreateDatabase, ActionRotateDBUser, ActionDropDBUser, ActionSetQuota:
+			req.Endpoint = monitor.master
+			resp.Data, resp.Code, resp.Err = monitor.manageDatabase(req)
 		case ActionDetach:
 			resp.Code, resp.Err = detach(req.Endpoint)
+		case ActionKillConnection, ActionKillQuery, ActionKillSessions:
+			resp.Code, resp.Err = kill(req)
 		case ActionPause:
 			resp.Code, resp.Err = pause(req.Endpoint)
+		case ActionRebuild:
+			if resp.Code, resp.Err = rebuild(req.Endpoint); resp.Err == nil {
+				monitor.saveConfig()
+			}
 		case ActionRegisterMaster, ActionRegisterSlave, ActionRegisterStandby:
 			if resp.Code, resp.Err = register(req.Endpoint, req.Action); resp.Err == nil {
 				monitor.saveConfig()
 			}
+		case ActionRepairRebuild:
+			// The instance may be unregistered even if rebuilding fails to start
+			resp.Code, resp.Err = repairRebuild(req.Endpoint)
+			monitor.saveConfig()
 		case ActionResume:
 			resp.Code, resp.Err = resume(req.Endpoint)
+		case ActionRetrySQL:
+			resp.Code, resp.Err = retrySQL(req.Endpoint)
+		case ActionRotateDBA:
+			if resp.Code, resp.Err = monitor.rotatePassword(req, conf.DBAUser, keyDBAPassword); resp.Err == nil {
+				// The request is answered by updateRotation once the rotation is verified
+				return
+			}
+		case ActionRotateRepl:
+			if resp.Code, resp.Err = monitor.rotatePassword(req, conf.ReplUser, keyReplPassword); resp.Err == nil {
+				return
+			}
+		case ActionSkipTrx:
+			resp.Code, resp.Err = skipTransaction(req.Endpoint, req.Params["gtid"])
 		case ActionSwtich:
 			if resp.Code, resp.Err = switchToMaster(req.Endpoint); resp.Err == nil {
 				monitor.saveConfig()
@@ -392,7 +600,10 @@ func (monitor *MySQLMonitor) handlePatch(req PatchRequest) {
 			if resp.Code, resp.Err = unregister(req.Endpoint); resp.Err == nil {
 				monitor.saveConfig()
 			}
+		default:
+			resp.Code, resp.Err = http.StatusBadRequest, fmt.Errorf("Unknown action %s", req.Action)
 		}
 	}
+	audit(req, resp.Err)
 	req.ResponseChan <- resp
 }
@@ -0,0 +1,288 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ericpai/msops"
+	"github.com/go-sql-driver/mysql"
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/fake"
+)
+
+const (
+	testDBAPassword  = "dba-secret"
+	testReplPassword = "repl-secret"
+)
+
+func TestMain(m *testing.M) {
+	// The driver logs the connections closed by the fake servers which are down
+	mysql.SetLogger(log.New(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+// testCluster is a set of fake MySQL servers found by msMonitor, which are unregistered at first
+type testCluster struct {
+	t       *testing.T
+	dir     string
+	servers []*fake.MySQL
+}
+
+// newTestCluster configures monitor with a temporary ConfigDir and starts n fake servers, which are
+// stopped by close
+func newTestCluster(t *testing.T, n int) *testCluster {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ConfigDir = dir
+	cfg.SecretFile = filepath.Join(dir, "secret.conf")
+	conf = cfg
+	if err := writeSecretFile("dba_passwd=" + testDBAPassword + "\nrepl_passwd=" + testReplPassword + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	credentials = &credentialManager{
+		secrets: make(map[string]string),
+		rotated: make(map[string]rotatedPassword),
+	}
+	Configure(cfg)
+	msMonitor = newMonitor()
+
+	c := &testCluster{t: t, dir: dir}
+	for i := 0; i < n; i++ {
+		server, err := fake.NewMySQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.SetPassword(cfg.DBAUser, testDBAPassword)
+		server.SetPassword(cfg.ReplUser, testReplPassword)
+		c.servers = append(c.servers, server)
+		msMonitor.unregistered[server.Addr()] = placeHolder
+	}
+	return c
+}
+
+// close stops the servers and removes ConfigDir
+func (c *testCluster) close() {
+	for _, server := range c.servers {
+		msops.Unregister(server.Addr())
+		server.Close()
+	}
+	msMonitor.closeSamplers()
+	(*(msMonitor.es)).Close()
+	os.RemoveAll(c.dir)
+}
+
+// setup registers the first server as master, the second one as standby if withStandby,
+// and the others as slaves, and starts the replication
+func (c *testCluster) setup(withStandby bool) {
+	c.mustAccept(register(c.servers[0].Addr(), ActionRegisterMaster))
+	for i, server := range c.servers[1:] {
+		role := ActionRegisterSlave
+		if i == 0 && withStandby {
+			role = ActionRegisterStandby
+		}
+		c.mustAccept(register(server.Addr(), role))
+		c.mustAccept(active(server.Addr()))
+	}
+}
+
+func (c *testCluster) mustAccept(code int, err error) {
+	c.t.Helper()
+	if err != nil {
+		c.t.Fatalf("Unexpected error: %s (%d)", err.Error(), code)
+	}
+}
+
+// writeSecretFile writes the secret file with a new modification time, which is checked by credentials.load
+func writeSecretFile(secrets string) error {
+	if err := ioutil.WriteFile(conf.SecretFile, []byte(secrets), 0600); err != nil {
+		return err
+	}
+	modTime := time.Now().Add(time.Duration(secretFileVersion) * time.Second)
+	secretFileVersion++
+	return os.Chtimes(conf.SecretFile, modTime, modTime)
+}
+
+var secretFileVersion int
+
+func inspectRoles(t *testing.T) map[string][]string {
+	t.Helper()
+	roles := make(map[string][]string)
+	if err := json.Unmarshal([]byte(msMonitor.inspect()), &roles); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(roles[roleSlave])
+	return roles
+}
+
+func TestInspect(t *testing.T) {
+	c := newTestCluster(t, 4)
+	defer c.close()
+	c.setup(false)
+	master, lagging, broken, down := c.servers[0], c.servers[1], c.servers[2], c.servers[3]
+	master.Commit(3)
+
+	roles := inspectRoles(t)
+	expected := []string{lagging.Addr(), broken.Addr(), down.Addr()}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(roles[roleMaster], []string{master.Addr()}) || !reflect.DeepEqual(roles[roleSlave], expected) {
+		t.Fatalf("Unexpected roles of a healthy cluster: %v", roles)
+	}
+
+	lagging.SetReplicationLag(30)
+	broken.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	down.SetDown(true)
+	master.Commit(1)
+	roles = inspectRoles(t)
+	if !reflect.DeepEqual(roles[roleSlave], []string{lagging.Addr()}) {
+		t.Errorf("Only the syncing slave should be served, got %v", roles[roleSlave])
+	}
+	if st := msops.CheckReplication(broken.Addr(), master.Addr()); st != msops.ReplicationError {
+		t.Errorf("Replication of the broken slave is %d", st)
+	}
+
+	// The vendored driver doesn't ping on Ping, so the master is found down after
+	// the pooled connections fail in the first inspection
+	master.SetDown(true)
+	inspectRoles(t)
+	if roles = inspectRoles(t); len(roles[roleMaster]) != 0 {
+		t.Errorf("The master which is down should not be served, got %v", roles[roleMaster])
+	}
+
+	data, err := load(conf.path(slaveConfig))
+	if err != nil || len(data) != 3 {
+		t.Errorf("The slaves should be saved by inspect, got %v: %v", data, err)
+	}
+}
+
+func TestInspectStandby(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	c.setup(true)
+	master, standby := c.servers[0], c.servers[1]
+
+	if roles := inspectRoles(t); !reflect.DeepEqual(roles[roleStandby], []string{standby.Addr()}) {
+		t.Fatalf("The standby should be published, got %v", roles)
+	}
+	standby.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	master.Commit(1)
+	if roles := inspectRoles(t); len(roles[roleStandby]) != 0 {
+		t.Errorf("The standby with broken replication should not be served, got %v", roles[roleStandby])
+	}
+}
+
+func TestUpdateServersList(t *testing.T) {
+	c := newTestCluster(t, 4)
+	defer c.close()
+	c.setup(true)
+	master, standby, slave, unregistered := c.servers[0], c.servers[1], c.servers[2], c.servers[3]
+	msMonitor.unregistered[unregistered.Addr()] = placeHolder
+	delete(msMonitor.slave, unregistered.Addr())
+
+	msMonitor.updateServersList(map[string]interface{}{
+		master.Addr():  placeHolder,
+		slave.Addr():   placeHolder,
+		"new-1:3306":   placeHolder,
+		standby.Addr(): placeHolder,
+	})
+	if msMonitor.master != master.Addr() || msMonitor.standby != standby.Addr() {
+		t.Errorf("Master and standby should be kept, got %s and %s", msMonitor.master, msMonitor.standby)
+	}
+	if _, exist := msMonitor.unregistered[unregistered.Addr()]; exist {
+		t.Errorf("The missing unregistered instance should be removed")
+	}
+	if _, exist := msMonitor.unregistered["new-1:3306"]; !exist {
+		t.Errorf("The new instance should be unregistered")
+	}
+
+	// A transient list missing master and standby doesn't drop their roles
+	msMonitor.updateServersList(map[string]interface{}{slave.Addr(): placeHolder})
+	if msMonitor.master != master.Addr() || msMonitor.standby != standby.Addr() {
+		t.Fatalf("The missing master and standby should be kept, got %s and %s", msMonitor.master, msMonitor.standby)
+	}
+	if len(msMonitor.missing) != 2 {
+		t.Errorf("Master and standby should be missing, got %v", msMonitor.missing)
+	}
+	if len(msMonitor.unregistered) != 0 {
+		t.Errorf("The missing unregistered instances should be removed, got %v", msMonitor.unregistered)
+	}
+	all := map[string]interface{}{master.Addr(): placeHolder, standby.Addr(): placeHolder, slave.Addr(): placeHolder}
+	msMonitor.updateServersList(all)
+	if len(msMonitor.missing) != 0 {
+		t.Errorf("The instances found again should not be missing, got %v", msMonitor.missing)
+	}
+
+	// Only the unreachable master is dropped after the grace events, the reachable standby is kept
+	conf.MissingGraceEvents = 2
+	master.SetDown(true)
+	// The vendored driver doesn't ping on Ping, so the master is found down after the pooled connections fail
+	inspectRoles(t)
+	for i := 0; i < 2; i++ {
+		msMonitor.updateServersList(map[string]interface{}{slave.Addr(): placeHolder})
+	}
+	if msMonitor.master != "" {
+		t.Errorf("The missing master should be removed, got %s", msMonitor.master)
+	}
+	if msops.CheckInstance(master.Addr()) != msops.InstanceUnregistered {
+		t.Errorf("The missing master should be unregistered from msops")
+	}
+	if msMonitor.standby != standby.Addr() {
+		t.Errorf("The reachable standby should be kept, got %s", msMonitor.standby)
+	}
+	if _, exist := msMonitor.slave[slave.Addr()]; !exist {
+		t.Errorf("The slave should be kept")
+	}
+	if missing := msMonitor.missing[standby.Addr()]; missing == nil || missing.Events != 2 {
+		t.Errorf("The standby should be missing in 2 lists, got %v", missing)
+	}
+}
+
+func TestCheckRebuilding(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	rebuilt := c.servers[0].Addr()
+	msMonitor.rebuilding[rebuilt] = &agent.RebuildStatus{Stage: agent.RebuildDownloading}
+
+	// The agents are polled outside the main loop, and only one poll runs at a time
+	msMonitor.checkRebuilding()
+	if !msMonitor.rebuildPolling {
+		t.Fatalf("The rebuild status should be polling")
+	}
+	msMonitor.checkRebuilding()
+	select {
+	case statuses := <-msMonitor.rebuildStatusChan:
+		if len(statuses) != 0 {
+			t.Errorf("No agent is running, got %v", statuses)
+		}
+		msMonitor.updateRebuilding(statuses)
+	case <-time.After(conf.AgentTimeout + time.Second):
+		t.Fatalf("The rebuild status is not polled")
+	}
+	select {
+	case <-msMonitor.rebuildStatusChan:
+		t.Errorf("Only one poll should run at a time")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if msMonitor.rebuildPolling || msMonitor.rebuilding[rebuilt].Stage != agent.RebuildDownloading {
+		t.Errorf("The status should be kept if the agent can't be reached, got %+v", msMonitor.rebuilding[rebuilt])
+	}
+
+	// The status polled before the instance is dropped is ignored
+	msMonitor.updateServersList(map[string]interface{}{})
+	if _, exist := msMonitor.rebuilding[rebuilt]; exist {
+		t.Errorf("The rebuilding of the dropped instance should be removed")
+	}
+	msMonitor.updateRebuilding(map[string]agent.RebuildStatus{rebuilt: {Stage: agent.RebuildDone}})
+	if _, exist := msMonitor.rebuilding[rebuilt]; exist {
+		t.Errorf("The dropped instance should not be rebuilding again")
+	}
+}
@@ -0,0 +1,266 @@
+package monitor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/glog"
+)
+
+const (
+	// quotaFile is the file in ConfigDir saving the quotas of the application databases
+	quotaFile = "quotas"
+	// errNoSuchUser is returned by GRANT to an account not existing, as sessions of openGrantSession
+	// never create it
+	errNoSuchUser = 1133
+)
+
+// writePrivileges are revoked from the users of a database blocked by its quota, with their columns
+// in mysql.db. DELETE and DROP are kept, so that the application can free the space.
+var writePrivileges = []struct{ name, column string }{
+	{"INSERT", "Insert_priv"}, {"UPDATE", "Update_priv"}, {"CREATE", "Create_priv"}, {"ALTER", "Alter_priv"},
+	{"INDEX", "Index_priv"}, {"CREATE TEMPORARY TABLES", "Create_tmp_table_priv"}, {"CREATE VIEW", "Create_view_priv"},
+	{"CREATE ROUTINE", "Create_routine_priv"}, {"ALTER ROUTINE", "Alter_routine_priv"}, {"EVENT", "Event_priv"},
+	{"TRIGGER", "Trigger_priv"},
+}
+
+// Quota is the limits of an application database. The zero values are unlimited.
+type Quota struct {
+	// MaxConnections is MAX_USER_CONNECTIONS of each user of the database, enforced by MySQL
+	MaxConnections int
+	// MaxSize is the bytes of the tables of the database, checked every QuotaCheckInterval
+	MaxSize int64
+	// Block revokes writePrivileges from the users when the database exceeds MaxSize, which are
+	// granted back once it's below MaxSize. Otherwise only an alert is raised.
+	Block bool
+	// Blocked is whether writePrivileges are revoked by monitor
+	Blocked bool
+	// Revoked is the privileges revoked from each account, and only these are granted back
+	Revoked []RevokedGrant `json:",omitempty"`
+}
+
+// RevokedGrant is the writePrivileges an account held on a database when it's blocked
+type RevokedGrant struct {
+	User       string
+	Host       string
+	Privileges []string
+}
+
+func (quota Quota) unlimited() bool {
+	return quota.MaxConnections == 0 && quota.MaxSize == 0 && !quota.Block
+}
+
+// parseSize parses the bytes with an optional unit K, M, G or T, e.g. "512M"
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(value), "B"))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if i := strings.IndexByte("KMGT", value[len(value)-1]); i >= 0 {
+		multiplier = 1 << (10 * uint(i+1))
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
+
+func (monitor *MySQLMonitor) loadQuotas() {
+	if data, err := ioutil.ReadFile(conf.path(quotaFile)); err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("Load quotas failed: %s", err.Error())
+		}
+	} else if err = json.Unmarshal(data, &monitor.quotas); err != nil {
+		glog.Errorf("Unmarshal quotas failed: %s", err.Error())
+	}
+}
+
+func (monitor *MySQLMonitor) saveQuotas() error {
+	data, _ := json.Marshal(monitor.quotas)
+	err := ioutil.WriteFile(conf.path(quotaFile), data, 0644)
+	if err != nil {
+		glog.Errorf("Save quotas failed: %s", err.Error())
+	}
+	return err
+}
+
+// userConnections returns the number of connections of each user on master
+func userConnections() map[string]int {
+	connections := make(map[string]int)
+	processes, err := fullProcessList(msMonitor.master)
+	if err != nil {
+		glog.V(2).Infof("Get process list of %s failed: %s", msMonitor.master, err.Error())
+	}
+	for _, process := range processes {
+		connections[process.User]++
+	}
+	return connections
+}
+
+// setQuota sets the quota of the database from params max_connections, max_size and block. The
+// connection limit is set to the users of the database on master immediately.
+func (monitor *MySQLMonitor) setQuota(name string, params map[string]string) (int, error) {
+	var quota Quota
+	var err error
+	if value := params["max_connections"]; value != "" {
+		if quota.MaxConnections, err = strconv.Atoi(value); err != nil || quota.MaxConnections < 0 {
+			return http.StatusBadRequest, fmt.Errorf("Invalid max_connections %s", value)
+		}
+	}
+	if quota.MaxSize, err = parseSize(params["max_size"]); err != nil {
+		return http.StatusBadRequest, err
+	}
+	quota.Block, _ = strconv.ParseBool(params["block"])
+	if monitor.master == "" {
+		return http.StatusForbidden, fmt.Errorf("Master is not registered")
+	}
+	db, err := openGrantSession(monitor.master)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	if code, err := checkDBAPrivileges(db); err != nil {
+		return code, err
+	}
+	databases, err := appDatabases(db)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	index := sort.Search(len(databases), func(i int) bool { return databases[i].Name >= name })
+	if index == len(databases) || databases[index].Name != name {
+		return http.StatusNotFound, fmt.Errorf("Database %s is not found", name)
+	}
+	database := databases[index]
+
+	glog.Infof("Set quota of %s: %+v", name, quota)
+	for _, account := range database.accounts {
+		if _, err = db.Exec(fmt.Sprintf("GRANT USAGE ON *.* TO '%s'@'%s' WITH MAX_USER_CONNECTIONS %d",
+			account.User, account.Host, quota.MaxConnections)); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("Limit the connections of %s@%s failed: %s", account.User, account.Host, err.Error())
+		}
+	}
+	if prev, exist := monitor.quotas[name]; exist && prev.Blocked {
+		quota.Blocked, quota.Revoked = true, prev.Revoked
+	}
+	if quota.unlimited() && !quota.Blocked {
+		delete(monitor.quotas, name)
+	} else {
+		monitor.quotas[name] = &quota
+	}
+	if err = monitor.saveQuotas(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// The database is blocked or unblocked by the new quota at once
+	monitor.checkQuotas()
+	return http.StatusAccepted, nil
+}
+
+// setBlocked revokes writePrivileges held by the accounts of the database, and kills their connections
+// so that the clients reconnect with the privileges revoked. The revoked privileges are saved in
+// quota, and only these are granted back when the database is unblocked. The accounts dropped since
+// then are skipped.
+func setBlocked(db *sql.DB, database DatabaseView, quota *Quota, blocked bool) error {
+	if !blocked {
+		for len(quota.Revoked) > 0 {
+			revoked := quota.Revoked[0]
+			_, err := db.Exec(fmt.Sprintf("GRANT %s ON `%s`.* TO '%s'@'%s'", strings.Join(revoked.Privileges, ", "),
+				grantName(database.Name), revoked.User, revoked.Host))
+			if e, ok := err.(*mysql.MySQLError); ok && e.Number == errNoSuchUser {
+				glog.Warningf("%s@%s is dropped, so its privileges on %s are not granted back", revoked.User, revoked.Host, database.Name)
+			} else if err != nil {
+				return err
+			}
+			quota.Revoked = quota.Revoked[1:]
+		}
+		return nil
+	}
+	for _, account := range database.accounts {
+		if len(account.Writes) == 0 {
+			continue
+		}
+		stmt := fmt.Sprintf("REVOKE %s ON `%s`.* FROM '%s'@'%s'", strings.Join(account.Writes, ", "),
+			grantName(database.Name), account.User, account.Host)
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+		quota.Revoked = append(quota.Revoked, RevokedGrant{User: account.User, Host: account.Host, Privileges: account.Writes})
+		if killed, _, err := killSessions(msMonitor.master, SessionFilter{User: account.User}, killModeConnection); err != nil {
+			glog.Errorf("Kill the connections of %s failed: %s", account.User, err.Error())
+		} else {
+			glog.Infof("%d connections of %s are killed as %s is blocked", len(killed), account.User, database.Name)
+		}
+	}
+	return nil
+}
+
+// checkQuotas checks the sizes and the connections of the databases with quotas on master, and
+// blocks or unblocks the databases. The exceeded quotas are raised as alerts by checkAlerts.
+func (monitor *MySQLMonitor) checkQuotas() {
+	exceeded := make(map[string]string)
+	defer func() { monitor.quotaAlerts = exceeded }()
+	if monitor.master == "" || len(monitor.quotas) == 0 {
+		return
+	}
+	db, err := openGrantSession(monitor.master)
+	if err != nil {
+		glog.Errorf("Check quotas failed: %s", err.Error())
+		return
+	}
+	defer db.Close()
+	databases, err := appDatabases(db)
+	if err != nil {
+		glog.Errorf("Check quotas failed: %s", err.Error())
+		return
+	}
+	connections := userConnections()
+	changed := false
+	for _, database := range databases {
+		quota, exist := monitor.quotas[database.Name]
+		if !exist {
+			continue
+		}
+		var summaries []string
+		overSize := quota.MaxSize > 0 && database.Size > quota.MaxSize
+		if overSize {
+			summaries = append(summaries, fmt.Sprintf("Database %s is %s, over the quota %s",
+				database.Name, formatSize(database.Size), formatSize(quota.MaxSize)))
+		}
+		for _, user := range database.Users {
+			if n := connections[user]; quota.MaxConnections > 0 && n >= quota.MaxConnections {
+				summaries = append(summaries, fmt.Sprintf("User %s has %d connections, reaching the limit %d",
+					user, n, quota.MaxConnections))
+			}
+		}
+		if len(summaries) > 0 {
+			exceeded[database.Name] = strings.Join(summaries, "; ")
+		}
+
+		if block := overSize && quota.Block; block != quota.Blocked {
+			// The privileges revoked or granted back before a failure are saved as well
+			changed = true
+			if err = setBlocked(db, database, quota, block); err != nil {
+				glog.Errorf("Set blocked of %s to %v failed: %s", database.Name, block, err.Error())
+				continue
+			}
+			glog.Warningf("Writes to %s are blocked: %v", database.Name, block)
+			quota.Blocked = block
+			if quota.unlimited() && !quota.Blocked {
+				delete(monitor.quotas, database.Name)
+			}
+		}
+	}
+	if changed {
+		monitor.saveQuotas()
+	}
+}
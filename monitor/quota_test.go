@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"": 0, "1024": 1024, "512M": 512 << 20, "2g": 2 << 30, "10KB": 10 << 10} {
+		if size, err := parseSize(value); err != nil || size != expected {
+			t.Errorf("Size of %q should be %d, got %d %v", value, expected, size, err)
+		}
+	}
+	if _, err := parseSize("-1G"); err == nil {
+		t.Errorf("Negative size should be rejected")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	c.setup(false)
+	master := c.servers[0]
+	if _, _, err := createDatabase("shop", ""); err != nil {
+		t.Fatal(err)
+	}
+	// The quota is granted to the hosts of the accounts, and only the privileges held are revoked
+	master.SetHost("shop", "10.0.%")
+	if err := execInSession(master.Addr(), "CREATE USER 'report'@'%' IDENTIFIED BY 'report'",
+		"GRANT SELECT, INSERT ON `shop`.* TO 'report'@'%'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := msMonitor.setQuota("missing", map[string]string{"max_size": "1M"}); code != http.StatusNotFound {
+		t.Errorf("Quota of an unknown database should be rejected, got %d", code)
+	}
+	c.mustAccept(msMonitor.setQuota("shop", map[string]string{"max_connections": "2", "max_size": "1M", "block": "true"}))
+	if n := master.MaxUserConnections("shop"); n != 2 {
+		t.Errorf("MAX_USER_CONNECTIONS of shop should be 2, got %d", n)
+	}
+	if len(msMonitor.quotaAlerts) != 0 || msMonitor.quotas["shop"].Blocked {
+		t.Fatalf("The quota should not be exceeded: %v", msMonitor.quotaAlerts)
+	}
+
+	master.SetDatabaseSize("shop", 2<<20)
+	master.AddQuery("shop", "10.0.0.1:40000", "shop", "SELECT 1", 1)
+	master.AddQuery("shop", "10.0.0.1:40001", "shop", "SELECT 2", 1)
+	master.ResetStatements()
+	msMonitor.checkQuotas()
+	if summary := msMonitor.quotaAlerts["shop"]; !strings.Contains(summary, "over the quota") || !strings.Contains(summary, "reaching the limit 2") {
+		t.Errorf("Unexpected alert of the quota: %q", summary)
+	}
+	if !msMonitor.quotas["shop"].Blocked || !hasStatement(master.Statements(), "REVOKE INSERT") {
+		t.Errorf("Writes to shop should be revoked, got %v", master.Statements())
+	}
+	if privileges := master.Privileges("report", "shop"); !reflect.DeepEqual(privileges, []string{"SELECT"}) {
+		t.Errorf("Only INSERT should be revoked from report, got %v", privileges)
+	}
+	if privileges := master.Privileges("shop", "shop"); containsString(privileges, "UPDATE") || !containsString(privileges, "DELETE") {
+		t.Errorf("Writes except DELETE and DROP should be revoked from shop, got %v", privileges)
+	}
+	if n := master.ProcessCount("shop"); n != 0 {
+		t.Errorf("The connections of shop should be killed when blocked, got %d", n)
+	}
+	msMonitor.checkAlerts()
+	found := false
+	for _, alert := range FiringAlerts() {
+		found = found || alert.Rule == RuleQuotaExceeded && alert.Subject == "shop"
+	}
+	if !found {
+		t.Errorf("The exceeded quota should be alerted, got %+v", FiringAlerts())
+	}
+
+	master.SetDatabaseSize("shop", 1<<10)
+	master.ResetStatements()
+	msMonitor.checkQuotas()
+	if msMonitor.quotas["shop"].Blocked || !hasStatement(master.Statements(), "GRANT INSERT") || len(msMonitor.quotaAlerts) != 0 {
+		t.Errorf("Writes to shop should be granted back, got %v", master.Statements())
+	}
+	if privileges := master.Privileges("report", "shop"); !reflect.DeepEqual(privileges, []string{"INSERT", "SELECT"}) {
+		t.Errorf("Only the revoked INSERT should be granted back to report, got %v", privileges)
+	}
+	if privileges := master.Privileges("shop", "shop"); len(privileges) != 18 || len(msMonitor.quotas["shop"].Revoked) != 0 {
+		t.Errorf("The privileges of shop should be granted back, got %v", privileges)
+	}
+
+	loaded := newMonitor()
+	loaded.loadQuotas()
+	if quota := loaded.quotas["shop"]; quota == nil || quota.MaxSize != 1<<20 || !quota.Block {
+		t.Errorf("The quota is not saved: %+v", quota)
+	}
+	c.mustAccept(msMonitor.setQuota("shop", map[string]string{}))
+	if _, exist := msMonitor.quotas["shop"]; exist || master.MaxUserConnections("shop") != 0 {
+		t.Errorf("The quota should be removed")
+	}
+}
+
+func hasStatement(statements []string, prefix string) bool {
+	for _, stmt := range statements {
+		if strings.HasPrefix(stmt, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package monitor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ericpai/msops"
+)
+
+const (
+	// RoleAnonymous is the console role of the web users when SSO is disabled
+	RoleAnonymous = "anonymous"
+
+	killModeQuery      = "query"
+	killModeConnection = "connection"
+)
+
+// SessionFilter selects the sessions killed by ActionKillSessions. Empty fields match all the sessions,
+// but at least one of User, Client, DB and MinTime must be set.
+type SessionFilter struct {
+	User string
+	// Client is the prefix of the client host, e.g. "10.0.1." or "10.0.1.5"
+	Client  string
+	DB      string
+	Command string
+	// MinTime is the seconds the session has been in its current state
+	MinTime int
+}
+
+func newSessionFilter(params map[string]string) (SessionFilter, error) {
+	filter := SessionFilter{
+		User:    params["user"],
+		Client:  params["client"],
+		DB:      params["db"],
+		Command: params["command"],
+	}
+	if value := params["min_time"]; value != "" {
+		var err error
+		if filter.MinTime, err = strconv.Atoi(value); err != nil || filter.MinTime < 0 {
+			return filter, fmt.Errorf("Invalid min_time %s", value)
+		}
+	}
+	if filter.User == "" && filter.Client == "" && filter.DB == "" && filter.MinTime == 0 {
+		return filter, fmt.Errorf("At least one of user, client, db and min_time is required")
+	}
+	return filter, nil
+}
+
+func (filter SessionFilter) match(process msops.Process) bool {
+	host := process.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return (filter.User == "" || process.User == filter.User) &&
+		(filter.Client == "" || strings.HasPrefix(host, filter.Client)) &&
+		(filter.DB == "" || process.DB == filter.DB) &&
+		(filter.Command == "" || process.Command == filter.Command) &&
+		process.Time >= filter.MinTime
+}
+
+// killAllowed returns whether the console role is allowed to kill sessions
+func killAllowed(role string) bool {
+	return roleAllowed(role, conf.KillRoles)
+}
+
+// roleAllowed returns whether the console role is in the comma separated roles. The empty role is
+// anonymous.
+func roleAllowed(role, roles string) bool {
+	if role == "" {
+		role = RoleAnonymous
+	}
+	for _, allowed := range splitList(roles) {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+func isSysUser(user string) bool {
+	for _, sysUser := range sysUsers() {
+		if user == sysUser {
+			return true
+		}
+	}
+	return false
+}
+
+// fullProcessList returns the processes with the whole queries, which "SHOW PROCESSLIST" truncates
+// to 100 characters
+func fullProcessList(endpoint string) ([]msops.Process, error) {
+	db, err := openSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SHOW FULL PROCESSLIST")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var processes []msops.Process
+	for rows.Next() {
+		var (
+			process                   msops.Process
+			user, host, schema, state sql.NullString
+			command, info             sql.NullString
+			seconds                   sql.NullInt64
+		)
+		if err = rows.Scan(&process.ID, &user, &host, &schema, &command, &seconds, &state, &info); err != nil {
+			return nil, err
+		}
+		process.User, process.Host, process.DB = user.String, host.String, schema.String
+		process.Command, process.Time, process.State, process.Info = command.String, int(seconds.Int64), state.String, info.String
+		processes = append(processes, process)
+	}
+	return processes, rows.Err()
+}
+
+// killStatement returns the statement killing the query or the connection of the process
+func killStatement(mode string, id int) (string, error) {
+	switch mode {
+	case killModeQuery:
+		return fmt.Sprintf("KILL QUERY %d", id), nil
+	case killModeConnection, "":
+		return fmt.Sprintf("KILL CONNECTION %d", id), nil
+	}
+	return "", fmt.Errorf("Unknown kill mode %s", mode)
+}
+
+// killSession kills the query or the connection of one session. The sessions of system users are
+// never killed, as the monitor and the replication depend on them.
+func killSession(endpoint, id, mode string) (int, error) {
+	processID, err := strconv.Atoi(id)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid session id %s", id)
+	}
+	stmt, err := killStatement(mode, processID)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	processes, err := fullProcessList(endpoint)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, process := range processes {
+		if process.ID != processID {
+			continue
+		}
+		if isSysUser(process.User) {
+			return http.StatusForbidden, fmt.Errorf("Session %d of system user %s can't be killed", processID, process.User)
+		}
+		if err = execInSession(endpoint, stmt); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusAccepted, nil
+	}
+	return http.StatusNotFound, fmt.Errorf("Session %d is not found on %s", processID, endpoint)
+}
+
+// killSessions kills the queries or the connections of the sessions matching the filter, and
+// returns the ids of the sessions killed
+func killSessions(endpoint string, filter SessionFilter, mode string) ([]int, int, error) {
+	if _, err := killStatement(mode, 0); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	processes, err := fullProcessList(endpoint)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	var killed []int
+	statements := make([]string, 0, len(processes))
+	for _, process := range processes {
+		if isSysUser(process.User) || !filter.match(process) {
+			continue
+		}
+		if mode == killModeQuery && process.Command != "Query" {
+			continue
+		}
+		stmt, _ := killStatement(mode, process.ID)
+		statements = append(statements, stmt)
+		killed = append(killed, process.ID)
+	}
+	if len(statements) == 0 {
+		return killed, http.StatusAccepted, nil
+	}
+	db, err := openSession(endpoint)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+	// The sessions may exit by themselves in the meanwhile, so only the ones killed are returned
+	done := killed[:0]
+	for i, stmt := range statements {
+		if _, err = db.Exec(stmt); err == nil {
+			done = append(done, killed[i])
+		}
+	}
+	return done, http.StatusAccepted, nil
+}
+
+// kill handles the kill actions of req, and records the sessions killed in req.Params for the audit log.
+// Only the sessions of the instances known by monitor are killed.
+func kill(req PatchRequest) (int, error) {
+	if !killAllowed(req.Role) {
+		return http.StatusForbidden, fmt.Errorf("Role %s is not allowed to kill sessions", req.Role)
+	}
+	if _, code, err := getInstance(req.Endpoint); err != nil {
+		return code, err
+	}
+	if req.Action == ActionKillQuery || req.Action == ActionKillConnection {
+		mode := killModeConnection
+		if req.Action == ActionKillQuery {
+			mode = killModeQuery
+		}
+		code, err := killSession(req.Endpoint, req.Params["id"], mode)
+		if err == nil {
+			req.Params["killed"] = req.Params["id"]
+		}
+		return code, err
+	}
+	filter, err := newSessionFilter(req.Params)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	killed, code, err := killSessions(req.Endpoint, filter, req.Params["mode"])
+	ids := make([]string, 0, len(killed))
+	for _, id := range killed {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	req.Params["killed"] = strings.Join(ids, ",")
+	return code, err
+}
+
+// getSessions returns the full process list of the instance
+func getSessions(endpoint string) ([]byte, int, error) {
+	if _, code, err := getInstance(endpoint); err != nil {
+		return nil, code, err
+	}
+	processes, err := fullProcessList(endpoint)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	data, err := json.Marshal(processes)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
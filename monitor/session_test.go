@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKillSessions(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	c.setup(false)
+	master := c.servers[0]
+	longQuery := "SELECT * FROM orders WHERE note = '" + strings.Repeat("x", 200) + "'"
+	slowID := master.AddQuery("app", "10.0.1.5:40000", "orders", longQuery, 120)
+	fastID := master.AddQuery("app", "10.0.1.6:40000", "orders", "SELECT 1", 1)
+	otherID := master.AddQuery("report", "10.0.2.1:40000", "stats", "SELECT 2", 300)
+	rootID := master.AddQuery("root", "localhost", "", "SELECT 3", 300)
+
+	processes, err := fullProcessList(master.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, process := range processes {
+		if process.ID == slowID && process.Info != longQuery {
+			t.Errorf("The full process list should not truncate the query, got %q", process.Info)
+		}
+	}
+
+	patch := func(action PatchAction, role string, params map[string]string) PatchRequest {
+		req := PatchRequest{Action: action, Endpoint: master.Addr(), Params: params, Operator: "tester", Role: role}
+		code, err := kill(req)
+		audit(req, err)
+		if role == "normal" {
+			if code != http.StatusForbidden {
+				t.Errorf("Role normal should not kill sessions, got %d", code)
+			}
+			return req
+		}
+		c.mustAccept(code, err)
+		return req
+	}
+	patch(ActionKillQuery, "normal", map[string]string{"id": "1"})
+	if code, err := killSession(master.Addr(), "1000", killModeQuery); err == nil || code != http.StatusNotFound {
+		t.Errorf("Killing an unknown session should be not found, got %d", code)
+	}
+	if code, err := killSession(master.Addr(), strconv.Itoa(rootID), killModeConnection); err == nil || code != http.StatusForbidden {
+		t.Errorf("The session of root should not be killed, got %d", code)
+	}
+	if _, err := newSessionFilter(map[string]string{"command": "Query"}); err == nil {
+		t.Errorf("The filter killing all the sessions should be rejected")
+	}
+
+	if code, _ := kill(PatchRequest{Action: ActionKillQuery, Endpoint: master.Addr(), Params: map[string]string{"id": "1"}, Role: RoleAnonymous}); code != http.StatusForbidden {
+		t.Errorf("Role anonymous should not kill sessions by default, got %d", code)
+	}
+	if code, _ := kill(PatchRequest{Action: ActionKillQuery, Endpoint: "127.0.0.1:1", Params: map[string]string{"id": "1"}, Role: "admin"}); code != http.StatusNotFound {
+		t.Errorf("Killing the sessions of an unknown instance should be not found, got %d", code)
+	}
+
+	req := patch(ActionKillSessions, "owner", map[string]string{"user": "app", "client": "10.0.1.", "min_time": "60", "mode": "query"})
+	if req.Params["killed"] != strconv.Itoa(slowID) {
+		t.Errorf("Only the slow query of app should be killed, got %q", req.Params["killed"])
+	}
+	if command, info, exist := master.Process(slowID); !exist || command != "Sleep" || info != "" {
+		t.Errorf("Killing the query should keep the connection, got %v %q %q", exist, command, info)
+	}
+	if command, _, _ := master.Process(fastID); command != "Query" {
+		t.Errorf("The fast query should not be killed")
+	}
+
+	patch(ActionKillConnection, "admin", map[string]string{"id": strconv.Itoa(otherID)})
+	if _, _, exist := master.Process(otherID); exist {
+		t.Errorf("The connection %d should be killed", otherID)
+	}
+	if _, _, exist := master.Process(rootID); !exist {
+		t.Errorf("The session of root should not be killed")
+	}
+
+	file, err := os.Open(conf.path(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []AuditRecord
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record AuditRecord
+		json.Unmarshal(scanner.Bytes(), &record)
+		records = append(records, record)
+	}
+	if len(records) != 3 || records[0].Role != "normal" || records[0].Result == "OK" ||
+		records[1].Params["killed"] != strconv.Itoa(slowID) || records[2].Action != string(ActionKillConnection) {
+		t.Errorf("Unexpected audit records: %+v", records)
+	}
+}
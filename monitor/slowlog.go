@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/laincloud/mysql-service/agent"
+)
+
+// getSlowQueries returns the top digests of the slow log analyzed by the agent running with endpoint.
+// It's called outside the main loop, since the agent may be slow, and the caller checks the endpoint.
+func getSlowQueries(endpoint, top, order string) ([]byte, int, error) {
+	var data []byte
+	location, err := agentURL(endpoint, agent.SlowLogLocation)
+	if err != nil {
+		return data, http.StatusBadRequest, err
+	}
+	query := url.Values{"top": {top}, "order": {order}}
+	resp, err := doAgentTimeout("GET", location+"?"+query.Encode(), conf.SlowLogTimeout)
+	if err != nil {
+		return data, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	var report agent.SlowLogReport
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return data, http.StatusBadGateway, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return data, resp.StatusCode, fmt.Errorf("agent returns %s: %s", resp.Status, report.Error)
+	}
+	if data, err = json.Marshal(report); err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
@@ -0,0 +1,59 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/agent"
+)
+
+func TestGetSlowQueries(t *testing.T) {
+	c := newTestCluster(t, 1)
+	defer c.close()
+	c.setup(false)
+	master := c.servers[0].Addr()
+	release := make(chan bool)
+	server := startAgent(t, func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		json.NewEncoder(rw).Encode(agent.SlowLogReport{Entries: 3, Order: req.FormValue("order")})
+	})
+	defer server.Close()
+	defer close(release)
+	conf.AgentTimeout = 10 * time.Millisecond
+
+	// The main loop doesn't wait for the agent
+	req := GetRequest{
+		RequestType:  GetSlowQueries,
+		Params:       map[string]string{"endpoint": master, "order": "count"},
+		ResponseChan: make(chan GetResponse, 1),
+	}
+	msMonitor.handleGet(req)
+	if len(req.ResponseChan) != 0 {
+		t.Fatalf("The slow queries should be returned after the agent responds")
+	}
+	release <- true
+	resp := <-req.ResponseChan
+	var report agent.SlowLogReport
+	if resp.Err != nil {
+		t.Fatalf("The slow log requests should not time out by agent_timeout: %s", resp.Err.Error())
+	}
+	if err := json.Unmarshal(resp.Data, &report); err != nil || report.Entries != 3 || report.Order != "count" {
+		t.Errorf("Unexpected report %s", resp.Data)
+	}
+
+	conf.SlowLogTimeout = 10 * time.Millisecond
+	if _, code, err := getSlowQueries(master, "", ""); err == nil || code != http.StatusBadGateway {
+		t.Errorf("The slow log request should time out by slowlog_timeout, got %d", code)
+	}
+
+	msMonitor.handleGet(GetRequest{
+		RequestType:  GetSlowQueries,
+		Params:       map[string]string{"endpoint": "127.0.0.1:1"},
+		ResponseChan: req.ResponseChan,
+	})
+	if resp = <-req.ResponseChan; resp.Code != http.StatusNotFound {
+		t.Errorf("An unknown instance should not be requested, got %d", resp.Code)
+	}
+}
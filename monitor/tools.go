@@ -2,15 +2,16 @@ package monitor
 
 import (
 	"bufio"
+	"database/sql"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ericpai/msops"
-	"github.com/golang/glog"
 )
 
 func save(data, fileName string) error {
@@ -42,25 +43,73 @@ func GetLainConf(key string) ([]byte, error) {
 	return lainletClient.Get("/v2/configwatcher?target="+key, 2*time.Second)
 }
 
-func getSecretConf() map[string]string {
-	conf := make(map[string]string)
-	if secretFile, err := os.Open(secretFileName); err == nil {
-		defer secretFile.Close()
-		bfRd := bufio.NewReader(secretFile)
-		for {
-			line, err := bfRd.ReadString('\n')
-			line = strings.TrimRight(line, "\n")
-			if err != nil || line == "" {
-				break
-			}
-			if lineArr := strings.SplitN(line, "=", 2); len(lineArr) == 2 {
-				conf[strings.TrimSpace(lineArr[0])] = strings.TrimSpace(lineArr[1])
-			}
+// execInSession executes the statements one by one in a dedicated connection to endpoint,
+// so that session variables like GTID_NEXT are kept between the statements.
+func execInSession(endpoint string, statements ...string) error {
+	db, err := openSession(endpoint)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range statements {
+		if _, err = db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %s", stmt, err.Error())
 		}
-	} else {
-		glog.Errorf("Cann't open secret file: %s", secretFileName)
 	}
-	return conf
+	return nil
+}
+
+// openSession opens a dedicated connection to endpoint as the dba user
+func openSession(endpoint string) (*sql.DB, error) {
+	return openSessionWith(endpoint, nil)
+}
+
+// openGrantSession opens a session in which GRANT fails instead of creating the account if it
+// doesn't exist, as the account of a user may be on another host than '%'
+func openGrantSession(endpoint string) (*sql.DB, error) {
+	return openSessionWith(endpoint, map[string]string{"sql_mode": "CONCAT(@@sql_mode, ',NO_AUTO_CREATE_USER')"})
+}
+
+// openSessionWith opens a session with connParam and the extra session variables
+func openSessionWith(endpoint string, variables map[string]string) (*sql.DB, error) {
+	return openSessionAs(endpoint, dbaPassword(), variables)
+}
+
+// openSessionAs opens a session as the dba user with password, which may differ from the current one
+// during a password rotation
+func openSessionAs(endpoint, password string, variables map[string]string) (*sql.DB, error) {
+	params := make([]string, 0, len(connParam)+len(variables))
+	for key, value := range connParam {
+		params = append(params, fmt.Sprintf("%s=%s", key, value))
+	}
+	for key, value := range variables {
+		params = append(params, fmt.Sprintf("%s=%s", key, url.QueryEscape(value)))
+	}
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/?%s", conf.DBAUser, password, endpoint, strings.Join(params, "&")))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// innodbStatusText returns the text of "SHOW ENGINE INNODB STATUS", which msops only parses for the semaphores
+func innodbStatusText(endpoint string) (string, error) {
+	db, err := openSession(endpoint)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var engine, name, status string
+	if err = db.QueryRow("SHOW ENGINE INNODB STATUS").Scan(&engine, &name, &status); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// sysUsers returns the users whose processes are not killed when switching master
+func sysUsers() []string {
+	return []string{conf.DBAUser, conf.ReplUser, "root", "system user"}
 }
 
 func prepareReportData(endpoint string) []string {
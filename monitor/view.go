@@ -2,21 +2,31 @@ package monitor
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ericpai/msops"
+	"github.com/laincloud/mysql-service/agent"
+	"github.com/laincloud/mysql-service/backup"
 )
 
 type PatchRequest struct {
 	Action       PatchAction
 	Endpoint     string
+	Params       map[string]string
+	Operator     string
+	Role         string
 	ResponseChan chan PatchResponse
 }
 
 type PatchResponse struct {
+	// Data is the result of the actions creating something, e.g. AccountView of ActionCreateDatabase
+	Data []byte
 	Err  error
 	Code int
 }
@@ -39,12 +49,70 @@ type InstanceView struct {
 	Role                  string
 	InstanceStatusText    string
 	ReplicationStatusText string
+	RebuildStatusText     string
+	// MissingText tells how long a registered instance is missing in service discovery
+	MissingText           string
 	AllowedActions        []string
 	ProcessesList         []map[string]string
 	SlaveStatusList       map[string]string
 	PerformanceStatusList map[string]string
 }
 
+type RepairView struct {
+	Instance              InstanceView
+	LastSQLErrno          int
+	LastSQLError          string
+	LastSQLErrorTimestamp string
+	FailedGTID            string
+	FailedGTIDError       string
+}
+
+// RoleView is the role information of one instance for the tools running in mysql-server containers
+type RoleView struct {
+	Role              string
+	InstanceStatus    string
+	ReplicationStatus string
+	StandbyRegistered bool
+}
+
+type BackupView struct {
+	Type           string
+	Endpoint       string
+	Started        string
+	Age            string
+	Size           string
+	BinlogPosition string
+	GTIDSet        string
+	StatusText     string
+	VerifyText     string
+	Error          string
+}
+
+type BackupsView struct {
+	Alerts  []string
+	Backups []BackupView
+}
+
+// MetricsView is the history of the metrics of an instance for the charts on the details page
+type MetricsView struct {
+	Endpoint string
+	Range    string
+	Interval string
+	Charts   []MetricChartView
+}
+
+type MetricChartView struct {
+	Title  string
+	Unit   string
+	Series []MetricSeriesView
+}
+
+// MetricSeriesView is a series in the format of flot, whose points are [unix milliseconds, value or null]
+type MetricSeriesView struct {
+	Label string           `json:"label"`
+	Data  [][2]interface{} `json:"data"`
+}
+
 type InstanceViewSorter []InstanceView
 
 func (svs InstanceViewSorter) Len() int {
@@ -80,7 +148,7 @@ func getOneDetails(endpoint string) ([]byte, int, error) {
 		return data, code, err
 	}
 	instView := getInstaceViewFromModel(instModel)
-	processList, _ := msops.GetProcessList(endpoint)
+	processList, _ := fullProcessList(endpoint)
 	instView.ProcessesList = make([]map[string]string, 0, len(processList))
 	for _, process := range processList {
 		instProcess := make(map[string]string)
@@ -133,6 +201,102 @@ func getOneDetails(endpoint string) ([]byte, int, error) {
 	return data, code, err
 }
 
+func getRepairPlan(endpoint string) ([]byte, int, error) {
+	var data []byte
+	instModel, code, err := getInstance(endpoint)
+	if err != nil {
+		return data, code, err
+	}
+	if instModel.ReplicationStatus != msops.ReplicationError {
+		return data, http.StatusForbidden, fmt.Errorf("The replication of %s has no error", endpoint)
+	}
+	slaveStatus, err := msops.GetSlaveStatus(endpoint)
+	if err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	repairView := RepairView{
+		Instance:              getInstaceViewFromModel(instModel),
+		LastSQLErrno:          slaveStatus.LastSQLErrno,
+		LastSQLError:          slaveStatus.LastSQLError,
+		LastSQLErrorTimestamp: slaveStatus.LastSQLErrorTimestamp,
+	}
+	if repairView.FailedGTID, _, err = failedTransaction(endpoint); err != nil {
+		repairView.FailedGTIDError = err.Error()
+	}
+	if data, err = json.Marshal(repairView); err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
+
+func getRoleInfo(endpoint string) ([]byte, int, error) {
+	var data []byte
+	instModel, code, err := getInstance(endpoint)
+	if err != nil {
+		return data, code, err
+	}
+	instView := getInstaceViewFromModel(instModel)
+	roleView := RoleView{
+		Role:              instView.Role,
+		InstanceStatus:    instView.InstanceStatusText,
+		ReplicationStatus: instView.ReplicationStatusText,
+		StandbyRegistered: msMonitor.standby != "",
+	}
+	if data, err = json.Marshal(roleView); err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
+
+func getBackups() ([]byte, int, error) {
+	backupsView := BackupsView{
+		Alerts:  msMonitor.backupAlerts(),
+		Backups: make([]BackupView, 0, len(msMonitor.backups)),
+	}
+	for i := len(msMonitor.backups) - 1; i >= 0; i-- {
+		record := msMonitor.backups[i]
+		manifest := record.Manifest
+		view := BackupView{
+			Type:       manifest.Type,
+			Endpoint:   record.Endpoint,
+			Started:    manifest.Started.Format("2006-01-02 15:04:05"),
+			Age:        formatAge(time.Since(manifest.Started)),
+			Size:       formatSize(manifest.Size()),
+			GTIDSet:    manifest.GTIDSet,
+			StatusText: "OK",
+			VerifyText: "VERIFIED",
+			Error:      record.Error,
+		}
+		if manifest.BinlogFile != "" {
+			view.BinlogPosition = fmt.Sprintf("%s:%d", manifest.BinlogFile, manifest.BinlogPos)
+		}
+		if record.ExitCode != backup.ExitOK {
+			view.StatusText = fmt.Sprintf("FAILED (%d)", record.ExitCode)
+		}
+		if !manifest.Verified {
+			view.VerifyText = "UNVERIFIED"
+			if manifest.VerifyError != "" {
+				view.Error = manifest.VerifyError
+			}
+		}
+		backupsView.Backups = append(backupsView.Backups, view)
+	}
+	data, err := json.Marshal(backupsView)
+	if err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// getCatalog returns all the records in the backup catalog, the oldest first
+func getCatalog() ([]byte, int, error) {
+	data, err := json.Marshal(msMonitor.backups)
+	if err != nil {
+		return data, http.StatusInternalServerError, err
+	}
+	return data, http.StatusOK, nil
+}
+
 func getAllOverview() ([]byte, int, error) {
 	var instances []InstanceModel
 	var err error
@@ -162,6 +326,9 @@ func getInstaceViewFromModel(model InstanceModel) InstanceView {
 		Addr: model.Addr,
 		Port: model.Port,
 	}
+	if missing, exist := msMonitor.missing[net.JoinHostPort(model.Addr, model.Port)]; exist {
+		view.MissingText = fmt.Sprintf("MISSING %s", time.Since(missing.Since)/time.Second*time.Second)
+	}
 	// Set InstanceStatus view part
 	switch model.InstanceStatus {
 	case msops.InstanceOK:
@@ -206,8 +373,15 @@ func getInstaceViewFromModel(model InstanceModel) InstanceView {
 		} else {
 			view.AllowedActions = append(view.AllowedActions, string(ActionDetach))
 		}
+		if model.ReplicationStatus == msops.ReplicationError {
+			view.AllowedActions = append(view.AllowedActions, getRepairActions(net.JoinHostPort(model.Addr, model.Port))...)
+		}
 	case "Unregistered":
 		view.AllowedActions = make([]string, 0)
+		status, isRebuilding := msMonitor.rebuilding[net.JoinHostPort(model.Addr, model.Port)]
+		if isRebuilding {
+			view.RebuildStatusText = getRebuildStatusText(status)
+		}
 		if msMonitor.master == "" {
 			view.AllowedActions = append(view.AllowedActions, string(ActionRegisterMaster))
 		} else {
@@ -215,6 +389,9 @@ func getInstaceViewFromModel(model InstanceModel) InstanceView {
 			if msMonitor.standby == "" {
 				view.AllowedActions = append(view.AllowedActions, string(ActionRegisterStandby))
 			}
+			if !isRebuilding || status.Stage == agent.RebuildFailed {
+				view.AllowedActions = append(view.AllowedActions, string(ActionRebuild))
+			}
 		}
 
 	default:
@@ -230,8 +407,69 @@ func getInstaceViewFromModel(model InstanceModel) InstanceView {
 			view.AllowedActions = append(view.AllowedActions, string(ActionDetach), string(ActionResume))
 		case msops.ReplicationWrongMaster:
 			view.AllowedActions = append(view.AllowedActions, string(ActionDetach))
+		case msops.ReplicationError:
+			view.AllowedActions = append(view.AllowedActions, string(ActionDetach))
+			view.AllowedActions = append(view.AllowedActions, getRepairActions(net.JoinHostPort(model.Addr, model.Port))...)
 		}
 		view.AllowedActions = append(view.AllowedActions, string(ActionUnregister))
 	}
 	return view
 }
+
+func getRebuildStatusText(status *agent.RebuildStatus) string {
+	switch status.Stage {
+	case agent.RebuildIdle:
+		return "REBUILD PENDING"
+	case agent.RebuildFailed:
+		return fmt.Sprintf("REBUILD FAILED: %s", status.Error)
+	default:
+		return fmt.Sprintf("REBUILD %s", strings.ToUpper(string(status.Stage)))
+	}
+}
+
+// formatAge formats the duration in days, hours and minutes, e.g. "3d 2h 5m"
+func formatAge(d time.Duration) string {
+	minutes := int(d.Minutes())
+	days, hours := minutes/(24*60), minutes/60%24
+	minutes %= 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// formatSize formats the bytes in a human readable unit, e.g. "1.5 GB"
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for ; value >= 1024 && i < len(units)-1; i++ {
+		value /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// getRepairActions returns the repair actions for an instance whose replication is broken by the SQL thread
+func getRepairActions(endpoint string) []string {
+	slaveStatus, err := msops.GetSlaveStatus(endpoint)
+	if err != nil || slaveStatus.LastSQLErrno == 0 {
+		return nil
+	}
+	actions := []string{string(ActionRetrySQL)}
+	if slaveStatus.AutoPosition {
+		// Skipping is only offered if the failed transaction is known for sure
+		if failedGTID, _, err := failedTransaction(endpoint); err == nil && failedGTID != "" {
+			actions = append(actions, string(ActionSkipTrx))
+		}
+	}
+	if endpoint != msMonitor.master {
+		actions = append(actions, string(ActionRepairRebuild))
+	}
+	return actions
+}
@@ -5,13 +5,47 @@ import (
 
 	"github.com/astaxie/beego"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/discovery"
 	"github.com/laincloud/mysql-service/monitor"
 	_ "github.com/laincloud/mysql-service/routers"
+	"github.com/laincloud/mysql-service/simulator"
+)
+
+var (
+	simulate          = flag.Bool("simulate", false, "Run against a simulated cluster of fake MySQL instances to rehearse failovers")
+	simulateInstances = flag.Int("simulate-instances", 4, "The number of instances of the simulated cluster")
 )
 
 func main() {
+	loader := monitor.NewConfigLoader(flag.CommandLine)
 	flag.Parse()
-	go monitor.Start()
+	var sim *simulator.Simulator
+	if *simulate {
+		var err error
+		if sim, err = simulator.New(*simulateInstances); err != nil {
+			glog.Fatal(err)
+		}
+		defer sim.Close()
+		for key, value := range sim.Config() {
+			loader.Override(key, value, monitor.SourceSimulator)
+		}
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	monitor.Configure(cfg)
+	var disc discovery.Discovery
+	if sim != nil {
+		disc = sim.Discovery()
+	} else if disc, err = discovery.FromFlags(); err != nil {
+		glog.Fatal(err)
+	}
+	go monitor.Start(disc)
+	if sim != nil {
+		go sim.Run()
+	}
 
 	beego.Run()
 }
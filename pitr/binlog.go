@@ -0,0 +1,148 @@
+package pitr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laincloud/mysql-service/gtid"
+)
+
+const (
+	binlogMagic    = "\xfebin"
+	binlogPrefix   = "lb."
+	eventHeaderLen = 19
+	// maxHeaderEvents is the number of events read at the beginning of a binlog,
+	// PREVIOUS_GTIDS_LOG_EVENT follows FORMAT_DESCRIPTION_EVENT if gtid_mode is on
+	maxHeaderEvents = 2
+
+	formatDescriptionEvent = 15
+	previousGTIDsEvent     = 35
+)
+
+// binlogHeader is the information read from the first events of a binlog
+type binlogHeader struct {
+	Path    string
+	Name    string
+	Seq     int
+	Created time.Time
+	// PreviousGTIDs is the GTID set executed before this binlog, nil if gtid_mode is off
+	PreviousGTIDs gtid.Set
+}
+
+// listBinlogs reads the headers of the binlogs in dir, sorted by their sequence numbers
+func listBinlogs(dir string) ([]binlogHeader, error) {
+	files, err := filepath.Glob(filepath.Join(dir, binlogPrefix+"[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	headers := make([]binlogHeader, 0, len(files))
+	for _, file := range files {
+		header, err := readBinlogHeader(file)
+		if err != nil {
+			return nil, fmt.Errorf("Read binlog %s failed: %s", file, err.Error())
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+func readBinlogHeader(fileName string) (binlogHeader, error) {
+	header := binlogHeader{Path: fileName, Name: filepath.Base(fileName)}
+	var err error
+	if header.Seq, err = strconv.Atoi(strings.TrimPrefix(header.Name, binlogPrefix)); err != nil {
+		return header, fmt.Errorf("invalid binlog name %s", header.Name)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return header, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(binlogMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != binlogMagic {
+		return header, fmt.Errorf("bad magic number")
+	}
+	for i := 0; i < maxHeaderEvents; i++ {
+		eventHeader := make([]byte, eventHeaderLen)
+		if _, err = io.ReadFull(r, eventHeader); err != nil {
+			return header, fmt.Errorf("read event header failed: %s", err.Error())
+		}
+		timestamp := binary.LittleEndian.Uint32(eventHeader[0:4])
+		eventType := eventHeader[4]
+		eventSize := binary.LittleEndian.Uint32(eventHeader[9:13])
+		if eventSize < eventHeaderLen {
+			return header, fmt.Errorf("bad event size %d", eventSize)
+		}
+		body := make([]byte, eventSize-eventHeaderLen)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return header, fmt.Errorf("read event body failed: %s", err.Error())
+		}
+		switch eventType {
+		case formatDescriptionEvent:
+			header.Created = time.Unix(int64(timestamp), 0)
+		case previousGTIDsEvent:
+			header.PreviousGTIDs, err = parsePreviousGTIDs(body)
+			return header, err
+		default:
+			return header, nil
+		}
+	}
+	return header, nil
+}
+
+// parsePreviousGTIDs decodes the body of PREVIOUS_GTIDS_LOG_EVENT: the number of UUIDs,
+// then for each UUID 16 bytes of UUID, the number of intervals and [start, end) of each interval.
+// The checksum at the end of the body, if any, is ignored.
+func parsePreviousGTIDs(body []byte) (gtid.Set, error) {
+	pos := 0
+	readUint64 := func() (uint64, error) {
+		if pos+8 > len(body) {
+			return 0, fmt.Errorf("truncated PREVIOUS_GTIDS event")
+		}
+		v := binary.LittleEndian.Uint64(body[pos : pos+8])
+		pos += 8
+		return v, nil
+	}
+	nSIDs, err := readUint64()
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, 0, nSIDs)
+	for i := uint64(0); i < nSIDs; i++ {
+		if pos+16 > len(body) {
+			return nil, fmt.Errorf("truncated PREVIOUS_GTIDS event")
+		}
+		sid := hex.EncodeToString(body[pos : pos+16])
+		pos += 16
+		part := fmt.Sprintf("%s-%s-%s-%s-%s", sid[0:8], sid[8:12], sid[12:16], sid[16:20], sid[20:32])
+		nIntervals, err := readUint64()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < nIntervals; j++ {
+			start, err := readUint64()
+			if err != nil {
+				return nil, err
+			}
+			end, err := readUint64()
+			if err != nil {
+				return nil, err
+			}
+			part += fmt.Sprintf(":%d-%d", start, end-1)
+		}
+		if nIntervals > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return gtid.Parse(strings.Join(parts, ","))
+}
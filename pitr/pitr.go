@@ -0,0 +1,333 @@
+// Package pitr implements the point-in-time recovery of mysql-server, which replays the backed-up
+// binlogs on a recovered full backup up to a target time or GTID set.
+package pitr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// pitr package needs go-sql-driver
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/backup"
+	"github.com/laincloud/mysql-service/gtid"
+)
+
+// The exit codes of the pitr command
+const (
+	ExitOK           = 0
+	ExitUsage        = 1
+	ExitPlanFailed   = 2
+	ExitReplayFailed = 3
+)
+
+const (
+	// TimeLayout is the layout of the target time, which is the local time of mysql-server
+	TimeLayout = "2006-01-02 15:04:05"
+
+	monitorTimeout = 5 * time.Second
+	mysqlSocket    = "/var/run/mysqld/mysqld.sock"
+)
+
+// Options are the options of one recovery
+type Options struct {
+	MonitorURL string
+	BackupDir  string
+	TargetTime string
+	TargetGTID string
+	DryRun     bool
+}
+
+// Plan is the full backup and the binlogs to recover the target. The binlogs are located and replayed
+// by GTID, since the full backups are taken on master while the increment backups are taken on standby,
+// whose binlog files and positions are unrelated to the ones of master.
+type Plan struct {
+	FullBackup     backup.Manifest
+	FullBackupFrom string
+	// Binlogs are the paths of binlogs to replay, skipping the transactions in ExcludeGTIDs,
+	// which is the GTID set of the full backup
+	Binlogs      []string
+	ExcludeGTIDs string
+	StopDatetime string
+	IncludeGTIDs string
+	Warnings     []string
+}
+
+// catalogRecord is one record returned by the /api/backups API of monitor
+type catalogRecord struct {
+	Endpoint string
+	Received time.Time
+	backup.Report
+}
+
+func (record catalogRecord) good(backupType string) bool {
+	return record.Manifest.Type == backupType && record.ExitCode == backup.ExitOK && record.Manifest.Verified
+}
+
+// Run parses args, plans and executes the recovery and returns the exit code
+func Run(args []string) int {
+	opts := Options{}
+	flags := flag.NewFlagSet("pitr", flag.ContinueOnError)
+	flags.StringVar(&opts.MonitorURL, "monitor", backup.DefaultMonitorURL(), "The base URL of monitor")
+	flags.StringVar(&opts.BackupDir, "backup-dir", "/var/lib/mysql_backup", "The directory of the downloaded binlogs")
+	flags.StringVar(&opts.TargetTime, "target-time", "", "Recover to the time, e.g. \"2016-01-02 15:04:05\"")
+	flags.StringVar(&opts.TargetGTID, "target-gtid", "", "Recover to the GTID set, e.g. \"uuid:1-1000\"")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Print the plan without replaying")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if (opts.TargetTime == "") == (opts.TargetGTID == "") {
+		fmt.Fprintln(os.Stderr, "One of -target-time and -target-gtid is required")
+		return ExitUsage
+	}
+
+	plan, err := makePlan(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Plan recovery failed: %s\n", err.Error())
+		return ExitPlanFailed
+	}
+	plan.Print(os.Stdout)
+	if opts.DryRun {
+		return ExitOK
+	}
+	if err = plan.Execute(); err != nil {
+		glog.Errorf("Point-in-time recovery failed: %s", err.Error())
+		glog.Flush()
+		fmt.Fprintf(os.Stderr, "Replay failed: %s\n", err.Error())
+		return ExitReplayFailed
+	}
+	glog.Info("Point-in-time recovery finished")
+	glog.Flush()
+	return ExitOK
+}
+
+func makePlan(opts Options) (Plan, error) {
+	var plan Plan
+	records, err := getCatalog(opts)
+	if err != nil {
+		return plan, fmt.Errorf("Get backup catalog from monitor failed: %s", err.Error())
+	}
+	var targetTime time.Time
+	var targetGTID gtid.Set
+	if opts.TargetTime != "" {
+		if targetTime, err = time.ParseInLocation(TimeLayout, opts.TargetTime, time.Local); err != nil {
+			return plan, fmt.Errorf("Invalid target time: %s", err.Error())
+		}
+		plan.StopDatetime = targetTime.Format(TimeLayout)
+	} else {
+		if targetGTID, err = gtid.Parse(opts.TargetGTID); err != nil {
+			return plan, fmt.Errorf("Invalid target GTID set: %s", err.Error())
+		}
+		plan.IncludeGTIDs = targetGTID.String()
+	}
+
+	// The latest good full backup taken before the target
+	found := false
+	for i := len(records) - 1; i >= 0 && !found; i-- {
+		record := records[i]
+		if !record.good(backup.TypeFull) {
+			continue
+		}
+		if targetGTID == nil {
+			found = !record.Manifest.Finished.After(targetTime)
+		} else if backupSet, err := gtid.Parse(record.Manifest.GTIDSet); err == nil {
+			found = targetGTID.ContainsSet(backupSet)
+		}
+		if found {
+			plan.FullBackup, plan.FullBackupFrom = record.Manifest, record.Endpoint
+		}
+	}
+	if !found {
+		return plan, fmt.Errorf("No good full backup is taken before the target")
+	}
+	backupSet, err := gtid.Parse(plan.FullBackup.GTIDSet)
+	if err != nil || len(backupSet) == 0 {
+		return plan, fmt.Errorf("The GTID set of the full backup is unknown")
+	}
+	plan.ExcludeGTIDs = backupSet.String()
+
+	binlogs, err := listBinlogs(opts.BackupDir)
+	if err != nil {
+		return plan, err
+	}
+	// The first binlog to replay is the last one starting within the full backup,
+	// the ones before it contain only the transactions of the full backup
+	start := -1
+	for i, binlog := range binlogs {
+		if binlog.PreviousGTIDs == nil {
+			return plan, fmt.Errorf("Binlog %s has no PREVIOUS_GTIDS event, recovery requires gtid_mode=ON", binlog.Name)
+		}
+		if !backupSet.ContainsSet(binlog.PreviousGTIDs) {
+			break
+		}
+		start = i
+	}
+	if start < 0 {
+		if len(binlogs) == 0 {
+			return plan, fmt.Errorf("No binlog is found in %s, download the increment backups with tools/download.py", opts.BackupDir)
+		}
+		return plan, fmt.Errorf("The binlogs in %s start after the full backup %s, the binlogs before %s are missing",
+			opts.BackupDir, plan.ExcludeGTIDs, binlogs[0].Name)
+	}
+	reached := false
+	for i := start; i < len(binlogs); i++ {
+		binlog := binlogs[i]
+		if i > start && binlog.Seq != binlogs[i-1].Seq+1 {
+			return plan, fmt.Errorf("Binlogs between %s and %s are missing", binlogs[i-1].Name, binlog.Name)
+		}
+		// A binlog containing nothing before the target is not needed
+		if i > start {
+			if targetGTID == nil && binlog.Created.After(targetTime) {
+				reached = true
+				break
+			}
+			if targetGTID != nil && binlog.PreviousGTIDs.ContainsSet(targetGTID) {
+				reached = true
+				break
+			}
+		}
+		plan.Binlogs = append(plan.Binlogs, binlog.Path)
+	}
+	if !reached {
+		if targetGTID != nil {
+			plan.Warnings = append(plan.Warnings, "The binlogs may not contain all the target transactions")
+		} else if !lastIncrBackup(records).After(targetTime) {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("No good increment backup is taken after the target, the binlogs may end before %s", plan.StopDatetime))
+		}
+	}
+	if len(plan.FullBackup.Files) > 0 {
+		if _, err := os.Stat(filepath.Join(opts.BackupDir, plan.FullBackup.Files[0].Name)); err != nil {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s is not found in %s, make sure it is recovered before replaying",
+				plan.FullBackup.Files[0].Name, opts.BackupDir))
+		}
+	}
+	return plan, nil
+}
+
+// lastIncrBackup returns the finished time of the latest good increment backup
+func lastIncrBackup(records []catalogRecord) time.Time {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].good(backup.TypeIncr) {
+			return records[i].Manifest.Finished
+		}
+	}
+	return time.Time{}
+}
+
+func getCatalog(opts Options) ([]catalogRecord, error) {
+	var records []catalogRecord
+	resp, err := (&http.Client{Timeout: monitorTimeout}).Get(opts.MonitorURL + "/api/backups")
+	if err != nil {
+		return records, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return records, fmt.Errorf("monitor returns %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&records)
+	return records, err
+}
+
+// mysqlbinlogArgs returns the arguments of mysqlbinlog to replay the plan
+func (plan Plan) mysqlbinlogArgs() []string {
+	args := []string{fmt.Sprintf("--exclude-gtids=%s", plan.ExcludeGTIDs)}
+	if plan.StopDatetime != "" {
+		args = append(args, fmt.Sprintf("--stop-datetime=%s", plan.StopDatetime))
+	}
+	if plan.IncludeGTIDs != "" {
+		args = append(args, fmt.Sprintf("--include-gtids=%s", plan.IncludeGTIDs))
+	}
+	return append(args, plan.Binlogs...)
+}
+
+// Print writes the plan in a human readable format
+func (plan Plan) Print(w io.Writer) {
+	fileName := ""
+	if len(plan.FullBackup.Files) > 0 {
+		fileName = plan.FullBackup.Files[0].Name
+	}
+	fmt.Fprintf(w, "Full backup:   %s of %s, finished at %s\n", fileName, plan.FullBackupFrom, plan.FullBackup.Finished.Format(TimeLayout))
+	fmt.Fprintf(w, "GTID purged:   %s\n", plan.FullBackup.GTIDSet)
+	fmt.Fprintf(w, "Exclude GTIDs: %s\n", plan.ExcludeGTIDs)
+	if plan.StopDatetime != "" {
+		fmt.Fprintf(w, "Stop at:       %s\n", plan.StopDatetime)
+	} else {
+		fmt.Fprintf(w, "Include GTIDs: %s\n", plan.IncludeGTIDs)
+	}
+	fmt.Fprintln(w, "Binlogs:")
+	for _, binlog := range plan.Binlogs {
+		fmt.Fprintf(w, "  %s\n", binlog)
+	}
+	args := plan.mysqlbinlogArgs()
+	for i, arg := range args {
+		if strings.Contains(arg, " ") {
+			args[i] = fmt.Sprintf("%q", arg)
+		}
+	}
+	fmt.Fprintf(w, "Command:       mysqlbinlog %s | mysql -uroot\n", strings.Join(args, " "))
+	for _, warning := range plan.Warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+}
+
+// Execute sets gtid_purged to the GTID set of the full backup and replays the binlogs.
+// The full backup must have been recovered by tools/full_recover.sh.
+func (plan Plan) Execute() error {
+	db, err := sql.Open("mysql", "root@unix("+mysqlSocket+")/")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var executed string
+	if err = db.QueryRow("SELECT @@GLOBAL.gtid_executed").Scan(&executed); err != nil {
+		return fmt.Errorf("Get gtid_executed failed: %s", err.Error())
+	}
+	executedSet, err := gtid.Parse(executed)
+	if err != nil {
+		return err
+	}
+	backupSet, err := gtid.Parse(plan.FullBackup.GTIDSet)
+	if err != nil {
+		return err
+	}
+	if len(executedSet) == 0 {
+		glog.Infof("Set gtid_purged to %s", plan.FullBackup.GTIDSet)
+		if _, err = db.Exec("RESET MASTER"); err == nil {
+			_, err = db.Exec(fmt.Sprintf("SET GLOBAL gtid_purged='%s'", backupSet.String()))
+		}
+		if err != nil {
+			return fmt.Errorf("Set gtid_purged failed: %s", err.Error())
+		}
+	} else if !executedSet.ContainsSet(backupSet) || !backupSet.ContainsSet(executedSet) {
+		return fmt.Errorf("mysqld has executed %s rather than the full backup %s, recover the full backup with tools/full_recover.sh first",
+			executed, plan.FullBackup.GTIDSet)
+	}
+
+	glog.Infof("Replay mysqlbinlog %s", strings.Join(plan.mysqlbinlogArgs(), " "))
+	dump := exec.Command("mysqlbinlog", plan.mysqlbinlogArgs()...)
+	load := exec.Command("mysql", "-uroot")
+	if load.Stdin, err = dump.StdoutPipe(); err != nil {
+		return err
+	}
+	dump.Stderr, load.Stdout, load.Stderr = os.Stderr, os.Stdout, os.Stderr
+	if err = load.Start(); err != nil {
+		return err
+	}
+	if err = dump.Run(); err != nil {
+		load.Wait()
+		return fmt.Errorf("mysqlbinlog failed: %s", err.Error())
+	}
+	if err = load.Wait(); err != nil {
+		return fmt.Errorf("mysql failed: %s", err.Error())
+	}
+	return nil
+}
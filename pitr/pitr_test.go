@@ -0,0 +1,206 @@
+package pitr
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/backup"
+	"github.com/laincloud/mysql-service/gtid"
+)
+
+const (
+	uuidMaster  = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuidStandby = "4a0b3c1d-71ca-11e1-9e33-c80aa9429562"
+)
+
+// event encodes a binlog event with the body and a checksum
+func event(eventType byte, timestamp time.Time, body []byte) []byte {
+	data := make([]byte, eventHeaderLen, eventHeaderLen+len(body)+4)
+	binary.LittleEndian.PutUint32(data[0:4], uint32(timestamp.Unix()))
+	data[4] = eventType
+	binary.LittleEndian.PutUint32(data[9:13], uint32(eventHeaderLen+len(body)+4))
+	data = append(data, body...)
+	return append(data, 0, 0, 0, 0)
+}
+
+// previousGTIDsBody encodes set into the body of PREVIOUS_GTIDS_LOG_EVENT
+func previousGTIDsBody(t *testing.T, set gtid.Set) []byte {
+	var uuids []string
+	for uuid := range set {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	body := make([]byte, 0, 64)
+	putUint64 := func(v uint64) {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v)
+		body = append(body, b[:]...)
+	}
+	putUint64(uint64(len(uuids)))
+	for _, uuid := range uuids {
+		sid, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = append(body, sid...)
+		putUint64(uint64(len(set[uuid])))
+		for _, iv := range set[uuid] {
+			putUint64(uint64(iv.Start))
+			putUint64(uint64(iv.End + 1))
+		}
+	}
+	return body
+}
+
+// writeBinlog writes a binlog with the header events only
+func writeBinlog(t *testing.T, dir, name string, created time.Time, previous string) {
+	set, err := gtid.Parse(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(binlogMagic)
+	data = append(data, event(formatDescriptionEvent, created, make([]byte, 80))...)
+	data = append(data, event(previousGTIDsEvent, created, previousGTIDsBody(t, set))...)
+	if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pitr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReadBinlogHeader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	created := time.Date(2016, 1, 2, 15, 4, 5, 0, time.Local)
+	for _, previous := range []string{
+		"",
+		uuidMaster + ":1-100",
+		uuidMaster + ":1-100:105-110," + uuidStandby + ":1-3:5",
+	} {
+		writeBinlog(t, dir, "lb.000001", created, previous)
+		header, err := readBinlogHeader(filepath.Join(dir, "lb.000001"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Seq != 1 || !header.Created.Equal(created) || header.PreviousGTIDs == nil || header.PreviousGTIDs.String() != previous {
+			t.Errorf("Unexpected header of %q: %+v", previous, header)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"lb.000002": []byte("not a binlog"),
+		"lb.000003": append([]byte(binlogMagic), event(previousGTIDsEvent, created, []byte{2, 0, 0, 0, 0, 0, 0, 0, 1})...),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBinlogHeader(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s should be invalid", name)
+		}
+	}
+}
+
+func TestMakePlan(t *testing.T) {
+	backupTime := time.Date(2016, 1, 2, 15, 0, 0, 0, time.Local)
+	full := func(finished time.Time, gtidSet string, exitCode int, verified bool) catalogRecord {
+		return catalogRecord{Endpoint: "mysql-server-1:3306", Report: backup.Report{
+			Manifest: backup.Manifest{Type: backup.TypeFull, Finished: finished, GTIDSet: gtidSet, BinlogFile: "lb.000042", BinlogPos: 1234, Verified: verified},
+			ExitCode: exitCode,
+		}}
+	}
+	catalog := []catalogRecord{
+		full(backupTime.Add(-24*time.Hour), uuidMaster+":1-10", backup.ExitOK, true),
+		full(backupTime, uuidMaster+":1-100,"+uuidStandby+":1-5", backup.ExitOK, true),
+		// The failed and unverified backups are never used
+		full(backupTime.Add(time.Hour), uuidMaster+":1-120", backup.ExitBackupFailed, true),
+		full(backupTime.Add(2*time.Hour), uuidMaster+":1-150", backup.ExitOK, false),
+	}
+	mon := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(catalog)
+	}))
+	defer mon.Close()
+
+	// The binlogs of standby, whose names are unrelated to the position of the full backup on master
+	type binlog struct {
+		name     string
+		created  time.Time
+		previous string
+	}
+	binlogs := []binlog{
+		{"lb.000001", backupTime.Add(-25 * time.Hour), ""},
+		{"lb.000002", backupTime.Add(-time.Hour), uuidMaster + ":1-80," + uuidStandby + ":1-5"},
+		{"lb.000003", backupTime.Add(time.Hour), uuidMaster + ":1-120," + uuidStandby + ":1-5"},
+		{"lb.000004", backupTime.Add(2 * time.Hour), uuidMaster + ":1-150," + uuidStandby + ":1-5"},
+	}
+	for _, c := range []struct {
+		name     string
+		binlogs  []binlog
+		time     string
+		gtid     string
+		expected []string
+		exclude  string
+		err      string
+	}{
+		{name: "time", binlogs: binlogs, time: "2016-01-02 16:30:00", expected: []string{"lb.000002", "lb.000003"},
+			exclude: uuidMaster + ":1-100," + uuidStandby + ":1-5"},
+		{name: "gtid", binlogs: binlogs, gtid: uuidMaster + ":1-130," + uuidStandby + ":1-5", expected: []string{"lb.000002", "lb.000003"},
+			exclude: uuidMaster + ":1-100," + uuidStandby + ":1-5"},
+		{name: "older backup", binlogs: binlogs, time: "2016-01-02 14:00:00", expected: []string{"lb.000001", "lb.000002"},
+			exclude: uuidMaster + ":1-10"},
+		{name: "after all binlogs", binlogs: binlogs, time: "2016-01-03 00:00:00", expected: []string{"lb.000002", "lb.000003", "lb.000004"},
+			exclude: uuidMaster + ":1-100," + uuidStandby + ":1-5"},
+		{name: "no backup before time", binlogs: binlogs, time: "2016-01-01 12:00:00", err: "No good full backup"},
+		{name: "no backup within gtid", binlogs: binlogs, gtid: uuidStandby + ":1-3", err: "No good full backup"},
+		{name: "invalid gtid", binlogs: binlogs, gtid: uuidMaster + ":5-1", err: "Invalid target GTID"},
+		{name: "no binlog", time: "2016-01-02 16:30:00", err: "No binlog is found"},
+		{name: "binlogs after backup", binlogs: binlogs[2:], time: "2016-01-02 16:30:00", err: "start after the full backup"},
+		{name: "missing binlog", binlogs: []binlog{binlogs[1], binlogs[3]}, time: "2016-01-02 18:30:00", err: "are missing"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			for _, b := range c.binlogs {
+				writeBinlog(t, dir, b.name, b.created, b.previous)
+			}
+			plan, err := makePlan(Options{MonitorURL: mon.URL, BackupDir: dir, TargetTime: c.time, TargetGTID: c.gtid})
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("Plan should fail with %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, path := range plan.Binlogs {
+				names = append(names, filepath.Base(path))
+			}
+			if !reflect.DeepEqual(names, c.expected) || plan.ExcludeGTIDs != c.exclude {
+				t.Errorf("Unexpected plan: binlogs %v excluding %s", names, plan.ExcludeGTIDs)
+			}
+			args := strings.Join(plan.mysqlbinlogArgs(), " ")
+			if strings.Contains(args, "position") || !strings.Contains(args, "--exclude-gtids="+c.exclude) {
+				t.Errorf("The binlogs should be replayed by GTID, got %s", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/discovery"
+)
+
+var appNameExp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+// aclEntry is a CIDR or an IP, or a LAIN app whose nets are the IPs of its containers
+type aclEntry struct {
+	app  string
+	nets []*net.IPNet
+}
+
+func (entry *aclEntry) contains(ip net.IP) bool {
+	for _, n := range entry.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL controls the clients connecting to the proxy by their source addresses. The entries are CIDRs, IPs
+// or LAIN app names, whose container IPs are resolved by discovery every resolveInterval.
+// Deny takes precedence over allow, and all the clients not denied are allowed if allow is empty.
+type ACL struct {
+	sync.RWMutex
+	allow           []*aclEntry
+	deny            []*aclEntry
+	disc            discovery.Discovery
+	resolveInterval time.Duration
+}
+
+// NewACL creates an ACL from the entries of allow and deny, and resolves the apps at once
+func NewACL(allow, deny []string, disc discovery.Discovery, resolveInterval time.Duration) (*ACL, error) {
+	acl := &ACL{disc: disc, resolveInterval: resolveInterval}
+	var err error
+	if acl.allow, err = parseACLEntries(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseACLEntries(deny); err != nil {
+		return nil, err
+	}
+	acl.resolve()
+	return acl, nil
+}
+
+// ParseACLList splits the comma separated entries of an allow or deny list
+func ParseACLList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func parseACLEntries(values []string) ([]*aclEntry, error) {
+	entries := make([]*aclEntry, 0, len(values))
+	for _, value := range values {
+		if _, n, err := net.ParseCIDR(value); err == nil {
+			entries = append(entries, &aclEntry{nets: []*net.IPNet{n}})
+		} else if ip := net.ParseIP(value); ip != nil {
+			entries = append(entries, &aclEntry{nets: []*net.IPNet{hostNet(ip)}})
+		} else if appNameExp.MatchString(value) {
+			entries = append(entries, &aclEntry{app: value})
+		} else {
+			return nil, fmt.Errorf("Invalid ACL entry %q, which should be a CIDR, an IP or an app name", value)
+		}
+	}
+	return entries, nil
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Allowed returns whether the client from ip may connect. A nil ACL allows all the clients.
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	acl.RLock()
+	defer acl.RUnlock()
+	for _, entry := range acl.deny {
+		if entry.contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, entry := range acl.allow {
+		if entry.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve updates the IPs of the apps. The last IPs of an app are kept if it fails to be resolved,
+// and an app never resolved matches no client.
+func (acl *ACL) resolve() {
+	for _, entries := range [][]*aclEntry{acl.allow, acl.deny} {
+		for _, entry := range entries {
+			if entry.app == "" {
+				continue
+			}
+			ips, err := discovery.ResolveApp(acl.disc, entry.app)
+			if err != nil {
+				glog.Errorf("Resolve app %s for ACL failed: %s", entry.app, err.Error())
+				continue
+			}
+			nets := make([]*net.IPNet, 0, len(ips))
+			for _, value := range ips {
+				if ip := net.ParseIP(value); ip != nil {
+					nets = append(nets, hostNet(ip))
+				}
+			}
+			acl.Lock()
+			entry.nets = nets
+			acl.Unlock()
+			glog.V(2).Infof("App %s of ACL is resolved to %v", entry.app, ips)
+		}
+	}
+}
+
+func (acl *ACL) hasApps() bool {
+	for _, entries := range [][]*aclEntry{acl.allow, acl.deny} {
+		for _, entry := range entries {
+			if entry.app != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watch resolves the apps every resolveInterval, which returns at once if there is no app
+func (acl *ACL) watch() {
+	if acl == nil || !acl.hasApps() {
+		return
+	}
+	for {
+		time.Sleep(acl.resolveInterval)
+		acl.resolve()
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+)
+
+func TestACL(t *testing.T) {
+	lainlet, err := fake.NewLainlet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lainlet.Close()
+	lainlet.SetContainers("orders", "172.20.0.5", "172.20.0.6")
+	disc := discovery.NewLainlet(lainlet.Addr(), "mysql", "mysql-server", "web-1:6033")
+
+	if _, err = NewACL([]string{"10.0.0.0/33"}, nil, disc, time.Second); err == nil {
+		t.Errorf("Invalid CIDR should be rejected")
+	}
+	acl, err := NewACL(ParseACLList("10.1.0.0/16, orders,"), ParseACLList("10.1.2.3,reports"), disc, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]bool{
+		"10.1.0.1": true, "10.1.2.3": false, "10.2.0.1": false, "172.20.0.5": true, "172.20.0.7": false,
+	} {
+		if allowed := acl.Allowed(net.ParseIP(ip)); allowed != expected {
+			t.Errorf("Allowed of %s should be %v", ip, expected)
+		}
+	}
+
+	// The app is resolved again, and the last IPs are kept when it fails
+	lainlet.SetContainers("orders", "172.20.0.7")
+	lainlet.SetContainers("reports", "10.1.0.9")
+	acl.resolve()
+	if acl.Allowed(net.ParseIP("172.20.0.5")) || !acl.Allowed(net.ParseIP("172.20.0.7")) || acl.Allowed(net.ParseIP("10.1.0.9")) {
+		t.Errorf("The apps are not resolved again")
+	}
+	lainlet.SetContainers("orders")
+	acl.resolve()
+	if !acl.Allowed(net.ParseIP("172.20.0.7")) {
+		t.Errorf("The last IPs should be kept if the app fails to be resolved")
+	}
+
+	if open, _ := NewACL(nil, []string{"reports"}, disc, time.Second); !open.Allowed(net.ParseIP("192.168.0.1")) {
+		t.Errorf("All the clients not denied should be allowed if the allow list is empty")
+	}
+}
+
+func TestProxyRejectsByACL(t *testing.T) {
+	server, err := fake.NewMySQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mon := newFakeMonitor(map[string][]string{"master": {server.Addr()}})
+	defer mon.Close()
+
+	acl, err := NewACL(nil, []string{"127.0.0.0/8"}, discovery.NewMemory(""), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), Options{ACL: acl})
+	deadline := time.Now().Add(3 * cooldownTime)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			// The rejected connection is closed by the proxy before the greeting of MySQL
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(make([]byte, 1))
+			conn.Close()
+			if n != 0 || err == nil {
+				t.Fatalf("The connection from 127.0.0.1 should be rejected")
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				break
+			}
+			t.Fatalf("The connection from 127.0.0.1 is not closed: %s", err.Error())
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(server.Statements()) != 0 {
+		t.Errorf("The rejected connection should not be proxied")
+	}
+}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The actions of the admin server on targets and connections
+const (
+	actionDrain   = "drain"
+	actionDisable = "disable"
+	actionEnable  = "enable"
+	actionKill    = "kill"
+
+	sourceMonitor = "monitor"
+	sourceCache   = "cache"
+	sourceNone    = "none"
+)
+
+// TargetView is a target of the proxy shown by the admin server. Healthy is the result of the last dial,
+// since probing mysqld by TCP counts as the connect errors of the proxy host.
+type TargetView struct {
+	Endpoint string
+	// Current is whether the target is in the last list of monitor for any listener. The others are
+	// shown while they have connections or are drained or disabled.
+	Current      bool
+	Healthy      bool
+	LastError    string
+	Active       int
+	Total        int64
+	DialFailures int64
+	// Draining targets take no new connections, and the connections of Disabled targets are closed as well
+	Draining bool
+	Disabled bool
+}
+
+// ConnView is a client connection proxied to a target
+type ConnView struct {
+	ID     int64
+	Client string
+	Target string
+	Since  time.Time
+}
+
+// ListenerView is a listener of the proxy with the targets of its mode in the last list of monitor
+type ListenerView struct {
+	Port      int
+	Mode      string
+	Targets   []string
+	Switching bool
+}
+
+// StatusView is the status of the proxy returned by GET /targets
+type StatusView struct {
+	Listeners []ListenerView
+	// Source is "monitor" if the targets are pushed by the watched monitor, or "cache" if the watch is broken
+	// and the last targets are used
+	Source  string
+	Monitor string
+	Updated time.Time
+	// Rejected and Overflowed are the connections rejected by ACL and MaxConnections
+	Rejected   int64
+	Overflowed int64
+	Targets    []TargetView
+}
+
+type trackedConn struct {
+	ConnView
+	client net.Conn
+	target net.Conn
+}
+
+// registry keeps the states of the targets and the client connections for the admin server
+type registry struct {
+	sync.Mutex
+	targets     map[string]*TargetView
+	conns       map[int64]*trackedConn
+	nextID      int64
+	monitorAddr string
+	watching    bool
+	updated     time.Time
+}
+
+func newRegistry() *registry {
+	return &registry{targets: make(map[string]*TargetView), conns: make(map[int64]*trackedConn)}
+}
+
+// target returns the state of endpoint, which is created if it doesn't exist. The caller must hold the lock.
+func (r *registry) target(endpoint string) *TargetView {
+	t, exist := r.targets[endpoint]
+	if !exist {
+		t = &TargetView{Endpoint: endpoint, Healthy: true}
+		r.targets[endpoint] = t
+	}
+	return t
+}
+
+func (r *registry) watch(monitorAddr string, watching bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.monitorAddr, r.watching = monitorAddr, watching
+}
+
+func (r *registry) update() {
+	r.Lock()
+	defer r.Unlock()
+	r.updated = time.Now()
+}
+
+// available returns whether endpoint takes new connections
+func (r *registry) available(endpoint string) bool {
+	r.Lock()
+	defer r.Unlock()
+	t, exist := r.targets[endpoint]
+	return !exist || !t.Draining && !t.Disabled
+}
+
+func (r *registry) dialFailed(endpoint string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	t := r.target(endpoint)
+	t.Healthy, t.LastError = false, err.Error()
+	t.DialFailures++
+}
+
+// open records the connection from client to target, and returns its id
+func (r *registry) open(endpoint string, client, target net.Conn) int64 {
+	r.Lock()
+	defer r.Unlock()
+	t := r.target(endpoint)
+	t.Healthy, t.LastError = true, ""
+	t.Active++
+	t.Total++
+	r.nextID++
+	r.conns[r.nextID] = &trackedConn{
+		ConnView: ConnView{ID: r.nextID, Client: client.RemoteAddr().String(), Target: endpoint, Since: time.Now()},
+		client:   client,
+		target:   target,
+	}
+	return r.nextID
+}
+
+func (r *registry) close(id int64) {
+	r.Lock()
+	defer r.Unlock()
+	if conn, exist := r.conns[id]; exist {
+		delete(r.conns, id)
+		r.target(conn.Target).Active--
+	}
+}
+
+// setState drains, disables or enables endpoint. The connections to a disabled target are closed.
+func (r *registry) setState(endpoint, action string) error {
+	r.Lock()
+	defer r.Unlock()
+	t := r.target(endpoint)
+	switch action {
+	case actionDrain:
+		t.Draining, t.Disabled = true, false
+	case actionDisable:
+		t.Draining, t.Disabled = false, true
+		for _, conn := range r.conns {
+			if conn.Target == endpoint {
+				conn.client.Close()
+				conn.target.Close()
+			}
+		}
+	case actionEnable:
+		t.Draining, t.Disabled = false, false
+	default:
+		return fmt.Errorf("Unknown action %s", action)
+	}
+	glog.Infof("Target %s is set to %s by the admin server", endpoint, action)
+	return nil
+}
+
+// kill closes the connection of id
+func (r *registry) kill(id int64) bool {
+	r.Lock()
+	defer r.Unlock()
+	conn, exist := r.conns[id]
+	if exist {
+		glog.Infof("Kill the connection from %s to %s by the admin server", conn.Client, conn.Target)
+		conn.client.Close()
+		conn.target.Close()
+	}
+	return exist
+}
+
+func (r *registry) connections() []ConnView {
+	r.Lock()
+	defer r.Unlock()
+	views := make([]ConnView, 0, len(r.conns))
+	for _, conn := range r.conns {
+		views = append(views, conn.ConnView)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	return views
+}
+
+// status returns the status with current as the targets of monitor. The states of the other targets
+// without connections, which are neither drained nor disabled, are dropped.
+func (r *registry) status(current []string) StatusView {
+	r.Lock()
+	defer r.Unlock()
+	view := StatusView{Monitor: r.monitorAddr, Updated: r.updated, Source: sourceNone}
+	if r.watching {
+		view.Source = sourceMonitor
+	} else if !r.updated.IsZero() {
+		view.Source = sourceCache
+	}
+	isCurrent := make(map[string]bool)
+	for _, endpoint := range current {
+		isCurrent[endpoint] = true
+		r.target(endpoint)
+	}
+	for endpoint, t := range r.targets {
+		t.Current = isCurrent[endpoint]
+		if !t.Current && t.Active == 0 && !t.Draining && !t.Disabled {
+			delete(r.targets, endpoint)
+			continue
+		}
+		view.Targets = append(view.Targets, *t)
+	}
+	sort.Slice(view.Targets, func(i, j int) bool { return view.Targets[i].Endpoint < view.Targets[j].Endpoint })
+	return view
+}
+
+// serveAdmin serves the admin HTTP server of all the listeners at AdminAddr
+func (g *proxyGroup) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/targets", g.serveTargets)
+	mux.HandleFunc("/connections", g.serveConnections)
+	glog.V(1).Infof("Start admin server at %s", g.opts.AdminAddr)
+	if err := http.ListenAndServe(g.opts.AdminAddr, mux); err != nil {
+		glog.Errorf("Admin server failed: %s", err.Error())
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// serveTargets returns the status by GET, and drains, disables or enables a target by
+// POST with type and endpoint
+func (g *proxyGroup) serveTargets(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		var listeners []ListenerView
+		var current []string
+		targetsLock.RLock()
+		for _, rp := range g.proxies {
+			listeners = append(listeners, ListenerView{
+				Port:      rp.servicePort,
+				Mode:      rp.serviceMode,
+				Targets:   append([]string{}, rp.targets...),
+				Switching: rp.switched != nil,
+			})
+			current = append(current, rp.targets...)
+		}
+		targetsLock.RUnlock()
+		view := g.registry.status(current)
+		view.Listeners = listeners
+		view.Rejected, view.Overflowed = atomic.LoadInt64(&g.rejected), atomic.LoadInt64(&g.overflowed)
+		writeJSON(rw, view)
+	case http.MethodPost:
+		endpoint := req.FormValue("endpoint")
+		if endpoint == "" {
+			http.Error(rw, "endpoint is required", http.StatusBadRequest)
+			return
+		}
+		if err := g.registry.setState(endpoint, req.FormValue("type")); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveConnections lists the client connections by GET, and kills a connection by POST with
+// type "kill" and id
+func (g *proxyGroup) serveConnections(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, g.registry.connections())
+	case http.MethodPost:
+		if action := req.FormValue("type"); action != actionKill {
+			http.Error(rw, fmt.Sprintf("Unknown action %s", action), http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		if !g.registry.kill(id) {
+			http.Error(rw, fmt.Sprintf("Connection %d is not found", id), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+	"golang.org/x/net/context"
+)
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func postForm(t *testing.T, url string, values url.Values) int {
+	t.Helper()
+	resp, err := http.PostForm(url, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	var servers []*fake.MySQL
+	for i := 0; i < 2; i++ {
+		server, err := fake.NewMySQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	drained, serving := servers[0], servers[1]
+	mon := newFakeMonitor(map[string][]string{"slave": {drained.Addr(), serving.Addr()}})
+	defer mon.Close()
+	port := freePort(t)
+	admin := "http://127.0.0.1:" + strconv.Itoa(freePort(t))
+	go StartProxy(port, "slave", discovery.NewMemory(mon.Listener.Addr().String()), Options{AdminAddr: admin[len("http://"):]})
+	waitReady(t, port)
+
+	if code := postForm(t, admin+"/targets", url.Values{"type": {actionDrain}, "endpoint": {drained.Addr()}}); code != http.StatusAccepted {
+		t.Fatalf("Drain should be accepted, got %d", code)
+	}
+	db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	drained.ResetStatements()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		if _, err = conn.ExecContext(ctx, "SET GLOBAL read_only=0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(drained.Statements()) != 0 {
+		t.Errorf("The drained target should not take new connections")
+	}
+
+	var status StatusView
+	getJSON(t, admin+"/targets", &status)
+	if len(status.Listeners) != 1 || status.Listeners[0].Mode != "slave" || status.Source != sourceMonitor || len(status.Targets) != 2 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if target := status.Targets[0]; target.Endpoint > status.Targets[1].Endpoint || !status.Targets[0].Current {
+		t.Errorf("The targets should be sorted and current: %+v", status.Targets)
+	}
+	for _, target := range status.Targets {
+		if target.Endpoint == drained.Addr() && (!target.Draining || target.Active != 0) ||
+			target.Endpoint == serving.Addr() && (target.Active != 1 || !target.Healthy) {
+			t.Errorf("Unexpected target %+v", target)
+		}
+	}
+
+	var conns []ConnView
+	getJSON(t, admin+"/connections", &conns)
+	if len(conns) != 1 || conns[0].Target != serving.Addr() {
+		t.Fatalf("Unexpected connections: %+v", conns)
+	}
+	if code := postForm(t, admin+"/connections", url.Values{"type": {actionKill}, "id": {"999"}}); code != http.StatusNotFound {
+		t.Errorf("Killing an unknown connection should be not found, got %d", code)
+	}
+	if code := postForm(t, admin+"/connections", url.Values{"type": {actionKill}, "id": {strconv.FormatInt(conns[0].ID, 10)}}); code != http.StatusAccepted {
+		t.Fatalf("Kill should be accepted, got %d", code)
+	}
+	if _, err = conn.ExecContext(ctx, "SET GLOBAL read_only=0"); err == nil {
+		t.Errorf("The killed connection should be closed")
+	}
+	waitProcesses(t, serving, 0, time.Second)
+
+	// No target takes new connections if all are drained or disabled
+	postForm(t, admin+"/targets", url.Values{"type": {actionDisable}, "endpoint": {serving.Addr()}})
+	if _, err = db.Exec("SET GLOBAL read_only=0"); err == nil {
+		t.Errorf("The connection should be rejected if all the targets are drained or disabled")
+	}
+	postForm(t, admin+"/targets", url.Values{"type": {actionEnable}, "endpoint": {drained.Addr()}})
+	if _, err = db.Exec("SET GLOBAL read_only=0"); err != nil || len(drained.Statements()) == 0 {
+		t.Errorf("The enabled target should take new connections: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrTooManyConnections is returned in place of the greeting to the clients over MaxConnections, like mysqld
+const ErrTooManyConnections = 1040
+
+// activity is the last time that bytes are read from either side of a proxied connection
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	return &activity{last: time.Now().UnixNano()}
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) lastTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// idleConn times out reading if there is no activity on both sides for timeout, so that a client
+// waiting for a long result set is not reaped while the server is sending
+type idleConn struct {
+	net.Conn
+	timeout  time.Duration
+	activity *activity
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(c.activity.lastTime().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.activity.touch()
+			return n, err
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(c.activity.lastTime()) < c.timeout {
+			// The other side is active
+			continue
+		}
+		return n, err
+	}
+}
+
+// acquire takes a slot of MaxConnections for conn, waiting up to QueueTimeout while the following
+// connections wait in the backlog of accept. The connection is rejected with "Too many connections"
+// if no slot is available, and the rejected connections are counted and logged.
+func (rp *MySQLProxy) acquire(conn net.Conn) bool {
+	if rp.slots == nil {
+		return true
+	}
+	select {
+	case rp.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if rp.opts.QueueTimeout > 0 {
+		timer := time.NewTimer(rp.opts.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case rp.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+	overflowed := atomic.AddInt64(&rp.overflowed, 1)
+	glog.Warningf("Rejected the connection from %s over %d connections, %d rejected in total", conn.RemoteAddr(), rp.opts.MaxConnections, overflowed)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writePacket(conn, 0, errPacket(ErrTooManyConnections, "Too many connections"))
+	return false
+}
+
+// release returns the slot taken by acquire
+func (rp *MySQLProxy) release() {
+	if rp.slots != nil {
+		<-rp.slots
+	}
+}
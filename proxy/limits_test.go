@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+	"golang.org/x/net/context"
+)
+
+// startLimitedProxy starts a proxy of server with opts, and waits until it listens
+func startLimitedProxy(t *testing.T, server *fake.MySQL, opts Options) (*sql.DB, func()) {
+	mon := newFakeMonitor(map[string][]string{"master": {server.Addr()}})
+	port := freePort(t)
+	go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), opts)
+	waitReady(t, port)
+	db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connections are closed instead of kept idle in the pool
+	db.SetMaxIdleConns(0)
+	return db, func() {
+		db.Close()
+		mon.Close()
+	}
+}
+
+// waitProcesses waits until the number of the connections of dba on server is n
+func waitProcesses(t *testing.T, server *fake.MySQL, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for server.ProcessCount("dba") != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("There should be %d connections, got %d", n, server.ProcessCount("dba"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// execUntil executes a statement through the proxy until it succeeds in timeout
+func execUntil(t *testing.T, db *sql.DB, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := db.Exec("SET GLOBAL read_only=0")
+		if err == nil {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Query through proxy failed: %s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProxyMaxConnections(t *testing.T) {
+	server, err := fake.NewMySQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	db, stop := startLimitedProxy(t, server, Options{MaxConnections: 1, DialTimeout: time.Second})
+	defer stop()
+
+	// The slot may be taken by the last connection for a while
+	ctx := context.Background()
+	var conn *sql.Conn
+	deadline := time.Now().Add(2 * cooldownTime)
+	for conn == nil {
+		if conn, err = db.Conn(ctx); err == nil {
+			if _, err = conn.ExecContext(ctx, "SET GLOBAL read_only=0"); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		if err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	other, err := db.Conn(ctx)
+	if err == nil {
+		_, err = other.ExecContext(ctx, "SET GLOBAL read_only=0")
+		other.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(ErrTooManyConnections)) {
+		t.Fatalf("The connection over the limit should be rejected, got %v", err)
+	}
+
+	// The slot is released after the first connection is closed
+	conn.Close()
+	waitProcesses(t, server, 0, 3*time.Second)
+	execUntil(t, db, 3*time.Second)
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	server, err := fake.NewMySQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	db, stop := startLimitedProxy(t, server, Options{IdleTimeout: 300 * time.Millisecond, MaxLifetime: 2 * time.Second})
+	defer stop()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "SET GLOBAL read_only=0"); err != nil {
+		t.Fatal(err)
+	}
+	waitProcesses(t, server, 0, time.Second)
+
+	// The active connection is kept until its lifetime ends
+	busy, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	started := time.Now()
+	for time.Since(started) < time.Second {
+		if _, err = busy.ExecContext(ctx, "SET GLOBAL read_only=0"); err != nil {
+			t.Fatalf("The active connection should not be closed: %s", err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for err == nil && time.Since(started) < 3*time.Second {
+		_, err = busy.ExecContext(ctx, "SET GLOBAL read_only=0")
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err == nil {
+		t.Errorf("The connection should be closed after the max lifetime")
+	}
+}
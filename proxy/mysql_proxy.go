@@ -1,81 +1,225 @@
 package proxy
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/json"
 
 	"github.com/golang/glog"
 	"github.com/laincloud/lainlet/client"
+	"github.com/laincloud/mysql-service/discovery"
 	"github.com/laincloud/mysql-service/monitor"
 	"golang.org/x/net/context"
 )
 
 const (
-	cooldownTime    = 3 * time.Second
-	monitorProcName = "web-1"
+	cooldownTime = 3 * time.Second
 )
 
 var targetsLock sync.RWMutex
 
+// The modes of the listeners, which are the roles published by monitor
+const (
+	ModeMaster  = "master"
+	ModeSlave   = "slave"
+	ModeStandby = "standby"
+)
+
+// Listener is a port of the proxy serving for a mode
+type Listener struct {
+	Port int
+	Mode string
+}
+
+// ParseListeners parses the comma separated port:mode list, e.g. "3306:master,3307:slave"
+func ParseListeners(list string) ([]Listener, error) {
+	var listeners []Listener
+	ports := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid listener %s, which should be port:mode", item)
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Invalid port of listener %s", item)
+		}
+		switch parts[1] {
+		case ModeMaster, ModeSlave, ModeStandby:
+		case "rw-split":
+			return nil, fmt.Errorf("Mode rw-split of port %d is not supported: proxyd is a transport layer proxy "+
+				"which doesn't parse the statements, use a master port for writes and a slave port for reads", port)
+		default:
+			return nil, fmt.Errorf("Unknown mode %s of port %d", parts[1], port)
+		}
+		if ports[port] {
+			return nil, fmt.Errorf("Port %d is listened more than once", port)
+		}
+		ports[port] = true
+		listeners = append(listeners, Listener{Port: port, Mode: parts[1]})
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("No listener is given")
+	}
+	return listeners, nil
+}
+
+// proxyGroup is shared by the MySQLProxies of all the listeners in the process, which watch monitor
+// once and share the limits, the counters and the admin server
+type proxyGroup struct {
+	// rejected and overflowed are the numbers of connections rejected by ACL and MaxConnections,
+	// which are updated atomically
+	rejected   int64
+	overflowed int64
+	disc       discovery.Discovery
+	opts       Options
+	// slots has a value for each client connection if MaxConnections is set
+	slots chan struct{}
+	// registry keeps the states of the targets and the connections for the admin server
+	registry *registry
+	proxies  []*MySQLProxy
+}
+
 // MySQLProxy proxies clients' requests to mysql servers.
 // The targets are thread-safe
 type MySQLProxy struct {
+	*proxyGroup
 	servicePort   int
-	serviceMode   string // master or slave
+	serviceMode   string // master, slave or standby
 	targets       []string
 	roundrobinIdx int
+	// switched is closed when the switching of master published by monitor is done, and is nil if
+	// master is not switching. It's protected by targetsLock.
+	switched chan struct{}
 }
 
-// StartProxy starts a MySQLProxy listening in port and serving for mode(master|slave)
-func StartProxy(port int, mode string) {
-	rp := MySQLProxy{
-		servicePort:   port,
-		serviceMode:   mode,
-		roundrobinIdx: -1,
-	}
-	//启动监听客户端连接的goroutine
-	go rp.listenConnectRequest()
-	glog.V(1).Infof("Start proxy. Server port: %d, mode: %s", port, mode)
-	rp.getInfoFromMonitor()
+// Options are the optional features of MySQLProxy, which are disabled by the zero value
+type Options struct {
+	// ACL checks the clients on accept, all are allowed if it's nil
+	ACL *ACL
+	// TLS makes the proxy handle the handshake of MySQL, the bytes are piped blindly if it's nil
+	TLS *TLSConfig
+	// DialTimeout is the timeout to connect to the backend
+	DialTimeout time.Duration
+	// MaxConnections limits the concurrent client connections of all the listeners. The connections over the limit wait
+	// up to QueueTimeout, and are rejected with "Too many connections".
+	MaxConnections int
+	QueueTimeout   time.Duration
+	// IdleTimeout closes the connections without any bytes in both directions for the duration
+	IdleTimeout time.Duration
+	// MaxLifetime closes the connections lasting longer than the duration
+	MaxLifetime time.Duration
+	// AdminAddr is the address of the admin HTTP server, which is disabled if it's empty
+	AdminAddr string
+	// HoldTimeout is the max time that the master-mode proxy holds the new connections while monitor
+	// is switching master, which are rejected if the new master is not published in time
+	HoldTimeout time.Duration
 }
 
-func (rp *MySQLProxy) getInfoFromMonitor() {
-	monitorClient := client.New(net.JoinHostPort(monitorProcName, monitor.MonitorPort))
+// StartProxy starts a MySQLProxy listening in port and serving for mode(master|slave|standby),
+// whose targets are pushed by the monitor found by disc
+func StartProxy(port int, mode string, disc discovery.Discovery, opts Options) {
+	StartProxies([]Listener{{Port: port, Mode: mode}}, disc, opts)
+}
+
+// StartProxies starts a MySQLProxy for each of listeners, which share the watch of monitor and opts
+func StartProxies(listeners []Listener, disc discovery.Discovery, opts Options) {
+	group := &proxyGroup{
+		disc:     disc,
+		opts:     opts,
+		registry: newRegistry(),
+	}
+	if opts.MaxConnections > 0 {
+		group.slots = make(chan struct{}, opts.MaxConnections)
+	}
+	for _, listener := range listeners {
+		rp := &MySQLProxy{
+			proxyGroup:    group,
+			servicePort:   listener.Port,
+			serviceMode:   listener.Mode,
+			roundrobinIdx: -1,
+		}
+		group.proxies = append(group.proxies, rp)
+		//启动监听客户端连接的goroutine
+		go rp.listenConnectRequest()
+		glog.V(1).Infof("Start proxy. Server port: %d, mode: %s", listener.Port, listener.Mode)
+	}
+	go opts.ACL.watch()
+	if opts.AdminAddr != "" {
+		go group.serveAdmin()
+	}
+	group.getInfoFromMonitor()
+}
+
+func (g *proxyGroup) getInfoFromMonitor() {
 	glog.V(1).Info("Connect to Monitor")
 	for {
-		ch, err := monitorClient.Watch(monitor.MonitorLocation, context.Background())
+		monitorAddr, err := g.disc.MonitorAddr()
+		if err != nil {
+			glog.Errorf("Find monitor failed: %s", err.Error())
+			time.Sleep(cooldownTime)
+			continue
+		}
+		// The SSE client of lainlet is used to watch monitor, which works without lainlet
+		ch, err := client.New(monitorAddr).Watch(monitor.MonitorLocation, context.Background())
 		if err != nil {
 			glog.Errorf("Watch monitor failed: %s", err.Error())
 			time.Sleep(cooldownTime)
 			continue
 		}
+		g.registry.watch(monitorAddr, true)
 		glog.Flush()
+		// Every event is taken at once, as monitor only publishes the roles when they are changed, and
+		// the switching of master must not wait behind the previous event
 		for event := range ch {
 			glog.Flush()
 			data := make(map[string][]string)
 			if err = json.Unmarshal(event.Data, &data); err == nil {
-				targetsLock.Lock()
-				rp.targets = data[rp.serviceMode]
-				rp.roundrobinIdx = -1
-				targetsLock.Unlock()
-				glog.V(1).Infof("Proxy %s successfully. Mode: %s, Port: %d, Targets: %v", event.Event, rp.serviceMode, rp.servicePort, rp.targets)
+				for _, rp := range g.proxies {
+					held := rp.update(data)
+					glog.V(1).Infof("Proxy %s successfully. Mode: %s, Port: %d, Targets: %v, Switching: %v", event.Event, rp.serviceMode, rp.servicePort, data[rp.serviceMode], held)
+				}
+				g.registry.update()
 				glog.Flush()
 			} else {
 				glog.Errorf("Unmarshal monitor data error: %s", err.Error())
 			}
-			time.Sleep(cooldownTime)
 		}
+		// The last targets are kept until monitor is watched again
+		g.registry.watch(monitorAddr, false)
 		glog.Flush()
 		time.Sleep(cooldownTime)
 	}
 
 }
 
+// update sets the targets by the data published by monitor, and returns whether master is switching
+// for the master-mode proxy
+func (rp *MySQLProxy) update(data map[string][]string) bool {
+	switching := rp.serviceMode == ModeMaster && len(data[monitor.SwitchingKey]) > 0
+	targetsLock.Lock()
+	defer targetsLock.Unlock()
+	rp.targets = data[rp.serviceMode]
+	rp.roundrobinIdx = -1
+	if switching && rp.switched == nil {
+		rp.switched = make(chan struct{})
+	} else if !switching && rp.switched != nil {
+		close(rp.switched)
+		rp.switched = nil
+	}
+	return switching
+}
+
 func (rp *MySQLProxy) listenConnectRequest() {
 	for {
 		// Listen the connection at servicePort
@@ -86,16 +230,16 @@ func (rp *MySQLProxy) listenConnectRequest() {
 			wg := &sync.WaitGroup{}
 			for {
 				glog.V(2).Info("Listen to other clients' request")
-				targetsLock.RLock()
-				targetsLen := len(rp.targets)
-				targetsLock.RUnlock()
-				if targetsLen == 0 {
-					glog.V(1).Infof("Waiting for targets infomation. Recheck in %s", cooldownTime)
-					time.Sleep(cooldownTime)
-				} else if conn, err := listener.Accept(); err == nil {
+				// The connections are accepted without targets, which are rejected with the reason by handleRequest
+				if conn, err := listener.Accept(); err == nil {
+					if !rp.allowed(conn) || !rp.acquire(conn) {
+						conn.Close()
+						continue
+					}
 					wg.Add(1)
 					go func(conn net.Conn) {
 						defer wg.Done()
+						defer rp.release()
 						defer conn.Close()
 						glog.V(2).Infof("Accepted: %s", conn.RemoteAddr())
 						rp.handleRequest(conn)
@@ -116,29 +260,92 @@ func (rp *MySQLProxy) listenConnectRequest() {
 
 }
 
-func (rp *MySQLProxy) handleRequest(client net.Conn) {
-	// Find an endpoint in RR algorithm
+// allowed checks the source address of conn by acl, the rejected connections are counted and logged
+func (rp *MySQLProxy) allowed(conn net.Conn) bool {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err == nil && rp.opts.ACL.Allowed(net.ParseIP(host)) {
+		return true
+	}
+	rejected := atomic.AddInt64(&rp.rejected, 1)
+	glog.Warningf("Rejected the connection from %s by ACL, %d rejected in total", conn.RemoteAddr(), rejected)
+	return false
+}
+
+// hold waits until the switching of master is done or HoldTimeout
+func (rp *MySQLProxy) hold(client net.Conn) {
 	targetsLock.RLock()
-	if len(rp.targets) == 0 {
-		glog.Errorf("No suitable targets")
-		targetsLock.RUnlock()
+	switched := rp.switched
+	targetsLock.RUnlock()
+	if switched == nil || rp.opts.HoldTimeout <= 0 {
 		return
 	}
-	rp.roundrobinIdx++
-	if rp.roundrobinIdx >= len(rp.targets) {
-		rp.roundrobinIdx = 0
+	glog.V(1).Infof("Hold the connection from %s while master is switching", client.RemoteAddr())
+	timer := time.NewTimer(rp.opts.HoldTimeout)
+	defer timer.Stop()
+	select {
+	case <-switched:
+	case <-timer.C:
+		glog.Warningf("Master is not switched in %s, the connection from %s is not held any more", rp.opts.HoldTimeout, client.RemoteAddr())
+	}
+}
+
+func (rp *MySQLProxy) handleRequest(client net.Conn) {
+	rp.hold(client)
+	// Find an endpoint in RR algorithm skipping the drained and disabled ones,
+	// the index is changed so the write lock is required
+	targetsLock.Lock()
+	targetsLen := len(rp.targets)
+	targetEndpoint := ""
+	for i := 0; i < targetsLen && targetEndpoint == ""; i++ {
+		rp.roundrobinIdx = (rp.roundrobinIdx + 1) % targetsLen
+		if endpoint := rp.targets[rp.roundrobinIdx]; rp.registry.available(endpoint) {
+			targetEndpoint = endpoint
+		}
+	}
+	targetsLock.Unlock()
+	if targetEndpoint == "" {
+		glog.Errorf("No suitable targets for %s", client.RemoteAddr())
+		message := fmt.Sprintf("No %s is available through the proxy, failover may be in progress", rp.serviceMode)
+		if targetsLen > 0 {
+			message = fmt.Sprintf("All the %ss are drained or disabled in the proxy", rp.serviceMode)
+		}
+		rejectHandshake(client, ErrNoBackend, message)
+		return
 	}
-	targetEndpoint := rp.targets[rp.roundrobinIdx]
-	targetsLock.RUnlock()
 
 	//得到目标地址后,建立proxy到目标地址的连接
-	target, err := net.Dial("tcp", targetEndpoint)
+	target, err := net.DialTimeout("tcp", targetEndpoint, rp.opts.DialTimeout)
 
 	if err != nil {
 		glog.Error(err)
+		rp.registry.dialFailed(targetEndpoint, err)
+		rejectHandshake(client, ErrNoBackend, fmt.Sprintf("Can't connect to the %s %s through the proxy", rp.serviceMode, targetEndpoint))
 		return
 	}
 	defer target.Close()
+	connID := rp.registry.open(targetEndpoint, client, target)
+	defer rp.registry.close(connID)
+	if rp.opts.MaxLifetime > 0 {
+		// The raw connections are closed, which are wrapped later
+		rawClient, rawTarget := client, target
+		timer := time.AfterFunc(rp.opts.MaxLifetime, func() {
+			glog.V(1).Infof("Close the connection from %s lasting %s", rawClient.RemoteAddr(), rp.opts.MaxLifetime)
+			rawClient.Close()
+			rawTarget.Close()
+		})
+		defer timer.Stop()
+	}
+	if rp.opts.IdleTimeout > 0 {
+		a := newActivity()
+		client = &idleConn{Conn: client, timeout: rp.opts.IdleTimeout, activity: a}
+		target = &idleConn{Conn: target, timeout: rp.opts.IdleTimeout, activity: a}
+	}
+	if rp.opts.TLS != nil {
+		if client, target, err = rp.opts.TLS.handshake(client, target, targetEndpoint); err != nil {
+			glog.Errorf("Handshake failed: %s", err.Error())
+			return
+		}
+	}
 	pipe(client, target)
 
 }
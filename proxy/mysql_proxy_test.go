@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+	"github.com/laincloud/mysql-service/monitor"
+)
+
+// fakeMonitor pushes the roles to proxies like the SSE server of monitor
+type fakeMonitor struct {
+	*httptest.Server
+	updates chan map[string][]string
+	stop    chan struct{}
+}
+
+func newFakeMonitor(init map[string][]string) *fakeMonitor {
+	m := &fakeMonitor{updates: make(chan map[string][]string), stop: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc(monitor.MonitorLocation, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		event, roles := "init", init
+		for {
+			data, _ := json.Marshal(roles)
+			fmt.Fprintf(rw, "id: 1\nevent: %s\ndata: %s\n\n", event, data)
+			rw.(http.Flusher).Flush()
+			select {
+			case roles = <-m.updates:
+				event = "update"
+			case <-m.stop:
+				return
+			}
+		}
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// Close ends the watches of proxies and stops the server
+func (m *fakeMonitor) Close() {
+	close(m.stop)
+	m.Server.Close()
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// connect executes a statement in a new connection through the proxy, retrying until the proxy listens
+func connect(t *testing.T, port int) {
+	t.Helper()
+	db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/?charset=utf8", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	deadline := time.Now().Add(3 * cooldownTime)
+	for {
+		if _, err = db.Exec("SET GLOBAL read_only=0"); err == nil {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Query through proxy failed: %s", err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProxyFollowsMonitor(t *testing.T) {
+	var servers []*fake.MySQL
+	for i := 0; i < 2; i++ {
+		server, err := fake.NewMySQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	oldMaster, newMaster := servers[0], servers[1]
+	mon := newFakeMonitor(map[string][]string{"master": {oldMaster.Addr()}, "slave": {newMaster.Addr()}})
+	defer mon.Close()
+
+	port := freePort(t)
+	go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), Options{})
+	connect(t, port)
+	if len(oldMaster.Statements()) == 0 {
+		t.Fatalf("Query is not proxied to master %s", oldMaster.Addr())
+	}
+
+	mon.updates <- map[string][]string{"master": {newMaster.Addr()}, "slave": {}}
+	deadline := time.Now().Add(2 * cooldownTime)
+	for len(newMaster.Statements()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Query is not proxied to the new master %s after switching", newMaster.Addr())
+		}
+		connect(t, port)
+		time.Sleep(100 * time.Millisecond)
+	}
+	oldMaster.ResetStatements()
+	connect(t, port)
+	if len(oldMaster.Statements()) != 0 {
+		t.Errorf("Query is proxied to the old master %s after switching", oldMaster.Addr())
+	}
+}
+
+func TestProxyNoBackend(t *testing.T) {
+	mon := newFakeMonitor(map[string][]string{"master": {}})
+	defer mon.Close()
+	port := freePort(t)
+	go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), Options{})
+	db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// execError executes a statement through the proxy, retrying until the proxy listens
+	execError := func() string {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			_, err := db.Exec("SET GLOBAL read_only=0")
+			if err == nil {
+				t.Fatalf("Query should fail without backend")
+			} else if !strings.Contains(err.Error(), "connection refused") || time.Now().After(deadline) {
+				return err.Error()
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if message := execError(); !strings.Contains(message, "Error 2003") || !strings.Contains(message, "No master is available") {
+		t.Errorf("The client should be told that no master is available, got %q", message)
+	}
+
+	// The dialing fails as the port is not listened
+	down := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	mon.updates <- map[string][]string{"master": {down}}
+	deadline := time.Now().Add(2 * cooldownTime)
+	for message := execError(); !strings.Contains(message, "Can't connect to the master "+down); message = execError() {
+		if time.Now().After(deadline) {
+			t.Fatalf("The client should be told that the master can't be connected, got %q", message)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProxyHoldsDuringSwitching(t *testing.T) {
+	var servers []*fake.MySQL
+	for i := 0; i < 2; i++ {
+		server, err := fake.NewMySQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	oldMaster, newMaster := servers[0], servers[1]
+	mon := newFakeMonitor(map[string][]string{"master": {oldMaster.Addr()}})
+	defer mon.Close()
+	port := freePort(t)
+	go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), Options{HoldTimeout: 5 * time.Second})
+	connect(t, port)
+
+	db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Every query opens a new connection through the proxy
+	db.SetMaxIdleConns(0)
+
+	// The switching right after the init event is taken at once, without waiting for any cooldown
+	mon.updates <- map[string][]string{"master": {}, monitor.SwitchingKey: {newMaster.Addr()}}
+	deadline := time.Now().Add(cooldownTime / 3)
+	done := make(chan error, 1)
+	for held := false; !held; {
+		if time.Now().After(deadline) {
+			t.Fatalf("The connection should be held soon after master starts switching")
+		}
+		oldMaster.ResetStatements()
+		go func() {
+			_, err := db.Exec("SET GLOBAL read_only=0")
+			done <- err
+		}()
+		select {
+		case <-done:
+		case <-time.After(300 * time.Millisecond):
+			held = true
+		}
+	}
+
+	mon.updates <- map[string][]string{"master": {newMaster.Addr()}}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Query through proxy failed: %s", err.Error())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("The held connection is not proxied after switching")
+	}
+	if len(oldMaster.Statements()) != 0 || len(newMaster.Statements()) == 0 {
+		t.Errorf("The held connection should be proxied to the new master")
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners("3306:master, 3307:slave,3309:standby")
+	if err != nil || !reflect.DeepEqual(listeners, []Listener{{3306, ModeMaster}, {3307, ModeSlave}, {3309, ModeStandby}}) {
+		t.Errorf("Unexpected listeners %v: %v", listeners, err)
+	}
+	for _, list := range []string{"", "3306", "port:master", "3306:master,3306:slave", "3306:backup"} {
+		if _, err = ParseListeners(list); err == nil {
+			t.Errorf("%q should be invalid", list)
+		}
+	}
+	if _, err = ParseListeners("3306:master,3308:rw-split"); err == nil || !strings.Contains(err.Error(), "transport layer") {
+		t.Errorf("rw-split should be rejected with the reason, got %v", err)
+	}
+}
+
+func TestProxyListeners(t *testing.T) {
+	servers := make(map[string]*fake.MySQL)
+	roles := make(map[string][]string)
+	for _, mode := range []string{ModeMaster, ModeSlave, ModeStandby} {
+		server, err := fake.NewMySQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		servers[mode] = server
+		roles[mode] = []string{server.Addr()}
+	}
+	mon := newFakeMonitor(roles)
+	defer mon.Close()
+	var listeners []Listener
+	for _, mode := range []string{ModeMaster, ModeSlave, ModeStandby} {
+		listeners = append(listeners, Listener{Port: freePort(t), Mode: mode})
+	}
+	go StartProxies(listeners, discovery.NewMemory(mon.Listener.Addr().String()), Options{})
+
+	for _, listener := range listeners {
+		for _, server := range servers {
+			server.ResetStatements()
+		}
+		connect(t, listener.Port)
+		for mode, server := range servers {
+			if proxied := len(server.Statements()) != 0; proxied != (mode == listener.Mode) {
+				t.Errorf("Port of %s should proxy to %s only, %s is proxied: %v", listener.Mode, listener.Mode, mode, proxied)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The packets and capability flags of the MySQL client/server protocol used by the handshake
+const (
+	iOK           = 0x00
+	iAuthMoreData = 0x01
+	iERR          = 0xff
+
+	// fastAuthSuccess follows iAuthMoreData when caching_sha2_password succeeds, and is followed by OK at once
+	fastAuthSuccess = 0x03
+
+	clientLongPass    = 0x00000001
+	clientLongFlag    = 0x00000004
+	clientProtocol41  = 0x00000200
+	clientSSL         = 0x00000800
+	clientTransaction = 0x00002000
+	clientSecureConn  = 0x00008000
+	clientPluginAuth  = 0x00080000
+	// greetingCapabilities are the capability flags in the greeting of the proxy, without SSL so that
+	// the clients send the handshake response in plain text
+	greetingCapabilities = clientLongPass | clientLongFlag | clientProtocol41 | clientTransaction | clientSecureConn | clientPluginAuth
+
+	protocolVersion    = 10
+	charsetUTF8        = 33
+	statusAutocommit   = 0x0002
+	proxyServerVersion = "5.6.0-mysql-service-proxy"
+	// handshakeTimeout is the time for a client to answer the greeting of the proxy
+	handshakeTimeout = 3 * time.Second
+	// sslRequestLength is the payload length of SSLRequest: capability flags [4], max packet size [4],
+	// charset [1] and reserved [23], which is also the prefix of HandshakeResponse41
+	sslRequestLength = 32
+	maxPayloadLength = 1<<24 - 1
+
+	// ErrSecureTransportRequired is returned to the clients without TLS if it's required
+	ErrSecureTransportRequired = 3159
+	// ErrHandshake is returned to the clients if the proxy fails in the handshake with the backend
+	ErrHandshake = 2013
+	// ErrNoBackend is returned to the clients if there is no target or the target can't be connected
+	ErrNoBackend = 2003
+)
+
+// TLSConfig is the TLS of the proxy. The proxy pipes the bytes blindly if it's nil, so that TLS
+// negotiated by the client is handled by mysqld.
+type TLSConfig struct {
+	// Server terminates the TLS of the clients, which is offered in the greeting if it's not nil
+	Server *tls.Config
+	// RequireClient rejects the clients not requesting TLS
+	RequireClient bool
+	// Backend opens TLS to mysqld if it's not nil. ServerName is the host of the backend if it's empty.
+	Backend *tls.Config
+}
+
+// readPacket reads a packet without buffering, so that the connection can be upgraded to TLS after it
+func readPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == maxPayloadLength {
+		return 0, nil, fmt.Errorf("Packet of %d bytes is too large for the handshake", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func writePacket(w io.Writer, seq byte, payload []byte) error {
+	if len(payload) >= maxPayloadLength {
+		return fmt.Errorf("Packet of %d bytes is too large", len(payload))
+	}
+	packet := make([]byte, 4, 4+len(payload))
+	packet[0], packet[1], packet[2], packet[3] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16), seq
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+// errPacket returns the payload of an ERR packet with SQL state HY000
+func errPacket(code uint16, message string) []byte {
+	payload := []byte{iERR, byte(code), byte(code >> 8)}
+	payload = append(payload, "#HY000"...)
+	return append(payload, message...)
+}
+
+// greetingPacket returns the initial handshake of the proxy itself, which is sent if there is no backend
+func greetingPacket() []byte {
+	scramble := make([]byte, 20)
+	rand.Read(scramble)
+	for i := range scramble {
+		// printable bytes without NUL, like the scramble of MySQL
+		scramble[i] = scramble[i]%94 + 33
+	}
+	capabilities := uint32(greetingCapabilities)
+	payload := []byte{protocolVersion}
+	payload = append(payload, proxyServerVersion...)
+	// NUL of the version and connection id [4]
+	payload = append(payload, 0, 0, 0, 0, 0)
+	payload = append(payload, scramble[:8]...)
+	payload = append(payload, 0, byte(capabilities), byte(capabilities>>8), charsetUTF8)
+	payload = append(payload, byte(statusAutocommit), byte(statusAutocommit>>8), byte(capabilities>>16), byte(capabilities>>24))
+	payload = append(payload, byte(len(scramble)+1))
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, scramble[8:]...)
+	payload = append(payload, 0)
+	payload = append(payload, "mysql_native_password"...)
+	return append(payload, 0)
+}
+
+// rejectHandshake sends the greeting of the proxy and answers the handshake response with an ERR packet,
+// so that the client reports the reason instead of losing the connection during the handshake
+func rejectHandshake(conn net.Conn, code uint16, message string) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writePacket(conn, 0, greetingPacket()); err != nil {
+		return
+	}
+	seq, _, err := readPacket(conn)
+	if err != nil {
+		glog.V(2).Infof("Read the handshake response of %s failed: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	writePacket(conn, seq+1, errPacket(code, message))
+}
+
+// greetingCapability returns the offset of the lower 2 bytes of the capability flags in the greeting,
+// which is after protocol version [1], server version [NUL], connection id [4], auth data [8] and filler [1]
+func greetingCapability(greeting []byte) (int, error) {
+	if len(greeting) == 0 || greeting[0] == iERR {
+		return 0, fmt.Errorf("Unexpected greeting")
+	}
+	for i := 1; i < len(greeting); i++ {
+		if greeting[i] == 0 {
+			if offset := i + 1 + 4 + 8 + 1; offset+2 <= len(greeting) {
+				return offset, nil
+			}
+			break
+		}
+	}
+	return 0, fmt.Errorf("Malformed greeting")
+}
+
+func setCapability(data []byte, offset int, flag uint16, on bool) {
+	capability := binary.LittleEndian.Uint16(data[offset:])
+	if on {
+		capability |= flag
+	} else {
+		capability &^= flag
+	}
+	binary.LittleEndian.PutUint16(data[offset:], capability)
+}
+
+// handshake relays the handshake between client and target, terminating the TLS of client and
+// opening TLS to target as configured. It returns the connections to pipe after the handshake,
+// which are wrapped by TLS if it's negotiated.
+func (config *TLSConfig) handshake(client, target net.Conn, targetEndpoint string) (net.Conn, net.Conn, error) {
+	seq, greeting, err := readPacket(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := greetingCapability(greeting)
+	if err != nil {
+		// e.g. "Too many connections" or "Host is blocked" of mysqld
+		writePacket(client, seq, greeting)
+		return nil, nil, err
+	}
+	targetSSL := binary.LittleEndian.Uint16(greeting[offset:])&clientSSL != 0
+	if config.Backend != nil && !targetSSL {
+		// The error is sent in place of the greeting like the errors of mysqld before the handshake
+		writePacket(client, seq, errPacket(ErrHandshake, fmt.Sprintf("SSL is not enabled by %s", targetEndpoint)))
+		return nil, nil, fmt.Errorf("SSL is not enabled by %s", targetEndpoint)
+	}
+	setCapability(greeting, offset, clientSSL, config.Server != nil)
+	if err = writePacket(client, seq, greeting); err != nil {
+		return nil, nil, err
+	}
+
+	clientSeq, response, err := readPacket(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(response) < sslRequestLength || binary.LittleEndian.Uint32(response)&clientProtocol41 == 0 {
+		return nil, nil, fmt.Errorf("Unsupported handshake response from %s", client.RemoteAddr())
+	}
+	clientTLS := false
+	if len(response) == sslRequestLength && binary.LittleEndian.Uint32(response)&clientSSL != 0 {
+		if config.Server == nil {
+			return nil, nil, fmt.Errorf("SSL is requested by %s but not offered", client.RemoteAddr())
+		}
+		tlsConn := tls.Server(client, config.Server)
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, nil, fmt.Errorf("TLS handshake with %s failed: %s", client.RemoteAddr(), err.Error())
+		}
+		client, clientTLS = tlsConn, true
+		if clientSeq, response, err = readPacket(client); err != nil {
+			return nil, nil, err
+		}
+		if len(response) < sslRequestLength {
+			return nil, nil, fmt.Errorf("Malformed handshake response from %s", client.RemoteAddr())
+		}
+	}
+	if config.RequireClient && !clientTLS {
+		writePacket(client, clientSeq+1, errPacket(ErrSecureTransportRequired,
+			"Connections using insecure transport are prohibited by the proxy"))
+		return nil, nil, fmt.Errorf("Rejected the connection from %s without TLS", client.RemoteAddr())
+	}
+
+	targetSeq := seq + 1
+	if config.Backend != nil {
+		request := append([]byte(nil), response[:sslRequestLength]...)
+		setCapability(request, 0, clientSSL, true)
+		if err = writePacket(target, targetSeq, request); err != nil {
+			return nil, nil, err
+		}
+		targetSeq++
+		tlsConfig := config.Backend
+		if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(targetEndpoint)
+		}
+		tlsConn := tls.Client(target, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			writePacket(client, clientSeq+1, errPacket(ErrHandshake, "TLS handshake with the backend failed"))
+			return nil, nil, fmt.Errorf("TLS handshake with %s failed: %s", targetEndpoint, err.Error())
+		}
+		target = tlsConn
+	}
+	setCapability(response, 0, clientSSL, config.Backend != nil)
+	if err = writePacket(target, targetSeq, response); err != nil {
+		return nil, nil, err
+	}
+	if delta := targetSeq - clientSeq; delta != 0 {
+		// The sequence ids of the two sides differ by the SSLRequest until the authentication completes
+		if err = relayAuth(client, target, delta); err != nil {
+			return nil, nil, err
+		}
+	}
+	glog.V(2).Infof("Handshake of %s is done, client TLS: %v, backend TLS: %v", client.RemoteAddr(), clientTLS, config.Backend != nil)
+	return client, target, nil
+}
+
+// relayAuth relays the packets of the authentication, whose sequence ids of target are delta ahead of client,
+// until target sends OK or ERR
+func relayAuth(client, target net.Conn, delta byte) error {
+	for {
+		seq, packet, err := readPacket(target)
+		if err != nil {
+			return err
+		}
+		if err = writePacket(client, seq-delta, packet); err != nil {
+			return err
+		}
+		if len(packet) == 0 || packet[0] == iOK || packet[0] == iERR {
+			return nil
+		}
+		if len(packet) == 2 && packet[0] == iAuthMoreData && packet[1] == fastAuthSuccess {
+			continue
+		}
+		if seq, packet, err = readPacket(client); err != nil {
+			return err
+		}
+		if err = writePacket(target, seq+delta, packet); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+)
+
+// selfSignedTLS returns a server config with a self-signed certificate of 127.0.0.1
+func selfSignedTLS(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mysql-service"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// waitReady waits until the proxy in port relays the greeting of a backend, instead of rejecting
+// the connections without targets
+func waitReady(t *testing.T, port int) {
+	deadline := time.Now().Add(3 * cooldownTime)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			var greeting []byte
+			conn.SetReadDeadline(deadline)
+			_, greeting, err = readPacket(conn)
+			conn.Close()
+			if err == nil && !strings.Contains(string(greeting), proxyServerVersion) {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Proxy is not ready: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	serverTLS := selfSignedTLS(t)
+	for _, c := range []struct {
+		name       string
+		config     TLSConfig
+		clientTLS  bool
+		backendTLS bool
+		errCode    string
+	}{
+		{name: "terminate", config: TLSConfig{Server: serverTLS}, clientTLS: true},
+		{name: "originate", config: TLSConfig{Backend: &tls.Config{InsecureSkipVerify: true}}, backendTLS: true},
+		{name: "both", config: TLSConfig{Server: serverTLS, RequireClient: true, Backend: &tls.Config{InsecureSkipVerify: true}},
+			clientTLS: true, backendTLS: true},
+		{name: "plain client required", config: TLSConfig{Server: serverTLS, RequireClient: true},
+			errCode: strconv.Itoa(ErrSecureTransportRequired)},
+		{name: "backend without SSL", config: TLSConfig{Backend: &tls.Config{InsecureSkipVerify: true}},
+			errCode: strconv.Itoa(ErrHandshake)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server, err := fake.NewMySQL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			server.SetPassword("dba", "dba")
+			if c.backendTLS {
+				server.SetTLS(serverTLS)
+			}
+			mon := newFakeMonitor(map[string][]string{"master": {server.Addr()}})
+			defer mon.Close()
+			port := freePort(t)
+			config := c.config
+			go StartProxy(port, "master", discovery.NewMemory(mon.Listener.Addr().String()), Options{TLS: &config})
+			waitReady(t, port)
+
+			db, err := sql.Open("mysql", fmt.Sprintf("dba:dba@tcp(127.0.0.1:%d)/?tls=%v", port, map[bool]string{true: "skip-verify", false: "false"}[c.clientTLS]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			_, err = db.Exec("SET GLOBAL read_only=0")
+			if c.errCode != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errCode) {
+					t.Fatalf("The connection should be rejected with %s, got %v", c.errCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Query through proxy failed: %s", err.Error())
+			}
+			if sessions := server.TLSSessions(); (sessions > 0) != c.backendTLS {
+				t.Errorf("TLS to the backend should be %v, got %d sessions", c.backendTLS, sessions)
+			}
+		})
+	}
+}
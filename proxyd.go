@@ -1,16 +1,99 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
 
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/discovery"
 	"github.com/laincloud/mysql-service/proxy"
 )
 
 func main() {
 	var servicePort int
 	var serviceMode string
+	var listen string
+	var allow, deny string
+	var resolveInterval time.Duration
+	var tlsCert, tlsKey, backendCA string
+	var requireTLS, backendTLS, backendSkipVerify bool
+	var opts proxy.Options
 	flag.IntVar(&servicePort, "p", 3306, "The service port for mysql clients")
-	flag.StringVar(&serviceMode, "m", "slave", "The service mode for mysql clients (master|slave)")
+	flag.StringVar(&serviceMode, "m", "slave", "The service mode for mysql clients (master|slave|standby)")
+	flag.StringVar(&listen, "listen", "", "The comma separated port:mode listeners sharing the watch of monitor, e.g. 3306:master,3307:slave, which override -p and -m")
+	flag.StringVar(&allow, "allow", "", "The comma separated CIDRs, IPs or LAIN app names allowed to connect, all by default")
+	flag.StringVar(&deny, "deny", "", "The comma separated CIDRs, IPs or LAIN app names denied to connect, which take precedence over -allow")
+	flag.DurationVar(&resolveInterval, "acl-resolve-interval", 30*time.Second, "The interval to resolve the app names of -allow and -deny")
+	flag.StringVar(&tlsCert, "tls-cert", "", "The certificate file to terminate the TLS of clients")
+	flag.StringVar(&tlsKey, "tls-key", "", "The key file of -tls-cert")
+	flag.BoolVar(&requireTLS, "tls-require", false, "Reject the clients without TLS, which requires -tls-cert")
+	flag.BoolVar(&backendTLS, "backend-tls", false, "Open TLS to mysql-server instances")
+	flag.StringVar(&backendCA, "backend-tls-ca", "", "The CA file to verify mysql-server instances, the system CAs by default")
+	flag.BoolVar(&backendSkipVerify, "backend-tls-skip-verify", false, "Skip verifying the certificates of mysql-server instances")
+	flag.DurationVar(&opts.DialTimeout, "dial-timeout", 5*time.Second, "The timeout to connect to mysql-server instances")
+	flag.IntVar(&opts.MaxConnections, "max-connections", 0, "The max concurrent client connections, unlimited if it's 0")
+	flag.DurationVar(&opts.QueueTimeout, "queue-timeout", time.Second, "The time that a connection over -max-connections waits before it's rejected")
+	flag.DurationVar(&opts.IdleTimeout, "idle-timeout", 0, "Close the connections idle for the duration, disabled if it's 0")
+	flag.DurationVar(&opts.MaxLifetime, "max-lifetime", 0, "Close the connections lasting longer than the duration, disabled if it's 0")
+	flag.DurationVar(&opts.HoldTimeout, "hold-timeout", 10*time.Second, "The max time to hold the new connections while master is switching, disabled if it's 0")
+	flag.StringVar(&opts.AdminAddr, "admin", "127.0.0.1:6034", "The address of the admin HTTP server, disabled if it's empty")
 	flag.Parse()
-	proxy.StartProxy(servicePort, serviceMode)
+	if listen == "" {
+		listen = fmt.Sprintf("%d:%s", servicePort, serviceMode)
+	}
+	listeners, err := proxy.ParseListeners(listen)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	disc, err := discovery.FromFlags()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if allow != "" || deny != "" {
+		if opts.ACL, err = proxy.NewACL(proxy.ParseACLList(allow), proxy.ParseACLList(deny), disc, resolveInterval); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if opts.TLS, err = tlsFromFlags(tlsCert, tlsKey, requireTLS, backendTLS, backendCA, backendSkipVerify); err != nil {
+		glog.Fatal(err)
+	}
+	proxy.StartProxies(listeners, disc, opts)
+}
+
+// tlsFromFlags returns the TLS of the proxy, which is nil if TLS is disabled on both sides
+func tlsFromFlags(cert, key string, require, backend bool, backendCA string, skipVerify bool) (*proxy.TLSConfig, error) {
+	if cert == "" && !backend {
+		if require {
+			return nil, fmt.Errorf("-tls-require requires -tls-cert")
+		}
+		return nil, nil
+	}
+	config := &proxy.TLSConfig{RequireClient: require}
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Server = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	} else if require {
+		return nil, fmt.Errorf("-tls-require requires -tls-cert")
+	}
+	if backend {
+		config.Backend = &tls.Config{InsecureSkipVerify: skipVerify}
+		if backendCA != "" {
+			data, err := ioutil.ReadFile(backendCA)
+			if err != nil {
+				return nil, err
+			}
+			config.Backend.RootCAs = x509.NewCertPool()
+			if !config.Backend.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("No certificate is found in %s", backendCA)
+			}
+		}
+	}
+	return config, nil
 }
@@ -19,11 +19,39 @@ func init() {
 	beego.Router("/error", mainCtl, "get:Error")
 	beego.Router("/details", mainCtl, "get:Details")
 	beego.Router("/action", mainCtl, "get:Action")
+	beego.Router("/repair", mainCtl, "get:Repair")
+	beego.Router("/slowlog", mainCtl, "get:SlowQueries")
+	beego.Router("/backups", mainCtl, "get:Backups")
+	beego.Router("/databases", mainCtl, "get:Databases;post:DatabaseAction")
+	beego.Router("/config", mainCtl, "get:Config")
+	beego.Router("/simulator", mainCtl, "get:Simulator")
+	beego.Router("/simulate", mainCtl, "get:Simulate")
 
 	beego.Router("/role", apiCtl, "get:GetRole")
+	beego.Router("/api/role", apiCtl, "get:GetRoleInfo")
+	beego.Router("/api/backups", apiCtl, "get:GetBackups;post:PostBackup")
+	beego.Router("/api/metrics", apiCtl, "get:GetMetrics")
+	beego.Router("/api/innodb", apiCtl, "get:GetInnoDB")
+	beego.Router("/api/slowlog", apiCtl, "get:GetSlowQueries")
+	beego.Router("/api/databases", apiCtl, "get:GetDatabases;post:PostDatabase")
+	beego.Router("/api/sessions", apiCtl, "get:GetSessions;post:KillSessions")
 
 	beego.InsertFilter("/", beego.BeforeRouter, controllers.FilterConsoleLogin)
 	beego.InsertFilter("/error", beego.BeforeRouter, controllers.FilterConsoleLogin)
 	beego.InsertFilter("/action", beego.BeforeRouter, controllers.FilterConsoleLogin)
 	beego.InsertFilter("/details", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/repair", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/slowlog", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/backups", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/databases", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/config", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/simulator", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/simulate", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/api/metrics", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/api/innodb", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/api/slowlog", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/api/databases", beego.BeforeRouter, controllers.FilterConsoleLogin)
+	beego.InsertFilter("/api/sessions", beego.BeforeRouter, controllers.FilterConsoleLogin)
+
+	beego.AddFuncMap("simulating", controllers.Simulating)
 }
@@ -0,0 +1,54 @@
+// Package secret reads the secret file injected into the containers, and authenticates the internal
+// requests between monitor, agents and backup commands by the service token in it.
+package secret
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultFile is the secret file in the containers configured by secret_files in lain.yaml
+	DefaultFile = "/lain/app/conf/secret.conf"
+	// TokenKey is the key of the service token in the secret file, which is shared by all the procs
+	TokenKey = "service_token"
+	// TokenHeader is the header carrying the service token in the internal requests
+	TokenHeader = "X-Service-Token"
+)
+
+// ReadFile reads the key=value lines of the secret file
+func ReadFile(fileName string) (map[string]string, error) {
+	secretConf := make(map[string]string)
+	secretFile, err := os.Open(fileName)
+	if err != nil {
+		return secretConf, err
+	}
+	defer secretFile.Close()
+	scanner := bufio.NewScanner(secretFile)
+	for scanner.Scan() {
+		if lineArr := strings.SplitN(scanner.Text(), "=", 2); len(lineArr) == 2 {
+			secretConf[strings.TrimSpace(lineArr[0])] = strings.TrimSpace(lineArr[1])
+		}
+	}
+	return secretConf, scanner.Err()
+}
+
+// Token returns the service token in the secret file, which is empty if the file can't be read
+func Token(fileName string) string {
+	secrets, _ := ReadFile(fileName)
+	return secrets[TokenKey]
+}
+
+// SetToken sets the service token on req
+func SetToken(req *http.Request, token string) {
+	req.Header.Set(TokenHeader, token)
+}
+
+// Authorized returns whether req carries token. All the requests are refused if token is empty,
+// so that a missing service token doesn't open the internal APIs.
+func Authorized(req *http.Request, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get(TokenHeader)), []byte(token)) == 1
+}
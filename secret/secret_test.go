@@ -0,0 +1,46 @@
+package secret
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret.conf")
+	if err = ioutil.WriteFile(file, []byte("dba_passwd=dba\nservice_token = s3cret=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if token := Token(file); token != "s3cret=1" {
+		t.Fatalf("Unexpected token %q", token)
+	}
+	if token := Token(filepath.Join(dir, "missing.conf")); token != "" {
+		t.Errorf("The token of a missing file should be empty, got %q", token)
+	}
+
+	for _, c := range []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{header: "s3cret=1", token: "s3cret=1", ok: true},
+		{header: "wrong", token: "s3cret=1"},
+		{header: "", token: "s3cret=1"},
+		{header: "", token: ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			SetToken(req, c.header)
+		}
+		if ok := Authorized(req, c.token); ok != c.ok {
+			t.Errorf("Authorized with %q and token %q should be %v", c.header, c.token, c.ok)
+		}
+	}
+}
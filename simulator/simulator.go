@@ -0,0 +1,432 @@
+// Package simulator runs a virtual cluster of fake MySQL instances for monitord -simulate.
+// The monitor and the UI run unchanged against it, so that DBAs can rehearse the failover
+// procedures by driving the cluster through the failure scenarios.
+package simulator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/laincloud/mysql-service/discovery"
+	"github.com/laincloud/mysql-service/fake"
+	"github.com/laincloud/mysql-service/monitor"
+)
+
+// Scenario is a failure injected into the simulated cluster
+type Scenario string
+
+const (
+	ScenarioMasterCrash      Scenario = "master-crash"
+	ScenarioStandbyPartition Scenario = "standby-partition"
+	ScenarioSlaveSQLError    Scenario = "slave-sql-error"
+	ScenarioLagSpike         Scenario = "lag-spike"
+	ScenarioInstanceRemoval  Scenario = "instance-removal"
+	ScenarioRecover          Scenario = "recover"
+
+	// Operator is the operator of the actions done by the simulator in the audit log
+	Operator = "simulator"
+
+	writeInterval    = time.Second
+	discoverTimeout  = 30 * time.Second
+	lagSpikeSeconds  = 120
+	lagSpikeDuration = time.Minute
+	maxEvents        = 50
+)
+
+// ScenarioInfo describes a scenario on the simulator page
+type ScenarioInfo struct {
+	Scenario Scenario
+	// Role is the role of the default target, or "" if the scenario applies to all the instances
+	Role        string
+	Description string
+}
+
+// Scenarios are the scenarios supported by Apply
+var Scenarios = []ScenarioInfo{
+	{ScenarioMasterCrash, "Master", "The master goes down and refuses all the connections"},
+	{ScenarioStandbyPartition, "Standby", "The standby is unreachable from the monitor, but keeps replicating"},
+	{ScenarioSlaveSQLError, "Slave", "The SQL thread stops with a duplicate key error on the next transaction"},
+	{ScenarioLagSpike, "", "The slaves and the standby stop applying transactions for a minute"},
+	{ScenarioInstanceRemoval, "Slave", "The instance disappears from service discovery"},
+	{ScenarioRecover, "", "All the instances are up, reachable, catching up and discovered again. SQL errors are left to be repaired."},
+}
+
+// Event is a scenario applied to the cluster
+type Event struct {
+	Time     time.Time
+	Scenario Scenario
+	Endpoint string
+}
+
+// InstanceState is the simulated state of an instance
+type InstanceState struct {
+	Endpoint    string
+	Host        string
+	Port        string
+	Role        string
+	Source      string
+	ReadOnly    string
+	GTIDSet     string
+	Down        bool
+	Partitioned bool
+	Removed     bool
+	Lag         int
+	SQLError    string
+}
+
+// Simulator is a cluster of fake MySQL instances found by a memory discovery
+type Simulator struct {
+	sync.Mutex
+	dir          string
+	dbaPassword  string
+	replPassword string
+	lainlet      *fake.Lainlet
+	servers      []*fake.MySQL
+	disc         *discovery.Memory
+	removed      map[string]bool
+	events       []Event
+	stop         chan struct{}
+}
+
+var current *Simulator
+
+// Current returns the simulator of monitord, or nil if it is not simulating
+func Current() *Simulator {
+	return current
+}
+
+// New starts n fake instances with a temporary secret file and config directory. The fake lainlet
+// serves no config, so that SSO and graphite are disabled.
+func New(n int) (*Simulator, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("The simulated cluster needs at least 1 instance, got %d", n)
+	}
+	dir, err := ioutil.TempDir("", "monitord-simulate")
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulator{
+		dir:          dir,
+		dbaPassword:  randomPassword(),
+		replPassword: randomPassword(),
+		removed:      make(map[string]bool),
+		stop:         make(chan struct{}),
+	}
+	if err = sim.writeFiles(); err == nil {
+		sim.lainlet, err = fake.NewLainlet()
+	}
+	for i := 0; i < n && err == nil; i++ {
+		var server *fake.MySQL
+		if server, err = fake.NewMySQL(); err == nil {
+			sim.servers = append(sim.servers, server)
+		}
+	}
+	if err != nil {
+		sim.Close()
+		return nil, err
+	}
+	sim.disc = discovery.NewMemory("")
+	sim.publish()
+	current = sim
+	return sim, nil
+}
+
+func (sim *Simulator) writeFiles() error {
+	secrets := fmt.Sprintf("dba_passwd=%s\nrepl_passwd=%s\n", sim.dbaPassword, sim.replPassword)
+	if err := ioutil.WriteFile(filepath.Join(sim.dir, "secret.conf"), []byte(secrets), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(sim.dir, "lain.yaml"), nil, 0644); err != nil {
+		return err
+	}
+	return os.Mkdir(filepath.Join(sim.dir, "monitor.conf"), 0755)
+}
+
+func randomPassword() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Config returns the configuration items of monitord pointing to the simulated cluster
+func (sim *Simulator) Config() map[string]string {
+	return map[string]string{
+		"config_dir":       filepath.Join(sim.dir, "monitor.conf"),
+		"secret_file":      filepath.Join(sim.dir, "secret.conf"),
+		"lain_config_file": filepath.Join(sim.dir, "lain.yaml"),
+		"lainlet_addr":     sim.lainlet.Addr(),
+	}
+}
+
+// Discovery returns the discovery of the simulated instances
+func (sim *Simulator) Discovery() discovery.Discovery {
+	return sim.disc
+}
+
+// Close stops the instances and removes the temporary files
+func (sim *Simulator) Close() {
+	sim.Lock()
+	defer sim.Unlock()
+	select {
+	case <-sim.stop:
+		return
+	default:
+		close(sim.stop)
+	}
+	for _, server := range sim.servers {
+		server.Close()
+	}
+	if sim.lainlet != nil {
+		sim.lainlet.Close()
+	}
+	os.RemoveAll(sim.dir)
+	if current == sim {
+		current = nil
+	}
+}
+
+// Run sets the passwords of the configured users, registers the first instance as master,
+// the second as standby and the others as slaves through the monitor, and then keeps writing
+// to the master until Close. Monitor must be configured and started before.
+func (sim *Simulator) Run() {
+	cfg := monitor.CurrentConfig()
+	for _, server := range sim.servers {
+		server.SetPassword(cfg.DBAUser, sim.dbaPassword)
+		server.SetPassword(cfg.ReplUser, sim.replPassword)
+	}
+	if err := sim.setup(); err != nil {
+		glog.Errorf("Set up the simulated cluster failed: %s", err.Error())
+	}
+
+	ticker := time.NewTicker(writeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sim.write()
+		case <-sim.stop:
+			return
+		}
+	}
+}
+
+func (sim *Simulator) setup() error {
+	for deadline := time.Now().Add(discoverTimeout); ; time.Sleep(500 * time.Millisecond) {
+		if roles, err := instanceRoles(); err == nil && len(roles) == len(sim.servers) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The instances are not found by monitor in %s", discoverTimeout)
+		}
+	}
+
+	master := sim.servers[0].Addr()
+	if err := patch(monitor.ActionRegisterMaster, master); err != nil {
+		return err
+	}
+	for i, server := range sim.servers[1:] {
+		action := monitor.ActionRegisterSlave
+		if i == 0 {
+			action = monitor.ActionRegisterStandby
+		}
+		if err := patch(action, server.Addr()); err != nil {
+			return err
+		}
+		if err := patch(monitor.ActionActive, server.Addr()); err != nil {
+			return err
+		}
+	}
+	glog.Infof("The simulated cluster of %d instances is set up, master is %s", len(sim.servers), master)
+	return nil
+}
+
+// write commits a transaction on the writable instances, which are up and don't replicate
+func (sim *Simulator) write() {
+	for _, server := range sim.servers {
+		if !server.Down() && server.Source() == "" && server.Variable("read_only") == "OFF" {
+			server.Commit(1)
+		}
+	}
+}
+
+// publish sends the instances not removed to the discovery
+func (sim *Simulator) publish() {
+	endpoints := make([]string, 0, len(sim.servers))
+	for _, server := range sim.servers {
+		if !sim.removed[server.Addr()] {
+			endpoints = append(endpoints, server.Addr())
+		}
+	}
+	sim.disc.Update(endpoints)
+}
+
+// Apply injects scenario into the instance of endpoint. An empty endpoint selects the default target
+// of the scenario by the role shown by monitor.
+func (sim *Simulator) Apply(scenario Scenario, endpoint string) error {
+	var info ScenarioInfo
+	for _, s := range Scenarios {
+		if s.Scenario == scenario {
+			info = s
+		}
+	}
+	if info.Scenario == "" {
+		return fmt.Errorf("Unknown scenario %s", scenario)
+	}
+	var targets []*fake.MySQL
+	if endpoint != "" {
+		server := sim.server(endpoint)
+		if server == nil {
+			return fmt.Errorf("%s is not a simulated instance", endpoint)
+		}
+		targets = append(targets, server)
+	} else {
+		roles, err := instanceRoles()
+		if err != nil {
+			return err
+		}
+		for _, server := range sim.servers {
+			role := roles[server.Addr()]
+			if role == info.Role || (info.Role == "" && (scenario == ScenarioRecover || role == "Standby" || role == "Slave")) {
+				targets = append(targets, server)
+				if info.Role != "" {
+					break
+				}
+			}
+		}
+		if len(targets) == 0 && scenario != ScenarioRecover {
+			return fmt.Errorf("There is no instance to apply %s", scenario)
+		}
+	}
+
+	sim.Lock()
+	defer sim.Unlock()
+	for _, server := range targets {
+		switch scenario {
+		case ScenarioMasterCrash:
+			server.SetDown(true)
+		case ScenarioStandbyPartition:
+			server.SetPartitioned(true)
+		case ScenarioSlaveSQLError:
+			server.BreakReplication(1062, "Duplicate entry '1' for key 'PRIMARY'")
+		case ScenarioLagSpike:
+			server.SetReplicationLag(lagSpikeSeconds)
+			s := server
+			time.AfterFunc(lagSpikeDuration, func() { s.SetReplicationLag(0) })
+		case ScenarioInstanceRemoval:
+			sim.removed[server.Addr()] = true
+		case ScenarioRecover:
+			server.SetDown(false)
+			server.SetPartitioned(false)
+			server.SetReplicationLag(0)
+			delete(sim.removed, server.Addr())
+		}
+		sim.events = append(sim.events, Event{Time: time.Now(), Scenario: scenario, Endpoint: server.Addr()})
+		glog.Infof("Simulated %s on %s", scenario, server.Addr())
+	}
+	if len(sim.events) > maxEvents {
+		sim.events = sim.events[len(sim.events)-maxEvents:]
+	}
+	if scenario == ScenarioInstanceRemoval || scenario == ScenarioRecover {
+		sim.publish()
+	}
+	return nil
+}
+
+func (sim *Simulator) server(endpoint string) *fake.MySQL {
+	for _, server := range sim.servers {
+		if server.Addr() == endpoint {
+			return server
+		}
+	}
+	return nil
+}
+
+// Instances returns the states of the instances with the roles shown by monitor
+func (sim *Simulator) Instances() []InstanceState {
+	roles, err := instanceRoles()
+	if err != nil {
+		glog.Errorf("Get roles of the simulated instances failed: %s", err.Error())
+	}
+	sim.Lock()
+	defer sim.Unlock()
+	states := make([]InstanceState, 0, len(sim.servers))
+	for _, server := range sim.servers {
+		host, port, _ := net.SplitHostPort(server.Addr())
+		role, exist := roles[server.Addr()]
+		if !exist {
+			role = "Missing"
+		}
+		states = append(states, InstanceState{
+			Endpoint:    server.Addr(),
+			Host:        host,
+			Port:        port,
+			Role:        role,
+			Source:      server.Source(),
+			ReadOnly:    server.Variable("read_only"),
+			GTIDSet:     server.ExecutedGTIDSet(),
+			Down:        server.Down(),
+			Partitioned: server.Partitioned(),
+			Removed:     sim.removed[server.Addr()],
+			Lag:         server.ReplicationLag(),
+			SQLError:    server.ReplicationError(),
+		})
+	}
+	return states
+}
+
+// Events returns the applied scenarios, the latest first
+func (sim *Simulator) Events() []Event {
+	sim.Lock()
+	defer sim.Unlock()
+	events := make([]Event, 0, len(sim.events))
+	for i := len(sim.events) - 1; i >= 0; i-- {
+		events = append(events, sim.events[i])
+	}
+	return events
+}
+
+// instanceRoles returns the roles of the instances found by monitor, by endpoint
+func instanceRoles() (map[string]string, error) {
+	req := monitor.GetRequest{
+		RequestType:  monitor.GetAllOverview,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(req)
+	resp := <-req.ResponseChan
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	var insts []monitor.InstanceView
+	if err := json.Unmarshal(resp.Data, &insts); err != nil {
+		return nil, err
+	}
+	roles := make(map[string]string, len(insts))
+	for _, inst := range insts {
+		roles[net.JoinHostPort(inst.Addr, inst.Port)] = inst.Role
+	}
+	return roles, nil
+}
+
+func patch(action monitor.PatchAction, endpoint string) error {
+	req := monitor.PatchRequest{
+		Action:       action,
+		Endpoint:     endpoint,
+		Params:       make(map[string]string),
+		Operator:     Operator,
+		ResponseChan: make(chan monitor.PatchResponse),
+	}
+	monitor.Patch(req)
+	if resp := <-req.ResponseChan; resp.Err != nil {
+		return fmt.Errorf("%s on %s failed: %s", action, endpoint, resp.Err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package simulator
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/laincloud/mysql-service/monitor"
+)
+
+func TestMain(m *testing.M) {
+	// The driver logs the connections closed by the fake servers which are down
+	mysql.SetLogger(log.New(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// overview returns the instances shown by monitor, by endpoint
+func overview(t *testing.T) map[string]monitor.InstanceView {
+	t.Helper()
+	req := monitor.GetRequest{
+		RequestType:  monitor.GetAllOverview,
+		ResponseChan: make(chan monitor.GetResponse),
+	}
+	monitor.Get(req)
+	resp := <-req.ResponseChan
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	var insts []monitor.InstanceView
+	if err := json.Unmarshal(resp.Data, &insts); err != nil {
+		t.Fatal(err)
+	}
+	views := make(map[string]monitor.InstanceView)
+	for _, inst := range insts {
+		views[net.JoinHostPort(inst.Addr, inst.Port)] = inst
+	}
+	return views
+}
+
+// waitFor polls cond until it's true or times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(20 * time.Second); !cond(); time.Sleep(200 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	sim, err := New(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	fs := flag.NewFlagSet("monitord", flag.ContinueOnError)
+	loader := monitor.NewConfigLoader(fs)
+	if err = fs.Parse([]string{"-monitor-port", freePort(t), "-inspect-interval", "1s"}); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range sim.Config() {
+		loader.Override(key, value, monitor.SourceSimulator)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.Configure(cfg)
+	go monitor.Start(sim.Discovery())
+	go sim.Run()
+
+	master, standby, slave, other := sim.servers[0], sim.servers[1], sim.servers[2], sim.servers[3]
+	waitFor(t, "the cluster set up", func() bool {
+		views := overview(t)
+		return views[master.Addr()].Role == "Master" && views[standby.Addr()].Role == "Standby" &&
+			views[slave.Addr()].Role == "Slave" && views[other.Addr()].Role == "Slave"
+	})
+	if standby.Source() != master.Addr() || slave.Source() != master.Addr() {
+		t.Errorf("The instances should replicate from master, got %q and %q", standby.Source(), slave.Source())
+	}
+
+	if err = sim.Apply(ScenarioInstanceRemoval, other.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	// The removed slave is reachable, so it keeps the role
+	waitFor(t, "the removed slave missing", func() bool {
+		view := overview(t)[other.Addr()]
+		return view.Role == "Slave" && view.MissingText != ""
+	})
+
+	if err = sim.Apply(ScenarioSlaveSQLError, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the SQL error", func() bool { return slave.ReplicationError() != "" })
+
+	if err = sim.Apply(ScenarioStandbyPartition, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the partitioned standby found", func() bool {
+		return overview(t)[standby.Addr()].InstanceStatusText == "ERROR"
+	})
+	if !standby.Partitioned() || standby.Source() != master.Addr() {
+		t.Errorf("The standby should be partitioned but keep replicating")
+	}
+
+	if err = sim.Apply(ScenarioMasterCrash, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the crashed master found", func() bool {
+		return overview(t)[master.Addr()].InstanceStatusText == "ERROR"
+	})
+
+	if err = sim.Apply(ScenarioRecover, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the cluster recovered", func() bool {
+		views := overview(t)
+		return views[master.Addr()].InstanceStatusText == "OK" && views[standby.Addr()].InstanceStatusText == "OK" &&
+			views[other.Addr()].Role == "Slave" && views[other.Addr()].MissingText == ""
+	})
+	if slave.ReplicationError() == "" {
+		t.Errorf("The SQL error should be left to be repaired")
+	}
+	if events := sim.Events(); len(events) != 8 || events[0].Scenario != ScenarioRecover {
+		t.Errorf("Unexpected events: %v", events)
+	}
+
+	if err = sim.Apply("flood", ""); err == nil {
+		t.Errorf("Unknown scenario should be rejected")
+	}
+	if err = sim.Apply(ScenarioLagSpike, "127.0.0.1:1"); err == nil {
+		t.Errorf("Unknown instance should be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package slowlog
+
+import (
+	"sort"
+	"time"
+)
+
+// The orders of the digests returned by Top
+const (
+	SortTotalTime    = "total"
+	SortAvgTime      = "avg"
+	SortMaxTime      = "max"
+	SortCount        = "count"
+	SortRowsExamined = "rows"
+)
+
+// SortOrders are the valid orders of Top
+var SortOrders = []string{SortTotalTime, SortAvgTime, SortMaxTime, SortCount, SortRowsExamined}
+
+// Digest is the aggregation of the entries of the same fingerprint. The times are in seconds.
+type Digest struct {
+	ID          string
+	Fingerprint string
+	// Sample is the slowest query of the digest
+	Sample          string
+	DB              string
+	User            string
+	Count           int
+	TotalTime       float64
+	AvgTime         float64
+	MaxTime         float64
+	TotalLockTime   float64
+	RowsSent        int64
+	RowsExamined    int64
+	AvgRowsExamined int64
+	FirstSeen       time.Time
+	LastSeen        time.Time
+}
+
+// Aggregator aggregates the entries into at most maxDigests digests
+type Aggregator struct {
+	maxDigests int
+	digests    map[string]*Digest
+	// Entries is the number of entries added, and Dropped is the number of entries dropped
+	// as there are too many digests
+	Entries int
+	Dropped int
+}
+
+// NewAggregator creates an Aggregator keeping at most maxDigests digests
+func NewAggregator(maxDigests int) *Aggregator {
+	return &Aggregator{maxDigests: maxDigests, digests: make(map[string]*Digest)}
+}
+
+// Add adds the entry to the digest of its fingerprint
+func (a *Aggregator) Add(e Entry) {
+	a.Entries++
+	fingerprint := Fingerprint(e.Query)
+	d, exist := a.digests[fingerprint]
+	if !exist {
+		if len(a.digests) >= a.maxDigests {
+			a.Dropped++
+			return
+		}
+		d = &Digest{ID: FingerprintID(fingerprint), Fingerprint: fingerprint, FirstSeen: e.Time}
+		a.digests[fingerprint] = d
+	}
+	d.Count++
+	d.TotalTime += e.QueryTime
+	d.TotalLockTime += e.LockTime
+	d.RowsSent += e.RowsSent
+	d.RowsExamined += e.RowsExamined
+	d.AvgTime = d.TotalTime / float64(d.Count)
+	d.AvgRowsExamined = d.RowsExamined / int64(d.Count)
+	if e.QueryTime >= d.MaxTime || d.Sample == "" {
+		d.MaxTime = e.QueryTime
+		d.Sample, d.DB, d.User = e.Query, e.DB, e.User
+		if len(d.Sample) > maxSampleSize {
+			d.Sample = d.Sample[:maxSampleSize] + "..."
+		}
+	}
+	if e.Time.Before(d.FirstSeen) {
+		d.FirstSeen = e.Time
+	}
+	if e.Time.After(d.LastSeen) {
+		d.LastSeen = e.Time
+	}
+}
+
+// Len returns the number of digests
+func (a *Aggregator) Len() int {
+	return len(a.digests)
+}
+
+// Top returns the first n digests in the order, or SortTotalTime if the order is unknown
+func (a *Aggregator) Top(n int, order string) []Digest {
+	key := map[string]func(d *Digest) float64{
+		SortTotalTime:    func(d *Digest) float64 { return d.TotalTime },
+		SortAvgTime:      func(d *Digest) float64 { return d.AvgTime },
+		SortMaxTime:      func(d *Digest) float64 { return d.MaxTime },
+		SortCount:        func(d *Digest) float64 { return float64(d.Count) },
+		SortRowsExamined: func(d *Digest) float64 { return float64(d.RowsExamined) },
+	}[order]
+	if key == nil {
+		key = func(d *Digest) float64 { return d.TotalTime }
+	}
+	digests := make([]*Digest, 0, len(a.digests))
+	for _, d := range a.digests {
+		digests = append(digests, d)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		if ki, kj := key(digests[i]), key(digests[j]); ki != kj {
+			return ki > kj
+		}
+		return digests[i].ID < digests[j].ID
+	})
+	if n > 0 && len(digests) > n {
+		digests = digests[:n]
+	}
+	top := make([]Digest, 0, len(digests))
+	for _, d := range digests {
+		top = append(top, *d)
+	}
+	return top
+}
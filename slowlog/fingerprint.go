@@ -0,0 +1,95 @@
+package slowlog
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+var (
+	inListExp     = regexp.MustCompile(`\bin\s*\(\s*\?(\s*,\s*\?)*\s*\)`)
+	valueListExp  = regexp.MustCompile(`\bvalues\s*\(\s*\?(\s*,\s*\?)*\s*\)(\s*,\s*\(\s*\?(\s*,\s*\?)*\s*\))*`)
+	whitespaceExp = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint returns the query with the literals replaced by "?", the comments removed and the
+// whitespaces collapsed, so that the queries differing only in values have the same fingerprint, e.g.
+// "SELECT * FROM t WHERE id IN (1, 2) AND name = 'a'" is "select * from t where id in(?+) and name = ?"
+func Fingerprint(query string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// Skip the string, where the quote is escaped by a backslash or doubled
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' {
+					i++
+				} else if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+			b.WriteByte('?')
+		case c == '`':
+			// Quoted identifiers are kept as they are, which may be case sensitive
+			end := i + 1 + strings.IndexByte(query[i+1:], '`')
+			if end <= i {
+				end = len(query) - 1
+			}
+			b.WriteString(query[i : end+1])
+			i = end
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			b.WriteByte(' ')
+		case (c == '-' && strings.HasPrefix(query[i:], "-- ")) || c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			b.WriteByte(' ')
+		case isDigit(c) && (i == 0 || !isIdentifier(query[i-1])):
+			// Numbers, including decimals, exponents and hex like 0x1F
+			for i+1 < len(query) && (isIdentifier(query[i+1]) || query[i+1] == '.') {
+				i++
+			}
+			b.WriteByte('?')
+		default:
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			b.WriteByte(c)
+		}
+	}
+	fingerprint := whitespaceExp.ReplaceAllString(b.String(), " ")
+	fingerprint = inListExp.ReplaceAllString(fingerprint, "in(?+)")
+	fingerprint = valueListExp.ReplaceAllString(fingerprint, "values(?+)")
+	return strings.TrimSpace(fingerprint)
+}
+
+// FingerprintID returns a short id of the fingerprint
+func FingerprintID(fingerprint string) string {
+	h := fnv.New64a()
+	h.Write([]byte(fingerprint))
+	return fmt.Sprintf("%016X", h.Sum64())
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifier(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
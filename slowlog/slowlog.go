@@ -0,0 +1,153 @@
+// Package slowlog parses the slow query log of MySQL, fingerprints the queries and aggregates
+// the entries of the same fingerprint into digests.
+package slowlog
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSampleSize bounds the sample query kept in a digest
+const maxSampleSize = 4096
+
+// The time formats in "# Time:" of MySQL 5.7 and 5.6
+var timeFormats = []string{"2006-01-02T15:04:05.999999Z07:00", "060102 15:04:05"}
+
+// Entry is a query in the slow log
+type Entry struct {
+	Time         time.Time
+	User         string
+	Host         string
+	DB           string
+	QueryTime    float64
+	LockTime     float64
+	RowsSent     int64
+	RowsExamined int64
+	Query        string
+}
+
+// Parser parses the slow log written to it, which can be split anywhere, and emits the entries
+// once their queries end
+type Parser struct {
+	emit func(Entry)
+	// partial is the incomplete last line written
+	partial []byte
+	entry   Entry
+	// inQuery is true after "# Query_time:", when the next lines are the query of the entry
+	inQuery bool
+	query   []string
+	db      string
+	time    time.Time
+}
+
+// NewParser creates a Parser emitting the entries to emit
+func NewParser(emit func(Entry)) *Parser {
+	return &Parser{emit: emit}
+}
+
+// Write parses the complete lines in data and keeps the incomplete one for the next Write
+func (p *Parser) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		p.parseLine(strings.TrimRight(string(p.partial[:i]), "\r"))
+		p.partial = p.partial[i+1:]
+	}
+	// Don't keep the large array of the lines parsed
+	p.partial = append([]byte(nil), p.partial...)
+	return len(data), nil
+}
+
+func (p *Parser) parseLine(line string) {
+	switch {
+	case strings.HasPrefix(line, "# Time:"):
+		value := strings.TrimSpace(strings.TrimPrefix(line, "# Time:"))
+		// MySQL 5.6 pads the hour with a space, e.g. "170301  9:00:00"
+		value = strings.Join(strings.Fields(value), " ")
+		for _, format := range timeFormats {
+			if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+				p.time = t
+				break
+			}
+			if t, err := time.ParseInLocation(format, strings.Replace(value, " ", " 0", 1), time.Local); err == nil {
+				p.time = t
+				break
+			}
+		}
+		p.reset()
+	case strings.HasPrefix(line, "# User@Host:"):
+		p.reset()
+		p.entry.User, p.entry.Host = parseUserHost(strings.TrimPrefix(line, "# User@Host:"))
+	case strings.HasPrefix(line, "# Query_time:"):
+		p.parseStats(strings.TrimPrefix(line, "#"))
+		p.inQuery = true
+	case strings.HasPrefix(line, "#"):
+		// Other comments like "# Schema:" of Percona Server or "# administrator command: Quit;"
+	case !p.inQuery:
+		// The header written when mysqld starts, like "Tcp port: 3306  Unix socket: ..."
+	case len(p.query) == 0 && strings.HasPrefix(strings.ToLower(line), "use ") && strings.HasSuffix(line, ";"):
+		p.db = strings.Trim(strings.TrimSpace(line[4:len(line)-1]), "`")
+	case len(p.query) == 0 && strings.HasPrefix(strings.ToLower(line), "set timestamp="):
+		if unix, err := strconv.ParseInt(strings.TrimSuffix(line[len("set timestamp="):], ";"), 10, 64); err == nil {
+			p.time = time.Unix(unix, 0)
+		}
+	default:
+		p.query = append(p.query, line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			entry := p.entry
+			entry.Time, entry.DB = p.time, p.db
+			entry.Query = strings.TrimSuffix(strings.TrimSpace(strings.Join(p.query, "\n")), ";")
+			p.reset()
+			p.emit(entry)
+		}
+	}
+}
+
+// reset drops the entry being parsed, while the time and the database are kept for the next entry
+// as MySQL only writes them when they change
+func (p *Parser) reset() {
+	p.entry, p.inQuery, p.query = Entry{}, false, nil
+}
+
+// parseUserHost parses e.g. " app[app] @  [10.0.0.5]  Id:    10" or " root[root] @ localhost []"
+func parseUserHost(value string) (user, host string) {
+	parts := strings.SplitN(value, "@", 2)
+	user = strings.TrimSpace(parts[0])
+	if i := strings.Index(user, "["); i >= 0 {
+		user = user[:i]
+	}
+	if len(parts) == 2 {
+		fields := strings.Fields(parts[1])
+		for _, field := range fields {
+			if field == "Id:" {
+				break
+			}
+			if ip := strings.Trim(field, "[]"); ip != "" {
+				host = ip
+			}
+		}
+	}
+	return user, host
+}
+
+// parseStats parses e.g. " Query_time: 2.000123  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 100000"
+func (p *Parser) parseStats(value string) {
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "Query_time:":
+			p.entry.QueryTime, _ = strconv.ParseFloat(fields[i+1], 64)
+		case "Lock_time:":
+			p.entry.LockTime, _ = strconv.ParseFloat(fields[i+1], 64)
+		case "Rows_sent:":
+			p.entry.RowsSent, _ = strconv.ParseInt(fields[i+1], 10, 64)
+		case "Rows_examined:":
+			p.entry.RowsExamined, _ = strconv.ParseInt(fields[i+1], 10, 64)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package slowlog
+
+import (
+	"strings"
+	"testing"
+)
+
+// slowLog57 is a slow log of MySQL 5.7 beginning with the header written when mysqld starts
+const slowLog57 = `/usr/sbin/mysqld, Version: 5.7.17-log (MySQL Community Server (GPL)). started with:
+Tcp port: 3306  Unix socket: /var/lib/mysql/mysql.sock
+Time                 Id Command    Argument
+# Time: 2017-03-01T10:00:00.123456Z
+# User@Host: app[app] @  [10.0.0.5]  Id:    10
+# Query_time: 2.000000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 100000
+use orders;
+SET timestamp=1488362400;
+SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'it''s';
+# Time: 2017-03-01T10:01:00.000000Z
+# User@Host: app[app] @  [10.0.0.5]  Id:    11
+# Query_time: 4.000000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 200000
+SET timestamp=1488362460;
+select *
+  from t where id in (7) and name = "b";
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 1.500000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1488362460;
+INSERT INTO ` + "`log`" + ` VALUES (1, 'a'), (2, 'b') /* batch */;
+`
+
+func TestParser(t *testing.T) {
+	var entries []Entry
+	p := NewParser(func(e Entry) { entries = append(entries, e) })
+	// The log is written in pieces split anywhere
+	for i := 0; i < len(slowLog57); i += 7 {
+		end := i + 7
+		if end > len(slowLog57) {
+			end = len(slowLog57)
+		}
+		p.Write([]byte(slowLog57[i:end]))
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d: %+v", len(entries), entries)
+	}
+	first := entries[0]
+	if first.User != "app" || first.Host != "10.0.0.5" || first.DB != "orders" || first.QueryTime != 2 ||
+		first.RowsExamined != 100000 || first.Time.Unix() != 1488362400 {
+		t.Errorf("Unexpected first entry: %+v", first)
+	}
+	if first.Query != "SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'it''s'" {
+		t.Errorf("Unexpected query: %q", first.Query)
+	}
+	if entries[1].Query != "select *\n  from t where id in (7) and name = \"b\"" || entries[1].DB != "orders" {
+		t.Errorf("The multi-line query should be kept in the database of the last entry: %+v", entries[1])
+	}
+	if entries[2].User != "root" || entries[2].Host != "localhost" {
+		t.Errorf("Unexpected user and host: %+v", entries[2])
+	}
+
+	p = NewParser(func(e Entry) { entries = append(entries, e) })
+	p.Write([]byte("# Time: 170301  9:00:00\n# User@Host: app[app] @  [10.0.0.5]\n# Query_time: 1.0  Lock_time: 0.0 Rows_sent: 0  Rows_examined: 0\nSELECT 1;\n"))
+	if last := entries[len(entries)-1]; last.Time.Format("2006-01-02 15:04:05") != "2017-03-01 09:00:00" {
+		t.Errorf("The time of MySQL 5.6 is not parsed: %v", last.Time)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	for query, expected := range map[string]string{
+		"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'it''s'":         "select * from t where id in(?+) and name = ?",
+		"select *\n  from t where id in (7) and name = \"b\"":              "select * from t where id in(?+) and name = ?",
+		"INSERT INTO `Log` VALUES (1, 'a'), (2, 'b') /* batch */":          "insert into `Log` values(?+)",
+		"UPDATE t2 SET a = a + 1.5, b = 0x1F WHERE c = 'x\\'y' -- comment": "update t2 set a = a + ?, b = ? where c = ?",
+	} {
+		if fingerprint := Fingerprint(query); fingerprint != expected {
+			t.Errorf("Fingerprint of %q should be %q, got %q", query, expected, fingerprint)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator(2)
+	p := NewParser(a.Add)
+	p.Write([]byte(slowLog57))
+	if a.Entries != 3 || a.Len() != 2 || a.Dropped != 0 {
+		t.Fatalf("Unexpected aggregation: %d entries, %d digests, %d dropped", a.Entries, a.Len(), a.Dropped)
+	}
+	top := a.Top(1, SortTotalTime)
+	if len(top) != 1 || top[0].Count != 2 || top[0].TotalTime != 6 || top[0].AvgTime != 3 || top[0].MaxTime != 4 {
+		t.Fatalf("Unexpected top digest: %+v", top)
+	}
+	if !strings.HasPrefix(top[0].Sample, "select *") || top[0].AvgRowsExamined != 150000 {
+		t.Errorf("The sample should be the slowest query: %+v", top[0])
+	}
+	if top = a.Top(0, SortCount); len(top) != 2 || top[1].Fingerprint != "insert into `log` values(?+)" {
+		t.Errorf("Unexpected digests by count: %+v", top)
+	}
+
+	p.Write([]byte("# Query_time: 1.0  Lock_time: 0.0 Rows_sent: 0  Rows_examined: 0\nSELECT 1;\n"))
+	if a.Dropped != 1 || a.Len() != 2 {
+		t.Errorf("The entries of new fingerprints should be dropped beyond the limit, got %d dropped", a.Dropped)
+	}
+}
@@ -0,0 +1,9 @@
+-- The privileges of dba, granted by entrypoint.sh when the instance is initialized,
+-- and by grant_dba.sh on master of an existing cluster
+GRANT RELOAD, PROCESS, SUPER, REPLICATION CLIENT, REPLICATION SLAVE ON *.* TO 'dba'@'%' ;
+-- dba changes the passwords of dba and repl when monitor rotates credentials,
+-- and lists the databases and users of applications
+GRANT SELECT, UPDATE ON mysql.* TO 'dba'@'%' ;
+-- dba creates the databases and users of applications, and grants them on their own databases
+GRANT CREATE USER ON *.* TO 'dba'@'%' ;
+GRANT SELECT, INSERT, UPDATE, DELETE, CREATE, DROP, INDEX, ALTER, CREATE TEMPORARY TABLES, LOCK TABLES, EXECUTE, CREATE VIEW, SHOW VIEW, CREATE ROUTINE, ALTER ROUTINE, EVENT, TRIGGER, REFERENCES ON *.* TO 'dba'@'%' WITH GRANT OPTION ;
@@ -90,7 +90,8 @@ if [ "$1" = 'mysqld' ]; then
 		echo "CREATE USER 'repl'@'%' IDENTIFIED BY '"$REPL_PASSWORD"' ;" >> "$tempSqlFile"
 		echo "GRANT PROCESS, REPLICATION SLAVE ON *.* TO 'repl'@'%' ;" >> "$tempSqlFile"
 		echo "CREATE USER 'dba'@'%' IDENTIFIED BY '"$DBA_PASSWORD"' ;" >> "$tempSqlFile"
-		echo "GRANT RELOAD, PROCESS, SUPER, REPLICATION CLIENT, REPLICATION SLAVE ON *.* TO 'dba'@'%' ;" >> "$tempSqlFile"
+		# The grants are shared with grant_dba.sh, which upgrades the existing clusters
+		cat "$parent/dba_grants.sql" >> "$tempSqlFile"
 		echo "FLUSH PRIVILEGES ;" >> "$tempSqlFile"
 
 		mysql --protocol=socket -uroot < "$tempSqlFile"
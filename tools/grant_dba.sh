@@ -0,0 +1,14 @@
+#!/bin/bash
+# Grants the privileges in dba_grants.sql to dba on master of a cluster initialized before
+# they were added, which are replicated to the other instances. Run it in the master container:
+#   /lain/app/tools/grant_dba.sh
+set -e
+
+parent=`dirname $0`
+read_only=$(mysql --protocol=socket -uroot -N -B -e "SELECT @@GLOBAL.read_only")
+if [ "$read_only" != "0" ]; then
+	echo >&2 'error: read_only is ON, run grant_dba.sh on master so that the grants are replicated'
+	exit 1
+fi
+mysql --protocol=socket -uroot < "$parent/dba_grants.sql"
+echo 'The privileges of dba are granted'
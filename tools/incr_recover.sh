@@ -2,20 +2,19 @@
 set -e
 parent=`dirname $0`
 bkdir=/var/lib/mysql_backup
-lb_name=$(head -1 $bkdir/incrbk_prepare | awk '{print $1}')
-lb_pos=$(head -1 $bkdir/incrbk_prepare | awk '{print $2}')
+# The full backup is taken on master and the binlogs on standby, so the binlog position of the
+# full backup doesn't apply to them. The transactions of the full backup are skipped by GTID instead.
+# The GTID set follows the file and position, and may be wrapped into several lines
+gtid_set=$(awk '{for (i = (NR == 1 ? 3 : 1); i <= NF; i++) printf "%s", $i}' $bkdir/incrbk_prepare)
+if [ -z "$gtid_set" ]; then
+    echo "No GTID set is found in $bkdir/incrbk_prepare"
+    exit 1
+fi
 
 echo "WARNING: Please execute 'RESET MASTER; SET GLOBAL gtid_purged=xxx' first where xxx is the Executed_Gtid_Set in $bkdir/incrbk_prepare !"
 
 for log in $(ls -1 $bkdir/ | egrep 'lb.[0-9]*$' | sort); do
-    if [ "$log" == "$lb_name" ]; then
-        echo "Start to restore data from binlog $log"
-        mysqlbinlog --start-position=$lb_pos $bkdir/$log | mysql -uroot
-    elif [[ "$log" > "$lb_name" ]]; then
-        echo "Restore data from binlog $log"
-        mysqlbinlog $bkdir/$log | mysql -uroot
-    else
-        echo "Skip $log"
-    fi
+    echo "Restore data from binlog $log excluding $gtid_set"
+    mysqlbinlog --exclude-gtids="$gtid_set" $bkdir/$log | mysql -uroot
     rm -f $bkdir/$log
 done